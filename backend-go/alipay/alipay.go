@@ -3,6 +3,7 @@ package alipay
 import (
 	"encoding/json"
 	"log"
+	"strings"
 )
 
 func (client *Client) ApplyToken(authCode string) (ApplyTokenResponse, error) {
@@ -69,12 +70,21 @@ func (client *Client) InquiryMerchantInfo(accessToken string) (InquiryMerchantIn
 	return body, err
 }
 
-func (client *Client) PrepareAuthorization(contractDescription string) (PrepareAuthorizationResponse, error) {
+func (client *Client) PrepareAuthorization(request PrepareAuthorizationRequest) (PrepareAuthorizationResponse, error) {
 	const path = "/v1/authorizations/prepare"
 
+	if len(request.Scopes) == 0 {
+		request.Scopes = []string{SCOPE_AGREEMENT_PAY}
+	}
+	if request.Language == "" {
+		request.Language = LANGUAGE_ENGLISH
+	}
+
 	extendInfoMap := map[string]string{
-		"language":     "en-US",
-		"contractDesc": contractDescription,
+		"language": request.Language,
+	}
+	if request.ContractDescription != "" {
+		extendInfoMap["contractDesc"] = request.ContractDescription
 	}
 
 	extendInfoJSON, err := json.Marshal(extendInfoMap)
@@ -83,9 +93,15 @@ func (client *Client) PrepareAuthorization(contractDescription string) (PrepareA
 	}
 
 	params := map[string]interface{}{
-		"scopes":     "AGREEMENT_PAY",
+		"scopes":     strings.Join(request.Scopes, ","),
 		"extendInfo": string(extendInfoJSON),
 	}
+	if request.AuthRedirectURL != "" {
+		params["authRedirectUrl"] = request.AuthRedirectURL
+	}
+	if request.State != "" {
+		params["state"] = request.State
+	}
 
 	log.Println("[Alipay Client] Preparing authorization request")
 	log.Printf("[Alipay Client] Scopes: %s\n", params["scopes"])
@@ -117,6 +133,39 @@ func (client *Client) PrepareAuthorization(contractDescription string) (PrepareA
 	return body, nil
 }
 
+func (client *Client) CancelToken(accessToken string) (CancelTokenResponse, error) {
+	const path = "/v1/authorizations/cancelToken"
+	params := map[string]string{
+		"accessToken": accessToken,
+	}
+
+	log.Println("[Alipay Client] Cancelling access token")
+
+	headers, err := client.buildHeaders("POST", path, params)
+	if err != nil {
+		log.Printf("[Alipay Client] ERROR: Failed to build headers: %v\n", err)
+		return CancelTokenResponse{}, err
+	}
+
+	response, err := client.sendRequest(path, "POST", headers, params)
+	if err != nil {
+		log.Printf("[Alipay Client] ERROR: Failed to send request: %v\n", err)
+		return CancelTokenResponse{}, err
+	}
+
+	var body CancelTokenResponse
+	err = json.Unmarshal(response, &body)
+	if err != nil {
+		log.Printf("[Alipay Client] ERROR: Failed to unmarshal response: %v\n", err)
+		return CancelTokenResponse{}, err
+	}
+
+	log.Printf("[Alipay Client] Cancel token response - Status: %s, Code: %s\n",
+		body.Result.ResultStatus, body.Result.ResultCode)
+
+	return body, nil
+}
+
 func (client *Client) InquiryUserCardList(accessToken string) (InquiryUserCardListResponse, error) {
 	const path = "/v1/users/inquiryUserCardList"
 	params := map[string]string{
@@ -0,0 +1,314 @@
+package alipay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+type CassetteMode string
+
+const (
+	CassetteRecord CassetteMode = "record"
+	CassetteReplay CassetteMode = "replay"
+)
+
+const redacted = "REDACTED"
+
+// Fields replaced on write, in requests and responses alike
+var redactedFields = map[string]bool{
+	"accessToken":  true,
+	"refreshToken": true,
+	"authCode":     true,
+	"customerId":   true,
+	"userId":       true,
+	"loginId":      true,
+	"hashLoginId":  true,
+	"maskLoginId":  true,
+	"fullName":     true,
+	"firstName":    true,
+	"secondName":   true,
+	"thirdName":    true,
+	"lastName":     true,
+	"nickName":     true,
+	"avatar":       true,
+	"birthDate":    true,
+	"phone":        true,
+	"mobile":       true,
+	"email":        true,
+}
+
+var redactedHeaders = []string{"Signature"}
+
+// Headers left out of cassettes, they change on every request
+var droppedHeaders = []string{"Request-Time", "Response-Time"}
+
+// Interaction is one recorded request to the gateway and its response
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Cassette is an http.RoundTripper that records gateway traffic to a JSON file, or replays
+// it from one without touching the network. Requests are matched by method, path and body,
+// ignoring request IDs and times generated per request. Identical requests, such as polled
+// inquiries, replay their recorded responses in order and then repeat the last one.
+type Cassette struct {
+	mu           sync.Mutex
+	path         string
+	mode         CassetteMode
+	transport    http.RoundTripper
+	interactions []Interaction
+	replayed     []bool
+}
+
+// NewCassette opens the cassette at path. Recording starts a new cassette and sends
+// requests through transport, or http.DefaultTransport when nil. Replaying loads it.
+func NewCassette(path string, mode CassetteMode, transport http.RoundTripper) (*Cassette, error) {
+	if path == "" {
+		return nil, errors.New("cassette path is required")
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	cassette := &Cassette{path: path, mode: mode, transport: transport}
+	switch mode {
+	case CassetteRecord:
+		return cassette, cassette.save()
+	case CassetteReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var file cassetteFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette %s: %w", path, err)
+		}
+		cassette.interactions = file.Interactions
+		cassette.replayed = make([]bool, len(file.Interactions))
+		return cassette, nil
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+}
+
+// Interactions returns the interactions recorded or loaded so far
+func (c *Cassette) Interactions() []Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Interaction(nil), c.interactions...)
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if c.mode == CassetteReplay {
+		return c.replay(req, body)
+	}
+	return c.record(req, body)
+}
+
+func (c *Cassette) record(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	interaction := Interaction{
+		Request: RecordedRequest{
+			Method:  req.Method,
+			Path:    req.URL.Path,
+			Headers: recordHeaders(req.Header),
+			Body:    redactBody(body),
+		},
+		Response: RecordedResponse{
+			Status:  resp.StatusCode,
+			Headers: recordHeaders(resp.Header),
+			Body:    redactBody(responseBody),
+		},
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interactions = append(c.interactions, interaction)
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	key := normalizeBody(redactBody(body))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found := -1
+	for i, interaction := range c.interactions {
+		if interaction.Request.Method != req.Method || interaction.Request.Path != req.URL.Path {
+			continue
+		}
+		if normalizeBody(interaction.Request.Body) != key {
+			continue
+		}
+		found = i
+		if !c.replayed[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("cassette %s has no interaction for %s %s", c.path, req.Method, req.URL.Path)
+	}
+	c.replayed[found] = true
+
+	recorded := c.interactions[found].Response
+	body = recordedBody(recorded.Body)
+	header := http.Header{}
+	for name, value := range recorded.Headers {
+		header.Set(name, value)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// save writes the cassette, the caller holds the lock
+func (c *Cassette) save() error {
+	data, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
+
+func recordHeaders(header http.Header) map[string]string {
+	recorded := map[string]string{}
+	for name := range header {
+		recorded[http.CanonicalHeaderKey(name)] = header.Get(name)
+	}
+	for _, name := range droppedHeaders {
+		delete(recorded, name)
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := recorded[name]; ok {
+			recorded[name] = redacted
+		}
+	}
+	return recorded
+}
+
+// redactBody replaces sensitive fields of a JSON body, and keeps other bodies as a JSON string
+func redactBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		quoted, _ := json.Marshal(string(body))
+		return quoted
+	}
+	data, _ := json.Marshal(walkFields(value, redactField))
+	return data
+}
+
+// recordedBody undoes the quoting of bodies that were not JSON
+func recordedBody(body json.RawMessage) []byte {
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		return []byte(text)
+	}
+	return body
+}
+
+func redactField(key string, value interface{}) interface{} {
+	if redactedFields[key] {
+		return redacted
+	}
+	return value
+}
+
+// normalizeBody turns a recorded body into its matching key, with generated values blanked
+func normalizeBody(body json.RawMessage) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(body)
+	}
+	normalized, _ := json.Marshal(walkFields(value, normalizeField))
+	return string(normalized)
+}
+
+// Request IDs are generated per request and expiry times derive from the current time
+func normalizeField(key string, value interface{}) interface{} {
+	if strings.HasSuffix(key, "RequestId") || key == "requestId" || strings.HasSuffix(key, "Time") {
+		return ""
+	}
+	return value
+}
+
+// walkFields rebuilds value with apply called on every object field, at any depth
+func walkFields(value interface{}, apply func(key string, value interface{}) interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, field := range typed {
+			typed[key] = apply(key, walkFields(field, apply))
+		}
+		return typed
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = walkFields(item, apply)
+		}
+		return typed
+	default:
+		return value
+	}
+}
@@ -0,0 +1,161 @@
+package alipay_test
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/mockgateway"
+)
+
+const cassetteClientID = "cassette-client"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// shutdown stops gateway once the client's pooled keep-alive connections are closed, which
+// can otherwise keep it waiting until they expire
+func shutdown(gateway *mockgateway.Gateway) {
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	gateway.Shutdown()
+}
+
+// journey signs a user in and polls a payment until the gateway settles it, returning the
+// access token and the two payment statuses
+func journey(t *testing.T, client *alipay.Client, requestID string, settle func(paymentID string)) (string, string, string) {
+	t.Helper()
+
+	token, err := client.ApplyToken("auth-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.InquiryUserInfo(token.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := client.Pay(alipay.PaymentRequest{
+		ProductCode:      alipay.ONLINE_PURCHASE,
+		PaymentRequestID: requestID,
+		PaymentAmount:    alipay.PaymentAmount{Currency: "IQD", Value: "1000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inquiry := alipay.InquiryPaymentRequest{PaymentID: payment.PaymentID}
+	first, err := client.InquiryPayment(inquiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settle(payment.PaymentID)
+	second, err := client.InquiryPayment(inquiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.AccessToken, first.PaymentStatus, second.PaymentStatus
+}
+
+func TestCassetteRecordThenReplay(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys")
+	if err := mockgateway.GenerateKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	merchantKey, err := mockgateway.LoadPublicKey(filepath.Join(keys, "merchant_public_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayKey, err := mockgateway.LoadPrivateKey(filepath.Join(keys, "gateway_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayURL := "http://" + listener.Addr().String()
+	gateway, err := mockgateway.New(mockgateway.Config{
+		ClientID:          cassetteClientID,
+		MerchantPublicKey: merchantKey,
+		GatewayPrivateKey: gatewayKey,
+		PublicURL:         gatewayURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gateway.Serve(listener)
+	defer shutdown(gateway)
+
+	config := alipay.Config{
+		GatewayURL:             gatewayURL,
+		MerchantPrivateKeyPath: filepath.Join(keys, "merchant_private_key.pem"),
+		AlipayPublicKeyPath:    filepath.Join(keys, "gateway_public_key.pem"),
+		ClientID:               cassetteClientID,
+	}
+	path := filepath.Join(dir, "cassette.json")
+
+	recorder, err := alipay.NewCassette(path, alipay.CassetteRecord, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Transport = recorder
+	client, err := alipay.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, recordedFirst, recordedSecond := journey(t, client, "PAY-recorded", func(paymentID string) {
+		gateway.CompletePayment(paymentID, true)
+	})
+	if recordedFirst != "PROCESSING" || recordedSecond != "SUCCESS" {
+		t.Fatalf("recorded statuses %s, %s", recordedFirst, recordedSecond)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken == "" || strings.Contains(string(data), accessToken) {
+		t.Fatalf("cassette keeps the access token %q", accessToken)
+	}
+	if strings.Contains(string(data), "signature=") || strings.Contains(string(data), "Request-Time") {
+		t.Fatal("cassette keeps signatures or request times")
+	}
+
+	// Replay never reaches the gateway, and generates its own request IDs
+	shutdown(gateway)
+	calls := len(gateway.Calls(""))
+	player, err := alipay.NewCassette(path, alipay.CassetteReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Transport = player
+	config.SkipResponseVerification = true
+	client, err = alipay.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, replayedFirst, replayedSecond := journey(t, client, "PAY-replayed", func(string) {})
+	if replayedFirst != recordedFirst || replayedSecond != recordedSecond {
+		t.Fatalf("replayed statuses %s, %s", replayedFirst, replayedSecond)
+	}
+	if len(gateway.Calls("")) != calls {
+		t.Fatal("replay reached the gateway")
+	}
+
+	if _, err := client.CancelToken("token"); err == nil || !strings.Contains(err.Error(), "no interaction") {
+		t.Fatalf("unrecorded request answered %v", err)
+	}
+}
@@ -9,41 +9,52 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
-var Interface *Client
-
 type Config struct {
 	GatewayURL             string
 	MerchantPrivateKeyPath string
 	AlipayPublicKeyPath    string
 	ClientID               string
+	// KeysPath names a key set file of versioned keys, which replaces the two key paths
+	KeysPath string
+	// Transport sends the gateway requests, http.DefaultTransport when nil
+	Transport http.RoundTripper
+	// SkipResponseVerification accepts responses without a valid signature, such as replayed ones
+	SkipResponseVerification bool
 }
 
 type Client struct {
 	config     Config
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
 	httpClient *http.Client
+
+	keysMu sync.RWMutex
+	keys   *KeySet
 }
 
-func loadEnvConfig() (Config, error) {
+// LoadEnvConfig reads the gateway configuration from the environment
+func LoadEnvConfig() (Config, error) {
 	gatewayURL := os.Getenv("ALIPAY_GATEWAY_URL")
 	if gatewayURL == "" {
 		return Config{}, errors.New("ALIPAY_GATEWAY_URL is not set")
 	}
 
+	// A key set file replaces the single key pair
+	keysPath := os.Getenv("ALIPAY_KEYS_PATH")
+
 	merchantPrivateKeyPath := os.Getenv("ALIPAY_MERCHANT_PRIVATE_KEY_PATH")
-	if merchantPrivateKeyPath == "" {
+	if merchantPrivateKeyPath == "" && keysPath == "" {
 		return Config{}, errors.New("ALIPAY_MERCHANT_PRIVATE_KEY_PATH is not set")
 	}
 
 	alipayPublicKeyPath := os.Getenv("ALIPAY_PUBLIC_KEY_PATH")
-	if alipayPublicKeyPath == "" {
+	if alipayPublicKeyPath == "" && keysPath == "" {
 		return Config{}, errors.New("ALIPAY_PUBLIC_KEY_PATH is not set")
 	}
 
@@ -57,34 +68,46 @@ func loadEnvConfig() (Config, error) {
 		MerchantPrivateKeyPath: merchantPrivateKeyPath,
 		AlipayPublicKeyPath:    alipayPublicKeyPath,
 		ClientID:               clientID,
+		KeysPath:               keysPath,
 	}, nil
 }
 
-func InitAlipayClient() error {
-	config, err := loadEnvConfig()
+// NewClient loads the keys of config and creates a client for its gateway
+func NewClient(config Config) (*Client, error) {
+	keys, err := LoadKeySet(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	privateKey, err := loadPrivateKey(config.MerchantPrivateKeyPath)
-	if err != nil {
-		return err
-	}
+	return &Client{
+		config: config,
+		keys:   keys,
+		httpClient: &http.Client{
+			Timeout:   time.Second * 25,
+			Transport: config.Transport,
+		},
+	}, nil
+}
 
-	publicKey, err := loadPublicKey(config.AlipayPublicKeyPath)
+// NewClientFromEnv creates a client configured by the ALIPAY_* environment variables.
+// ALIPAY_CASSETTE_MODE records its traffic to, or replays it from, ALIPAY_CASSETTE_PATH.
+func NewClientFromEnv() (*Client, error) {
+	config, err := LoadEnvConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	Interface = &Client{
-		config:     config,
-		privateKey: privateKey,
-		publicKey:  publicKey,
-		httpClient: &http.Client{
-			Timeout: time.Second * 25,
-		},
+	if mode := os.Getenv("ALIPAY_CASSETTE_MODE"); mode != "" {
+		cassette, err := NewCassette(os.Getenv("ALIPAY_CASSETTE_PATH"), CassetteMode(mode), nil)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[INFO] Gateway traffic %s with cassette %s\n", mode, os.Getenv("ALIPAY_CASSETTE_PATH"))
+		config.Transport = cassette
+		// Replayed responses carry redacted signatures
+		config.SkipResponseVerification = CassetteMode(mode) == CassetteReplay
 	}
-	return nil
+	return NewClient(config)
 }
 
 func (client *Client) buildHeaders(method, path string, params interface{}) (map[string]string, error) {
@@ -94,7 +117,8 @@ func (client *Client) buildHeaders(method, path string, params interface{}) (map
 		return nil, err
 	}
 
-	signature, err := client.generateSignature(method, path, currentTimestamp, string(paramsJSON))
+	keys := client.currentKeys()
+	signature, err := client.generateSignature(keys.MerchantKeys[keys.SigningVersion], method, path, currentTimestamp, string(paramsJSON))
 	if err != nil {
 		return nil, err
 	}
@@ -103,15 +127,15 @@ func (client *Client) buildHeaders(method, path string, params interface{}) (map
 		"Content-Type": "application/json; charset=UTF-8",
 		"Client-Id":    client.config.ClientID,
 		"Request-Time": currentTimestamp,
-		"Signature":    fmt.Sprintf("algorithm=RSA256, keyVersion=1, signature=%s", signature),
+		"Signature":    fmt.Sprintf("algorithm=RSA256, keyVersion=%s, signature=%s", keys.SigningVersion, signature),
 	}, nil
 }
 
-func (client *Client) generateSignature(httpMethod, path, requestTime, content string) (string, error) {
+func (client *Client) generateSignature(privateKey *rsa.PrivateKey, httpMethod, path, requestTime, content string) (string, error) {
 	signContent := fmt.Sprintf("%s %s\n%s.%s.%s", httpMethod, path, client.config.ClientID, requestTime, content)
 	hash := sha256.Sum256([]byte(signContent))
 
-	signature, err := rsa.SignPKCS1v15(nil, client.privateKey, crypto.SHA256, hash[:])
+	signature, err := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA256, hash[:])
 	if err != nil {
 		return "", err
 	}
@@ -154,6 +178,10 @@ func (client *Client) sendRequest(path, method string, headers map[string]string
 		return nil, errors.New("empty response body from API")
 	}
 
+	if err := client.verifyResponse(method, path, resp.Header, body); err != nil {
+		return nil, err
+	}
+
 	return body, nil
 }
 
@@ -192,5 +220,9 @@ func (client *Client) sendRequestWithInterface(path, method string, headers map[
 		return nil, errors.New("empty response body from API")
 	}
 
+	if err := client.verifyResponse(method, path, resp.Header, body); err != nil {
+		return nil, err
+	}
+
 	return body, nil
 }
@@ -6,3 +6,17 @@ const (
 	ONLINE_PURCHASE_AUTH_CAPTURE = "51051000101000000012"
 	ESCROW_PAYMENT               = "51051000101000100008"
 )
+
+// Authorization scopes
+const (
+	SCOPE_AGREEMENT_PAY = "AGREEMENT_PAY"
+	SCOPE_CARD_LIST     = "CARD_LIST"
+	SCOPE_USER_INFO     = "USER_INFO"
+)
+
+// Authorization page languages
+const (
+	LANGUAGE_ARABIC  = "ar-IQ"
+	LANGUAGE_ENGLISH = "en-US"
+	LANGUAGE_KURDISH = "ku"
+)
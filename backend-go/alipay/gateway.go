@@ -0,0 +1,27 @@
+package alipay
+
+// Gateway is every operation of the SuperQi open API used by the backend.
+// Client implements it against the real gateway, tests substitute their own.
+type Gateway interface {
+	ApplyToken(authCode string) (ApplyTokenResponse, error)
+	InquiryUserInfo(accessToken string) (InquiryUserInfoResponse, error)
+	InquiryMerchantInfo(accessToken string) (InquiryMerchantInfoResponse, error)
+	InquiryUserCardList(accessToken string) (InquiryUserCardListResponse, error)
+	PrepareAuthorization(request PrepareAuthorizationRequest) (PrepareAuthorizationResponse, error)
+	CancelToken(accessToken string) (CancelTokenResponse, error)
+
+	Pay(request PaymentRequest) (PaymentResponse, error)
+	InquiryPayment(request InquiryPaymentRequest) (InquiryPaymentResponse, error)
+	Refund(request RefundRequest) (RefundResponse, error)
+	InquiryRefund(request InquiryRefundRequest) (InquiryRefundResponse, error)
+
+	MerchantAccept(request MerchantAcceptRequest) (MerchantAcceptResponse, error)
+	ConfirmOrder(request ConfirmOrderRequest) (ConfirmOrderResponse, error)
+	CancelPayment(request CancelPaymentRequest) (CancelPaymentResponse, error)
+	Void(request VoidRequest) (VoidResponse, error)
+
+	SendInbox(request SendInboxRequest) (SendInboxResponse, error)
+	SendPush(request SendPushRequest) (SendPushResponse, error)
+}
+
+var _ Gateway = (*Client)(nil)
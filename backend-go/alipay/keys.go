@@ -0,0 +1,173 @@
+package alipay
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DefaultKeyVersion is the version of keys configured by a single path
+const DefaultKeyVersion = "1"
+
+// KeySet is the merchant's signing keys and the gateway's verification keys, by key version.
+// While a key is rotated both versions are present and SigningVersion picks the one in use.
+type KeySet struct {
+	SigningVersion string
+	MerchantKeys   map[string]*rsa.PrivateKey
+	GatewayKeys    map[string]*rsa.PublicKey
+}
+
+type keySetFile struct {
+	SigningKeyVersion   string            `json:"signingKeyVersion"`
+	MerchantPrivateKeys map[string]string `json:"merchantPrivateKeys"`
+	GatewayPublicKeys   map[string]string `json:"gatewayPublicKeys"`
+}
+
+// LoadKeySet reads the keys of config from its key set file, or from its two key paths as
+// version 1 when it has none
+func LoadKeySet(config Config) (*KeySet, error) {
+	file := keySetFile{
+		SigningKeyVersion:   DefaultKeyVersion,
+		MerchantPrivateKeys: map[string]string{DefaultKeyVersion: config.MerchantPrivateKeyPath},
+		GatewayPublicKeys:   map[string]string{DefaultKeyVersion: config.AlipayPublicKeyPath},
+	}
+	if config.KeysPath != "" {
+		data, err := os.ReadFile(config.KeysPath)
+		if err != nil {
+			return nil, err
+		}
+		file = keySetFile{}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse key set %s: %w", config.KeysPath, err)
+		}
+	}
+
+	keys := &KeySet{
+		SigningVersion: file.SigningKeyVersion,
+		MerchantKeys:   make(map[string]*rsa.PrivateKey),
+		GatewayKeys:    make(map[string]*rsa.PublicKey),
+	}
+	for version, path := range file.MerchantPrivateKeys {
+		key, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("merchant private key version %s: %w", version, err)
+		}
+		keys.MerchantKeys[version] = key
+	}
+	for version, path := range file.GatewayPublicKeys {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("gateway public key version %s: %w", version, err)
+		}
+		keys.GatewayKeys[version] = key
+	}
+
+	if _, exists := keys.MerchantKeys[keys.SigningVersion]; !exists {
+		return nil, fmt.Errorf("no merchant private key for signing key version %q", keys.SigningVersion)
+	}
+	if len(keys.GatewayKeys) == 0 {
+		return nil, errors.New("at least one gateway public key is required")
+	}
+	return keys, nil
+}
+
+// GatewayVersions lists the versions of the gateway keys, in order
+func (keys *KeySet) GatewayVersions() []string {
+	versions := make([]string, 0, len(keys.GatewayKeys))
+	for version := range keys.GatewayKeys {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// ReloadKeys reads the keys from disk again and uses them for the following requests.
+// The keys in use are kept when the new ones cannot be loaded.
+func (client *Client) ReloadKeys() error {
+	keys, err := LoadKeySet(client.config)
+	if err != nil {
+		return err
+	}
+
+	client.keysMu.Lock()
+	client.keys = keys
+	client.keysMu.Unlock()
+
+	log.Printf("[INFO] Keys reloaded: signing with version %s, verifying versions %s\n", keys.SigningVersion, strings.Join(keys.GatewayVersions(), ", "))
+	return nil
+}
+
+func (client *Client) currentKeys() *KeySet {
+	client.keysMu.RLock()
+	defer client.keysMu.RUnlock()
+	return client.keys
+}
+
+// verifyResponse checks the signature of a gateway response with the gateway key of the
+// version it names, or with every known key when it names none
+func (client *Client) verifyResponse(method, path string, header http.Header, body []byte) error {
+	if client.config.SkipResponseVerification {
+		return nil
+	}
+
+	version, signature, err := parseSignatureHeader(header.Get("Signature"))
+	if err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("response signature is not base64: %v", err)
+	}
+
+	keys := client.currentKeys()
+	candidates := keys.GatewayKeys
+	if version != "" {
+		key, exists := keys.GatewayKeys[version]
+		if !exists {
+			return fmt.Errorf("response signed with unknown gateway key version %s", version)
+		}
+		candidates = map[string]*rsa.PublicKey{version: key}
+	}
+
+	signContent := fmt.Sprintf("%s %s\n%s.%s.%s", method, path, client.config.ClientID, header.Get("Response-Time"), body)
+	hash := sha256.Sum256([]byte(signContent))
+	for _, key := range candidates {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], decoded) == nil {
+			return nil
+		}
+	}
+	return errors.New("response signature is invalid")
+}
+
+// parseSignatureHeader extracts the key version and signature from
+// "algorithm=RSA256, keyVersion=1, signature=..."
+func parseSignatureHeader(header string) (string, string, error) {
+	var version string
+	for _, part := range strings.Split(header, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch name {
+		case "algorithm":
+			if value != "RSA256" {
+				return "", "", fmt.Errorf("unsupported signature algorithm %s", value)
+			}
+		case "keyVersion":
+			version = value
+		case "signature":
+			// Base64 padding also uses '=', so everything after the first one is the value
+			return version, value, nil
+		}
+	}
+	return "", "", errors.New("response has no signature")
+}
@@ -0,0 +1,110 @@
+package alipay_test
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/mockgateway"
+)
+
+// writeKeySet writes a key set file signing with version and holding the key pairs of versions
+func writeKeySet(t *testing.T, path, signing string, versions ...string) {
+	t.Helper()
+
+	file := map[string]interface{}{
+		"signingKeyVersion":   signing,
+		"merchantPrivateKeys": map[string]string{},
+		"gatewayPublicKeys":   map[string]string{},
+	}
+	for _, version := range versions {
+		dir := filepath.Join(filepath.Dir(path), "v"+version)
+		file["merchantPrivateKeys"].(map[string]string)[version] = filepath.Join(dir, "merchant_private_key.pem")
+		file["gatewayPublicKeys"].(map[string]string)[version] = filepath.Join(dir, "gateway_public_key.pem")
+	}
+	data, _ := json.Marshal(file)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	for _, version := range []string{"1", "2"} {
+		if err := mockgateway.GenerateKeys(filepath.Join(dir, "v"+version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(version, name string) string { return filepath.Join(dir, "v"+version, name) }
+	merchantV1, err := mockgateway.LoadPublicKey(load("1", "merchant_public_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merchantV2, err := mockgateway.LoadPublicKey(load("2", "merchant_public_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayV2, err := mockgateway.LoadPrivateKey(load("2", "gateway_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway already signs with its version 2 key and accepts both merchant keys
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayURL := "http://" + listener.Addr().String()
+	gateway, err := mockgateway.New(mockgateway.Config{
+		ClientID:           cassetteClientID,
+		MerchantPublicKey:  merchantV1,
+		GatewayPrivateKey:  gatewayV2,
+		PublicURL:          gatewayURL,
+		MerchantPublicKeys: map[string]*rsa.PublicKey{"2": merchantV2},
+		GatewayKeyVersion:  "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gateway.Serve(listener)
+	defer shutdown(gateway)
+
+	keysPath := filepath.Join(dir, "keys.json")
+	writeKeySet(t, keysPath, "1", "1")
+	client, err := alipay.NewClient(alipay.Config{
+		GatewayURL: gatewayURL,
+		ClientID:   cassetteClientID,
+		KeysPath:   keysPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ApplyToken("auth-code"); err == nil || !strings.Contains(err.Error(), "unknown gateway key version 2") {
+		t.Fatalf("response of an unknown key version answered %v", err)
+	}
+
+	// Both versions are valid during the rotation, and requests are signed with the new one
+	writeKeySet(t, keysPath, "2", "1", "2")
+	if err := client.ReloadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.ApplyToken("auth-code")
+	if err != nil || token.Result.ResultStatus != "S" {
+		t.Fatalf("apply token after rotation answered %+v, %v", token.Result, err)
+	}
+
+	// A broken key set leaves the keys in use
+	writeKeySet(t, keysPath, "3", "1", "2")
+	if err := client.ReloadKeys(); err == nil {
+		t.Fatal("key set without a signing key was loaded")
+	}
+	if _, err := client.ApplyToken("auth-code"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -153,12 +153,26 @@ type InquiryRefundResponse struct {
 	RefundFailReason string       `json:"refundFailReason,omitempty"`
 }
 
+// Agreement Payment - Prepare Authorization Request
+type PrepareAuthorizationRequest struct {
+	Scopes              []string `json:"scopes"`
+	Language            string   `json:"language,omitempty"`
+	ContractDescription string   `json:"contractDescription,omitempty"`
+	AuthRedirectURL     string   `json:"authRedirectUrl,omitempty"`
+	State               string   `json:"state,omitempty"`
+}
+
 // Agreement Payment - Prepare Authorization Response
 type PrepareAuthorizationResponse struct {
 	Result  Result `json:"result"`
 	AuthURL string `json:"authUrl"`
 }
 
+// Agreement Payment - Cancel Token Response
+type CancelTokenResponse struct {
+	Result Result `json:"result"`
+}
+
 // inbox template related types below
 type InboxTemplate struct {
 	TemplateParameters map[string]string `json:"templateParameters"`
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireAdminKey protects operator endpoints with the ADMIN_API_KEY sent in the X-Admin-Key header
+func requireAdminKey(ctx *fiber.Ctx) error {
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	if adminKey == "" {
+		log.Println("[WARNING] Admin endpoint called but ADMIN_API_KEY is not set")
+		return fiber.NewError(fiber.StatusForbidden, "Admin API is disabled")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(ctx.Get("X-Admin-Key")), []byte(adminKey)) != 1 {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid admin key")
+	}
+
+	return ctx.Next()
+}
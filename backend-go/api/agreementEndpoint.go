@@ -2,10 +2,12 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"net/url"
+	"strings"
 	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/jwe"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -17,100 +19,157 @@ import (
 // =========================================================================
 
 type prepareContractRequest struct {
-	ContractDescription string `json:"contractDescription" validate:"required"`
+	ContractDescription string   `json:"contractDescription"`
+	Scopes              []string `json:"scopes,omitempty"`
+	Language            string   `json:"language,omitempty"`
+	AuthRedirectURL     string   `json:"authRedirectUrl,omitempty"`
+	State               string   `json:"state,omitempty"`
 }
 
 type applyAccessTokenRequest struct {
 	AuthCode string `json:"authCode" validate:"required"`
+	State    string `json:"state" validate:"required"` // returned by /api/agreement/prepare
+}
+
+type unbindAgreementRequest struct {
+	Token      string `json:"token" validate:"required"`
+	CustomerID string `json:"customerId,omitempty"`
 }
 
 type executeAgreementPaymentRequest struct {
-	AccessToken      string `json:"accessToken" validate:"required"`
-	CustomerID       string `json:"customerId" validate:"required"`
+	Token            string `json:"token" validate:"required"`
+	CustomerID       string `json:"customerId,omitempty"`
 	Amount           int64  `json:"amount" validate:"required"`
 	Currency         string `json:"currency"`
 	OrderDescription string `json:"orderDescription"`
 }
 
+// Scopes and languages the frontend may request through /api/agreement/prepare
+var allowedAuthorizationScopes = map[string]bool{
+	alipay.SCOPE_AGREEMENT_PAY: true,
+	alipay.SCOPE_CARD_LIST:     true,
+	alipay.SCOPE_USER_INFO:     true,
+}
+
+var allowedAuthorizationLanguages = map[string]bool{
+	alipay.LANGUAGE_ARABIC:  true,
+	alipay.LANGUAGE_ENGLISH: true,
+	alipay.LANGUAGE_KURDISH: true,
+}
+
 // =========================================================================
 // ENDPOINT INITIALIZATION
 // =========================================================================
 
-func InitAgreementEndpoint(group fiber.Router) {
-	log.Println("=================================================================")
-	log.Println("[Backend] Initializing Agreement Payment Endpoints")
-	log.Println("=================================================================")
-	log.Println("[Backend] Registering route: POST /api/agreement/prepare")
-	log.Println("[Backend] Registering route: POST /api/agreement/apply-token")
-	log.Println("[Backend] Registering route: POST /api/agreement/pay")
-	log.Println("=================================================================")
+func (s *Server) registerAgreementEndpoint(group fiber.Router) {
+	s.logger.Println("=================================================================")
+	s.logger.Println("[Backend] Initializing Agreement Payment Endpoints")
+	s.logger.Println("=================================================================")
+	s.logger.Println("[Backend] Registering route: POST /api/agreement/prepare")
+	s.logger.Println("[Backend] Registering route: POST /api/agreement/apply-token")
+	s.logger.Println("[Backend] Registering route: POST /api/agreement/pay")
+	s.logger.Println("[Backend] Registering route: POST /api/agreement/unbind")
+	s.logger.Println("[Backend] Registering route: GET /api/agreement/:customerId")
+	s.logger.Println("=================================================================")
 
 	agreementGroup := group.Group("/agreement")
 
-	agreementGroup.Post("/prepare", handlePrepareContract)
+	agreementGroup.Post("/prepare", s.handlePrepareContract)
+
+	agreementGroup.Post("/apply-token", s.handleApplyAccessToken)
+
+	agreementGroup.Post("/pay", s.handleExecuteAgreementPayment)
 
-	agreementGroup.Post("/apply-token", handleApplyAccessToken)
+	agreementGroup.Post("/unbind", s.handleUnbindAgreement)
 
-	agreementGroup.Post("/pay", handleExecuteAgreementPayment)
+	agreementGroup.Get("/:customerId", s.handleGetAgreement)
 }
 
 // =========================================================================
 // STEP 1: PREPARE CONTRACT
 // =========================================================================
 
-func handlePrepareContract(ctx *fiber.Ctx) error {
-	log.Println("\n=================================================================")
-	log.Println("[Backend] INCOMING REQUEST: POST /api/agreement/prepare")
-	log.Println("=================================================================")
+func (s *Server) handlePrepareContract(ctx *fiber.Ctx) error {
+	s.logger.Println("\n=================================================================")
+	s.logger.Println("[Backend] INCOMING REQUEST: POST /api/agreement/prepare")
+	s.logger.Println("=================================================================")
 
-	log.Println("[Backend] Request Headers:")
+	s.logger.Println("[Backend] Request Headers:")
 	ctx.Request().Header.VisitAll(func(key, value []byte) {
-		log.Printf("[Backend]   %s: %s\n", string(key), string(value))
+		s.logger.Printf("[Backend]   %s: %s\n", string(key), string(value))
 	})
 
 	rawBody := string(ctx.Body())
-	log.Printf("[Backend] Raw Request Body: %s\n", rawBody)
+	s.logger.Printf("[Backend] Raw Request Body: %s\n", rawBody)
 
 	var request prepareContractRequest
 	if err := ctx.BodyParser(&request); err != nil {
-		log.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
-		log.Println("=================================================================")
+		s.logger.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
+		s.logger.Println("=================================================================")
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
-	log.Printf("[Backend] SUCCESS: Request parsed successfully\n")
-	log.Printf("[Backend] Contract description: %s\n", request.ContractDescription)
-	log.Println("[Backend] -----------------------------------------------------------")
-	log.Println("[Backend] Calling Alipay+ PrepareAuthorization API...")
+	if len(request.Scopes) == 0 {
+		request.Scopes = []string{alipay.SCOPE_AGREEMENT_PAY}
+	}
+	if request.Language == "" {
+		request.Language = alipay.LANGUAGE_ENGLISH
+	}
+	if request.State == "" {
+		request.State = uuid.New().String()
+	}
+
+	if err := s.validatePrepareContractRequest(request); err != nil {
+		s.logger.Printf("[Backend] ERROR: Invalid prepare request: %v\n", err)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success":       false,
+			"resultStatus":  "F",
+			"resultMessage": err.Error(),
+		})
+	}
 
-	prepareResponse, err := alipay.Interface.PrepareAuthorization(request.ContractDescription)
+	s.logger.Printf("[Backend] SUCCESS: Request parsed successfully\n")
+	s.logger.Printf("[Backend] Contract description: %s\n", request.ContractDescription)
+	s.logger.Printf("[Backend] Scopes: %s\n", strings.Join(request.Scopes, ","))
+	s.logger.Printf("[Backend] Language: %s\n", request.Language)
+	s.logger.Println("[Backend] -----------------------------------------------------------")
+	s.logger.Println("[Backend] Calling Alipay+ PrepareAuthorization API...")
+
+	prepareResponse, err := s.gateway.PrepareAuthorization(alipay.PrepareAuthorizationRequest{
+		Scopes:              request.Scopes,
+		Language:            request.Language,
+		ContractDescription: request.ContractDescription,
+		AuthRedirectURL:     request.AuthRedirectURL,
+		State:               request.State,
+	})
 	if err != nil {
-		log.Printf("[Backend] ERROR: Alipay+ API call failed: %v\n", err)
-		log.Println("[Backend] This could mean:")
-		log.Println("[Backend]   1. Alipay+ gateway is unreachable")
-		log.Println("[Backend]   2. Invalid credentials in .env file")
-		log.Println("[Backend]   3. Network/firewall issue")
-		log.Println("[Backend]   4. PrepareAuthorization function not implemented")
-		log.Println("=================================================================")
+		s.logger.Printf("[Backend] ERROR: Alipay+ API call failed: %v\n", err)
+		s.logger.Println("[Backend] This could mean:")
+		s.logger.Println("[Backend]   1. Alipay+ gateway is unreachable")
+		s.logger.Println("[Backend]   2. Invalid credentials in .env file")
+		s.logger.Println("[Backend]   3. Network/firewall issue")
+		s.logger.Println("[Backend]   4. PrepareAuthorization function not implemented")
+		s.logger.Println("=================================================================")
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to prepare contract: "+err.Error())
 	}
 
-	log.Println("[Backend] SUCCESS: Alipay+ API call successful")
+	s.logger.Println("[Backend] SUCCESS: Alipay+ API call successful")
 	responseJSON, _ := json.MarshalIndent(prepareResponse, "", "  ")
-	log.Printf("[Backend] Alipay+ Response:\n%s\n", string(responseJSON))
-	log.Println("[Backend] -----------------------------------------------------------")
+	s.logger.Printf("[Backend] Alipay+ Response:\n%s\n", string(responseJSON))
+	s.logger.Println("[Backend] -----------------------------------------------------------")
 
-	log.Printf("[Backend] Checking result status: %s\n", prepareResponse.Result.ResultStatus)
-	log.Printf("[Backend] Result code: %s\n", prepareResponse.Result.ResultCode)
-	log.Printf("[Backend] Result message: %s\n", prepareResponse.Result.ResultMessage)
+	s.logger.Printf("[Backend] Checking result status: %s\n", prepareResponse.Result.ResultStatus)
+	s.logger.Printf("[Backend] Result code: %s\n", prepareResponse.Result.ResultCode)
+	s.logger.Printf("[Backend] Result message: %s\n", prepareResponse.Result.ResultMessage)
 
 	if prepareResponse.Result.ResultStatus != "S" {
-		log.Printf("[Backend] ERROR: Contract preparation failed\n")
-		log.Printf("[Backend] Status: %s, Code: %s, Message: %s\n",
+		s.logger.Printf("[Backend] ERROR: Contract preparation failed\n")
+		s.logger.Printf("[Backend] Status: %s, Code: %s, Message: %s\n",
 			prepareResponse.Result.ResultStatus,
 			prepareResponse.Result.ResultCode,
 			prepareResponse.Result.ResultMessage)
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
 		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success":       false,
 			"resultStatus":  prepareResponse.Result.ResultStatus,
@@ -120,28 +179,37 @@ func handlePrepareContract(ctx *fiber.Ctx) error {
 	}
 
 	if prepareResponse.AuthURL == "" {
-		log.Printf("[Backend] WARNING: authUrl is EMPTY in response!\n")
-		log.Printf("[Backend] This should not happen if resultStatus is 'S'\n")
-		log.Printf("[Backend] Full response: %+v\n", prepareResponse)
-		log.Println("=================================================================")
+		s.logger.Printf("[Backend] WARNING: authUrl is EMPTY in response!\n")
+		s.logger.Printf("[Backend] This should not happen if resultStatus is 'S'\n")
+		s.logger.Printf("[Backend] Full response: %+v\n", prepareResponse)
+		s.logger.Println("=================================================================")
 	} else {
-		log.Printf("[Backend] SUCCESS: Authorization URL received: %s\n", prepareResponse.AuthURL)
+		s.logger.Printf("[Backend] SUCCESS: Authorization URL received: %s\n", prepareResponse.AuthURL)
 	}
 
+	// The scopes are bound to the state, applying the auth code cannot widen them
+	s.agreements.Prepare(request.State, &PreparedAuthorization{
+		Scopes:              request.Scopes,
+		ContractDescription: request.ContractDescription,
+		PreparedAt:          s.clock.Now(),
+	})
+
 	response := fiber.Map{
 		"success":       true,
 		"authUrl":       prepareResponse.AuthURL,
+		"scopes":        request.Scopes,
+		"state":         request.State,
 		"resultStatus":  prepareResponse.Result.ResultStatus,
 		"resultCode":    prepareResponse.Result.ResultCode,
 		"resultMessage": prepareResponse.Result.ResultMessage,
 	}
 
-	log.Println("[Backend] -----------------------------------------------------------")
-	log.Println("[Backend] Building response to frontend:")
+	s.logger.Println("[Backend] -----------------------------------------------------------")
+	s.logger.Println("[Backend] Building response to frontend:")
 	responseToFrontendJSON, _ := json.MarshalIndent(response, "", "  ")
-	log.Printf("%s\n", string(responseToFrontendJSON))
-	log.Println("[Backend] SUCCESS: Sending response to frontend")
-	log.Println("=================================================================")
+	s.logger.Printf("%s\n", string(responseToFrontendJSON))
+	s.logger.Println("[Backend] SUCCESS: Sending response to frontend")
+	s.logger.Println("=================================================================")
 
 	return ctx.JSON(response)
 }
@@ -150,45 +218,59 @@ func handlePrepareContract(ctx *fiber.Ctx) error {
 // STEP 2: APPLY ACCESS TOKEN
 // =========================================================================
 
-func handleApplyAccessToken(ctx *fiber.Ctx) error {
-	log.Println("\n=================================================================")
-	log.Println("[Backend] INCOMING REQUEST: POST /api/agreement/apply-token")
-	log.Println("=================================================================")
+func (s *Server) handleApplyAccessToken(ctx *fiber.Ctx) error {
+	s.logger.Println("\n=================================================================")
+	s.logger.Println("[Backend] INCOMING REQUEST: POST /api/agreement/apply-token")
+	s.logger.Println("=================================================================")
 
 	rawBody := string(ctx.Body())
-	log.Printf("[Backend] Raw Request Body: %s\n", rawBody)
+	s.logger.Printf("[Backend] Raw Request Body: %s\n", rawBody)
 
 	var request applyAccessTokenRequest
 	if err := ctx.BodyParser(&request); err != nil {
-		log.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
-		log.Println("=================================================================")
+		s.logger.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
+		s.logger.Println("=================================================================")
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
-	log.Printf("[Backend] SUCCESS: Request parsed successfully\n")
-	log.Printf("[Backend] Auth code received (first 20 chars): %s...\n", truncateString(request.AuthCode, 20))
-	log.Printf("[Backend] Auth code length: %d\n", len(request.AuthCode))
-	log.Println("[Backend] -----------------------------------------------------------")
-	log.Println("[Backend] Calling Alipay+ ApplyToken API...")
+	// The state is taken so two requests cannot apply it, and put back if the token is not applied
+	prepared, exists := s.agreements.TakePrepared(request.State, s.clock.Now())
+	if !exists {
+		s.logger.Printf("[Backend] ERROR: No prepared contract for state %s\n", request.State)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success":       false,
+			"resultStatus":  "F",
+			"resultMessage": "Unknown or expired authorization state, please prepare the contract again",
+		})
+	}
+
+	s.logger.Printf("[Backend] SUCCESS: Request parsed successfully\n")
+	s.logger.Printf("[Backend] Auth code received (first 20 chars): %s...\n", truncateString(request.AuthCode, 20))
+	s.logger.Printf("[Backend] Auth code length: %d\n", len(request.AuthCode))
+	s.logger.Println("[Backend] -----------------------------------------------------------")
+	s.logger.Println("[Backend] Calling Alipay+ ApplyToken API...")
 
-	tokenResponse, err := alipay.Interface.ApplyToken(request.AuthCode)
+	tokenResponse, err := s.gateway.ApplyToken(request.AuthCode)
 	if err != nil {
-		log.Printf("[Backend] ERROR: Token exchange failed: %v\n", err)
-		log.Println("=================================================================")
+		s.agreements.RestorePrepared(request.State, prepared)
+		s.logger.Printf("[Backend] ERROR: Token exchange failed: %v\n", err)
+		s.logger.Println("=================================================================")
 		return fiber.NewError(fiber.StatusBadRequest, "Token exchange failed: "+err.Error())
 	}
 
-	log.Println("[Backend] SUCCESS: Alipay+ API call successful")
+	s.logger.Println("[Backend] SUCCESS: Alipay+ API call successful")
 	responseJSON, _ := json.MarshalIndent(tokenResponse, "", "  ")
-	log.Printf("[Backend] Alipay+ Response:\n%s\n", string(responseJSON))
-	log.Println("[Backend] -----------------------------------------------------------")
+	s.logger.Printf("[Backend] Alipay+ Response:\n%s\n", string(responseJSON))
+	s.logger.Println("[Backend] -----------------------------------------------------------")
 
-	log.Printf("[Backend] Checking result status: %s\n", tokenResponse.Result.ResultStatus)
-	log.Printf("[Backend] Result code: %s\n", tokenResponse.Result.ResultCode)
+	s.logger.Printf("[Backend] Checking result status: %s\n", tokenResponse.Result.ResultStatus)
+	s.logger.Printf("[Backend] Result code: %s\n", tokenResponse.Result.ResultCode)
 
 	if tokenResponse.Result.ResultStatus != "S" || tokenResponse.Result.ResultCode != "SUCCESS" {
-		log.Printf("[Backend] ERROR: Token application failed: %s\n", tokenResponse.Result.ResultMessage)
-		log.Println("=================================================================")
+		s.agreements.RestorePrepared(request.State, prepared)
+		s.logger.Printf("[Backend] ERROR: Token application failed: %s\n", tokenResponse.Result.ResultMessage)
+		s.logger.Println("=================================================================")
 		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success":       false,
 			"resultStatus":  tokenResponse.Result.ResultStatus,
@@ -197,19 +279,41 @@ func handleApplyAccessToken(ctx *fiber.Ctx) error {
 		})
 	}
 
-	log.Printf("[Backend] SUCCESS: Access token obtained\n")
-	log.Printf("[Backend] Access Token (first 20 chars): %s...\n", truncateString(tokenResponse.AccessToken, 20))
-	log.Printf("[Backend] Refresh Token (first 20 chars): %s...\n", truncateString(tokenResponse.RefreshToken, 20))
-	log.Printf("[Backend] Token Expiry: %s\n", tokenResponse.AccessTokenExpiryTime)
-	log.Printf("[Backend] Customer ID: %s\n", tokenResponse.CustomerID)
-	log.Printf("[Backend] IMPORTANT: Store this accessToken in database for future payments!\n")
-	log.Println("[Backend] SUCCESS: Sending response to frontend")
-	log.Println("=================================================================")
+	s.logger.Printf("[Backend] SUCCESS: Access token obtained\n")
+	s.logger.Printf("[Backend] Access Token (first 20 chars): %s...\n", truncateString(tokenResponse.AccessToken, 20))
+	s.logger.Printf("[Backend] Refresh Token (first 20 chars): %s...\n", truncateString(tokenResponse.RefreshToken, 20))
+	s.logger.Printf("[Backend] Token Expiry: %s\n", tokenResponse.AccessTokenExpiryTime)
+	s.logger.Printf("[Backend] Customer ID: %s\n", tokenResponse.CustomerID)
+
+	s.agreements.Set(tokenResponse.CustomerID, &AgreementInfo{
+		CustomerID:             tokenResponse.CustomerID,
+		AccessToken:            tokenResponse.AccessToken,
+		RefreshToken:           tokenResponse.RefreshToken,
+		Scopes:                 prepared.Scopes,
+		ContractDescription:    prepared.ContractDescription,
+		AccessTokenExpiryTime:  tokenResponse.AccessTokenExpiryTime,
+		RefreshTokenExpiryTime: tokenResponse.RefreshTokenExpiryTime,
+		CreatedAt:              s.clock.Now(),
+	})
+	s.logger.Println("[Backend] Agreement stored, the tokens never leave the backend")
+
+	// The frontend authenticates later agreement requests with a JWE of the customer
+	jweToken, err := jwe.CreateJWE(jwe.TokenClaims{
+		UserID:   tokenResponse.CustomerID,
+		TenantID: s.tenantID,
+	})
+	if err != nil {
+		s.logger.Printf("[Backend] ERROR: Failed to create JWE token: %v\n", err)
+		s.logger.Println("=================================================================")
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	s.logger.Println("[Backend] SUCCESS: Sending response to frontend")
+	s.logger.Println("=================================================================")
 
 	return ctx.JSON(fiber.Map{
 		"success":                true,
-		"accessToken":            tokenResponse.AccessToken,
-		"refreshToken":           tokenResponse.RefreshToken,
+		"token":                  jweToken,
 		"accessTokenExpiryTime":  tokenResponse.AccessTokenExpiryTime,
 		"refreshTokenExpiryTime": tokenResponse.RefreshTokenExpiryTime,
 		"customerId":             tokenResponse.CustomerID,
@@ -223,38 +327,49 @@ func handleApplyAccessToken(ctx *fiber.Ctx) error {
 // STEP 3: EXECUTE AGREEMENT PAYMENT
 // =========================================================================
 
-func handleExecuteAgreementPayment(ctx *fiber.Ctx) error {
-	log.Println("\n=================================================================")
-	log.Println("[Backend] INCOMING REQUEST: POST /api/agreement/pay")
-	log.Println("=================================================================")
+func (s *Server) handleExecuteAgreementPayment(ctx *fiber.Ctx) error {
+	s.logger.Println("\n=================================================================")
+	s.logger.Println("[Backend] INCOMING REQUEST: POST /api/agreement/pay")
+	s.logger.Println("=================================================================")
 
 	rawBody := string(ctx.Body())
-	log.Printf("[Backend] Raw Request Body: %s\n", rawBody)
+	s.logger.Printf("[Backend] Raw Request Body: %s\n", rawBody)
 
 	var request executeAgreementPaymentRequest
 	if err := ctx.BodyParser(&request); err != nil {
-		log.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
-		log.Println("=================================================================")
+		s.logger.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
+		s.logger.Println("=================================================================")
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
+	customerID, err := s.agreementCustomer(request.Token, request.CustomerID)
+	if err != nil {
+		s.logger.Println("=================================================================")
+		return err
+	}
+	request.CustomerID = customerID
+
 	if request.Currency == "" {
-		request.Currency = "IQD"
+		request.Currency = s.currency()
+	}
+	if !s.acceptsCurrency(request.Currency) {
+		s.logger.Printf("[Backend] ERROR: Currency %s is not accepted\n", request.Currency)
+		s.logger.Println("=================================================================")
+		return fiber.NewError(fiber.StatusBadRequest, "Currency "+request.Currency+" is not accepted")
 	}
 	if request.OrderDescription == "" {
 		request.OrderDescription = "Agreement payment - Monthly subscription"
 	}
 
-	log.Printf("[Backend] SUCCESS: Request parsed successfully\n")
-	log.Printf("[Backend] Access Token (first 20 chars): %s...\n", truncateString(request.AccessToken, 20))
-	log.Printf("[Backend] Customer ID: %s\n", request.CustomerID)
-	log.Printf("[Backend] Amount: %d %s\n", request.Amount, request.Currency)
-	log.Printf("[Backend] Order Description: %s\n", request.OrderDescription)
-	log.Println("[Backend] -----------------------------------------------------------")
+	s.logger.Printf("[Backend] SUCCESS: Request parsed successfully\n")
+	s.logger.Printf("[Backend] Customer ID: %s\n", request.CustomerID)
+	s.logger.Printf("[Backend] Amount: %d %s\n", request.Amount, request.Currency)
+	s.logger.Printf("[Backend] Order Description: %s\n", request.OrderDescription)
+	s.logger.Println("[Backend] -----------------------------------------------------------")
 
 	if request.Amount <= 0 {
-		log.Println("[Backend] ERROR: Invalid payment amount")
-		log.Println("=================================================================")
+		s.logger.Println("[Backend] ERROR: Invalid payment amount")
+		s.logger.Println("=================================================================")
 		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success":       false,
 			"resultStatus":  "F",
@@ -262,32 +377,42 @@ func handleExecuteAgreementPayment(ctx *fiber.Ctx) error {
 		})
 	}
 
-	if request.AccessToken == "" {
-		log.Println("[Backend] ERROR: Access token is required")
-		log.Println("=================================================================")
-		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+	// Only the access token stored with the agreement is used, clients never hold one
+	agreement, exists := s.agreements.Get(request.CustomerID)
+	if !exists {
+		s.logger.Printf("[Backend] ERROR: No agreement found for customer %s\n", request.CustomerID)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"success":       false,
 			"resultStatus":  "F",
-			"resultMessage": "Access token is required",
+			"resultMessage": "No agreement found for this customer",
 		})
 	}
-
-	if request.CustomerID == "" {
-		log.Println("[Backend] ERROR: Customer ID is required")
-		log.Println("=================================================================")
+	if agreement.IsExpired(s.clock.Now()) {
+		s.logger.Printf("[Backend] ERROR: Agreement for customer %s expired at %s\n", request.CustomerID, agreement.AccessTokenExpiryTime)
+		s.logger.Println("=================================================================")
 		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success":       false,
 			"resultStatus":  "F",
-			"resultMessage": "Customer ID is required",
+			"resultMessage": "Agreement has expired, please sign the contract again",
+		})
+	}
+	if !agreement.HasScope(alipay.SCOPE_AGREEMENT_PAY) {
+		s.logger.Printf("[Backend] ERROR: Agreement for customer %s was not granted %s (scopes: %v)\n", request.CustomerID, alipay.SCOPE_AGREEMENT_PAY, agreement.Scopes)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"success":       false,
+			"resultStatus":  "F",
+			"resultMessage": "Agreement does not allow payments, please sign a contract with the " + alipay.SCOPE_AGREEMENT_PAY + " scope",
 		})
 	}
 
-	log.Println("[Backend] Executing agreement payment...")
+	s.logger.Println("[Backend] Executing agreement payment with the stored access token...")
 
-	paymentResponse, err := executeAgreementPaymentInternal(request.AccessToken, request.CustomerID, request.Amount, request.Currency, request.OrderDescription)
+	paymentResponse, err := s.executeAgreementPaymentInternal(agreement.AccessToken, request.CustomerID, request.Amount, request.Currency, request.OrderDescription)
 	if err != nil {
-		log.Printf("[Backend] ERROR: Failed to execute payment: %v\n", err)
-		log.Println("=================================================================")
+		s.logger.Printf("[Backend] ERROR: Failed to execute payment: %v\n", err)
+		s.logger.Println("=================================================================")
 		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success":       false,
 			"resultStatus":  "F",
@@ -297,29 +422,156 @@ func handleExecuteAgreementPayment(ctx *fiber.Ctx) error {
 
 	response := buildAgreementPaymentResponse(paymentResponse)
 
-	log.Println("[Backend] SUCCESS: Sending payment response to frontend")
-	log.Println("=================================================================")
+	s.logger.Println("[Backend] SUCCESS: Sending payment response to frontend")
+	s.logger.Println("=================================================================")
 	return ctx.JSON(response)
 }
 
+// =========================================================================
+// AGREEMENT STATUS INQUIRY
+// =========================================================================
+
+func (s *Server) handleGetAgreement(ctx *fiber.Ctx) error {
+	token := strings.TrimPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+	if token == "" {
+		token = ctx.Query("token")
+	}
+	customerID, err := s.agreementCustomer(token, ctx.Params("customerId"))
+	if err != nil {
+		return err
+	}
+
+	s.logger.Printf("[Backend] Agreement status request for customer: %s\n", customerID)
+
+	agreement, exists := s.agreements.Get(customerID)
+	if !exists {
+		s.logger.Printf("[Backend] WARNING: No agreement found for customer %s\n", customerID)
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"message": "No agreement found for this customer",
+		})
+	}
+
+	status := "ACTIVE"
+	if agreement.IsExpired(s.clock.Now()) {
+		status = "EXPIRED"
+	}
+
+	return ctx.JSON(fiber.Map{
+		"success":                true,
+		"customerId":             agreement.CustomerID,
+		"status":                 status,
+		"scopes":                 agreement.Scopes,
+		"contractDescription":    agreement.ContractDescription,
+		"accessTokenExpiryTime":  agreement.AccessTokenExpiryTime,
+		"refreshTokenExpiryTime": agreement.RefreshTokenExpiryTime,
+		"createdAt":              agreement.CreatedAt,
+	})
+}
+
+// =========================================================================
+// UNBIND AGREEMENT
+// =========================================================================
+
+func (s *Server) handleUnbindAgreement(ctx *fiber.Ctx) error {
+	s.logger.Println("\n=================================================================")
+	s.logger.Println("[Backend] INCOMING REQUEST: POST /api/agreement/unbind")
+	s.logger.Println("=================================================================")
+
+	var request unbindAgreementRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		s.logger.Printf("[Backend] ERROR: Failed to parse request body: %v\n", err)
+		s.logger.Println("=================================================================")
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	customerID, err := s.agreementCustomer(request.Token, request.CustomerID)
+	if err != nil {
+		s.logger.Println("=================================================================")
+		return err
+	}
+	request.CustomerID = customerID
+
+	agreement, exists := s.agreements.Get(request.CustomerID)
+	if !exists {
+		s.logger.Printf("[Backend] ERROR: No agreement found for customer %s\n", request.CustomerID)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success":       false,
+			"resultStatus":  "F",
+			"resultMessage": "No agreement found for this customer",
+		})
+	}
+
+	s.logger.Printf("[Backend] Unbinding agreement for customer: %s\n", request.CustomerID)
+	s.logger.Println("[Backend] Calling Alipay+ CancelToken API...")
+
+	cancelResponse, err := s.gateway.CancelToken(agreement.AccessToken)
+	if err != nil {
+		s.logger.Printf("[Backend] ERROR: Token cancellation failed: %v\n", err)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success":       false,
+			"resultStatus":  "F",
+			"resultMessage": err.Error(),
+		})
+	}
+
+	if cancelResponse.Result.ResultStatus != "S" {
+		s.logger.Printf("[Backend] ERROR: Token cancellation failed: %s\n", cancelResponse.Result.ResultMessage)
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success":       false,
+			"resultStatus":  cancelResponse.Result.ResultStatus,
+			"resultCode":    cancelResponse.Result.ResultCode,
+			"resultMessage": cancelResponse.Result.ResultMessage,
+		})
+	}
+
+	s.agreements.Delete(request.CustomerID)
+
+	s.logger.Println("[Backend] SUCCESS: Agreement unbound")
+	s.logger.Println("=================================================================")
+
+	return ctx.JSON(fiber.Map{
+		"success":       true,
+		"customerId":    request.CustomerID,
+		"resultStatus":  cancelResponse.Result.ResultStatus,
+		"resultCode":    cancelResponse.Result.ResultCode,
+		"resultMessage": cancelResponse.Result.ResultMessage,
+	})
+}
+
 // =========================================================================
 // INTERNAL HELPER FUNCTIONS
 // =========================================================================
 
-func executeAgreementPaymentInternal(accessToken string, customerID string, amount int64, currency string, orderDescription string) (alipay.PaymentResponse, error) {
-	log.Println("[Backend] Preparing agreement payment request...")
-	log.Printf("[Backend] Using Customer ID: %s\n", customerID)
+// agreementCustomer returns the customer a JWE was issued for. A customer ID sent along
+// with it must name the same customer, agreements of others are never touched.
+func (s *Server) agreementCustomer(token, customerID string) (string, error) {
+	claims, err := jwe.ParseAndValidateJWE(token)
+	if err != nil {
+		s.logger.Printf("[Backend] ERROR: Invalid token: %v\n", err)
+		return "", fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+	}
+	if customerID != "" && customerID != claims.UserID {
+		s.logger.Printf("[Backend] ERROR: Customer %s asked for the agreement of customer %s\n", claims.UserID, customerID)
+		return "", fiber.NewError(fiber.StatusForbidden, "Agreement belongs to another customer")
+	}
+	return claims.UserID, nil
+}
+
+func (s *Server) executeAgreementPaymentInternal(accessToken string, customerID string, amount int64, currency string, orderDescription string) (alipay.PaymentResponse, error) {
+	s.logger.Println("[Backend] Preparing agreement payment request...")
+	s.logger.Printf("[Backend] Using Customer ID: %s\n", customerID)
 
-	paymentRequestID := fmt.Sprintf("AGREEMENT-PAY-%s-%d", uuid.New().String(), time.Now().Unix())
-	log.Printf("[Backend] Generated Payment Request ID: %s\n", paymentRequestID)
+	paymentRequestID := fmt.Sprintf("AGREEMENT-PAY-%s-%d", uuid.New().String(), s.clock.Now().Unix())
+	s.logger.Printf("[Backend] Generated Payment Request ID: %s\n", paymentRequestID)
 
-	expiryTime := time.Now().Add(30 * time.Minute).Format("2006-01-02T15:04:05-07:00")
+	expiryTime := s.clock.Now().Add(30 * time.Minute).Format("2006-01-02T15:04:05-07:00")
 
 	// base URL for notification
-	baseURL := os.Getenv("BASE_URL")
-	if baseURL == "" {
-		baseURL = "http://localhost:1999"
-	}
+	baseURL := s.baseURL
 
 	paymentRequest := alipay.PaymentRequest{
 		ProductCode:      alipay.AGREEMENT_PAYMENT,
@@ -340,36 +592,36 @@ func executeAgreementPaymentInternal(accessToken string, customerID string, amou
 	}
 
 	requestJSON, _ := json.MarshalIndent(paymentRequest, "", "  ")
-	log.Printf("[Backend] Agreement payment request:\n%s\n", string(requestJSON))
+	s.logger.Printf("[Backend] Agreement payment request:\n%s\n", string(requestJSON))
 
-	log.Println("[Backend] Calling /v1/payments/pay API...")
-	paymentResponse, err := alipay.Interface.Pay(paymentRequest)
+	s.logger.Println("[Backend] Calling /v1/payments/pay API...")
+	paymentResponse, err := s.gateway.Pay(paymentRequest)
 	if err != nil {
-		log.Printf("[Backend] ERROR: Payment API call failed: %v\n", err)
+		s.logger.Printf("[Backend] ERROR: Payment API call failed: %v\n", err)
 		return alipay.PaymentResponse{}, fmt.Errorf("payment API call failed: %v", err)
 	}
 
 	responseJSON, _ := json.MarshalIndent(paymentResponse, "", "  ")
-	log.Printf("[Backend] Payment API response:\n%s\n", string(responseJSON))
+	s.logger.Printf("[Backend] Payment API response:\n%s\n", string(responseJSON))
 
 	// Log payment status
 	switch paymentResponse.Result.ResultStatus {
 	case "S":
-		log.Println("[Backend] SUCCESS: Payment completed immediately")
-		log.Printf("[Backend] Payment ID: %s\n", paymentResponse.PaymentID)
-		log.Printf("[Backend] Payment Time: %s\n", paymentResponse.PaymentTime)
-		log.Println("[Backend] Money deducted from user's wallet automatically!")
+		s.logger.Println("[Backend] SUCCESS: Payment completed immediately")
+		s.logger.Printf("[Backend] Payment ID: %s\n", paymentResponse.PaymentID)
+		s.logger.Printf("[Backend] Payment Time: %s\n", paymentResponse.PaymentTime)
+		s.logger.Println("[Backend] Money deducted from user's wallet automatically!")
 
 	case "U":
-		log.Println("[Backend] WARNING: Payment status unknown")
-		log.Println("[Backend] Backend should poll /v1/payments/inquiryPayment for status")
+		s.logger.Println("[Backend] WARNING: Payment status unknown")
+		s.logger.Println("[Backend] Backend should poll /v1/payments/inquiryPayment for status")
 
 	case "F":
-		log.Printf("[Backend] ERROR: Payment failed - %s\n", paymentResponse.Result.ResultMessage)
-		log.Printf("[Backend] Error Code: %s\n", paymentResponse.Result.ResultCode)
+		s.logger.Printf("[Backend] ERROR: Payment failed - %s\n", paymentResponse.Result.ResultMessage)
+		s.logger.Printf("[Backend] Error Code: %s\n", paymentResponse.Result.ResultCode)
 
 	default:
-		log.Printf("[Backend] WARNING: Unexpected status: %s\n", paymentResponse.Result.ResultStatus)
+		s.logger.Printf("[Backend] WARNING: Unexpected status: %s\n", paymentResponse.Result.ResultStatus)
 	}
 
 	return paymentResponse, nil
@@ -418,6 +670,37 @@ func buildAgreementPaymentResponse(paymentResponse alipay.PaymentResponse) fiber
 	return response
 }
 
+func (s *Server) validatePrepareContractRequest(request prepareContractRequest) error {
+	for _, scope := range request.Scopes {
+		if !allowedAuthorizationScopes[scope] {
+			return fmt.Errorf("unsupported scope: %s", scope)
+		}
+	}
+
+	if !allowedAuthorizationLanguages[request.Language] {
+		return fmt.Errorf("unsupported language: %s", request.Language)
+	}
+
+	for _, scope := range request.Scopes {
+		if scope == alipay.SCOPE_AGREEMENT_PAY && request.ContractDescription == "" {
+			return errors.New("contract description is required for AGREEMENT_PAY scope")
+		}
+	}
+
+	if request.AuthRedirectURL != "" {
+		redirectURL, err := url.Parse(request.AuthRedirectURL)
+		if err != nil || redirectURL.Scheme == "" || redirectURL.Host == "" {
+			return fmt.Errorf("invalid auth redirect URL: %s", request.AuthRedirectURL)
+		}
+		// The auth code is sent to the redirect URL, it must stay with the merchant
+		if !s.redirectHosts[strings.ToLower(redirectURL.Hostname())] {
+			return fmt.Errorf("auth redirect URL host is not allowed: %s", redirectURL.Host)
+		}
+	}
+
+	return nil
+}
+
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+)
+
+const defaultAgreementsPath = "./data/agreements.json"
+
+// AgreementInfo stores a bound agreement (contract) for a customer
+type AgreementInfo struct {
+	CustomerID             string    `json:"customerId"`
+	AccessToken            string    `json:"-"`
+	RefreshToken           string    `json:"-"`
+	Scopes                 []string  `json:"scopes"`
+	ContractDescription    string    `json:"contractDescription,omitempty"`
+	AccessTokenExpiryTime  time.Time `json:"accessTokenExpiryTime"`
+	RefreshTokenExpiryTime time.Time `json:"refreshTokenExpiryTime"`
+	CreatedAt              time.Time `json:"createdAt"`
+}
+
+// IsExpired reports whether the agreement access token can no longer be used at now
+func (a *AgreementInfo) IsExpired(now time.Time) bool {
+	return !a.AccessTokenExpiryTime.IsZero() && now.After(a.AccessTokenExpiryTime)
+}
+
+// HasScope reports whether the customer consented to scope when binding the agreement
+func (a *AgreementInfo) HasScope(scope string) bool {
+	for _, granted := range a.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// How long a prepared contract waits for the user to consent and the auth code to be applied
+const preparedAuthorizationLifetime = 30 * time.Minute
+
+// PreparedAuthorization is what a prepared contract asks the user to consent to, kept
+// until the auth code is applied so the agreement only gets the scopes the user saw
+type PreparedAuthorization struct {
+	Scopes              []string
+	ContractDescription string
+	PreparedAt          time.Time
+}
+
+// AgreementStore persists agreements keyed by customer ID. Prepared authorizations are
+// short-lived and kept in memory only.
+type AgreementStore struct {
+	mu         sync.RWMutex
+	agreements map[string]*AgreementInfo
+	prepared   map[string]*PreparedAuthorization // by authorization state
+	path       string
+}
+
+// storedAgreement keeps the tokens when the agreements are written to disk, they are never
+// part of an API response
+type storedAgreement struct {
+	AgreementInfo
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// OpenAgreementStore loads the agreements of a tenant from its directory next to
+// AGREEMENTS_PATH, or from the path itself when tenantID is empty
+func OpenAgreementStore(tenantID string) (*AgreementStore, error) {
+	path := os.Getenv("AGREEMENTS_PATH")
+	if path == "" {
+		path = defaultAgreementsPath
+	}
+	path = tenant.ScopedPath(path, tenantID)
+
+	store, err := NewAgreementStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[AgreementStore] Loaded %d agreement(s) from %s", len(store.agreements), path)
+	return store, nil
+}
+
+// NewAgreementStore creates an agreement store, restoring it from path if it exists
+func NewAgreementStore(path string) (*AgreementStore, error) {
+	store := &AgreementStore{
+		agreements: make(map[string]*AgreementInfo),
+		prepared:   make(map[string]*PreparedAuthorization),
+		path:       path,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Prepare remembers the authorization prepared under state, dropping expired ones
+func (s *AgreementStore) Prepare(state string, authorization *PreparedAuthorization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for other, prepared := range s.prepared {
+		if authorization.PreparedAt.Sub(prepared.PreparedAt) > preparedAuthorizationLifetime {
+			delete(s.prepared, other)
+		}
+	}
+	s.prepared[state] = authorization
+}
+
+// TakePrepared returns the authorization prepared under state and forgets it, so each
+// state is applied once
+func (s *AgreementStore) TakePrepared(state string, now time.Time) (*PreparedAuthorization, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authorization, exists := s.prepared[state]
+	if !exists {
+		return nil, false
+	}
+	delete(s.prepared, state)
+	if now.Sub(authorization.PreparedAt) > preparedAuthorizationLifetime {
+		return nil, false
+	}
+	return authorization, true
+}
+
+// RestorePrepared puts back an authorization taken with TakePrepared whose auth code could
+// not be applied, so the user can retry under the same state
+func (s *AgreementStore) RestorePrepared(state string, authorization *PreparedAuthorization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.prepared[state]; !exists {
+		s.prepared[state] = authorization
+	}
+}
+
+// Set updates or creates the agreement of a customer
+func (s *AgreementStore) Set(customerID string, info *AgreementInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agreements[customerID] = info
+	s.saveLocked()
+	log.Printf("[AgreementStore] Stored agreement for customer %s (expires: %s)", customerID, info.AccessTokenExpiryTime)
+}
+
+// Get retrieves the agreement of a customer
+func (s *AgreementStore) Get(customerID string) (*AgreementInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, exists := s.agreements[customerID]
+	return info, exists
+}
+
+// Delete removes the agreement of a customer (after unbinding)
+func (s *AgreementStore) Delete(customerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.agreements, customerID)
+	s.saveLocked()
+	log.Printf("[AgreementStore] Deleted agreement for customer %s", customerID)
+}
+
+func (s *AgreementStore) load() error {
+	var agreements []storedAgreement
+	if err := jsonfile.Load(s.path, &agreements); err != nil {
+		return fmt.Errorf("failed to load agreements %s: %v", s.path, err)
+	}
+	for _, stored := range agreements {
+		info := stored.AgreementInfo
+		info.AccessToken = stored.AccessToken
+		info.RefreshToken = stored.RefreshToken
+		s.agreements[info.CustomerID] = &info
+	}
+	return nil
+}
+
+// saveLocked writes the agreements to disk; the caller must hold the lock
+func (s *AgreementStore) saveLocked() {
+	agreements := make([]storedAgreement, 0, len(s.agreements))
+	for _, info := range s.agreements {
+		agreements = append(agreements, storedAgreement{AgreementInfo: *info, AccessToken: info.AccessToken, RefreshToken: info.RefreshToken})
+	}
+
+	if err := jsonfile.Save(s.path, agreements); err != nil {
+		log.Printf("[AgreementStore] ERROR: Failed to save agreements: %v", err)
+	}
+}
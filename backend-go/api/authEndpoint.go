@@ -2,8 +2,6 @@ package api
 
 import (
 	"encoding/json"
-	"log"
-	"superQiMiniAppBackend/alipay"
 	"superQiMiniAppBackend/jwe"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,44 +11,48 @@ type authRequest struct {
 	AuthCode string `json:"auth_code" validate:"required"`
 }
 
-func InitAuthEndpoint(group fiber.Router) {
+func (s *Server) registerAuthEndpoint(group fiber.Router) {
 	group.Post("/auth/apply-token", func(ctx *fiber.Ctx) error {
 		var request authRequest
 		if err := ctx.BodyParser(&request); err != nil {
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("STARTING AUTH TOKEN EXCHANGE")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("STARTING AUTH TOKEN EXCHANGE")
+		s.logger.Println("=================================================================")
 
-		tokenResponse, err := alipay.Interface.ApplyToken(request.AuthCode)
+		tokenResponse, err := s.gateway.ApplyToken(request.AuthCode)
 		if err != nil {
-			log.Printf("[ERROR] Token exchange failed: %v\n", err)
+			s.logger.Printf("[ERROR] Token exchange failed: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
 
 		tokenResponseJson, _ := json.MarshalIndent(tokenResponse, "", "  ")
-		log.Printf("[SUCCESS] Token response received:\n%s\n\n", string(tokenResponseJson))
+		s.logger.Printf("[SUCCESS] Token response received:\n%s\n\n", string(tokenResponseJson))
 
 		if tokenResponse.Result.ResultCode != "SUCCESS" {
-			log.Printf("[ERROR] Invalid token response: %s\n", tokenResponse.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Invalid token response: %s\n", tokenResponse.Result.ResultMessage)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid token response: "+tokenResponse.Result.ResultMessage)
 		}
 
-		log.Println("[INFO] Token exchange successful")
-		log.Printf("[INFO] Customer ID: %s\n", tokenResponse.CustomerID)
-		log.Println("[INFO] User/Merchant detailed info can be retrieved via separate endpoints")
+		s.logger.Println("[INFO] Token exchange successful")
+		s.logger.Printf("[INFO] Customer ID: %s\n", tokenResponse.CustomerID)
+		s.logger.Println("[INFO] User/Merchant detailed info can be retrieved via separate endpoints")
+
+		// Remember the session so operators can target the user in notification campaigns
+		s.sessions.Set(tokenResponse.CustomerID, tokenResponse.AccessToken, s.clock.Now())
 
 		// Return a JWE to the MiniApp containing the access token and customer ID
 		// The customerID is returned from the token exchange and can be either userId or merchantId
 		jweToken, err := jwe.CreateJWE(jwe.TokenClaims{
 			UserID:      tokenResponse.CustomerID,
 			AccessToken: tokenResponse.AccessToken,
+			TenantID:    s.tenantID,
 		})
 
 		if err != nil {
-			log.Printf("[ERROR] Failed to create JWE token: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to create JWE token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
 		}
 
@@ -58,7 +60,7 @@ func InitAuthEndpoint(group fiber.Router) {
 			"token": jweToken,
 		}
 
-		log.Println("[SUCCESS] Returning auth token to frontend")
+		s.logger.Println("[SUCCESS] Returning auth token to frontend")
 		return ctx.JSON(response)
 	})
 }
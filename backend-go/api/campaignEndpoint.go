@@ -0,0 +1,137 @@
+package api
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type createCampaignRequest struct {
+	Name         string            `json:"name" validate:"required"`
+	TemplateCode string            `json:"templateCode" validate:"required"`
+	Language     string            `json:"language,omitempty"`
+	Parameters   map[string]string `json:"parameters"`
+	Audience     CampaignAudience  `json:"audience" validate:"required"`
+	ScheduledAt  *time.Time        `json:"scheduledAt,omitempty"` // RFC 3339, sent immediately when omitted
+}
+
+func (s *Server) registerCampaignEndpoint(group fiber.Router) {
+	s.logger.Printf("[Campaign] Sending at most %d message(s) per second", time.Second/s.campaignInterval)
+
+	// Campaigns interrupted by a restart pick up where they left off
+	for _, campaign := range s.campaigns.Unfinished() {
+		s.logger.Printf("[Campaign] Resuming %s campaign %s", campaign.Status, campaign.ID)
+		s.startCampaign(campaign)
+	}
+
+	adminGroup := group.Group("/admin/campaigns", requireAdminKey)
+
+	// GET /api/admin/campaigns/sessions - Users that can be targeted by campaigns
+	adminGroup.Get("/sessions", func(ctx *fiber.Ctx) error {
+		sessions := s.sessions.List()
+		return ctx.JSON(fiber.Map{
+			"success":  true,
+			"count":    len(sessions),
+			"sessions": sessions,
+		})
+	})
+
+	// POST /api/admin/campaigns
+	adminGroup.Post("/", func(ctx *fiber.Ctx) error {
+		var request createCampaignRequest
+		if err := ctx.BodyParser(&request); err != nil {
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+		}
+
+		s.logger.Println("=================================================================")
+		s.logger.Println("CREATE NOTIFICATION CAMPAIGN REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
+
+		if request.Name == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Campaign name is required")
+		}
+		if len(request.Audience.UserIDs) == 0 && len(request.Audience.CustomerIDs) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Campaign audience is empty")
+		}
+
+		// Validate the message once up front instead of failing for every recipient
+		rendered, err := s.templates.Render(request.TemplateCode, request.Language, request.Parameters)
+		if err != nil {
+			s.logger.Printf("[ERROR] Template validation failed: %v\n", err)
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		campaign := &Campaign{
+			Name:         request.Name,
+			TemplateCode: request.TemplateCode,
+			Language:     request.Language,
+			Parameters:   request.Parameters,
+			Channel:      rendered.Channel,
+			Audience:     request.Audience,
+		}
+		if request.ScheduledAt != nil {
+			campaign.ScheduledAt = *request.ScheduledAt
+		}
+
+		s.campaigns.Create(campaign, s.clock.Now())
+		s.startCampaign(campaign)
+
+		created, stats, _ := s.campaigns.Get(campaign.ID)
+
+		s.logger.Println("[SUCCESS] Campaign created")
+		s.logger.Println("=================================================================")
+		return ctx.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"success":  true,
+			"campaign": created,
+			"stats":    stats,
+		})
+	})
+
+	// GET /api/admin/campaigns
+	adminGroup.Get("/", func(ctx *fiber.Ctx) error {
+		s.campaigns.ResolveUnknown(s.sendLog)
+		campaigns := s.campaigns.List()
+		return ctx.JSON(fiber.Map{
+			"success":   true,
+			"count":     len(campaigns),
+			"campaigns": campaigns,
+		})
+	})
+
+	// GET /api/admin/campaigns/:id - Campaign with per-recipient results and delivery stats
+	adminGroup.Get("/:id", func(ctx *fiber.Ctx) error {
+		s.campaigns.ResolveUnknown(s.sendLog)
+		campaign, stats, exists := s.campaigns.Get(ctx.Params("id"))
+		if !exists {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Campaign not found",
+			})
+		}
+		return ctx.JSON(fiber.Map{
+			"success":  true,
+			"campaign": campaign,
+			"stats":    stats,
+		})
+	})
+
+	// POST /api/admin/campaigns/:id/cancel
+	adminGroup.Post("/:id/cancel", func(ctx *fiber.Ctx) error {
+		s.logger.Printf("[INFO] Cancel requested for campaign %s\n", ctx.Params("id"))
+
+		if err := s.campaigns.Cancel(ctx.Params("id"), s.clock.Now()); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+
+		campaign, stats, _ := s.campaigns.Get(ctx.Params("id"))
+		return ctx.JSON(fiber.Map{
+			"success":  true,
+			"campaign": campaign,
+			"stats":    stats,
+		})
+	})
+}
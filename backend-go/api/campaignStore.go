@@ -0,0 +1,591 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/notification"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Campaign statuses
+const (
+	CampaignStatusScheduled = "SCHEDULED"
+	CampaignStatusRunning   = "RUNNING"
+	CampaignStatusCompleted = "COMPLETED"
+	CampaignStatusCancelled = "CANCELLED"
+)
+
+// Recipient statuses
+const (
+	RecipientStatusPending   = "PENDING"
+	RecipientStatusSent      = "SENT"
+	RecipientStatusUnknown   = "UNKNOWN"
+	RecipientStatusFailed    = "FAILED"
+	RecipientStatusSkipped   = "SKIPPED"
+	RecipientStatusDeferred  = "DEFERRED"  // push held until the recipient's quiet hours end
+	RecipientStatusCancelled = "CANCELLED" // campaign cancelled before the recipient was sent to
+)
+
+// Recipient sources
+const (
+	RecipientSourceSession   = "SESSION"   // access token from /auth/apply-token
+	RecipientSourceAgreement = "AGREEMENT" // access token from a bound agreement
+)
+
+const (
+	defaultCampaignRatePerSecond = 10
+	defaultCampaignsPath         = "./data/campaigns.json"
+)
+
+// CampaignAudience lists who receives a campaign
+type CampaignAudience struct {
+	UserIDs     []string `json:"userIds,omitempty"`     // users with a stored session
+	CustomerIDs []string `json:"customerIds,omitempty"` // customers with a bound agreement
+}
+
+// CampaignRecipient tracks the message sent to one recipient
+type CampaignRecipient struct {
+	RecipientID   string    `json:"recipientId"`
+	Source        string    `json:"source"`
+	Status        string    `json:"status"`
+	RequestID     string    `json:"requestId,omitempty"`
+	MessageID     string    `json:"messageId,omitempty"`
+	ResultStatus  string    `json:"resultStatus,omitempty"`
+	ResultCode    string    `json:"resultCode,omitempty"`
+	ResultMessage string    `json:"resultMessage,omitempty"`
+	SentAt        time.Time `json:"sentAt,omitempty"`
+}
+
+// CampaignStats summarizes the delivery of a campaign
+type CampaignStats struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Sent      int `json:"sent"`
+	Unknown   int `json:"unknown"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+	Deferred  int `json:"deferred"`
+	Cancelled int `json:"cancelled"`
+}
+
+// Campaign is a templated message fanned out to an audience at a scheduled time
+type Campaign struct {
+	ID           string               `json:"id"`
+	Name         string               `json:"name"`
+	TemplateCode string               `json:"templateCode"`
+	Language     string               `json:"language,omitempty"`
+	Parameters   map[string]string    `json:"parameters"`
+	Channel      string               `json:"channel"`
+	Audience     CampaignAudience     `json:"audience"`
+	Status       string               `json:"status"`
+	ScheduledAt  time.Time            `json:"scheduledAt"`
+	CreatedAt    time.Time            `json:"createdAt"`
+	StartedAt    time.Time            `json:"startedAt,omitempty"`
+	CompletedAt  time.Time            `json:"completedAt,omitempty"`
+	Recipients   []*CampaignRecipient `json:"recipients"`
+	cancel       chan struct{}
+}
+
+// CampaignSummary is a campaign listed with its stats
+type CampaignSummary struct {
+	Campaign Campaign      `json:"campaign"`
+	Stats    CampaignStats `json:"stats"`
+}
+
+// CampaignStore persists campaigns and the results of their recipients keyed by campaign ID
+type CampaignStore struct {
+	mu        sync.RWMutex
+	campaigns map[string]*Campaign
+	path      string
+}
+
+// OpenCampaignStore loads the campaigns of a tenant from its directory next to
+// CAMPAIGNS_PATH, or from the path itself when tenantID is empty
+func OpenCampaignStore(tenantID string) (*CampaignStore, error) {
+	path := os.Getenv("CAMPAIGNS_PATH")
+	if path == "" {
+		path = defaultCampaignsPath
+	}
+	path = tenant.ScopedPath(path, tenantID)
+
+	store, err := NewCampaignStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Campaign] Loaded %d campaign(s) from %s", len(store.campaigns), path)
+	return store, nil
+}
+
+// NewCampaignStore creates a campaign store, restoring it from path if it exists
+func NewCampaignStore(path string) (*CampaignStore, error) {
+	store := &CampaignStore{
+		campaigns: make(map[string]*Campaign),
+		path:      path,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create stores a new campaign created at now, which is delivered by Server.runCampaign
+func (s *CampaignStore) Create(campaign *Campaign, now time.Time) {
+	campaign.ID = fmt.Sprintf("CAMPAIGN-%s-%d", uuid.New().String(), now.Unix())
+	campaign.Status = CampaignStatusScheduled
+	campaign.CreatedAt = now
+	if campaign.ScheduledAt.IsZero() {
+		campaign.ScheduledAt = campaign.CreatedAt
+	}
+	campaign.cancel = make(chan struct{})
+
+	for _, userID := range campaign.Audience.UserIDs {
+		campaign.Recipients = append(campaign.Recipients, &CampaignRecipient{
+			RecipientID: userID,
+			Source:      RecipientSourceSession,
+			Status:      RecipientStatusPending,
+		})
+	}
+	for _, customerID := range campaign.Audience.CustomerIDs {
+		campaign.Recipients = append(campaign.Recipients, &CampaignRecipient{
+			RecipientID: customerID,
+			Source:      RecipientSourceAgreement,
+			Status:      RecipientStatusPending,
+		})
+	}
+
+	s.mu.Lock()
+	s.campaigns[campaign.ID] = campaign
+	s.saveLocked()
+	s.mu.Unlock()
+
+	log.Printf("[Campaign] Created campaign %s (%s) for %d recipient(s), scheduled at %s",
+		campaign.ID, campaign.Name, len(campaign.Recipients), campaign.ScheduledAt.Format(time.RFC3339))
+}
+
+// Get returns a snapshot of a campaign with its stats
+func (s *CampaignStore) Get(campaignID string) (Campaign, CampaignStats, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	campaign, exists := s.campaigns[campaignID]
+	if !exists {
+		return Campaign{}, CampaignStats{}, false
+	}
+	return snapshotCampaign(campaign), campaignStats(campaign), true
+}
+
+// Unfinished returns the campaigns that are scheduled or running, to resume them after a restart
+func (s *CampaignStore) Unfinished() []*Campaign {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var unfinished []*Campaign
+	for _, campaign := range s.campaigns {
+		if campaign.Status == CampaignStatusScheduled || campaign.Status == CampaignStatusRunning {
+			unfinished = append(unfinished, campaign)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].CreatedAt.Before(unfinished[j].CreatedAt)
+	})
+	return unfinished
+}
+
+// List returns every campaign without recipients, newest first
+func (s *CampaignStore) List() []CampaignSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]CampaignSummary, 0, len(s.campaigns))
+	for _, campaign := range s.campaigns {
+		summary := snapshotCampaign(campaign)
+		summary.Recipients = nil
+		list = append(list, CampaignSummary{Campaign: summary, Stats: campaignStats(campaign)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Campaign.CreatedAt.After(list[j].Campaign.CreatedAt)
+	})
+	return list
+}
+
+// ResolveUnknown settles the recipients whose send was unknown with the outcome the
+// reconciler recorded in sendLog for their request ID
+func (s *CampaignStore) ResolveUnknown(sendLog *notification.SendLog) {
+	if sendLog == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, campaign := range s.campaigns {
+		for _, recipient := range campaign.Recipients {
+			if recipient.Status != RecipientStatusUnknown {
+				continue
+			}
+			record, exists := sendLog.Get(recipient.RequestID)
+			if !exists {
+				continue
+			}
+			switch record.Status {
+			case notification.SendStatusSent:
+				recipient.Status = RecipientStatusSent
+			case notification.SendStatusFailed:
+				recipient.Status = RecipientStatusFailed
+			default:
+				continue
+			}
+			recipient.MessageID = record.MessageID
+			recipient.ResultStatus = record.ResultStatus
+			recipient.ResultCode = record.ResultCode
+			recipient.ResultMessage = record.ResultMessage
+			recipient.SentAt = record.LastAttemptAt
+			changed = true
+		}
+	}
+	if changed {
+		s.saveLocked()
+	}
+}
+
+// Cancel stops a campaign that has not completed yet. Recipients already sent to are kept,
+// the pending and deferred ones are marked cancelled.
+func (s *CampaignStore) Cancel(campaignID string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign, exists := s.campaigns[campaignID]
+	if !exists {
+		return fmt.Errorf("campaign %s not found", campaignID)
+	}
+	if campaign.Status == CampaignStatusCompleted || campaign.Status == CampaignStatusCancelled {
+		return fmt.Errorf("campaign %s is already %s", campaignID, campaign.Status)
+	}
+
+	campaign.Status = CampaignStatusCancelled
+	campaign.CompletedAt = now
+	for _, recipient := range campaign.Recipients {
+		if recipient.Status == RecipientStatusPending || recipient.Status == RecipientStatusDeferred {
+			recipient.Status = RecipientStatusCancelled
+		}
+	}
+	close(campaign.cancel)
+	s.saveLocked()
+	log.Printf("[Campaign] Cancelled campaign %s", campaignID)
+	return nil
+}
+
+// startCampaign runs a campaign in the background until it completes, is cancelled or the server closes
+func (s *Server) startCampaign(campaign *Campaign) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.runCampaign(campaign)
+	}()
+}
+
+// runCampaign waits for the schedule and sends the campaign to every recipient, one gateway call at a time.
+// It completes once the recipients deferred by their quiet hours have been sent to as well. A campaign
+// stopped by Close stays running and resumes with the recipients it has not sent to yet.
+func (s *Server) runCampaign(campaign *Campaign) {
+	select {
+	case <-s.clock.After(campaign.ScheduledAt.Sub(s.clock.Now())):
+	case <-campaign.cancel:
+		return
+	case <-s.done:
+		return
+	}
+
+	s.campaigns.mu.Lock()
+	switch campaign.Status {
+	case CampaignStatusScheduled:
+		campaign.Status = CampaignStatusRunning
+		campaign.StartedAt = s.clock.Now()
+		s.campaigns.saveLocked()
+	case CampaignStatusRunning:
+	default:
+		s.campaigns.mu.Unlock()
+		return
+	}
+	// Recipients sent to before a restart keep their result, deferred ones are decided again
+	unsent := make([]bool, len(campaign.Recipients))
+	for index, recipient := range campaign.Recipients {
+		unsent[index] = recipient.Status == RecipientStatusPending || recipient.Status == RecipientStatusDeferred
+	}
+	s.campaigns.mu.Unlock()
+
+	s.logger.Printf("[Campaign] Starting campaign %s", campaign.ID)
+
+	rendered, renderErr := s.templates.Render(campaign.TemplateCode, campaign.Language, campaign.Parameters)
+	if renderErr != nil {
+		// Templates are validated on creation, this only happens if the registry changed since
+		s.logger.Printf("[Campaign] ERROR: Campaign %s template is no longer valid: %v", campaign.ID, renderErr)
+	}
+
+	var deferred sync.WaitGroup
+	for index, recipient := range campaign.Recipients {
+		if !unsent[index] {
+			continue
+		}
+		select {
+		case <-campaign.cancel:
+			s.logger.Printf("[Campaign] Campaign %s stopped after %d recipient(s)", campaign.ID, index)
+			return
+		case <-s.done:
+			s.logger.Printf("[Campaign] Campaign %s paused after %d recipient(s)", campaign.ID, index)
+			return
+		default:
+		}
+
+		requestID := fmt.Sprintf("%s-%d", campaign.ID, index)
+
+		if renderErr != nil {
+			s.campaigns.recordRecipient(recipient, requestID, RecipientStatusFailed, alipay.Result{ResultMessage: renderErr.Error()}, "", s.clock.Now())
+			continue
+		}
+
+		accessToken, reason := s.resolveRecipientToken(recipient)
+		if accessToken == "" {
+			s.campaigns.recordRecipient(recipient, requestID, RecipientStatusSkipped, alipay.Result{ResultMessage: reason}, "", s.clock.Now())
+			continue
+		}
+
+		decision := s.decideNotification(recipient.RecipientID, rendered.Category, rendered.Channel)
+		switch decision.Action {
+		case notification.DecisionSuppress:
+			s.campaigns.recordRecipient(recipient, requestID, RecipientStatusSkipped, alipay.Result{ResultMessage: decision.Reason}, "", s.clock.Now())
+			continue
+		case notification.DecisionDefer, notification.DecisionDowngrade:
+			s.campaigns.recordRecipient(recipient, requestID, RecipientStatusDeferred, alipay.Result{ResultMessage: decision.Reason}, "", s.clock.Now())
+			deferred.Add(1)
+			s.workers.Add(1)
+			go func(recipient *CampaignRecipient, accessToken, requestID string) {
+				defer s.workers.Done()
+				defer deferred.Done()
+				s.deferRecipient(campaign, recipient, rendered, accessToken, requestID, decision.Until)
+			}(recipient, accessToken, requestID)
+			continue
+		}
+
+		select {
+		case <-s.campaignTurn():
+		case <-campaign.cancel:
+			s.logger.Printf("[Campaign] Campaign %s stopped after %d recipient(s)", campaign.ID, index)
+			return
+		case <-s.done:
+			s.logger.Printf("[Campaign] Campaign %s paused after %d recipient(s)", campaign.ID, index)
+			return
+		}
+
+		s.sendToRecipient(recipient, rendered, accessToken, requestID)
+	}
+	deferred.Wait()
+
+	select {
+	case <-s.done:
+		// Deferred recipients dropped by Close are sent to when the campaign resumes
+		return
+	default:
+	}
+
+	s.campaigns.mu.Lock()
+	if campaign.Status == CampaignStatusRunning {
+		campaign.Status = CampaignStatusCompleted
+		campaign.CompletedAt = s.clock.Now()
+		s.campaigns.saveLocked()
+	}
+	stats := campaignStats(campaign)
+	s.campaigns.mu.Unlock()
+
+	s.logger.Printf("[Campaign] Campaign %s completed: %d sent, %d unknown, %d failed, %d skipped",
+		campaign.ID, stats.Sent, stats.Unknown, stats.Failed, stats.Skipped)
+}
+
+// sendToRecipient sends the campaign message to one recipient and records the result
+func (s *Server) sendToRecipient(recipient *CampaignRecipient, rendered notification.Rendered, accessToken, requestID string) {
+	result, messageID, err := s.sendCampaignMessage(rendered, recipient.RecipientID, accessToken, requestID)
+	switch {
+	case err != nil:
+		// The wallet may still have received it, the reconciler re-sends it like a "U" result
+		s.campaigns.recordRecipient(recipient, requestID, RecipientStatusUnknown, alipay.Result{ResultStatus: "U", ResultMessage: err.Error()}, "", s.clock.Now())
+	case result.ResultStatus == "S" || result.ResultStatus == "A":
+		s.campaigns.recordRecipient(recipient, requestID, RecipientStatusSent, result, messageID, s.clock.Now())
+	case result.ResultStatus == "U":
+		s.campaigns.recordRecipient(recipient, requestID, RecipientStatusUnknown, result, messageID, s.clock.Now())
+	default:
+		s.campaigns.recordRecipient(recipient, requestID, RecipientStatusFailed, result, messageID, s.clock.Now())
+	}
+}
+
+// deferRecipient sends a campaign push once the recipient's quiet hours are over, unless the
+// campaign is cancelled first. Cancel marks the recipient cancelled.
+func (s *Server) deferRecipient(campaign *Campaign, recipient *CampaignRecipient, rendered notification.Rendered, accessToken, requestID string, until time.Time) {
+	s.logger.Printf("[Campaign] Quiet hours for %s, deferring %s until %s", recipient.RecipientID, requestID, until.Format(time.RFC3339))
+
+	select {
+	case <-s.clock.After(until.Sub(s.clock.Now())):
+	case <-campaign.cancel:
+		s.logger.Printf("[Campaign] Campaign %s cancelled, dropping deferred %s", campaign.ID, requestID)
+		return
+	case <-s.done:
+		return
+	}
+
+	select {
+	case <-s.campaignTurn():
+	case <-campaign.cancel:
+		s.logger.Printf("[Campaign] Campaign %s cancelled, dropping deferred %s", campaign.ID, requestID)
+		return
+	case <-s.done:
+		return
+	}
+
+	s.sendToRecipient(recipient, rendered, accessToken, requestID)
+}
+
+func (s *CampaignStore) recordRecipient(recipient *CampaignRecipient, requestID, status string, result alipay.Result, messageID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recipient.Status = status
+	recipient.RequestID = requestID
+	recipient.MessageID = messageID
+	recipient.ResultStatus = result.ResultStatus
+	recipient.ResultCode = result.ResultCode
+	recipient.ResultMessage = result.ResultMessage
+	recipient.SentAt = at
+	s.saveLocked()
+}
+
+// resolveRecipientToken finds the access token of a recipient, or explains why there is none
+func (s *Server) resolveRecipientToken(recipient *CampaignRecipient) (string, string) {
+	switch recipient.Source {
+	case RecipientSourceSession:
+		session, exists := s.sessions.Get(recipient.RecipientID)
+		if !exists {
+			return "", "No stored session for user"
+		}
+		return session.AccessToken, ""
+
+	case RecipientSourceAgreement:
+		agreement, exists := s.agreements.Get(recipient.RecipientID)
+		if !exists {
+			return "", "No agreement for customer"
+		}
+		if agreement.IsExpired(s.clock.Now()) {
+			return "", "Agreement access token expired"
+		}
+		return agreement.AccessToken, ""
+	}
+	return "", "Unknown recipient source"
+}
+
+// sendCampaignMessage sends a rendered template to one recipient through its channel
+func (s *Server) sendCampaignMessage(rendered notification.Rendered, recipientID, accessToken, requestID string) (alipay.Result, string, error) {
+	if rendered.Channel == notification.ChannelPush {
+		pushResponse, err := s.sendPush(recipientID, alipay.SendPushRequest{
+			AccessToken:  accessToken,
+			RequestID:    requestID,
+			TemplateCode: rendered.Code,
+			Templates: []alipay.PushTemplate{
+				{
+					TemplateParameters: rendered.Parameters,
+				},
+			},
+		})
+		return pushResponse.Result, pushResponse.MessageID, err
+	}
+
+	inboxResponse, err := s.sendInbox(recipientID, alipay.SendInboxRequest{
+		AccessToken:  accessToken,
+		RequestID:    requestID,
+		TemplateCode: rendered.Code,
+		Templates: []alipay.InboxTemplate{
+			{
+				TemplateParameters: rendered.Parameters,
+			},
+		},
+	})
+	return inboxResponse.Result, inboxResponse.MessageID, err
+}
+
+// campaignTurn reserves the next slot for a campaign message and fires when it comes.
+// Slots are campaignInterval apart across every campaign of the server.
+func (s *Server) campaignTurn() <-chan time.Time {
+	s.campaignMu.Lock()
+	defer s.campaignMu.Unlock()
+
+	now := s.clock.Now()
+	if s.nextCampaignSend.Before(now) {
+		s.nextCampaignSend = now
+	}
+	turn := s.nextCampaignSend
+	s.nextCampaignSend = turn.Add(s.campaignInterval)
+	return s.clock.After(turn.Sub(now))
+}
+
+func (s *CampaignStore) load() error {
+	var campaigns []*Campaign
+	if err := jsonfile.Load(s.path, &campaigns); err != nil {
+		return fmt.Errorf("failed to load campaigns %s: %v", s.path, err)
+	}
+	for _, campaign := range campaigns {
+		campaign.cancel = make(chan struct{})
+		s.campaigns[campaign.ID] = campaign
+	}
+	return nil
+}
+
+// saveLocked writes the campaigns to disk; the caller must hold the lock
+func (s *CampaignStore) saveLocked() {
+	campaigns := make([]*Campaign, 0, len(s.campaigns))
+	for _, campaign := range s.campaigns {
+		campaigns = append(campaigns, campaign)
+	}
+
+	if err := jsonfile.Save(s.path, campaigns); err != nil {
+		log.Printf("[Campaign] ERROR: Failed to save campaigns: %v", err)
+	}
+}
+
+// snapshotCampaign copies a campaign so it can be read without holding the lock
+func snapshotCampaign(campaign *Campaign) Campaign {
+	snapshot := *campaign
+	snapshot.Recipients = make([]*CampaignRecipient, len(campaign.Recipients))
+	for i, recipient := range campaign.Recipients {
+		copied := *recipient
+		snapshot.Recipients[i] = &copied
+	}
+	return snapshot
+}
+
+func campaignStats(campaign *Campaign) CampaignStats {
+	stats := CampaignStats{Total: len(campaign.Recipients)}
+	for _, recipient := range campaign.Recipients {
+		switch recipient.Status {
+		case RecipientStatusPending:
+			stats.Pending++
+		case RecipientStatusSent:
+			stats.Sent++
+		case RecipientStatusUnknown:
+			stats.Unknown++
+		case RecipientStatusFailed:
+			stats.Failed++
+		case RecipientStatusSkipped:
+			stats.Skipped++
+		case RecipientStatusDeferred:
+			stats.Deferred++
+		case RecipientStatusCancelled:
+			stats.Cancelled++
+		}
+	}
+	return stats
+}
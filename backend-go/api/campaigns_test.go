@@ -0,0 +1,323 @@
+package api_test
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/api"
+	"superQiMiniAppBackend/mockgateway"
+	"superQiMiniAppBackend/notification"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// createCampaign starts a campaign of template for the users and returns its ID
+func (h *harness) createCampaign(templateCode string, userIDs ...string) string {
+	h.t.Helper()
+
+	created := h.doAsAdmin(http.MethodPost, "/api/admin/campaigns", fiber.Map{
+		"name":         "journey",
+		"templateCode": templateCode,
+		"parameters":   fiber.Map{"Title": "Sale", "Content": "Everything must go"},
+		"audience":     fiber.Map{"userIds": userIDs},
+	})
+	campaign, _ := created.Body["campaign"].(map[string]interface{})
+	campaignID, _ := campaign["id"].(string)
+	if created.Status != fiber.StatusCreated || campaignID == "" {
+		h.t.Fatalf("campaign create answered %d: %s", created.Status, created.Raw)
+	}
+	return campaignID
+}
+
+// campaignState returns the status and the delivery stats of a campaign
+func (h *harness) campaignState(campaignID string) (string, map[string]int) {
+	h.t.Helper()
+
+	result := h.doAsAdmin(http.MethodGet, "/api/admin/campaigns/"+campaignID, nil)
+	if result.Status != fiber.StatusOK {
+		h.t.Fatalf("campaign answered %d: %s", result.Status, result.Raw)
+	}
+	campaign, _ := result.Body["campaign"].(map[string]interface{})
+	status, _ := campaign["status"].(string)
+
+	stats := map[string]int{}
+	values, _ := result.Body["stats"].(map[string]interface{})
+	for name, value := range values {
+		count, _ := value.(float64)
+		stats[name] = int(count)
+	}
+	return status, stats
+}
+
+func newPreferenceStore(t *testing.T) *notification.PreferenceStore {
+	t.Helper()
+
+	preferences, err := notification.NewPreferenceStore(filepath.Join(t.TempDir(), "preferences.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return preferences
+}
+
+// startQuietHours puts a user in quiet hours for the next two hours
+func startQuietHours(t *testing.T, preferences *notification.PreferenceStore, userID string, now time.Time) {
+	t.Helper()
+
+	_, err := preferences.Set(notification.Preferences{
+		CustomerID: userID,
+		QuietHours: &notification.QuietHours{
+			Start:    now.UTC().Add(-time.Hour).Format("15:04"),
+			End:      now.UTC().Add(2 * time.Hour).Format("15:04"),
+			Timezone: "UTC",
+		},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCampaignsListedForAdmins(t *testing.T) {
+	h := newHarness(t)
+	h.clock.Advance(24 * time.Hour)
+	_, userID := h.login("campaign-listed")
+
+	if result := h.do(http.MethodGet, "/api/admin/campaigns", nil); result.Status != fiber.StatusUnauthorized {
+		t.Errorf("campaigns without the admin key answered %d", result.Status)
+	}
+
+	// Signed in users are the audience campaigns can target
+	sessions := h.doAsAdmin(http.MethodGet, "/api/admin/campaigns/sessions", nil)
+	targetable := false
+	list, _ := sessions.Body["sessions"].([]interface{})
+	for _, session := range list {
+		if session, _ := session.(map[string]interface{}); session["userId"] == userID {
+			targetable = true
+			// Sessions are seen on the server's clock
+			if lastSeenAt, _ := session["lastSeenAt"].(string); lastSeenAt != h.clock.Now().Format(time.RFC3339Nano) {
+				t.Errorf("session of %s last seen at %s, want %s", userID, lastSeenAt, h.clock.Now().Format(time.RFC3339Nano))
+			}
+		}
+	}
+	if sessions.Status != fiber.StatusOK || !targetable {
+		t.Errorf("sessions answered %d without %s: %s", sessions.Status, userID, sessions.Raw)
+	}
+
+	campaignID := h.createCampaign("MINI_APP_COMMON_INBOX", userID)
+	campaigns := h.doAsAdmin(http.MethodGet, "/api/admin/campaigns", nil)
+	listed := false
+	list, _ = campaigns.Body["campaigns"].([]interface{})
+	for _, entry := range list {
+		entry, _ := entry.(map[string]interface{})
+		if campaign, _ := entry["campaign"].(map[string]interface{}); campaign["id"] == campaignID {
+			listed = true
+		}
+	}
+	if campaigns.Status != fiber.StatusOK || !listed {
+		t.Errorf("campaigns answered %d without %s: %s", campaigns.Status, campaignID, campaigns.Raw)
+	}
+
+	if result := h.doAsAdmin(http.MethodGet, "/api/admin/campaigns/CAMPAIGN-UNKNOWN", nil); result.Status != fiber.StatusNotFound {
+		t.Errorf("unknown campaign answered %d", result.Status)
+	}
+	if result := h.doAsAdmin(http.MethodPost, "/api/admin/campaigns/CAMPAIGN-UNKNOWN/cancel", nil); result.Status != fiber.StatusBadRequest {
+		t.Errorf("cancelling an unknown campaign answered %d", result.Status)
+	}
+	if result := h.doAsAdmin(http.MethodPost, "/api/admin/campaigns", fiber.Map{
+		"name":         "journey",
+		"templateCode": "MINI_APP_COMMON_INBOX",
+		"audience":     fiber.Map{"userIds": []string{userID}},
+	}); result.Status != fiber.StatusBadRequest {
+		t.Errorf("campaign without its template parameters answered %d: %s", result.Status, result.Raw)
+	}
+}
+
+func TestCampaignSendsArePacedByTheClock(t *testing.T) {
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.CampaignRate = 2
+	})
+	_, first := h.login("campaign-paced-1")
+	_, second := h.login("campaign-paced-2")
+	_, third := h.login("campaign-paced-3")
+
+	campaignID := h.createCampaign("MINI_APP_COMMON_INBOX", first, second, third)
+
+	sent := func() int {
+		_, stats := h.campaignState(campaignID)
+		return stats["sent"]
+	}
+	h.eventually(0, "the first message", func() bool {
+		return sent() == 1
+	})
+
+	// Two messages per second: the next one waits for half a second of the clock, however long it takes
+	time.Sleep(50 * time.Millisecond)
+	h.clock.Advance(499 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if count := sent(); count != 1 {
+		t.Fatalf("expected one message before the next slot, got %d", count)
+	}
+
+	h.clock.Advance(time.Millisecond)
+	h.eventually(0, "the second message", func() bool {
+		return sent() == 2
+	})
+	h.eventually(500*time.Millisecond, "the campaign to complete", func() bool {
+		status, _ := h.campaignState(campaignID)
+		return status == api.CampaignStatusCompleted
+	})
+
+	_, stats := h.campaignState(campaignID)
+	if stats["total"] != 3 || stats["sent"] != 3 || stats["pending"] != 0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	for _, requestID := range []string{campaignID + "-0", campaignID + "-1", campaignID + "-2"} {
+		if !gatewayCalled("/v1/messages/sendInbox", "requestId", requestID) {
+			t.Errorf("%s was not sent", requestID)
+		}
+	}
+}
+
+func TestCampaignCompletesOnceDeferredRecipientsAreSent(t *testing.T) {
+	preferences := newPreferenceStore(t)
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.Preferences = preferences
+	})
+	_, quiet := h.login("campaign-deferred-quiet")
+	_, loud := h.login("campaign-deferred-loud")
+	startQuietHours(t, preferences, quiet, h.clock.Now())
+
+	campaignID := h.createCampaign("MINI_APP_COMMON_PUSH", quiet, loud, "USER-WITHOUT-SESSION")
+
+	h.eventually(0, "the recipients outside quiet hours", func() bool {
+		_, stats := h.campaignState(campaignID)
+		return stats["sent"] == 1 && stats["deferred"] == 1 && stats["skipped"] == 1
+	})
+	if status, _ := h.campaignState(campaignID); status != api.CampaignStatusRunning {
+		t.Fatalf("campaign with a deferred recipient is %s, want RUNNING", status)
+	}
+
+	h.eventually(10*time.Minute, "the campaign to complete", func() bool {
+		status, _ := h.campaignState(campaignID)
+		return status == api.CampaignStatusCompleted
+	})
+
+	_, stats := h.campaignState(campaignID)
+	if stats["total"] != 3 || stats["sent"] != 2 || stats["skipped"] != 1 || stats["deferred"] != 0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	if !gatewayCalled("/v1/messages/sendPush", "requestId", campaignID+"-0") {
+		t.Error("deferred push was not sent after quiet hours")
+	}
+}
+
+func TestCancelledCampaignDropsDeferredRecipients(t *testing.T) {
+	preferences := newPreferenceStore(t)
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.Preferences = preferences
+	})
+	_, quiet := h.login("campaign-cancel-quiet")
+	_, loud := h.login("campaign-cancel-loud")
+	startQuietHours(t, preferences, quiet, h.clock.Now())
+
+	campaignID := h.createCampaign("MINI_APP_COMMON_PUSH", quiet, loud)
+
+	h.eventually(0, "the recipient outside quiet hours", func() bool {
+		_, stats := h.campaignState(campaignID)
+		return stats["sent"] == 1 && stats["deferred"] == 1
+	})
+
+	cancelled := h.doAsAdmin(http.MethodPost, "/api/admin/campaigns/"+campaignID+"/cancel", nil)
+	if cancelled.Status != fiber.StatusOK || !cancelled.Bool("success") {
+		t.Fatalf("cancel answered %d: %s", cancelled.Status, cancelled.Raw)
+	}
+
+	// Quiet hours end, but the cancelled recipient is not sent to
+	h.clock.Advance(3 * time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	h.clock.Advance(time.Second)
+	time.Sleep(50 * time.Millisecond)
+
+	status, stats := h.campaignState(campaignID)
+	if status != api.CampaignStatusCancelled {
+		t.Errorf("campaign is %s, want CANCELLED", status)
+	}
+	if stats["sent"] != 1 || stats["cancelled"] != 1 || stats["deferred"] != 0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	if gatewayCalled("/v1/messages/sendPush", "requestId", campaignID+"-0") {
+		t.Error("push of a cancelled campaign was sent")
+	}
+}
+
+func TestUnknownCampaignSendIsResolvedByTheReconciler(t *testing.T) {
+	h := newHarness(t)
+	_, userID := h.login("campaign-unknown")
+
+	gateway.Program("/v1/messages/sendInbox", mockgateway.UnknownResult())
+	campaignID := h.createCampaign("MINI_APP_COMMON_INBOX", userID)
+
+	h.eventually(0, "the campaign to complete", func() bool {
+		status, _ := h.campaignState(campaignID)
+		return status == api.CampaignStatusCompleted
+	})
+	if _, stats := h.campaignState(campaignID); stats["unknown"] != 1 || stats["sent"] != 0 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	// The reconciler re-sends the message with the same request ID and the campaign picks up its outcome
+	h.eventually(notificationReconcileInterval, "the re-sent message", func() bool {
+		_, stats := h.campaignState(campaignID)
+		return stats["sent"] == 1 && stats["unknown"] == 0
+	})
+}
+
+func TestScheduledCampaignResumesAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "campaigns.json")
+	openCampaigns := func() *api.CampaignStore {
+		campaigns, err := api.NewCampaignStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return campaigns
+	}
+
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.Campaigns = openCampaigns()
+	})
+	_, userID := h.login("campaign-restart")
+
+	created := h.doAsAdmin(http.MethodPost, "/api/admin/campaigns", fiber.Map{
+		"name":         "journey",
+		"templateCode": "MINI_APP_COMMON_INBOX",
+		"parameters":   fiber.Map{"Title": "Sale", "Content": "Everything must go"},
+		"audience":     fiber.Map{"userIds": []string{userID}},
+		"scheduledAt":  h.clock.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	campaign, _ := created.Body["campaign"].(map[string]interface{})
+	campaignID, _ := campaign["id"].(string)
+	if created.Status != fiber.StatusCreated || campaignID == "" {
+		t.Fatalf("campaign create answered %d: %s", created.Status, created.Raw)
+	}
+
+	// A server started on the same file sends the campaign when it is due, the first one never does
+	restarted := newHarnessWith(t, func(config *api.Config) {
+		config.Campaigns = openCampaigns()
+		config.Sessions = h.sessions
+	})
+	if status, _ := restarted.campaignState(campaignID); status != api.CampaignStatusScheduled {
+		t.Fatalf("restored campaign is %s, want SCHEDULED", status)
+	}
+	restarted.eventually(30*time.Minute, "the resumed campaign to complete", func() bool {
+		status, _ := restarted.campaignState(campaignID)
+		return status == api.CampaignStatusCompleted
+	})
+
+	if _, stats := restarted.campaignState(campaignID); stats["sent"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	if !gatewayCalled("/v1/messages/sendInbox", "requestId", campaignID+"-0") {
+		t.Error("resumed campaign was not sent")
+	}
+}
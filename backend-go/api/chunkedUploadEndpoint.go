@@ -0,0 +1,310 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"superQiMiniAppBackend/storage"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Chunked upload error codes, in addition to the ones of POST /api/upload
+const (
+	UploadErrorSessionNotFound  = "UPLOAD_NOT_FOUND"
+	UploadErrorInvalidChunk     = "INVALID_CHUNK"
+	UploadErrorChunkChecksum    = "CHUNK_CHECKSUM_MISMATCH"
+	UploadErrorIncomplete       = "UPLOAD_INCOMPLETE"
+	UploadErrorChecksumMismatch = "CHECKSUM_MISMATCH"
+)
+
+const (
+	defaultChunkSize = 1024 * 1024 // 1MB
+	minChunkSize     = 64 * 1024
+	// Chunks are sent as a single request body, which Fiber limits to 4MB
+	maxChunkSize         = 2 * 1024 * 1024
+	maxChunkedUploadSize = 200 * 1024 * 1024 // 200MB
+)
+
+// Default policy of the chunked upload routes, overridable with CHUNKED_UPLOAD_ALLOWED_TYPES and CHUNKED_UPLOAD_MAX_SIZE
+var chunkedUploadPolicy = UploadPolicy{
+	AllowedTypes: documentUploadPolicy.AllowedTypes,
+	MaxSize:      maxChunkedUploadSize,
+}
+
+type InitChunkedUploadRequest struct {
+	FileName  string `json:"fileName"`
+	FileType  string `json:"fileType"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+	SHA256    string `json:"sha256"` // optional checksum of the whole file, verified on completion
+}
+
+// completingUploads guards against a session being assembled twice by concurrent complete calls
+var completingUploads sync.Map
+
+func (s *Server) registerChunkedUploadEndpoint(group fiber.Router) {
+	policy := withUploadPolicy(loadUploadPolicy("CHUNKED_UPLOAD", chunkedUploadPolicy))
+
+	// POST /api/uploads - Start a resumable upload
+	group.Post("/uploads", policy, s.handleInitChunkedUpload)
+
+	// GET /api/uploads/:id - Chunks received so far, so an interrupted client knows what to resend
+	group.Get("/uploads/:id", func(ctx *fiber.Ctx) error {
+		session, err := s.ownedUploadSession(ctx)
+		if err != nil {
+			return err
+		}
+		return ctx.JSON(buildUploadSessionResponse(session))
+	})
+
+	// PUT /api/uploads/:id/chunks/:index - Raw chunk body with its SHA-256 in X-Chunk-SHA256
+	group.Put("/uploads/:id/chunks/:index", s.handleUploadChunk)
+
+	// POST /api/uploads/:id/complete - Assemble the chunks into a stored file
+	group.Post("/uploads/:id/complete", policy, s.handleCompleteChunkedUpload)
+
+	// DELETE /api/uploads/:id - Abandon an upload and free its chunks
+	group.Delete("/uploads/:id", func(ctx *fiber.Ctx) error {
+		session, err := s.ownedUploadSession(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.uploads.Delete(session.ID)
+		s.logger.Printf("[INFO] Upload %s cancelled by user %s\n", session.ID, session.OwnerID)
+
+		return ctx.JSON(fiber.Map{
+			"success": true,
+			"message": "Upload cancelled",
+		})
+	})
+}
+
+func (s *Server) handleInitChunkedUpload(ctx *fiber.Ctx) error {
+	ownerID, err := s.authenticateFileOwner(ctx)
+	if err != nil {
+		return uploadFailure(ctx, fiber.StatusUnauthorized, UploadErrorUnauthorized, "A valid token is required to upload files")
+	}
+
+	policy, _ := ctx.Locals("uploadPolicy").(UploadPolicy)
+
+	var req InitChunkedUploadRequest
+	if err := ctx.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+	if req.Size <= 0 {
+		return uploadFailure(ctx, fiber.StatusBadRequest, UploadErrorInvalidChunk, "size must be greater than zero")
+	}
+
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultChunkSize
+	}
+	if req.ChunkSize < minChunkSize || req.ChunkSize > maxChunkSize {
+		return uploadFailure(ctx, fiber.StatusBadRequest, UploadErrorInvalidChunk,
+			fmt.Sprintf("chunkSize must be between %d and %d bytes", minChunkSize, maxChunkSize))
+	}
+
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.SHA256 != "" && !isSHA256Hex(req.SHA256) {
+		return fiber.NewError(fiber.StatusBadRequest, "sha256 must be a hex encoded SHA-256 digest")
+	}
+
+	// Name, type and size are checked now, the content once every chunk has arrived
+	upload, err := validateUploadName(policy, req.FileName, req.FileType, req.Size)
+	if err == nil {
+		err = s.checkStorageQuota(ownerID, req.Size)
+	}
+	if err != nil {
+		rejection := err.(*uploadError)
+		s.logger.Printf("[ERROR] Chunked upload rejected (%s): %s\n", rejection.Code, rejection.Message)
+		return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
+	}
+
+	session := s.uploads.Create(storage.UploadSession{
+		OwnerID:     ownerID,
+		FileName:    upload.FileName,
+		FileType:    upload.Kind,
+		Size:        req.Size,
+		ChunkSize:   req.ChunkSize,
+		TotalChunks: int((req.Size + req.ChunkSize - 1) / req.ChunkSize),
+		SHA256:      req.SHA256,
+	})
+
+	s.logger.Printf("[INFO] Upload %s started by user %s: %s, %d bytes in %d chunk(s)\n",
+		session.ID, ownerID, session.FileName, session.Size, session.TotalChunks)
+
+	return ctx.Status(fiber.StatusCreated).JSON(buildUploadSessionResponse(session))
+}
+
+func (s *Server) handleUploadChunk(ctx *fiber.Ctx) error {
+	session, err := s.ownedUploadSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	index, err := strconv.Atoi(ctx.Params("index"))
+	if err != nil || index < 0 || index >= session.TotalChunks {
+		return uploadFailure(ctx, fiber.StatusBadRequest, UploadErrorInvalidChunk,
+			fmt.Sprintf("Chunk index must be between 0 and %d", session.TotalChunks-1))
+	}
+
+	checksum := strings.ToLower(ctx.Get("X-Chunk-SHA256"))
+	if !isSHA256Hex(checksum) {
+		return uploadFailure(ctx, fiber.StatusBadRequest, UploadErrorInvalidChunk, "X-Chunk-SHA256 header with the chunk's SHA-256 is required")
+	}
+
+	body := ctx.Body()
+	if expected := session.ChunkLength(index); int64(len(body)) != expected {
+		return uploadFailure(ctx, fiber.StatusBadRequest, UploadErrorInvalidChunk,
+			fmt.Sprintf("Chunk %d must be %d bytes, got %d", index, expected, len(body)))
+	}
+
+	updated, err := s.uploads.PutChunk(session.ID, index, bytes.NewReader(body), checksum)
+	if errors.Is(err, storage.ErrChunkChecksum) {
+		s.logger.Printf("[ERROR] Chunk %d of %s failed checksum verification\n", index, session.ID)
+		return uploadFailure(ctx, fiber.StatusUnprocessableEntity, UploadErrorChunkChecksum,
+			fmt.Sprintf("Chunk %d does not match its SHA-256, resend it", index))
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return uploadFailure(ctx, fiber.StatusNotFound, UploadErrorSessionNotFound, "Upload not found or expired")
+	}
+	if err != nil {
+		s.logger.Printf("[ERROR] Failed to store chunk %d of %s: %v\n", index, session.ID, err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to store chunk")
+	}
+
+	return ctx.JSON(buildUploadSessionResponse(updated))
+}
+
+func (s *Server) handleCompleteChunkedUpload(ctx *fiber.Ctx) error {
+	s.logger.Println("=================================================================")
+	s.logger.Println("CHUNKED UPLOAD COMPLETION REQUEST RECEIVED")
+	s.logger.Println("=================================================================")
+
+	session, err := s.ownedUploadSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy, _ := ctx.Locals("uploadPolicy").(UploadPolicy)
+
+	if missing := session.Missing(); len(missing) > 0 {
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success":   false,
+			"errorCode": UploadErrorIncomplete,
+			"message":   fmt.Sprintf("%d chunk(s) have not been received", len(missing)),
+			"missing":   missing,
+		})
+	}
+
+	if _, busy := completingUploads.LoadOrStore(session.ID, true); busy {
+		return uploadFailure(ctx, fiber.StatusConflict, UploadErrorIncomplete, "Upload is already being completed")
+	}
+	defer completingUploads.Delete(session.ID)
+
+	// A concurrent call may have completed the upload while this one was checking it
+	if _, exists := s.uploads.Get(session.ID); !exists {
+		return fiber.NewError(fiber.StatusNotFound, "Upload not found or expired")
+	}
+
+	s.logger.Printf("[INFO] Assembling %s: %s, %d bytes from %d chunk(s)\n", session.ID, session.FileName, session.Size, session.TotalChunks)
+
+	assembled, err := s.uploads.TempFile()
+	if err != nil {
+		s.logger.Printf("[ERROR] Failed to create assembly file: %v\n", err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to assemble file")
+	}
+	defer os.Remove(assembled.Name())
+	defer assembled.Close()
+
+	hash := sha256.New()
+	if err := s.uploads.Assemble(session.ID, io.MultiWriter(assembled, hash)); err != nil {
+		s.logger.Printf("[ERROR] Failed to assemble %s: %v\n", session.ID, err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to assemble file")
+	}
+
+	// Every chunk was verified on arrival, a mismatch here means the client hashed a different file
+	if sum := hex.EncodeToString(hash.Sum(nil)); session.SHA256 != "" && sum != session.SHA256 {
+		s.logger.Printf("[ERROR] Assembled %s has SHA-256 %s, expected %s\n", session.ID, sum, session.SHA256)
+		s.uploads.Delete(session.ID)
+		return uploadFailure(ctx, fiber.StatusUnprocessableEntity, UploadErrorChecksumMismatch, "Assembled file does not match the declared SHA-256")
+	}
+
+	upload, err := validateUpload(policy, session.FileName, session.FileType, assembled, session.Size)
+	if err != nil {
+		rejection := err.(*uploadError)
+		s.logger.Printf("[ERROR] Upload rejected (%s): %s\n", rejection.Code, rejection.Message)
+		s.uploads.Delete(session.ID)
+		return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
+	}
+
+	if _, err := assembled.Seek(0, io.SeekStart); err != nil {
+		s.logger.Printf("[ERROR] Failed to rewind assembled file: %v\n", err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to save file")
+	}
+
+	record, err := s.storeUpload(session.OwnerID, upload, assembled, session.Size)
+	if rejection, ok := err.(*uploadError); ok {
+		s.logger.Printf("[ERROR] Upload rejected (%s): %s\n", rejection.Code, rejection.Message)
+		s.uploads.Delete(session.ID)
+		return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
+	}
+	if err != nil {
+		s.logger.Printf("[ERROR] Failed to save file: %v\n", err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to save file")
+	}
+
+	s.uploads.Delete(session.ID)
+
+	return ctx.JSON(s.buildUploadFileResponse(record))
+}
+
+// ownedUploadSession loads the session in the :id parameter, hiding sessions that belong to someone else
+func (s *Server) ownedUploadSession(ctx *fiber.Ctx) (storage.UploadSession, error) {
+	ownerID, err := s.authenticateFileOwner(ctx)
+	if err != nil {
+		return storage.UploadSession{}, err
+	}
+
+	session, exists := s.uploads.Get(ctx.Params("id"))
+	if !exists || session.OwnerID != ownerID {
+		return storage.UploadSession{}, fiber.NewError(fiber.StatusNotFound, "Upload not found or expired")
+	}
+	return session, nil
+}
+
+func buildUploadSessionResponse(session storage.UploadSession) fiber.Map {
+	received := make([]int, 0, len(session.Received))
+	for index := range session.Received {
+		received = append(received, index)
+	}
+	sort.Ints(received)
+
+	return fiber.Map{
+		"success":     true,
+		"uploadId":    session.ID,
+		"fileName":    session.FileName,
+		"fileType":    session.FileType,
+		"size":        session.Size,
+		"chunkSize":   session.ChunkSize,
+		"totalChunks": session.TotalChunks,
+		"received":    received,
+		"missing":     session.Missing(),
+		"expiresAt":   session.ExpiresAt.Format(time.RFC3339),
+	}
+}
+
+func isSHA256Hex(value string) bool {
+	decoded, err := hex.DecodeString(value)
+	return err == nil && len(decoded) == sha256.Size
+}
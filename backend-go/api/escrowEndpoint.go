@@ -3,9 +3,8 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
 	"superQiMiniAppBackend/jwe"
 	"time"
 
@@ -21,30 +20,30 @@ type escrowActionRequest struct {
 	PaymentID string `json:"paymentId" validate:"required"`
 }
 
-func InitEscrowEndpoint(group fiber.Router) {
+func (s *Server) registerEscrowEndpoint(group fiber.Router) {
 	// POST /api/escrow/create - Create escrow payment
 	group.Post("/escrow/create", func(ctx *fiber.Ctx) error {
 		var request createEscrowPaymentRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("ESCROW PAYMENT CREATION REQUEST RECEIVED")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("ESCROW PAYMENT CREATION REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
 
 		claims, err := jwe.ParseAndValidateJWE(request.Token)
 		if err != nil {
-			log.Printf("[ERROR] Invalid token: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
 		}
 
-		log.Printf("[INFO] Creating escrow payment for user ID: %s\n", claims.UserID)
+		s.logger.Printf("[INFO] Creating escrow payment for user ID: %s\n", claims.UserID)
 
-		paymentResponse, err := createEscrowPayment(claims.UserID)
+		paymentRequest, paymentResponse, err := s.createEscrowPayment(claims.UserID)
 		if err != nil {
-			log.Printf("[ERROR] Failed to create escrow payment: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to create escrow payment: %v\n", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to create escrow payment: "+err.Error())
 		}
 
@@ -56,14 +55,21 @@ func InitEscrowEndpoint(group fiber.Router) {
 		if paymentResponse.GetRedirectURL() != "" {
 			response["paymentUrl"] = paymentResponse.GetRedirectURL()
 			response["paymentId"] = paymentResponse.PaymentID
-			log.Printf("[INFO] Sending payment URL to frontend: %s\n", paymentResponse.GetRedirectURL())
+			s.logger.Printf("[INFO] Sending payment URL to frontend: %s\n", paymentResponse.GetRedirectURL())
+
+			s.events.Publish(events.EscrowCreated{
+				PaymentID:        paymentResponse.PaymentID,
+				PaymentRequestID: paymentResponse.PaymentRequestID,
+				UserID:           claims.UserID,
+				Amount:           paymentRequest.PaymentAmount,
+			})
 		} else {
-			log.Println("[WARNING] No payment URL in response")
+			s.logger.Println("[WARNING] No payment URL in response")
 			response["success"] = false
 			response["error"] = "No redirect URL received from payment API"
 		}
 
-		log.Println("[SUCCESS] Returning escrow payment response to frontend")
+		s.logger.Println("[SUCCESS] Returning escrow payment response to frontend")
 		return ctx.JSON(response)
 	})
 
@@ -71,17 +77,17 @@ func InitEscrowEndpoint(group fiber.Router) {
 	group.Post("/escrow/merchant-accept", func(ctx *fiber.Ctx) error {
 		var request escrowActionRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("MERCHANT ACCEPT REQUEST RECEIVED")
-		log.Println("=================================================================")
-		log.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
+		s.logger.Println("=================================================================")
+		s.logger.Println("MERCHANT ACCEPT REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
+		s.logger.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
 
 		if request.PaymentID == "" {
-			log.Println("[ERROR] Payment ID is required")
+			s.logger.Println("[ERROR] Payment ID is required")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -93,9 +99,9 @@ func InitEscrowEndpoint(group fiber.Router) {
 			PaymentID: request.PaymentID,
 		}
 
-		merchantAcceptResponse, err := alipay.Interface.MerchantAccept(merchantAcceptRequest)
+		merchantAcceptResponse, err := s.gateway.MerchantAccept(merchantAcceptRequest)
 		if err != nil {
-			log.Printf("[ERROR] Failed to merchant accept: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to merchant accept: %v\n", err)
 			return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -112,13 +118,15 @@ func InitEscrowEndpoint(group fiber.Router) {
 		if merchantAcceptResponse.Result.ResultStatus == "S" {
 			response["success"] = true
 			response["paymentId"] = merchantAcceptResponse.PaymentID
-			log.Println("[SUCCESS] Merchant accept successful")
+			s.logger.Println("[SUCCESS] Merchant accept successful")
+
+			s.events.Publish(events.EscrowAccepted{PaymentID: request.PaymentID})
 		} else {
 			response["success"] = false
-			log.Printf("[ERROR] Merchant accept failed: %s\n", merchantAcceptResponse.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Merchant accept failed: %s\n", merchantAcceptResponse.Result.ResultMessage)
 		}
 
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
 
@@ -126,17 +134,17 @@ func InitEscrowEndpoint(group fiber.Router) {
 	group.Post("/escrow/confirm", func(ctx *fiber.Ctx) error {
 		var request escrowActionRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("CONFIRM ORDER REQUEST RECEIVED")
-		log.Println("=================================================================")
-		log.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
+		s.logger.Println("=================================================================")
+		s.logger.Println("CONFIRM ORDER REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
+		s.logger.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
 
 		if request.PaymentID == "" {
-			log.Println("[ERROR] Payment ID is required")
+			s.logger.Println("[ERROR] Payment ID is required")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -145,17 +153,17 @@ func InitEscrowEndpoint(group fiber.Router) {
 		}
 
 		// Generate unique confirm request ID
-		confirmRequestID := fmt.Sprintf("CONFIRM-%s-%d", uuid.New().String(), time.Now().Unix())
-		log.Printf("[INFO] Generated Confirm Request ID: %s\n", confirmRequestID)
+		confirmRequestID := fmt.Sprintf("CONFIRM-%s-%d", uuid.New().String(), s.clock.Now().Unix())
+		s.logger.Printf("[INFO] Generated Confirm Request ID: %s\n", confirmRequestID)
 
 		confirmOrderRequest := alipay.ConfirmOrderRequest{
 			PaymentID:        request.PaymentID,
 			ConfirmRequestID: confirmRequestID,
 		}
 
-		confirmOrderResponse, err := alipay.Interface.ConfirmOrder(confirmOrderRequest)
+		confirmOrderResponse, err := s.gateway.ConfirmOrder(confirmOrderRequest)
 		if err != nil {
-			log.Printf("[ERROR] Failed to confirm order: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to confirm order: %v\n", err)
 			return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -173,15 +181,21 @@ func InitEscrowEndpoint(group fiber.Router) {
 			response["success"] = true
 			response["confirmId"] = confirmOrderResponse.ConfirmID
 			response["confirmTime"] = confirmOrderResponse.ConfirmTime
-			log.Println("[SUCCESS] Confirm order successful")
-			log.Printf("[INFO] Confirm ID: %s\n", confirmOrderResponse.ConfirmID)
-			log.Printf("[INFO] Confirm Time: %s\n", confirmOrderResponse.ConfirmTime)
+			s.logger.Println("[SUCCESS] Confirm order successful")
+			s.logger.Printf("[INFO] Confirm ID: %s\n", confirmOrderResponse.ConfirmID)
+			s.logger.Printf("[INFO] Confirm Time: %s\n", confirmOrderResponse.ConfirmTime)
+
+			s.events.Publish(events.EscrowConfirmed{
+				PaymentID:   request.PaymentID,
+				ConfirmID:   confirmOrderResponse.ConfirmID,
+				ConfirmTime: confirmOrderResponse.ConfirmTime,
+			})
 		} else {
 			response["success"] = false
-			log.Printf("[ERROR] Confirm order failed: %s\n", confirmOrderResponse.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Confirm order failed: %s\n", confirmOrderResponse.Result.ResultMessage)
 		}
 
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
 
@@ -189,17 +203,17 @@ func InitEscrowEndpoint(group fiber.Router) {
 	group.Post("/escrow/cancel", func(ctx *fiber.Ctx) error {
 		var request escrowActionRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("CANCEL PAYMENT REQUEST RECEIVED")
-		log.Println("=================================================================")
-		log.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
+		s.logger.Println("=================================================================")
+		s.logger.Println("CANCEL PAYMENT REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
+		s.logger.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
 
 		if request.PaymentID == "" {
-			log.Println("[ERROR] Payment ID is required")
+			s.logger.Println("[ERROR] Payment ID is required")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -211,9 +225,9 @@ func InitEscrowEndpoint(group fiber.Router) {
 			PaymentID: request.PaymentID,
 		}
 
-		cancelPaymentResponse, err := alipay.Interface.CancelPayment(cancelPaymentRequest)
+		cancelPaymentResponse, err := s.gateway.CancelPayment(cancelPaymentRequest)
 		if err != nil {
-			log.Printf("[ERROR] Failed to cancel payment: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to cancel payment: %v\n", err)
 			return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -230,13 +244,15 @@ func InitEscrowEndpoint(group fiber.Router) {
 		if cancelPaymentResponse.Result.ResultStatus == "S" {
 			response["success"] = true
 			response["paymentId"] = cancelPaymentResponse.PaymentID
-			log.Println("[SUCCESS] Cancel payment successful")
+			s.logger.Println("[SUCCESS] Cancel payment successful")
+
+			s.events.Publish(events.EscrowCancelled{PaymentID: request.PaymentID})
 		} else {
 			response["success"] = false
-			log.Printf("[ERROR] Cancel payment failed: %s\n", cancelPaymentResponse.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Cancel payment failed: %s\n", cancelPaymentResponse.Result.ResultMessage)
 		}
 
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
 
@@ -244,17 +260,17 @@ func InitEscrowEndpoint(group fiber.Router) {
 	group.Post("/escrow/void", func(ctx *fiber.Ctx) error {
 		var request escrowActionRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("VOID PAYMENT REQUEST RECEIVED")
-		log.Println("=================================================================")
-		log.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
+		s.logger.Println("=================================================================")
+		s.logger.Println("VOID PAYMENT REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
+		s.logger.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
 
 		if request.PaymentID == "" {
-			log.Println("[ERROR] Payment ID is required")
+			s.logger.Println("[ERROR] Payment ID is required")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -263,17 +279,17 @@ func InitEscrowEndpoint(group fiber.Router) {
 		}
 
 		// Generate unique void request ID
-		voidRequestID := fmt.Sprintf("VOID-%s-%d", uuid.New().String(), time.Now().Unix())
-		log.Printf("[INFO] Generated Void Request ID: %s\n", voidRequestID)
+		voidRequestID := fmt.Sprintf("VOID-%s-%d", uuid.New().String(), s.clock.Now().Unix())
+		s.logger.Printf("[INFO] Generated Void Request ID: %s\n", voidRequestID)
 
 		voidRequest := alipay.VoidRequest{
 			PaymentID:     request.PaymentID,
 			VoidRequestID: voidRequestID,
 		}
 
-		voidResponse, err := alipay.Interface.Void(voidRequest)
+		voidResponse, err := s.gateway.Void(voidRequest)
 		if err != nil {
-			log.Printf("[ERROR] Failed to void payment: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to void payment: %v\n", err)
 			return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -291,44 +307,42 @@ func InitEscrowEndpoint(group fiber.Router) {
 			response["success"] = true
 			response["voidId"] = voidResponse.VoidID
 			response["voidTime"] = voidResponse.VoidTime
-			log.Println("[SUCCESS] Void payment successful")
-			log.Printf("[INFO] Void ID: %s\n", voidResponse.VoidID)
-			log.Printf("[INFO] Void Time: %s\n", voidResponse.VoidTime)
+			s.logger.Println("[SUCCESS] Void payment successful")
+			s.logger.Printf("[INFO] Void ID: %s\n", voidResponse.VoidID)
+			s.logger.Printf("[INFO] Void Time: %s\n", voidResponse.VoidTime)
+
+			s.events.Publish(events.EscrowVoided{
+				PaymentID: request.PaymentID,
+				VoidID:    voidResponse.VoidID,
+				VoidTime:  voidResponse.VoidTime,
+			})
 		} else {
 			response["success"] = false
-			log.Printf("[ERROR] Void payment failed: %s\n", voidResponse.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Void payment failed: %s\n", voidResponse.Result.ResultMessage)
 		}
 
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
 }
 
-func createEscrowPayment(userID string) (alipay.PaymentResponse, error) {
-	log.Println("=================================================================")
-	log.Printf("CREATING ESCROW PAYMENT FOR USER: %s\n", userID)
-	log.Println("=================================================================")
-
-	paymentRequestID := fmt.Sprintf("ESCROW-PAY-%s-%d", uuid.New().String(), time.Now().Unix())
+func (s *Server) createEscrowPayment(userID string) (alipay.PaymentRequest, alipay.PaymentResponse, error) {
+	s.logger.Println("=================================================================")
+	s.logger.Printf("CREATING ESCROW PAYMENT FOR USER: %s\n", userID)
+	s.logger.Println("=================================================================")
 
-	expiryTime := time.Now().Add(30 * time.Minute).Format("2006-01-02T15:04:05-07:00")
+	paymentRequestID := fmt.Sprintf("ESCROW-PAY-%s-%d", uuid.New().String(), s.clock.Now().Unix())
 
-	baseURL := os.Getenv("BASE_URL")
-	if baseURL == "" {
-		baseURL = "http://localhost:1999"
-	}
+	expiryTime := s.clock.Now().Add(30 * time.Minute).Format("2006-01-02T15:04:05-07:00")
 
 	// Frontend URL for redirect after payment
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "http://172.20.10.2:5173" // Default frontend URL
-	}
+	frontendURL := s.frontendURL
 
 	paymentRequest := alipay.PaymentRequest{
 		ProductCode:      alipay.ESCROW_PAYMENT,
 		PaymentRequestID: paymentRequestID,
 		PaymentAmount: alipay.PaymentAmount{
-			Currency: "IQD",
+			Currency: s.currency(),
 			Value:    "1000",
 		},
 		Order: alipay.Order{
@@ -341,44 +355,44 @@ func createEscrowPayment(userID string) (alipay.PaymentResponse, error) {
 		PaymentRedirectURL: frontendURL + "/payment-success.html",
 	}
 
-	log.Println("[INFO] Escrow payment request details:")
+	s.logger.Println("[INFO] Escrow payment request details:")
 	requestJSON, _ := json.MarshalIndent(paymentRequest, "", "  ")
-	log.Printf("%s\n\n", string(requestJSON))
+	s.logger.Printf("%s\n\n", string(requestJSON))
 
-	log.Println("[INFO] Calling payment API with ESCROW_PAYMENT product code...")
-	paymentResponse, err := alipay.Interface.Pay(paymentRequest)
+	s.logger.Println("[INFO] Calling payment API with ESCROW_PAYMENT product code...")
+	paymentResponse, err := s.gateway.Pay(paymentRequest)
 	if err != nil {
-		log.Printf("[ERROR] Payment API error: %v\n", err)
-		return alipay.PaymentResponse{}, err
+		s.logger.Printf("[ERROR] Payment API error: %v\n", err)
+		return paymentRequest, alipay.PaymentResponse{}, err
 	}
 
 	responseJSON, _ := json.MarshalIndent(paymentResponse, "", "  ")
-	log.Printf("[SUCCESS] Payment API response received:\n%s\n\n", string(responseJSON))
+	s.logger.Printf("[SUCCESS] Payment API response received:\n%s\n\n", string(responseJSON))
 
 	redirectURL := paymentResponse.GetRedirectURL()
 
 	if paymentResponse.Result.ResultStatus == "A" {
-		log.Println("[SUCCESS] Escrow payment accepted")
+		s.logger.Println("[SUCCESS] Escrow payment accepted")
 		if redirectURL != "" {
-			log.Printf("[INFO] Redirection URL: %s\n", redirectURL)
-			log.Println("[INFO] Frontend should call my.tradePay() with this URL")
+			s.logger.Printf("[INFO] Redirection URL: %s\n", redirectURL)
+			s.logger.Println("[INFO] Frontend should call my.tradePay() with this URL")
 		} else {
-			log.Println("[WARNING] Redirection URL is empty in response")
+			s.logger.Println("[WARNING] Redirection URL is empty in response")
 		}
-		log.Printf("[INFO] Payment ID: %s\n", paymentResponse.PaymentID)
-		log.Printf("[INFO] Payment Request ID: %s\n", paymentResponse.PaymentRequestID)
-		log.Println("[INFO] Payment will be held in escrow until merchant accepts")
+		s.logger.Printf("[INFO] Payment ID: %s\n", paymentResponse.PaymentID)
+		s.logger.Printf("[INFO] Payment Request ID: %s\n", paymentResponse.PaymentRequestID)
+		s.logger.Println("[INFO] Payment will be held in escrow until merchant accepts")
 	} else if paymentResponse.Result.ResultStatus == "S" {
-		log.Println("[SUCCESS] Payment completed immediately")
+		s.logger.Println("[SUCCESS] Payment completed immediately")
 	} else if paymentResponse.Result.ResultStatus == "U" {
-		log.Println("[WARNING] Unknown payment status - need to query later")
+		s.logger.Println("[WARNING] Unknown payment status - need to query later")
 	} else {
-		log.Printf("[ERROR] Payment failed: %s\n", paymentResponse.Result.ResultMessage)
+		s.logger.Printf("[ERROR] Payment failed: %s\n", paymentResponse.Result.ResultMessage)
 	}
 
-	log.Println("=================================================================")
-	log.Println("ESCROW PAYMENT CREATION COMPLETED")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("ESCROW PAYMENT CREATION COMPLETED")
+	s.logger.Println("=================================================================")
 
-	return paymentResponse, nil
+	return paymentRequest, paymentResponse, nil
 }
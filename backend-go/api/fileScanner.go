@@ -0,0 +1,217 @@
+package api
+
+import (
+	"superQiMiniAppBackend/scanner"
+	"superQiMiniAppBackend/storage"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	fileScanWorkers    = 2
+	maxFileScanRetries = 3
+	fileScanRetryDelay = 30 * time.Second
+)
+
+// fileScanQueue feeds the scan workers of a server and counts the failed scans of each file
+type fileScanQueue struct {
+	start    sync.Once
+	ready    chan struct{} // signalled when a scan is queued
+	mu       sync.Mutex
+	queued   []queuedFileScan
+	attempts map[string]int
+}
+
+// queuedFileScan is a file to scan once due, later than now for retries
+type queuedFileScan struct {
+	fileID string
+	due    time.Time
+}
+
+func newFileScanQueue() *fileScanQueue {
+	return &fileScanQueue{
+		ready:    make(chan struct{}, 1),
+		attempts: make(map[string]int),
+	}
+}
+
+// push queues a scan of fileID at due and wakes a worker
+func (q *fileScanQueue) push(fileID string, due time.Time) {
+	q.mu.Lock()
+	q.queued = append(q.queued, queuedFileScan{fileID: fileID, due: due})
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest scan due at now. Otherwise it returns how long until the next one
+// is due, or zero when nothing is queued.
+func (q *fileScanQueue) next(now time.Time) (string, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var wait time.Duration
+	for i, queued := range q.queued {
+		if !queued.due.After(now) {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			return queued.fileID, 0, true
+		}
+		if until := queued.due.Sub(now); wait == 0 || until < wait {
+			wait = until
+		}
+	}
+	return "", wait, false
+}
+
+// startFileScanner starts the scan workers and queues files left pending by a restart
+func (s *Server) startFileScanner() {
+	s.fileScans.start.Do(func() {
+		s.workers.Add(fileScanWorkers)
+		for i := 0; i < fileScanWorkers; i++ {
+			go s.runFileScans()
+		}
+
+		pending := s.files.PendingScans()
+		if len(pending) > 0 {
+			s.logger.Printf("[INFO] Re-queueing %d file(s) waiting for a scan\n", len(pending))
+		}
+		for _, record := range pending {
+			s.queueFileScan(record.ID)
+		}
+	})
+}
+
+// runFileScans scans queued files as they fall due, until the server is closed
+func (s *Server) runFileScans() {
+	defer s.workers.Done()
+
+	for {
+		fileID, wait, ok := s.fileScans.next(s.clock.Now())
+		if ok {
+			s.scanFile(fileID)
+			continue
+		}
+
+		var retry <-chan time.Time
+		if wait > 0 {
+			retry = s.clock.After(wait)
+		}
+		select {
+		case <-s.fileScans.ready:
+		case <-retry:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// queueFileScan schedules a scan without blocking the upload request
+func (s *Server) queueFileScan(fileID string) {
+	s.fileScans.push(fileID, s.clock.Now())
+}
+
+// scanFile scans the content of a pending file and releases it, or removes it when infected
+func (s *Server) scanFile(fileID string) {
+	record, exists := s.files.Get(fileID)
+	if !exists || record.ScanStatus != storage.ScanStatusPending {
+		return
+	}
+
+	reader, err := s.fileStore.Get(record.Key, 0, -1)
+	if err == nil {
+		var result scanner.Result
+		result, err = s.scanner.Scan(reader)
+		reader.Close()
+		if err == nil {
+			s.completeFileScan(record, result)
+			return
+		}
+	}
+
+	s.fileScans.mu.Lock()
+	s.fileScans.attempts[fileID]++
+	attempt := s.fileScans.attempts[fileID]
+	s.fileScans.mu.Unlock()
+
+	if attempt <= maxFileScanRetries {
+		s.logger.Printf("[ERROR] Scan of file %s failed (attempt %d), retrying: %v\n", fileID, attempt, err)
+		s.fileScans.push(fileID, s.clock.Now().Add(fileScanRetryDelay*time.Duration(attempt)))
+		return
+	}
+
+	s.logger.Printf("[ERROR] Scan of file %s failed after %d attempts, file stays quarantined: %v\n", fileID, attempt, err)
+	s.clearFileScanAttempts(fileID)
+	s.finishFileScan(fileID, storage.ScanStatusError, err.Error())
+}
+
+// completeFileScan applies a verdict to every file sharing the scanned content
+func (s *Server) completeFileScan(record storage.FileRecord, result scanner.Result) {
+	s.clearFileScanAttempts(record.ID)
+
+	sharing := s.files.WithHash(record.SHA256)
+	if record.SHA256 == "" {
+		sharing = []storage.FileRecord{record}
+	}
+
+	if result.Clean {
+		s.logger.Printf("[SUCCESS] File %s is clean (%s)\n", record.ID, s.scanner.Name())
+		for _, file := range sharing {
+			if file.ScanStatus == storage.ScanStatusPending {
+				s.finishFileScan(file.ID, storage.ScanStatusClean, "")
+			}
+		}
+		return
+	}
+
+	// Infected content is removed, the records stay so owners can see why their files are gone
+	s.logger.Printf("[ERROR] File %s of user %s is infected: %s\n", record.ID, record.OwnerID, result.Signature)
+	unlock := lockContent(record.SHA256)
+	defer unlock()
+
+	if err := s.fileStore.Delete(record.Key); err != nil {
+		s.logger.Printf("[ERROR] Failed to delete infected file %s: %v\n", record.ID, err)
+	}
+	s.deleteDerivatives(record)
+	for _, file := range sharing {
+		s.finishFileScan(file.ID, storage.ScanStatusInfected, result.Signature)
+	}
+}
+
+func (s *Server) finishFileScan(fileID, status, result string) {
+	now := s.clock.Now()
+	s.files.Update(fileID, func(record *storage.FileRecord) {
+		record.ScanStatus = status
+		record.ScanResult = result
+		record.ScannedAt = &now
+		if status == storage.ScanStatusInfected {
+			record.Derivatives = nil
+		}
+	})
+}
+
+func (s *Server) clearFileScanAttempts(fileID string) {
+	s.fileScans.mu.Lock()
+	defer s.fileScans.mu.Unlock()
+	delete(s.fileScans.attempts, fileID)
+}
+
+// fileAvailable rejects access to content that has not passed its scan
+func fileAvailable(record storage.FileRecord) error {
+	if record.Available() {
+		return nil
+	}
+
+	switch record.ScanStatus {
+	case storage.ScanStatusInfected:
+		return fiber.NewError(fiber.StatusGone, "File was removed: malware detected")
+	case storage.ScanStatusError:
+		return fiber.NewError(fiber.StatusLocked, "File could not be scanned and is quarantined")
+	default:
+		return fiber.NewError(fiber.StatusLocked, "File is being scanned, try again shortly")
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"superQiMiniAppBackend/jwe"
+	"superQiMiniAppBackend/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// fileMetadataResponse is a stored file as returned to its owner
+type fileMetadataResponse struct {
+	storage.FileRecord
+	URL            string            `json:"url"`
+	DerivativeURLs map[string]string `json:"derivativeUrls,omitempty"`
+}
+
+func (s *Server) registerFilesEndpoint(group fiber.Router) {
+	s.startFileScanner()
+
+	// GET /api/files - Files uploaded by the caller
+	group.Get("/files", func(ctx *fiber.Ctx) error {
+		ownerID, err := s.authenticateFileOwner(ctx)
+		if err != nil {
+			return err
+		}
+
+		records := s.files.List(ownerID)
+		files := make([]fileMetadataResponse, 0, len(records))
+		for _, record := range records {
+			files = append(files, s.buildFileMetadata(record))
+		}
+
+		return ctx.JSON(fiber.Map{
+			"success": true,
+			"count":   len(files),
+			"files":   files,
+		})
+	})
+
+	// HEAD /api/files/by-hash/:sha256 - Whether the caller already has this content, so it need not be uploaded again
+	group.Head("/files/by-hash/:sha256", func(ctx *fiber.Ctx) error {
+		record, err := s.ownedContent(ctx)
+		if err != nil {
+			return err
+		}
+
+		ctx.Set("X-File-Id", record.ID)
+		ctx.Set(fiber.HeaderContentType, record.ContentType)
+		ctx.Set(fiber.HeaderContentLength, strconv.FormatInt(record.Size, 10))
+		return ctx.SendStatus(fiber.StatusOK)
+	})
+
+	// POST /api/files/by-hash/:sha256 - New file from content the caller already has, without sending the bytes
+	group.Post("/files/by-hash/:sha256", func(ctx *fiber.Ctx) error {
+		original, err := s.ownedContent(ctx)
+		if err != nil {
+			return err
+		}
+
+		var req struct {
+			FileName string `json:"fileName"`
+		}
+		if err := ctx.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+		}
+		if req.FileName == "" {
+			req.FileName = original.FileName
+		}
+
+		// The content was validated when first uploaded, the new name must keep its type
+		upload, err := validateUploadName(loadUploadPolicy("UPLOAD", documentUploadPolicy), req.FileName, original.FileType, original.Size)
+		if err != nil {
+			rejection := err.(*uploadError)
+			return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
+		}
+
+		record := original
+		record.ID = fmt.Sprintf("FILE-%s", uuid.New().String())
+		record.FileName = upload.FileName
+		record.CreatedAt = s.clock.Now()
+
+		unlock := lockContent(record.SHA256)
+		_, stillExists := s.files.Get(original.ID)
+		if stillExists {
+			s.files.Add(record)
+		}
+		unlock()
+		if !stillExists {
+			return fiber.NewError(fiber.StatusNotFound, "File not found")
+		}
+
+		s.logger.Printf("[INFO] File %s created from content %s for user %s\n", record.ID, record.SHA256, record.OwnerID)
+		return ctx.Status(fiber.StatusCreated).JSON(s.buildUploadFileResponse(record))
+	})
+
+	// GET /api/files/:id/meta
+	group.Get("/files/:id/meta", func(ctx *fiber.Ctx) error {
+		record, err := s.ownedFile(ctx)
+		if err != nil {
+			return err
+		}
+
+		return ctx.JSON(fiber.Map{
+			"success": true,
+			"file":    s.buildFileMetadata(record),
+		})
+	})
+
+	// GET /api/files/:id - File content, honouring a single Range header
+	group.Get("/files/:id", s.handleFileDownload)
+
+	// GET /api/files/:id/derivatives/:name - A rendition of the file, such as thumb-256
+	group.Get("/files/:id/derivatives/:name", s.handleDerivativeDownload)
+
+	// DELETE /api/files/:id
+	group.Delete("/files/:id", func(ctx *fiber.Ctx) error {
+		record, err := s.ownedFile(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.logger.Printf("[INFO] Deleting file %s for user %s\n", record.ID, record.OwnerID)
+
+		if err := s.releaseFile(record); err != nil {
+			s.logger.Printf("[ERROR] Failed to delete file %s: %v\n", record.ID, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete file")
+		}
+
+		return ctx.JSON(fiber.Map{
+			"success": true,
+			"message": "File deleted",
+		})
+	})
+}
+
+func (s *Server) handleFileDownload(ctx *fiber.Ctx) error {
+	record, err := s.ownedFile(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fileAvailable(record); err != nil {
+		return err
+	}
+
+	offset, length, partial, err := parseRange(ctx.Get(fiber.HeaderRange), record.Size)
+	if err != nil {
+		ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", record.Size))
+		return fiber.NewError(fiber.StatusRequestedRangeNotSatisfiable, err.Error())
+	}
+
+	reader, err := s.fileStore.Get(record.Key, offset, length)
+	if errors.Is(err, storage.ErrNotFound) {
+		s.logger.Printf("[ERROR] Content of file %s is missing from storage\n", record.ID)
+		return fiber.NewError(fiber.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		s.logger.Printf("[ERROR] Failed to read file %s: %v\n", record.ID, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to read file")
+	}
+
+	ctx.Set(fiber.HeaderContentType, record.ContentType)
+	ctx.Set(fiber.HeaderAcceptRanges, "bytes")
+	ctx.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("inline", map[string]string{"filename": record.FileName}))
+	if partial {
+		ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, record.Size))
+		ctx.Status(fiber.StatusPartialContent)
+	}
+
+	// Fiber closes the reader once the body has been written
+	return ctx.SendStream(reader, int(length))
+}
+
+func (s *Server) handleDerivativeDownload(ctx *fiber.Ctx) error {
+	record, err := s.ownedFile(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fileAvailable(record); err != nil {
+		return err
+	}
+
+	for _, derivative := range record.Derivatives {
+		if derivative.Name != ctx.Params("name") {
+			continue
+		}
+
+		reader, err := s.fileStore.Get(derivativeKey(record, derivative), 0, -1)
+		if errors.Is(err, storage.ErrNotFound) {
+			s.logger.Printf("[ERROR] %s of file %s is missing from storage\n", derivative.Name, record.ID)
+			break
+		}
+		if err != nil {
+			s.logger.Printf("[ERROR] Failed to read %s of file %s: %v\n", derivative.Name, record.ID, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to read file")
+		}
+
+		ctx.Set(fiber.HeaderContentType, derivative.ContentType)
+		return ctx.SendStream(reader, int(derivative.Size))
+	}
+
+	return fiber.NewError(fiber.StatusNotFound, "Derivative not found")
+}
+
+// authenticateFileOwner returns the user ID of the JWE sent as a Bearer token, or in the token field
+func (s *Server) authenticateFileOwner(ctx *fiber.Ctx) (string, error) {
+	token := strings.TrimPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+	if token == "" {
+		token = ctx.FormValue("token")
+	}
+	if token == "" {
+		token = ctx.Query("token")
+	}
+
+	claims, err := jwe.ParseAndValidateJWE(token)
+	if err != nil {
+		s.logger.Printf("[ERROR] Invalid token: %v\n", err)
+		return "", fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+	}
+	return claims.UserID, nil
+}
+
+// ownedFile loads the file in the :id parameter, hiding files that belong to someone else
+func (s *Server) ownedFile(ctx *fiber.Ctx) (storage.FileRecord, error) {
+	ownerID, err := s.authenticateFileOwner(ctx)
+	if err != nil {
+		return storage.FileRecord{}, err
+	}
+
+	record, exists := s.files.Get(ctx.Params("id"))
+	if !exists || record.OwnerID != ownerID {
+		return storage.FileRecord{}, fiber.NewError(fiber.StatusNotFound, "File not found")
+	}
+	return record, nil
+}
+
+// ownedContent finds a file of the caller with the content in the :sha256 parameter.
+// Only the caller's own files are looked up, so the answer never reveals what other users stored.
+func (s *Server) ownedContent(ctx *fiber.Ctx) (storage.FileRecord, error) {
+	ownerID, err := s.authenticateFileOwner(ctx)
+	if err != nil {
+		return storage.FileRecord{}, err
+	}
+
+	hash := strings.ToLower(ctx.Params("sha256"))
+	if !isSHA256Hex(hash) {
+		return storage.FileRecord{}, fiber.NewError(fiber.StatusBadRequest, "Invalid SHA-256")
+	}
+
+	for _, record := range s.files.WithHash(hash) {
+		if record.OwnerID == ownerID && record.ScanStatus != storage.ScanStatusInfected {
+			return record, nil
+		}
+	}
+	return storage.FileRecord{}, fiber.NewError(fiber.StatusNotFound, "File not found")
+}
+
+// parseRange resolves a "bytes=start-end" header against the file size.
+// Without a header the whole file is returned; multiple ranges are not supported.
+func parseRange(header string, size int64) (int64, int64, bool, error) {
+	if header == "" {
+		return 0, size, false, nil
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, fmt.Errorf("unsupported range: %s", header)
+	}
+	startText, endText, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false, fmt.Errorf("invalid range: %s", header)
+	}
+
+	// Suffix range: the last N bytes
+	if startText == "" {
+		suffix, err := strconv.ParseInt(endText, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid range: %s", header)
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, true, nil
+	}
+
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range: %s", header)
+	}
+
+	end := size - 1
+	if endText != "" {
+		end, err = strconv.ParseInt(endText, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range: %s", header)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, true, nil
+}
+
+func (s *Server) buildFileMetadata(record storage.FileRecord) fileMetadataResponse {
+	return fileMetadataResponse{
+		FileRecord:     record,
+		URL:            s.fileDownloadURL(record.ID),
+		DerivativeURLs: s.derivativeURLs(record),
+	}
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"superQiMiniAppBackend/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const UploadErrorInvalidImage = "INVALID_IMAGE"
+
+const (
+	defaultThumbnailSizes   = "256,1024"
+	defaultJPEGQuality      = 90
+	defaultMaxImagePixels   = 50_000_000
+	exifOrientationTag      = 0x0112
+	jpegMarkerStartOfScan   = 0xDA
+	jpegMarkerApplication1  = 0xE1
+	webpExtendedFormatFlags = 0x0C // EXIF and XMP metadata bits of the VP8X header
+)
+
+// processedImage is an upload with its metadata removed, plus its thumbnails
+type processedImage struct {
+	Data       []byte
+	Width      int
+	Height     int
+	Thumbnails []thumbnail
+}
+
+type thumbnail struct {
+	Name        string
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+func isImageKind(kind string) bool {
+	switch kind {
+	case "JPG", "PNG", "GIF", "WEBP":
+		return true
+	}
+	return false
+}
+
+// thumbnailSizes are the longest edges, in pixels, set with IMAGE_THUMBNAIL_SIZES
+func thumbnailSizes() []int {
+	value := os.Getenv("IMAGE_THUMBNAIL_SIZES")
+	if value == "" {
+		value = defaultThumbnailSizes
+	}
+
+	sizes := []int{}
+	for _, part := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(part))
+		if err == nil && size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// processImage decodes an uploaded image and re-encodes it without EXIF, XMP or comments,
+// so location data never reaches storage, then renders its thumbnails
+func processImage(kind string, data []byte) (processedImage, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return processedImage{}, invalidImage("Image could not be decoded: " + err.Error())
+	}
+	if maxPixels := envInt("IMAGE_MAX_PIXELS", defaultMaxImagePixels); config.Width*config.Height > maxPixels {
+		return processedImage{}, invalidImage(fmt.Sprintf("Image is %dx%d, the limit is %d pixels", config.Width, config.Height, maxPixels))
+	}
+
+	var picture image.Image
+	var cleaned bytes.Buffer
+	thumbnailType := "image/png"
+
+	switch kind {
+	case "JPG":
+		picture, err = jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			break
+		}
+		// The orientation lives in the EXIF being removed, so it is applied to the pixels instead
+		picture = applyOrientation(picture, jpegOrientation(data))
+		err = jpeg.Encode(&cleaned, picture, &jpeg.Options{Quality: envInt("IMAGE_JPEG_QUALITY", defaultJPEGQuality)})
+		thumbnailType = "image/jpeg"
+
+	case "PNG":
+		picture, err = png.Decode(bytes.NewReader(data))
+		if err == nil {
+			err = png.Encode(&cleaned, picture)
+		}
+
+	case "GIF":
+		// Every frame is kept, comments and application extensions other than looping are dropped
+		var animation *gif.GIF
+		animation, err = gif.DecodeAll(bytes.NewReader(data))
+		if err == nil {
+			picture = animation.Image[0]
+			err = gif.EncodeAll(&cleaned, animation)
+		}
+
+	case "WEBP":
+		// There is no pure-Go WebP encoder, the metadata chunks are cut out of the container instead
+		picture, err = webp.Decode(bytes.NewReader(data))
+		if err == nil {
+			var stripped []byte
+			stripped, err = stripWebPMetadata(data)
+			cleaned.Write(stripped)
+		}
+
+	default:
+		return processedImage{}, invalidImage(kind + " is not an image type")
+	}
+	if err != nil {
+		return processedImage{}, invalidImage("Image could not be processed: " + err.Error())
+	}
+
+	bounds := picture.Bounds()
+	processed := processedImage{
+		Data:   cleaned.Bytes(),
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}
+
+	for _, size := range thumbnailSizes() {
+		thumb, err := renderThumbnail(picture, size, thumbnailType)
+		if err != nil {
+			return processedImage{}, invalidImage("Thumbnail could not be rendered: " + err.Error())
+		}
+		processed.Thumbnails = append(processed.Thumbnails, thumb)
+	}
+
+	return processed, nil
+}
+
+func invalidImage(message string) error {
+	return &uploadError{
+		Status:  fiber.StatusUnprocessableEntity,
+		Code:    UploadErrorInvalidImage,
+		Message: message,
+	}
+}
+
+// renderThumbnail scales the image so its longest edge is size, never enlarging it
+func renderThumbnail(picture image.Image, size int, contentType string) (thumbnail, error) {
+	bounds := picture.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if longest := max(width, height); longest > size {
+		width = max(1, width*size/longest)
+		height = max(1, height*size/longest)
+	}
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), picture, bounds, draw.Src, nil)
+
+	var encoded bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&encoded, scaled, &jpeg.Options{Quality: envInt("IMAGE_JPEG_QUALITY", defaultJPEGQuality)})
+	} else {
+		err = png.Encode(&encoded, scaled)
+	}
+	if err != nil {
+		return thumbnail{}, err
+	}
+
+	return thumbnail{
+		Name:        fmt.Sprintf("thumb-%d", size),
+		ContentType: contentType,
+		Width:       width,
+		Height:      height,
+		Data:        encoded.Bytes(),
+	}, nil
+}
+
+// jpegOrientation reads the EXIF orientation (1-8) of a JPEG, 1 when there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if marker == jpegMarkerStartOfScan || length < 2 || offset+2+length > len(data) {
+			return 1
+		}
+
+		segment := data[offset+4 : offset+2+length]
+		if marker == jpegMarkerApplication1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation looks up the orientation tag in the first IFD of an EXIF TIFF block
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips an image so it displays upright without its EXIF orientation
+func applyOrientation(picture image.Image, orientation int) image.Image {
+	if orientation <= 1 {
+		return picture
+	}
+
+	bounds := picture.Bounds()
+	source := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(source, source.Bounds(), picture, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+	result := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotate 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // flip vertically
+				dx, dy = x, height-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // transverse
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotate 90° counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			copy(result.Pix[result.PixOffset(dx, dy):][:4], source.Pix[source.PixOffset(x, y):][:4])
+		}
+	}
+	return result
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks of a WebP file and clears their VP8X flags
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for offset := 12; offset < len(data); {
+		if offset+8 > len(data) {
+			return nil, fmt.Errorf("truncated WebP chunk")
+		}
+		fourCC := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		end := offset + 8 + size + size%2 // chunks are padded to an even size
+		if end > len(data) {
+			return nil, fmt.Errorf("truncated WebP chunk %s", fourCC)
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[offset:end]...)
+			chunk[8] &^= webpExtendedFormatFlags
+			out.Write(chunk)
+		default:
+			out.Write(data[offset:end])
+		}
+		offset = end
+	}
+
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, nil
+}
+
+// derivativeKey is where a derivative is stored, shared by every file with the same content
+func derivativeKey(record storage.FileRecord, derivative storage.Derivative) string {
+	ext := ".png"
+	if derivative.ContentType == "image/jpeg" {
+		ext = ".jpg"
+	}
+	if record.SHA256 == "" {
+		// Files stored before content addressing keep their derivatives next to them
+		return "files/" + record.ID + "/" + derivative.Name + ext
+	}
+	return "derivatives/" + record.SHA256 + "/" + derivative.Name + ext
+}
+
+// fileDerivativeURL is the backend URL of a derivative, such as a thumbnail
+func (s *Server) fileDerivativeURL(fileID, name string) string {
+	return s.fileDownloadURL(fileID) + "/derivatives/" + name
+}
+
+func (s *Server) derivativeURLs(record storage.FileRecord) map[string]string {
+	if len(record.Derivatives) == 0 {
+		return nil
+	}
+	urls := make(map[string]string, len(record.Derivatives))
+	for _, derivative := range record.Derivatives {
+		urls[derivative.Name] = s.fileDerivativeURL(record.ID, derivative.Name)
+	}
+	return urls
+}
@@ -2,7 +2,6 @@ package api
 
 import (
 	"encoding/json"
-	"log"
 	"superQiMiniAppBackend/alipay"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,29 +12,29 @@ type inquiryPaymentRequest struct {
 	PaymentRequestID string `json:"paymentRequestId,omitempty"`
 }
 
-func InitInquiryPaymentEndpoint(group fiber.Router) {
-	group.Post("/payment/inquiry", handleInquiryPayment)
+func (s *Server) registerInquiryPaymentEndpoint(group fiber.Router) {
+	group.Post("/payment/inquiry", s.handleInquiryPayment)
 }
 
-func handleInquiryPayment(ctx *fiber.Ctx) error {
+func (s *Server) handleInquiryPayment(ctx *fiber.Ctx) error {
 	var request inquiryPaymentRequest
 	if err := ctx.BodyParser(&request); err != nil {
-		log.Printf("[ERROR] Invalid request body: %v\n", err)
+		s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
-	log.Println("=================================================================")
-	log.Println("PAYMENT INQUIRY REQUEST RECEIVED")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("PAYMENT INQUIRY REQUEST RECEIVED")
+	s.logger.Println("=================================================================")
 
 	// Validate that at least one identifier is provided
 	if request.PaymentID == "" && request.PaymentRequestID == "" {
-		log.Println("[ERROR] Either paymentId or paymentRequestId must be provided")
+		s.logger.Println("[ERROR] Either paymentId or paymentRequestId must be provided")
 		return fiber.NewError(fiber.StatusBadRequest, "Either paymentId or paymentRequestId is required")
 	}
 
-	log.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
-	log.Printf("[INFO] Payment Request ID: %s\n", request.PaymentRequestID)
+	s.logger.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
+	s.logger.Printf("[INFO] Payment Request ID: %s\n", request.PaymentRequestID)
 
 	// Call Alipay InquiryPayment API
 	inquiryRequest := alipay.InquiryPaymentRequest{
@@ -43,20 +42,20 @@ func handleInquiryPayment(ctx *fiber.Ctx) error {
 		PaymentRequestID: request.PaymentRequestID,
 	}
 
-	inquiryResponse, err := alipay.Interface.InquiryPayment(inquiryRequest)
+	inquiryResponse, err := s.gateway.InquiryPayment(inquiryRequest)
 	if err != nil {
-		log.Printf("[ERROR] Failed to inquiry payment: %v\n", err)
+		s.logger.Printf("[ERROR] Failed to inquiry payment: %v\n", err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to inquiry payment: "+err.Error())
 	}
 
 	responseJSON, _ := json.MarshalIndent(inquiryResponse, "", "  ")
-	log.Printf("[INFO] Inquiry response:\n%s\n", string(responseJSON))
+	s.logger.Printf("[INFO] Inquiry response:\n%s\n", string(responseJSON))
 
 	// Build response
 	response := buildInquiryPaymentResponse(inquiryResponse)
 
-	log.Println("[SUCCESS] Returning inquiry response to frontend")
-	log.Println("=================================================================")
+	s.logger.Println("[SUCCESS] Returning inquiry response to frontend")
+	s.logger.Println("=================================================================")
 	return ctx.JSON(response)
 }
 
@@ -0,0 +1,1089 @@
+package api_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/api"
+	"superQiMiniAppBackend/events"
+	"superQiMiniAppBackend/mockgateway"
+	"superQiMiniAppBackend/notification"
+	"superQiMiniAppBackend/scanner"
+	"superQiMiniAppBackend/webhook"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Intervals the background workers wait on the clock between gateway calls
+const (
+	pollingInterval               = 5 * time.Second
+	refundPollingInterval         = 5 * time.Second
+	notificationReconcileInterval = 10 * time.Second
+)
+
+func TestAuthThenUserInfo(t *testing.T) {
+	h := newHarness(t)
+
+	token, userID := h.login("auth-journey")
+
+	if _, exists := h.sessions.Get(userID); !exists {
+		t.Errorf("session of %s was not stored", userID)
+	}
+
+	result := h.do(http.MethodPost, "/api/user/info", fiber.Map{"token": token})
+	if result.Status != fiber.StatusOK {
+		t.Fatalf("user info answered %d: %s", result.Status, result.Raw)
+	}
+	userInfo, _ := result.Body["userInfo"].(map[string]interface{})
+	if userInfo["userId"] == "" || userInfo["userId"] == nil {
+		t.Errorf("user info has no user ID: %s", result.Raw)
+	}
+
+	if result := h.do(http.MethodPost, "/api/user/info", fiber.Map{"token": "not-a-token"}); result.Status != fiber.StatusUnauthorized {
+		t.Errorf("user info with an invalid token answered %d, want 401", result.Status)
+	}
+}
+
+func TestPaymentPolledToSuccess(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("payment-journey")
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if created.Status != fiber.StatusOK || !created.Bool("success") || paymentID == "" || created.String("paymentUrl") == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+
+	status := h.do(http.MethodGet, "/api/payment/status/"+paymentID, nil)
+	if status.String("status") != "PENDING" {
+		t.Fatalf("new payment is %q, want PENDING", status.String("status"))
+	}
+
+	if !gateway.CompletePayment(paymentID, true) {
+		t.Fatalf("gateway could not complete payment %s", paymentID)
+	}
+
+	h.eventually(pollingInterval, "payment to succeed", func() bool {
+		return h.do(http.MethodGet, "/api/payment/status/"+paymentID, nil).String("status") == "SUCCESS"
+	})
+
+	status = h.do(http.MethodGet, "/api/payment/status/"+paymentID, nil)
+	if !status.Bool("completed") || status.String("paymentStatus") != mockgateway.PaymentSuccess {
+		t.Errorf("completed payment status: %s", status.Raw)
+	}
+	if !h.published(events.TypePaymentSucceeded) {
+		t.Errorf("%s was not published, got %v", events.TypePaymentSucceeded, h.publishedTypes())
+	}
+
+	// The receipt goes out on its own goroutine once the success is published
+	h.eventually(0, "the receipt", func() bool {
+		return gatewayCalled("/v1/messages/sendInbox", "requestId", "RECEIPT-INBOX-"+paymentID)
+	})
+}
+
+func TestFailedReceiptIsRetried(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("receipt-retry-journey")
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if paymentID == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+
+	gateway.Program("/v1/messages/sendInbox", mockgateway.FailResult("SYSTEM_BUSY"), mockgateway.FailResult("SYSTEM_BUSY"))
+	if !gateway.CompletePayment(paymentID, true) {
+		t.Fatalf("gateway could not complete payment %s", paymentID)
+	}
+
+	// Two failures, then the third send with the same request ID goes through
+	receiptSends := func() int {
+		sends := 0
+		for _, call := range gateway.Calls("/v1/messages/sendInbox") {
+			if call.Request["requestId"] == "RECEIPT-INBOX-"+paymentID {
+				sends++
+			}
+		}
+		return sends
+	}
+	h.eventually(pollingInterval, "the receipt retries", func() bool {
+		return receiptSends() >= 3
+	})
+	if sends := receiptSends(); sends != 3 {
+		t.Errorf("expected the receipt to be sent three times, got %d", sends)
+	}
+}
+
+func TestReceiptRetryStopsWhenServerCloses(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("receipt-close-journey")
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if paymentID == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+
+	gateway.Program("/v1/messages/sendInbox", mockgateway.FailResult("SYSTEM_BUSY"))
+	if !gateway.CompletePayment(paymentID, true) {
+		t.Fatalf("gateway could not complete payment %s", paymentID)
+	}
+	h.eventually(pollingInterval, "payment to succeed", func() bool {
+		return h.do(http.MethodGet, "/api/payment/status/"+paymentID, nil).String("status") == "SUCCESS"
+	})
+	receiptSent := func() bool {
+		return gatewayCalled("/v1/messages/sendInbox", "requestId", "RECEIPT-INBOX-"+paymentID)
+	}
+	h.eventually(0, "the failed receipt", receiptSent)
+
+	// The retry is waiting on the clock when the server closes, it must not be sent afterwards
+	time.Sleep(50 * time.Millisecond)
+	h.server.Close()
+	h.clock.Advance(time.Hour)
+	time.Sleep(50 * time.Millisecond)
+
+	sends := 0
+	for _, call := range gateway.Calls("/v1/messages/sendInbox") {
+		if call.Request["requestId"] == "RECEIPT-INBOX-"+paymentID {
+			sends++
+		}
+	}
+	if sends != 1 {
+		t.Errorf("expected the receipt to be sent once before the server closed, got %d", sends)
+	}
+}
+
+func TestPaymentPollingTimesOut(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("payment-timeout-journey")
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if paymentID == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+
+	h.eventually(pollingInterval, "payment to time out", func() bool {
+		return h.do(http.MethodGet, "/api/payment/status/"+paymentID, nil).String("status") == "TIMEOUT"
+	})
+	if !h.published(events.TypePaymentTimedOut) {
+		t.Errorf("%s was not published, got %v", events.TypePaymentTimedOut, h.publishedTypes())
+	}
+}
+
+func TestPaymentStatusStreamedUntilCompleted(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("payment-stream-journey")
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if paymentID == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+
+	// The stream only ends once the payment completes, which needs the poller to run on the clock
+	streamed := make(chan response, 1)
+	go func() {
+		streamed <- h.do(http.MethodGet, "/api/payment/status/"+paymentID+"/stream", nil)
+	}()
+	if !gateway.CompletePayment(paymentID, true) {
+		t.Fatalf("gateway could not complete payment %s", paymentID)
+	}
+
+	var stream response
+	h.eventually(pollingInterval, "the status stream to end", func() bool {
+		select {
+		case stream = <-streamed:
+			return true
+		default:
+			return false
+		}
+	})
+
+	var statuses []string
+	for _, line := range strings.Split(string(stream.Raw), "\n") {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			t.Fatalf("status event %q: %v", line, err)
+		}
+		status, _ := event["status"].(string)
+		statuses = append(statuses, status)
+	}
+	if len(statuses) < 2 || statuses[0] != "PENDING" || statuses[len(statuses)-1] != "SUCCESS" {
+		t.Errorf("streamed statuses %v, want PENDING first and SUCCESS last", statuses)
+	}
+
+	if result := h.do(http.MethodGet, "/api/payment/status/PAY-UNKNOWN/stream", nil); result.Status != fiber.StatusNotFound {
+		t.Errorf("stream of an unknown payment answered %d", result.Status)
+	}
+}
+
+func TestMerchantSessionReceivesPaymentEvents(t *testing.T) {
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.MerchantID = "2188" + testClientID
+	})
+
+	// WebSockets need a real connection, app.Test cannot upgrade one
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.app.Listener(listener)
+	t.Cleanup(func() {
+		h.app.Shutdown()
+	})
+	token, _ := h.login("merchant-events-journey")
+	eventsURL := "ws://" + listener.Addr().String() + "/api/merchant/events?token=" + url.QueryEscape(token)
+
+	if result := h.do(http.MethodGet, "/api/merchant/events?token="+url.QueryEscape(token), nil); result.Status != fiber.StatusUpgradeRequired {
+		t.Errorf("merchant events without an upgrade answered %d", result.Status)
+	}
+	if _, rejected, err := websocket.DefaultDialer.Dial(eventsURL+"&events=gossip", nil); err == nil || rejected == nil || rejected.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("merchant events with an unknown filter were not rejected: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(eventsURL+"&events=payment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() map[string]interface{} {
+		t.Helper()
+		var message map[string]interface{}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	if message := read(); message["type"] != "subscribed" {
+		t.Fatalf("first message %v, want the subscription", message)
+	}
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if paymentID == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+	for {
+		message := read()
+		if message["type"] == api.MerchantEventPaymentStatus && message["paymentId"] == paymentID {
+			break
+		}
+	}
+
+	if err := conn.WriteJSON(fiber.Map{"action": "subscribe", "events": []string{"escrow"}}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		message := read()
+		if message["type"] == "subscribed" {
+			if filters, _ := message["events"].([]interface{}); len(filters) != 1 || filters[0] != "escrow" {
+				t.Errorf("subscription changed to %v, want escrow", message["events"])
+			}
+			break
+		}
+	}
+}
+
+// paidPayment creates a payment through the API and pays it at the gateway
+func (h *harness) paidPayment(token string) string {
+	h.t.Helper()
+
+	created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if paymentID == "" {
+		h.t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+	if !gateway.CompletePayment(paymentID, true) {
+		h.t.Fatalf("gateway could not complete payment %s", paymentID)
+	}
+	return paymentID
+}
+
+func TestRefundUnknownThenPolled(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("refund-journey")
+	paymentID := h.paidPayment(token)
+
+	// The refund goes through at the gateway, but the answer is lost and the first inquiry is too early
+	gateway.Program("/v1/payments/refund", mockgateway.UnknownResult())
+	gateway.Program("/v1/payments/inquiryRefund", mockgateway.WithFields(1, map[string]interface{}{"refundStatus": mockgateway.RefundProcessing}))
+
+	result := h.doWhileAdvancing(refundPollingInterval, http.MethodPost, "/api/payment/refund", fiber.Map{
+		"paymentId": paymentID,
+		"amount":    1,
+	})
+	if result.Status != fiber.StatusOK || !result.Bool("success") || result.String("status") != "SUCCESS" {
+		t.Fatalf("refund answered %d: %s", result.Status, result.Raw)
+	}
+	if result.String("refundId") == "" {
+		t.Errorf("refund has no refund ID: %s", result.Raw)
+	}
+	if calls := len(gateway.Calls("/v1/payments/inquiryRefund")); calls != 2 {
+		t.Errorf("refund was inquired %d time(s), want 2", calls)
+	}
+	if !h.published(events.TypeRefundSucceeded) {
+		t.Errorf("%s was not published, got %v", events.TypeRefundSucceeded, h.publishedTypes())
+	}
+}
+
+func TestRefundExceedingPayment(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("refund-exceed-journey")
+	paymentID := h.paidPayment(token)
+
+	result := h.do(http.MethodPost, "/api/payment/refund", fiber.Map{
+		"paymentId": paymentID,
+		"amount":    5,
+	})
+	if result.Bool("success") || result.String("resultCode") != "REFUND_AMOUNT_EXCEED" {
+		t.Fatalf("refund above the payment answered %d: %s", result.Status, result.Raw)
+	}
+	if !h.published(events.TypeRefundFailed) {
+		t.Errorf("%s was not published, got %v", events.TypeRefundFailed, h.publishedTypes())
+	}
+}
+
+func TestEscrowAcceptedThenConfirmed(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("escrow-journey")
+
+	created := h.do(http.MethodPost, "/api/escrow/create", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if created.Status != fiber.StatusOK || paymentID == "" {
+		t.Fatalf("escrow create answered %d: %s", created.Status, created.Raw)
+	}
+
+	// Nothing can be accepted before the buyer pays
+	early := h.do(http.MethodPost, "/api/escrow/merchant-accept", fiber.Map{"paymentId": paymentID})
+	if early.Bool("success") || early.String("resultCode") != "ORDER_STATUS_INVALID" {
+		t.Fatalf("accept before payment answered %d: %s", early.Status, early.Raw)
+	}
+
+	if !gateway.CompletePayment(paymentID, true) {
+		t.Fatalf("gateway could not complete payment %s", paymentID)
+	}
+
+	for _, step := range []string{"merchant-accept", "confirm"} {
+		result := h.do(http.MethodPost, "/api/escrow/"+step, fiber.Map{"paymentId": paymentID})
+		if result.Status != fiber.StatusOK || !result.Bool("success") {
+			t.Fatalf("escrow %s answered %d: %s", step, result.Status, result.Raw)
+		}
+	}
+
+	var escrowEvents []string
+	for _, eventType := range h.publishedTypes() {
+		if strings.HasPrefix(eventType, "escrow.") {
+			escrowEvents = append(escrowEvents, eventType)
+		}
+	}
+	want := []string{events.TypeEscrowCreated, events.TypeEscrowAccepted, events.TypeEscrowConfirmed}
+	if strings.Join(escrowEvents, ",") != strings.Join(want, ",") {
+		t.Errorf("escrow events %v, want %v", escrowEvents, want)
+	}
+}
+
+func TestDeadWebhookIsReplayed(t *testing.T) {
+	// The subscriber is down until the delivery has exhausted its attempts
+	var subscriberStatus atomic.Int32
+	subscriberStatus.Store(http.StatusInternalServerError)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(subscriberStatus.Load()))
+	}))
+	t.Cleanup(subscriber.Close)
+
+	h := newHarnessWith(t, func(config *api.Config) {
+		dispatcher, err := webhook.NewDispatcher(webhook.Config{
+			Subscriptions: []webhook.Subscription{{ID: "journey", URL: subscriber.URL, Secret: "journey-secret", Events: []string{events.TypePaymentCreated}}},
+			QueuePath:     filepath.Join(t.TempDir(), "deliveries.json"),
+			Clock:         config.Clock,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatcher.Start()
+		t.Cleanup(dispatcher.Close)
+		config.Webhooks = dispatcher
+	})
+	token, _ := h.login("webhook-journey")
+
+	if created := h.do(http.MethodPost, "/api/payment/create", fiber.Map{"token": token}); created.String("paymentId") == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+
+	var dead []interface{}
+	h.eventually(10*time.Minute, "the delivery to be dead", func() bool {
+		deadLetters := h.doAsAdmin(http.MethodGet, "/api/admin/webhooks/dead-letters", nil)
+		dead, _ = deadLetters.Body["deliveries"].([]interface{})
+		return len(dead) == 1
+	})
+	delivery, _ := dead[0].(map[string]interface{})
+	deliveryID, _ := delivery["id"].(string)
+	if delivery["eventType"] != events.TypePaymentCreated || delivery["attempts"] != float64(8) {
+		t.Errorf("unexpected dead letter %v", delivery)
+	}
+
+	if result := h.do(http.MethodGet, "/api/admin/webhooks/deliveries", nil); result.Status != fiber.StatusUnauthorized {
+		t.Errorf("deliveries without the admin key answered %d", result.Status)
+	}
+	if result := h.doAsAdmin(http.MethodPost, "/api/admin/webhooks/deliveries/WHD-UNKNOWN/replay", nil); result.Status != fiber.StatusNotFound {
+		t.Errorf("replay of an unknown delivery answered %d", result.Status)
+	}
+
+	subscriberStatus.Store(http.StatusOK)
+	if replayed := h.doAsAdmin(http.MethodPost, "/api/admin/webhooks/deliveries/"+deliveryID+"/replay", nil); replayed.Status != fiber.StatusOK {
+		t.Fatalf("replay answered %d: %s", replayed.Status, replayed.Raw)
+	}
+
+	h.eventually(time.Second, "the replayed delivery", func() bool {
+		delivered := h.doAsAdmin(http.MethodGet, "/api/admin/webhooks/deliveries?status="+webhook.StatusDelivered, nil)
+		return delivered.Body["count"] == float64(1)
+	})
+	result := h.doAsAdmin(http.MethodGet, "/api/admin/webhooks/deliveries/"+deliveryID, nil)
+	delivery, _ = result.Body["delivery"].(map[string]interface{})
+	if delivery["status"] != webhook.StatusDelivered || delivery["attempts"] != float64(1) {
+		t.Errorf("replayed delivery answered %d: %s", result.Status, result.Raw)
+	}
+	if deadLetters := h.doAsAdmin(http.MethodGet, "/api/admin/webhooks/dead-letters", nil); deadLetters.Body["count"] != float64(0) {
+		t.Errorf("dead letters after the replay: %s", deadLetters.Raw)
+	}
+}
+
+// bindAgreement prepares a contract for scopes, the default ones when none are given,
+// consents to it on the gateway's page and applies the auth code
+func (h *harness) bindAgreement(scopes ...string) response {
+	h.t.Helper()
+
+	prepared := h.do(http.MethodPost, "/api/agreement/prepare", fiber.Map{
+		"contractDescription": "Monthly plan",
+		"scopes":              scopes,
+		"authRedirectUrl":     "https://merchant.example/agreement",
+		"state":               "journey",
+	})
+	authURL := prepared.String("authUrl")
+	if prepared.Status != fiber.StatusOK || !prepared.Bool("success") || authURL == "" {
+		h.t.Fatalf("agreement prepare answered %d: %s", prepared.Status, prepared.Raw)
+	}
+
+	// The user consents on the wallet's page, which redirects back with an auth code
+	authCode := authorize(h.t, authURL)
+
+	bound := h.do(http.MethodPost, "/api/agreement/apply-token", fiber.Map{
+		"authCode": authCode,
+		"state":    "journey",
+	})
+	if bound.Status != fiber.StatusOK || !bound.Bool("success") || bound.String("customerId") == "" || bound.String("token") == "" {
+		h.t.Fatalf("agreement apply-token answered %d: %s", bound.Status, bound.Raw)
+	}
+	return bound
+}
+
+func TestAgreementPreparedBoundAndPaid(t *testing.T) {
+	h := newHarness(t)
+
+	bound := h.bindAgreement()
+	customerID, token := bound.String("customerId"), bound.String("token")
+	if _, leaked := bound.Body["accessToken"]; leaked {
+		t.Errorf("agreement apply-token returned the access token: %s", bound.Raw)
+	}
+	if agreement, exists := h.agreements.Get(customerID); !exists || agreement.ContractDescription != "Monthly plan" {
+		t.Errorf("agreement of %s was not stored as prepared", customerID)
+	}
+
+	if result := h.do(http.MethodGet, "/api/agreement/"+customerID+"?token="+url.QueryEscape(token), nil); result.Status != fiber.StatusOK {
+		t.Errorf("agreement lookup answered %d: %s", result.Status, result.Raw)
+	}
+	if result := h.do(http.MethodGet, "/api/agreement/"+customerID, nil); result.Status != fiber.StatusUnauthorized {
+		t.Errorf("agreement lookup without a token answered %d, want 401", result.Status)
+	}
+
+	paid := h.do(http.MethodPost, "/api/agreement/pay", fiber.Map{
+		"token":  token,
+		"amount": 5000,
+	})
+	if paid.Status != fiber.StatusOK || !paid.Bool("success") || paid.String("paymentId") == "" {
+		t.Fatalf("agreement pay answered %d: %s", paid.Status, paid.Raw)
+	}
+
+	// A token only ever reaches the agreement of its own customer
+	_, otherCustomerID := h.login("agreement-journey-other")
+	foreign := h.do(http.MethodPost, "/api/agreement/pay", fiber.Map{
+		"token":      token,
+		"customerId": otherCustomerID,
+		"amount":     5000,
+	})
+	if foreign.Status != fiber.StatusForbidden {
+		t.Errorf("agreement pay for another customer answered %d: %s", foreign.Status, foreign.Raw)
+	}
+	if result := h.do(http.MethodPost, "/api/agreement/unbind", fiber.Map{"token": token, "customerId": otherCustomerID}); result.Status != fiber.StatusForbidden {
+		t.Errorf("agreement unbind for another customer answered %d: %s", result.Status, result.Raw)
+	}
+
+	unbound := h.do(http.MethodPost, "/api/agreement/unbind", fiber.Map{"token": token})
+	if unbound.Status != fiber.StatusOK || !unbound.Bool("success") || unbound.String("customerId") != customerID {
+		t.Fatalf("agreement unbind answered %d: %s", unbound.Status, unbound.Raw)
+	}
+	if calls := len(gateway.Calls("/v1/authorizations/cancelToken")); calls == 0 {
+		t.Error("gateway did not receive the token cancellation")
+	}
+	if _, exists := h.agreements.Get(customerID); exists {
+		t.Errorf("agreement of %s is still stored after unbinding", customerID)
+	}
+	if result := h.do(http.MethodPost, "/api/agreement/pay", fiber.Map{"token": token, "amount": 5000}); result.Status != fiber.StatusNotFound {
+		t.Errorf("agreement pay after unbinding answered %d: %s", result.Status, result.Raw)
+	}
+}
+
+func TestAgreementRedirectsOnlyToTheMerchant(t *testing.T) {
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.BaseURL = "https://api.merchant.example:8443"
+		config.AgreementRedirectHosts = []string{"wallet-partner.example"}
+	})
+
+	prepare := func(redirectURL string) response {
+		return h.do(http.MethodPost, "/api/agreement/prepare", fiber.Map{
+			"contractDescription": "Monthly plan",
+			"authRedirectUrl":     redirectURL,
+		})
+	}
+	for _, redirectURL := range []string{"https://merchant.example/agreement", "https://wallet-partner.example/agreement", "https://api.merchant.example/agreement"} {
+		if result := prepare(redirectURL); result.Status != fiber.StatusOK || !result.Bool("success") {
+			t.Errorf("agreement prepare redirecting to %s answered %d: %s", redirectURL, result.Status, result.Raw)
+		}
+	}
+
+	// The auth code would be handed to whoever owns the redirect host
+	for _, redirectURL := range []string{"https://attacker.example/agreement", "https://merchant.example.attacker.example/agreement"} {
+		if result := prepare(redirectURL); result.Status != fiber.StatusBadRequest || result.Bool("success") {
+			t.Errorf("agreement prepare redirecting to %s answered %d: %s", redirectURL, result.Status, result.Raw)
+		}
+	}
+}
+
+func TestAgreementWithoutPayScopeIsNotCharged(t *testing.T) {
+	h := newHarness(t)
+
+	bound := h.bindAgreement(alipay.SCOPE_USER_INFO)
+	calls := len(gateway.Calls("/v1/payments/pay"))
+
+	paid := h.do(http.MethodPost, "/api/agreement/pay", fiber.Map{
+		"token":  bound.String("token"),
+		"amount": 5000,
+	})
+	if paid.Status != fiber.StatusForbidden || paid.Bool("success") {
+		t.Errorf("agreement pay without the %s scope answered %d: %s", alipay.SCOPE_AGREEMENT_PAY, paid.Status, paid.Raw)
+	}
+	if after := len(gateway.Calls("/v1/payments/pay")); after != calls {
+		t.Errorf("gateway was asked to charge an agreement without the %s scope", alipay.SCOPE_AGREEMENT_PAY)
+	}
+}
+
+func TestAgreementStateSurvivesFailedTokenApplication(t *testing.T) {
+	h := newHarness(t)
+
+	prepared := h.do(http.MethodPost, "/api/agreement/prepare", fiber.Map{
+		"contractDescription": "Monthly plan",
+		"authRedirectUrl":     "https://merchant.example/agreement",
+		"state":               "journey",
+	})
+	if prepared.Status != fiber.StatusOK || !prepared.Bool("success") {
+		t.Fatalf("agreement prepare answered %d: %s", prepared.Status, prepared.Raw)
+	}
+	authCode := authorize(t, prepared.String("authUrl"))
+
+	// The wallet is unsure whether the token was issued, the user retries with the same state
+	gateway.Program("/v1/authorizations/applyToken", mockgateway.UnknownResult())
+	failed := h.do(http.MethodPost, "/api/agreement/apply-token", fiber.Map{"authCode": authCode, "state": "journey"})
+	if failed.Status != fiber.StatusBadRequest || failed.Bool("success") {
+		t.Fatalf("agreement apply-token with an unknown result answered %d: %s", failed.Status, failed.Raw)
+	}
+
+	bound := h.do(http.MethodPost, "/api/agreement/apply-token", fiber.Map{"authCode": authCode, "state": "journey"})
+	if bound.Status != fiber.StatusOK || !bound.Bool("success") || bound.String("token") == "" {
+		t.Fatalf("agreement apply-token retry answered %d: %s", bound.Status, bound.Raw)
+	}
+
+	// Once applied, the state is spent
+	if result := h.do(http.MethodPost, "/api/agreement/apply-token", fiber.Map{"authCode": authCode, "state": "journey"}); result.Status != fiber.StatusBadRequest {
+		t.Errorf("agreement apply-token replay answered %d: %s", result.Status, result.Raw)
+	}
+}
+
+func TestAgreementSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agreements.json")
+	open := func(config *api.Config) {
+		agreements, err := api.NewAgreementStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Agreements = agreements
+	}
+
+	token := newHarnessWith(t, open).bindAgreement().String("token")
+
+	// The access token only exists in the store, a restarted server must still be able to charge
+	restarted := newHarnessWith(t, open)
+	paid := restarted.do(http.MethodPost, "/api/agreement/pay", fiber.Map{
+		"token":  token,
+		"amount": 5000,
+	})
+	if paid.Status != fiber.StatusOK || !paid.Bool("success") {
+		t.Fatalf("agreement pay after a restart answered %d: %s", paid.Status, paid.Raw)
+	}
+}
+
+// authorize follows an authorization URL of the gateway and returns the auth code it hands out
+func authorize(t *testing.T, authURL string) string {
+	t.Helper()
+
+	wallet := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	result, err := wallet.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Body.Close()
+
+	location, err := url.Parse(result.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCode := location.Query().Get("authCode")
+	if authCode == "" || location.Query().Get("state") != "journey" {
+		t.Fatalf("authorization redirected to %q", location)
+	}
+	return authCode
+}
+
+func TestNotificationSent(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("notification-journey")
+
+	inbox := h.do(http.MethodPost, "/api/notification/send-inbox", fiber.Map{
+		"token":   token,
+		"title":   "Hello",
+		"content": "Your order has shipped",
+	})
+	requestID := inbox.String("requestId")
+	if inbox.Status != fiber.StatusOK || !inbox.Bool("success") || inbox.String("messageId") == "" {
+		t.Fatalf("send-inbox answered %d: %s", inbox.Status, inbox.Raw)
+	}
+	if !gatewayCalled("/v1/messages/sendInbox", "requestId", requestID) {
+		t.Errorf("gateway did not receive inbox message %s", requestID)
+	}
+
+	logged := h.do(http.MethodGet, "/api/notification/"+requestID+"?token="+token, nil)
+	record, _ := logged.Body["notification"].(map[string]interface{})
+	if logged.Status != fiber.StatusOK || record["status"] != "SENT" {
+		t.Errorf("logged notification answered %d: %s", logged.Status, logged.Raw)
+	}
+	if anonymous := h.do(http.MethodGet, "/api/notification/"+requestID, nil); anonymous.Status != fiber.StatusUnauthorized {
+		t.Errorf("notification without a token answered %d", anonymous.Status)
+	}
+	otherToken, _ := h.login("notification-journey-other")
+	if foreign := h.do(http.MethodGet, "/api/notification/"+requestID+"?token="+otherToken, nil); foreign.Status != fiber.StatusNotFound {
+		t.Errorf("notification of another user answered %d", foreign.Status)
+	}
+
+	push := h.do(http.MethodPost, "/api/notification/send-push", fiber.Map{
+		"token":   token,
+		"title":   "Hello",
+		"content": "Your order has shipped",
+	})
+	if push.Status != fiber.StatusOK || !push.Bool("success") || push.String("delivery") != "SENT" {
+		t.Fatalf("send-push answered %d: %s", push.Status, push.Raw)
+	}
+	if !h.published(events.TypeNotificationSent) {
+		t.Errorf("%s was not published, got %v", events.TypeNotificationSent, h.publishedTypes())
+	}
+}
+
+func TestUnknownNotificationIsResentOnce(t *testing.T) {
+	// Both servers share the process send log, only the first one reconciles it
+	reconciling := newHarness(t)
+	h := newHarness(t)
+	token, _ := h.login("notification-unknown-journey")
+
+	gateway.Program("/v1/messages/sendInbox", mockgateway.UnknownResult())
+	inbox := h.do(http.MethodPost, "/api/notification/send-inbox", fiber.Map{
+		"token":   token,
+		"title":   "Hello",
+		"content": "Your order has shipped",
+	})
+	requestID := inbox.String("requestId")
+	if inbox.String("status") != "UNKNOWN" || requestID == "" {
+		t.Fatalf("send-inbox answered %d: %s", inbox.Status, inbox.Raw)
+	}
+
+	status := func() string {
+		logged := h.do(http.MethodGet, "/api/notification/"+requestID+"?token="+token, nil)
+		record, _ := logged.Body["notification"].(map[string]interface{})
+		value, _ := record["status"].(string)
+		return value
+	}
+	if current := status(); current != "UNKNOWN" {
+		t.Fatalf("logged notification is %s, want UNKNOWN", current)
+	}
+
+	h.eventually(notificationReconcileInterval, "the re-sent notification", func() bool {
+		reconciling.clock.Advance(notificationReconcileInterval)
+		return status() == "SENT"
+	})
+	for i := 0; i < 3; i++ {
+		h.clock.Advance(notificationReconcileInterval)
+		reconciling.clock.Advance(notificationReconcileInterval)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sends := 0
+	for _, call := range gateway.Calls("/v1/messages/sendInbox") {
+		if call.Request["requestId"] == requestID {
+			sends++
+		}
+	}
+	if sends != 2 {
+		t.Errorf("expected the unknown notification to be sent twice, got %d", sends)
+	}
+}
+
+func TestTemplateNotificationFollowsPreferences(t *testing.T) {
+	h := newHarness(t)
+	token, userID := h.login("template-journey")
+
+	templates := h.do(http.MethodGet, "/api/notification/templates", nil)
+	if list, _ := templates.Body["templates"].([]interface{}); templates.Status != fiber.StatusOK || len(list) == 0 {
+		t.Fatalf("templates answered %d: %s", templates.Status, templates.Raw)
+	}
+
+	send := func() response {
+		return h.do(http.MethodPost, "/api/notification/send", fiber.Map{
+			"token":        token,
+			"templateCode": "MINI_APP_COMMON_INBOX",
+			"parameters":   fiber.Map{"Title": "Hello", "Content": "Your order has shipped"},
+		})
+	}
+	sent := send()
+	if sent.Status != fiber.StatusOK || !sent.Bool("success") || sent.String("channel") != notification.ChannelInbox {
+		t.Fatalf("template send answered %d: %s", sent.Status, sent.Raw)
+	}
+	if !gatewayCalled("/v1/messages/sendInbox", "requestId", sent.String("requestId")) {
+		t.Errorf("gateway did not receive template message %s", sent.String("requestId"))
+	}
+
+	missing := h.do(http.MethodPost, "/api/notification/send", fiber.Map{
+		"token":        token,
+		"templateCode": "MINI_APP_COMMON_INBOX",
+		"parameters":   fiber.Map{"Title": "Hello"},
+	})
+	if missing.Status != fiber.StatusBadRequest {
+		t.Errorf("template send without a required parameter answered %d: %s", missing.Status, missing.Raw)
+	}
+
+	preferences := h.do(http.MethodGet, "/api/notification/preferences?token="+url.QueryEscape(token), nil)
+	if preferences.Status != fiber.StatusOK || !preferences.Bool("success") {
+		t.Fatalf("preferences answered %d: %s", preferences.Status, preferences.Raw)
+	}
+	if result := h.do(http.MethodGet, "/api/notification/preferences", nil); result.Status != fiber.StatusUnauthorized {
+		t.Errorf("preferences without a token answered %d", result.Status)
+	}
+	if result := h.do(http.MethodPut, "/api/notification/preferences", fiber.Map{"token": token, "optOut": []string{"gossip"}}); result.Status != fiber.StatusBadRequest {
+		t.Errorf("opting out of an unknown category answered %d: %s", result.Status, result.Raw)
+	}
+
+	updated := h.do(http.MethodPut, "/api/notification/preferences", fiber.Map{
+		"token":  token,
+		"optOut": []string{notification.CategoryTransactional},
+	})
+	stored, _ := updated.Body["preferences"].(map[string]interface{})
+	if updated.Status != fiber.StatusOK || stored["customerId"] != userID {
+		t.Fatalf("preferences update answered %d: %s", updated.Status, updated.Raw)
+	}
+
+	suppressed := send()
+	if suppressed.Bool("success") || suppressed.String("status") != "SUPPRESSED" {
+		t.Errorf("template send after opting out answered %d: %s", suppressed.Status, suppressed.Raw)
+	}
+	if gatewayCalled("/v1/messages/sendInbox", "requestId", suppressed.String("requestId")) {
+		t.Errorf("gateway received suppressed message %s", suppressed.String("requestId"))
+	}
+	inbox := h.do(http.MethodPost, "/api/notification/send-inbox", fiber.Map{
+		"token":   token,
+		"title":   "Hello",
+		"content": "Your order has shipped",
+	})
+	if inbox.Bool("success") || inbox.String("status") != "SUPPRESSED" {
+		t.Errorf("send-inbox after opting out answered %d: %s", inbox.Status, inbox.Raw)
+	}
+	if gatewayCalled("/v1/messages/sendInbox", "requestId", inbox.String("requestId")) {
+		t.Errorf("gateway received suppressed inbox message %s", inbox.String("requestId"))
+	}
+
+	h.do(http.MethodPut, "/api/notification/preferences", fiber.Map{"token": token, "optOut": []string{}})
+	if resent := send(); !resent.Bool("success") {
+		t.Errorf("template send after opting back in answered %d: %s", resent.Status, resent.Raw)
+	}
+}
+
+func TestUploadThenDownload(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("upload-journey")
+	content := []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\ntrailer << /Root 1 0 R >>\n%%EOF\n")
+
+	uploaded := h.send(uploadRequest(t, token, "report.pdf", content))
+	fileID := uploaded.String("fileId")
+	if uploaded.Status != fiber.StatusOK || !uploaded.Bool("success") || fileID == "" {
+		t.Fatalf("upload answered %d: %s", uploaded.Status, uploaded.Raw)
+	}
+	if uploaded.String("fileType") != "PDF" {
+		t.Errorf("upload detected %q, want PDF", uploaded.String("fileType"))
+	}
+
+	// Uploads are quarantined until the scanner has looked at them
+	var download response
+	h.eventually(0, "the upload to be scanned", func() bool {
+		request := httptest.NewRequest(http.MethodGet, "/api/files/"+fileID, nil)
+		request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		download = h.send(request)
+		return download.Status == fiber.StatusOK
+	})
+	if !bytes.Equal(download.Raw, content) {
+		t.Errorf("downloaded %q, want %q", download.Raw, content)
+	}
+
+	meta := h.do(http.MethodGet, "/api/files/"+fileID+"/meta?token="+url.QueryEscape(token), nil)
+	if meta.Status != fiber.StatusOK || !meta.Bool("success") {
+		t.Errorf("file metadata answered %d: %s", meta.Status, meta.Raw)
+	}
+
+	// Files are private to their owner
+	otherToken, _ := h.login("upload-journey-other")
+	if result := h.do(http.MethodGet, "/api/files/"+fileID+"/meta?token="+url.QueryEscape(otherToken), nil); result.Status != fiber.StatusNotFound {
+		t.Errorf("another user's metadata lookup answered %d, want 404", result.Status)
+	}
+}
+
+func TestChunkedUploadThenCopiedByHash(t *testing.T) {
+	h := newHarness(t)
+	token, _ := h.login("chunked-upload-journey")
+	otherToken, _ := h.login("chunked-upload-journey-other")
+
+	const chunkSize = 64 * 1024
+	content := []byte("%PDF-1.4\n% chunked " + time.Now().String() + "\n")
+	content = append(content, bytes.Repeat([]byte("0 0 obj << >> endobj\n"), 4000)...)
+	content = append(content, []byte("trailer << >>\n%%EOF\n")...)
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	as := func(token string, request *http.Request) response {
+		request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		return h.send(request)
+	}
+	chunk := func(index int) []byte {
+		end := (index + 1) * chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		return content[index*chunkSize : end]
+	}
+	chunkSum := func(index int) string {
+		sum := sha256.Sum256(chunk(index))
+		return hex.EncodeToString(sum[:])
+	}
+	putChunk := func(uploadID string, index int, checksum string) response {
+		request := httptest.NewRequest(http.MethodPut, "/api/uploads/"+uploadID+"/chunks/"+strconv.Itoa(index), bytes.NewReader(chunk(index)))
+		request.Header.Set("X-Chunk-SHA256", checksum)
+		return as(token, request)
+	}
+
+	started := as(token, h.request(http.MethodPost, "/api/uploads", fiber.Map{
+		"fileName":  "large.pdf",
+		"size":      len(content),
+		"chunkSize": chunkSize,
+		"sha256":    hash,
+	}))
+	uploadID := started.String("uploadId")
+	if started.Status != fiber.StatusCreated || uploadID == "" || started.Body["totalChunks"] != float64(2) {
+		t.Fatalf("upload start answered %d: %s", started.Status, started.Raw)
+	}
+
+	if result := putChunk(uploadID, 0, chunkSum(1)); result.Status != fiber.StatusUnprocessableEntity {
+		t.Errorf("chunk with a wrong checksum answered %d: %s", result.Status, result.Raw)
+	}
+	if result := putChunk(uploadID, 0, chunkSum(0)); result.Status != fiber.StatusOK {
+		t.Fatalf("chunk 0 answered %d: %s", result.Status, result.Raw)
+	}
+
+	// An interrupted client learns which chunks are left, other users do not see the upload at all
+	progress := as(token, h.request(http.MethodGet, "/api/uploads/"+uploadID, nil))
+	if missing, _ := progress.Body["missing"].([]interface{}); len(missing) != 1 || missing[0] != float64(1) {
+		t.Errorf("upload progress answered %d: %s", progress.Status, progress.Raw)
+	}
+	if result := as(otherToken, h.request(http.MethodGet, "/api/uploads/"+uploadID, nil)); result.Status != fiber.StatusNotFound {
+		t.Errorf("another user's upload progress answered %d", result.Status)
+	}
+	if result := as(token, h.request(http.MethodPost, "/api/uploads/"+uploadID+"/complete", nil)); result.Status != fiber.StatusConflict {
+		t.Errorf("completing an incomplete upload answered %d: %s", result.Status, result.Raw)
+	}
+
+	if result := putChunk(uploadID, 1, chunkSum(1)); result.Status != fiber.StatusOK {
+		t.Fatalf("chunk 1 answered %d: %s", result.Status, result.Raw)
+	}
+	completed := as(token, h.request(http.MethodPost, "/api/uploads/"+uploadID+"/complete", nil))
+	fileID := completed.String("fileId")
+	if completed.Status != fiber.StatusOK || fileID == "" || completed.String("fileType") != "PDF" {
+		t.Fatalf("upload complete answered %d: %s", completed.Status, completed.Raw)
+	}
+	if result := as(token, h.request(http.MethodGet, "/api/uploads/"+uploadID, nil)); result.Status != fiber.StatusNotFound {
+		t.Errorf("completed upload is still open, answered %d", result.Status)
+	}
+
+	// Content the user already has is copied without sending it again
+	copied := as(token, h.request(http.MethodPost, "/api/files/by-hash/"+hash, fiber.Map{"fileName": "copy.pdf"}))
+	copyID := copied.String("fileId")
+	if copied.Status != fiber.StatusCreated || copyID == "" || copyID == fileID || copied.String("fileName") != "copy.pdf" {
+		t.Fatalf("copy by hash answered %d: %s", copied.Status, copied.Raw)
+	}
+	if result := as(otherToken, h.request(http.MethodPost, "/api/files/by-hash/"+hash, fiber.Map{})); result.Status != fiber.StatusNotFound {
+		t.Errorf("another user's copy by hash answered %d: %s", result.Status, result.Raw)
+	}
+
+	var download response
+	h.eventually(0, "the copy to be scanned", func() bool {
+		download = as(token, httptest.NewRequest(http.MethodGet, "/api/files/"+copyID, nil))
+		return download.Status == fiber.StatusOK
+	})
+	if !bytes.Equal(download.Raw, content) {
+		t.Errorf("downloaded copy has %d bytes, want %d", len(download.Raw), len(content))
+	}
+
+	abandoned := as(token, h.request(http.MethodPost, "/api/uploads", fiber.Map{
+		"fileName":  "abandoned.pdf",
+		"size":      len(content),
+		"chunkSize": chunkSize,
+	}))
+	abandonedID := abandoned.String("uploadId")
+	if result := as(token, h.request(http.MethodDelete, "/api/uploads/"+abandonedID, nil)); result.Status != fiber.StatusOK {
+		t.Errorf("upload cancel answered %d: %s", result.Status, result.Raw)
+	}
+	if result := as(token, h.request(http.MethodGet, "/api/uploads/"+abandonedID, nil)); result.Status != fiber.StatusNotFound {
+		t.Errorf("cancelled upload answered %d", result.Status)
+	}
+}
+
+// flakyScanner fails its first scans, then finds every file clean
+type flakyScanner struct {
+	mu       sync.Mutex
+	failures int
+	scans    int
+}
+
+func (s *flakyScanner) Name() string {
+	return "flaky"
+}
+
+func (s *flakyScanner) Scan(content io.Reader) (scanner.Result, error) {
+	io.Copy(io.Discard, content)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scans++
+	if s.failures > 0 {
+		s.failures--
+		return scanner.Result{}, errors.New("scanner unavailable")
+	}
+	return scanner.Result{Clean: true}, nil
+}
+
+func (s *flakyScanner) scanned() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans
+}
+
+func TestFailedScanIsRetriedOnTheClock(t *testing.T) {
+	flaky := &flakyScanner{failures: 2}
+	h := newHarnessWith(t, func(config *api.Config) {
+		config.Scanner = flaky
+	})
+	token, _ := h.login("scan-retry-journey")
+	content := []byte("%PDF-1.4\n% scan retry " + time.Now().String() + "\ntrailer << >>\n%%EOF\n")
+
+	uploaded := h.send(uploadRequest(t, token, "retry.pdf", content))
+	fileID := uploaded.String("fileId")
+	if uploaded.Status != fiber.StatusOK || fileID == "" {
+		t.Fatalf("upload answered %d: %s", uploaded.Status, uploaded.Raw)
+	}
+	download := func() int {
+		request := httptest.NewRequest(http.MethodGet, "/api/files/"+fileID, nil)
+		request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		return h.send(request).Status
+	}
+
+	h.eventually(0, "the first scan", func() bool {
+		return flaky.scanned() == 1
+	})
+	if status := download(); status != fiber.StatusLocked {
+		t.Errorf("download of a file that failed its scan answered %d, want 423", status)
+	}
+
+	// The first retry waits for 30 seconds of the clock
+	h.clock.Advance(29 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if scans := flaky.scanned(); scans != 1 {
+		t.Fatalf("scan retried before its delay, %d scans", scans)
+	}
+
+	h.eventually(time.Second, "the retried scans", func() bool {
+		return download() == fiber.StatusOK
+	})
+	if scans := flaky.scanned(); scans != 3 {
+		t.Errorf("expected three scans, got %d", scans)
+	}
+}
+
+func uploadRequest(t *testing.T, token, fileName string, content []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	request.Header.Set(fiber.HeaderContentType, form.FormDataContentType())
+	request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	return request
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"log"
+	"strings"
+	"superQiMiniAppBackend/events"
+	"sync"
+	"time"
+)
+
+// Merchant event types pushed to merchant sessions
+const (
+	MerchantEventPaymentStatus   = "payment.status"
+	MerchantEventEscrowCreated   = events.TypeEscrowCreated
+	MerchantEventEscrowAccepted  = events.TypeEscrowAccepted
+	MerchantEventEscrowConfirmed = events.TypeEscrowConfirmed
+	MerchantEventEscrowCancelled = events.TypeEscrowCancelled
+	MerchantEventEscrowVoided    = events.TypeEscrowVoided
+	MerchantEventRefundSucceeded = events.TypeRefundSucceeded
+	MerchantEventRefundFailed    = events.TypeRefundFailed
+)
+
+// MerchantEvent is a single order event delivered to merchant sessions
+type MerchantEvent struct {
+	Type      string      `json:"type"`
+	PaymentID string      `json:"paymentId,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// MerchantSubscriber is one connected merchant session
+type MerchantSubscriber struct {
+	merchantID string
+	events     chan MerchantEvent
+	mu         sync.RWMutex
+	filters    []string
+}
+
+// SetFilters replaces the event types the subscriber wants to receive.
+// A filter is either an exact type ("escrow.accepted") or a category ("escrow").
+// An empty filter list receives every event.
+func (s *MerchantSubscriber) SetFilters(filters []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filters = filters
+}
+
+func (s *MerchantSubscriber) accepts(eventType string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.filters) == 0 {
+		return true
+	}
+	for _, filter := range s.filters {
+		if filter == eventType || strings.HasPrefix(eventType, filter+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// MerchantEventHub fans out merchant events to every connected merchant session
+type MerchantEventHub struct {
+	mu          sync.RWMutex
+	subscribers map[*MerchantSubscriber]struct{}
+}
+
+func newMerchantEventHub() *MerchantEventHub {
+	return &MerchantEventHub{
+		subscribers: make(map[*MerchantSubscriber]struct{}),
+	}
+}
+
+// Subscribe registers a new session of a merchant, receiving the events of its own payments
+func (h *MerchantEventHub) Subscribe(merchantID string, filters []string) *MerchantSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscriber := &MerchantSubscriber{
+		merchantID: merchantID,
+		events:     make(chan MerchantEvent, 32),
+		filters:    filters,
+	}
+	h.subscribers[subscriber] = struct{}{}
+	log.Printf("[MerchantEvents] Session subscribed (%d active)", len(h.subscribers))
+	return subscriber
+}
+
+// Unsubscribe removes a merchant session
+func (h *MerchantEventHub) Unsubscribe(subscriber *MerchantSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, subscriber)
+	log.Printf("[MerchantEvents] Session unsubscribed (%d active)", len(h.subscribers))
+}
+
+// Publish sends an event of a payment that happened at now to the sessions of the merchant
+// owning it that are subscribed to its type
+func (h *MerchantEventHub) Publish(merchantID, eventType, paymentID string, data interface{}, now time.Time) {
+	event := MerchantEvent{
+		Type:      eventType,
+		PaymentID: paymentID,
+		Data:      data,
+		Timestamp: now,
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for subscriber := range h.subscribers {
+		if merchantID == "" || subscriber.merchantID != merchantID || !subscriber.accepts(eventType) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			log.Printf("[MerchantEvents] Session is not keeping up, dropping %s event", eventType)
+		}
+	}
+}
+
+// subscribeMerchantEvents forwards escrow and refund lifecycle events to merchant sessions.
+// Payment status changes come from the payment store, since they include intermediate states.
+func (s *Server) subscribeMerchantEvents() {
+	forwarded := []string{
+		events.TypeEscrowCreated,
+		events.TypeEscrowAccepted,
+		events.TypeEscrowConfirmed,
+		events.TypeEscrowCancelled,
+		events.TypeEscrowVoided,
+		events.TypeRefundSucceeded,
+		events.TypeRefundFailed,
+	}
+
+	for _, eventType := range forwarded {
+		s.events.Subscribe(eventType, func(event events.Event) {
+			paymentID := eventPaymentID(event)
+			s.merchantEvents.Publish(s.paymentMerchant(paymentID), event.Type(), paymentID, event, s.clock.Now())
+		})
+	}
+	s.payments.OnUpdate(func(status PaymentStatusInfo) {
+		s.merchantEvents.Publish(status.MerchantID, MerchantEventPaymentStatus, status.PaymentID, status, s.clock.Now())
+	})
+}
+
+// paymentMerchant returns the merchant owning a payment. Payments the server no longer
+// tracks were made to its own merchant as well.
+func (s *Server) paymentMerchant(paymentID string) string {
+	if status, exists := s.payments.Get(paymentID); exists && status.MerchantID != "" {
+		return status.MerchantID
+	}
+	return s.merchantID
+}
+
+func eventPaymentID(event events.Event) string {
+	switch e := event.(type) {
+	case events.EscrowCreated:
+		return e.PaymentID
+	case events.EscrowAccepted:
+		return e.PaymentID
+	case events.EscrowConfirmed:
+		return e.PaymentID
+	case events.EscrowCancelled:
+		return e.PaymentID
+	case events.EscrowVoided:
+		return e.PaymentID
+	case events.RefundSucceeded:
+		return e.PaymentID
+	case events.RefundFailed:
+		return e.PaymentID
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"superQiMiniAppBackend/jwe"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+const merchantEventsPingInterval = 30 * time.Second
+
+// Event types and categories a merchant session may subscribe to
+var merchantEventFilters = map[string]bool{
+	"payment":                    true,
+	"escrow":                     true,
+	"refund":                     true,
+	MerchantEventPaymentStatus:   true,
+	MerchantEventEscrowCreated:   true,
+	MerchantEventEscrowAccepted:  true,
+	MerchantEventEscrowConfirmed: true,
+	MerchantEventEscrowCancelled: true,
+	MerchantEventEscrowVoided:    true,
+	MerchantEventRefundSucceeded: true,
+	MerchantEventRefundFailed:    true,
+}
+
+// merchantEventsMessage is sent by the merchant console to change its subscription
+type merchantEventsMessage struct {
+	Action string   `json:"action"`
+	Events []string `json:"events"`
+}
+
+func (s *Server) registerMerchantEventsEndpoint(group fiber.Router) {
+	s.subscribeMerchantEvents()
+	if s.merchantID == "" {
+		s.logger.Println("[WARNING] MERCHANT_ID is not set, merchant sessions will receive no order events")
+	}
+
+	// GET /api/merchant/events?token=...&events=payment,escrow - WebSocket stream of order events
+	group.Get("/merchant/events", s.authenticateMerchantSession, websocket.New(s.handleMerchantEvents))
+}
+
+// authenticateMerchantSession validates the JWE token before the WebSocket upgrade.
+// Browsers cannot set headers on WebSocket requests, so the token is passed as a query parameter.
+func (s *Server) authenticateMerchantSession(ctx *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(ctx) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	token := ctx.Query("token")
+	if token == "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "Token is required")
+	}
+
+	claims, err := jwe.ParseAndValidateJWE(token)
+	if err != nil {
+		s.logger.Printf("[ERROR] Invalid merchant session token: %v\n", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+	}
+
+	// Only merchant tokens can inquire merchant info, which tells merchant sessions apart from users
+	merchantInfo, err := s.gateway.InquiryMerchantInfo(claims.AccessToken)
+	if err != nil {
+		s.logger.Printf("[ERROR] Merchant info inquiry failed: %v\n", err)
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if merchantInfo.Result.ResultStatus != "S" {
+		s.logger.Printf("[ERROR] Token of %s is not a merchant session: %s\n", claims.UserID, merchantInfo.Result.ResultMessage)
+		return fiber.NewError(fiber.StatusForbidden, "Merchant session required")
+	}
+
+	filters, err := parseMerchantEventFilters(strings.Split(ctx.Query("events"), ","))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	ctx.Locals("merchantId", merchantInfo.MerchantInfo.MerchantID)
+	ctx.Locals("eventFilters", filters)
+	return ctx.Next()
+}
+
+func (s *Server) handleMerchantEvents(conn *websocket.Conn) {
+	merchantID, _ := conn.Locals("merchantId").(string)
+	filters, _ := conn.Locals("eventFilters").([]string)
+
+	s.logger.Printf("[MerchantEvents] Merchant %s connected (filters: %v)", merchantID, filters)
+
+	subscriber := s.merchantEvents.Subscribe(merchantID, filters)
+	defer s.merchantEvents.Unsubscribe(subscriber)
+
+	// Fiber's WebSocket connections allow one concurrent writer, so replies from the
+	// reader goroutine are funneled through the writer loop below
+	replies := make(chan fiber.Map, 4)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	reply := func(message fiber.Map) {
+		select {
+		case replies <- message:
+		case <-done:
+		}
+	}
+
+	go func() {
+		defer close(closed)
+		for {
+			var message merchantEventsMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+
+			if message.Action != "subscribe" {
+				reply(fiber.Map{"type": "error", "message": "Unsupported action: " + message.Action})
+				continue
+			}
+
+			newFilters, err := parseMerchantEventFilters(message.Events)
+			if err != nil {
+				reply(fiber.Map{"type": "error", "message": err.Error()})
+				continue
+			}
+
+			subscriber.SetFilters(newFilters)
+			s.logger.Printf("[MerchantEvents] Merchant %s changed filters to %v", merchantID, newFilters)
+			reply(fiber.Map{"type": "subscribed", "events": newFilters})
+		}
+	}()
+
+	ping := time.NewTicker(merchantEventsPingInterval)
+	defer ping.Stop()
+
+	if err := conn.WriteJSON(fiber.Map{"type": "subscribed", "events": filters}); err != nil {
+		return
+	}
+
+	for {
+		var err error
+		select {
+		case event := <-subscriber.events:
+			err = conn.WriteJSON(event)
+		case message := <-replies:
+			err = conn.WriteJSON(message)
+		case <-ping.C:
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		case <-closed:
+			s.logger.Printf("[MerchantEvents] Merchant %s disconnected", merchantID)
+			return
+		}
+
+		if err != nil {
+			s.logger.Printf("[MerchantEvents] Failed to write to merchant %s: %v", merchantID, err)
+			return
+		}
+	}
+}
+
+func parseMerchantEventFilters(events []string) ([]string, error) {
+	filters := []string{}
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		if !merchantEventFilters[event] {
+			return nil, fmt.Errorf("unsupported event type: %s", event)
+		}
+		filters = append(filters, event)
+	}
+	return filters, nil
+}
@@ -2,14 +2,12 @@ package api
 
 import (
 	"encoding/json"
-	"log"
-	"superQiMiniAppBackend/alipay"
 	"superQiMiniAppBackend/jwe"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func InitMerchantInfoEndpoint(group fiber.Router) {
+func (s *Server) registerMerchantInfoEndpoint(group fiber.Router) {
 	group.Post("/merchant/info", func(ctx *fiber.Ctx) error {
 		var request map[string]string
 		if err := ctx.BodyParser(&request); err != nil {
@@ -21,35 +19,35 @@ func InitMerchantInfoEndpoint(group fiber.Router) {
 			return fiber.NewError(fiber.StatusBadRequest, "Token is required")
 		}
 
-		log.Println("=================================================================")
-		log.Println("INQUIRING MERCHANT INFO")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("INQUIRING MERCHANT INFO")
+		s.logger.Println("=================================================================")
 
 		// Decrypt the JWE token to get the access token
 		claims, err := jwe.ParseAndValidateJWE(token)
 		if err != nil {
-			log.Printf("[ERROR] Failed to decrypt JWE token: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to decrypt JWE token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
 		}
 
-		log.Printf("[INFO] Customer ID from token: %s\n", claims.UserID)
-		log.Printf("[INFO] Calling InquiryMerchantInfo API...\n")
+		s.logger.Printf("[INFO] Customer ID from token: %s\n", claims.UserID)
+		s.logger.Printf("[INFO] Calling InquiryMerchantInfo API...\n")
 
-		merchantInfo, err := alipay.Interface.InquiryMerchantInfo(claims.AccessToken)
+		merchantInfo, err := s.gateway.InquiryMerchantInfo(claims.AccessToken)
 		if err != nil {
-			log.Printf("[ERROR] Merchant info inquiry failed: %v\n", err)
+			s.logger.Printf("[ERROR] Merchant info inquiry failed: %v\n", err)
 			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 		}
 
 		merchantInfoJson, _ := json.MarshalIndent(merchantInfo, "", "  ")
-		log.Printf("[RESPONSE] Merchant info retrieved:\n%s\n\n", string(merchantInfoJson))
+		s.logger.Printf("[RESPONSE] Merchant info retrieved:\n%s\n\n", string(merchantInfoJson))
 
 		if merchantInfo.Result.ResultCode != "SUCCESS" {
-			log.Printf("[ERROR] Merchant info inquiry returned error: %s\n", merchantInfo.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Merchant info inquiry returned error: %s\n", merchantInfo.Result.ResultMessage)
 			return fiber.NewError(fiber.StatusBadRequest, "Failed to retrieve merchant info: "+merchantInfo.Result.ResultMessage)
 		}
 
-		log.Println("[SUCCESS] Merchant info retrieved successfully")
+		s.logger.Println("[SUCCESS] Merchant info retrieved successfully")
 		return ctx.JSON(merchantInfo)
 	})
 }
@@ -3,9 +3,11 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"strings"
 	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
 	"superQiMiniAppBackend/jwe"
+	"superQiMiniAppBackend/notification"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,52 +15,84 @@ import (
 )
 
 type sendInboxRequest struct {
-	Token   string `json:"token" validate:"required"`
-	Title   string `json:"title" validate:"required"`
-	Content string `json:"content" validate:"required"`
-	Url     string `json:"url,omitempty"`
+	Token    string `json:"token" validate:"required"`
+	Title    string `json:"title" validate:"required"`
+	Content  string `json:"content" validate:"required"`
+	Url      string `json:"url,omitempty"`
+	Category string `json:"category,omitempty"` // preference category, transactional by default
 }
 
+type sendTemplateNotificationRequest struct {
+	Token        string            `json:"token" validate:"required"`
+	TemplateCode string            `json:"templateCode" validate:"required"`
+	Language     string            `json:"language,omitempty"`
+	Parameters   map[string]string `json:"parameters"`
+}
+
+const (
+	commonInboxTemplate = "MINI_APP_COMMON_INBOX"
+	commonPushTemplate  = "MINI_APP_COMMON_PUSH"
+)
+
 type sendPushRequest struct {
-	Token   string `json:"token" validate:"required"`
-	Title   string `json:"title" validate:"required"`
-	Content string `json:"content" validate:"required"`
-	Url     string `json:"url,omitempty"`
+	Token    string `json:"token" validate:"required"`
+	Title    string `json:"title" validate:"required"`
+	Content  string `json:"content" validate:"required"`
+	Url      string `json:"url,omitempty"`
+	Category string `json:"category,omitempty"` // preference category, transactional by default
 }
 
-func InitNotificationEndpoint(group fiber.Router) {
+func (s *Server) registerNotificationEndpoint(group fiber.Router) {
+	s.subscribeReceipts()
+	s.startNotificationReconciler()
+
 	// POST /api/notification/send-inbox
 	group.Post("/notification/send-inbox", func(ctx *fiber.Ctx) error {
 		var request sendInboxRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("SEND INBOX NOTIFICATION REQUEST RECEIVED")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("SEND INBOX NOTIFICATION REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
 
 		claims, err := jwe.ParseAndValidateJWE(request.Token)
 		if err != nil {
-			log.Printf("[ERROR] Invalid token: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
 		}
 
-		log.Printf("[INFO] Sending notification for user ID: %s\n", claims.UserID)
-		log.Printf("[INFO] Title: %s\n", request.Title)
-		log.Printf("[INFO] Content: %s\n", request.Content)
+		s.logger.Printf("[INFO] Sending notification for user ID: %s\n", claims.UserID)
+		s.logger.Printf("[INFO] Title: %s\n", request.Title)
+		s.logger.Printf("[INFO] Content: %s\n", request.Content)
 
-		notificationResponse, err := sendInboxNotification(claims.AccessToken, request.Title, request.Content, request.Url)
+		if request.Category == "" {
+			request.Category = notification.CategoryTransactional
+		}
+		if decision := s.decideNotification(claims.UserID, request.Category, notification.ChannelInbox); decision.Action == notification.DecisionSuppress {
+			requestID := generateNotificationRequestID(s.clock.Now())
+			s.logger.Printf("[INFO] Notification %s suppressed: %s\n", requestID, decision.Reason)
+			return ctx.JSON(fiber.Map{
+				"success":   false,
+				"status":    deliveryOutcomeSuppressed,
+				"message":   decision.Reason,
+				"requestId": requestID,
+			})
+		}
+
+		notificationResponse, requestID, err := s.sendInboxNotification(claims.UserID, claims.AccessToken, request.Title, request.Content, request.Url)
 		if err != nil {
-			log.Printf("[ERROR] Failed to send notification: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to send notification: %v\n", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to send notification: "+err.Error())
 		}
 
 		response := buildNotificationResponse(notificationResponse)
+		response["requestId"] = requestID
 
-		log.Println("[SUCCESS] Returning notification response to frontend")
-		log.Println("=================================================================")
+		s.logger.Println("[SUCCESS] Returning notification response to frontend")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
 
@@ -66,101 +100,262 @@ func InitNotificationEndpoint(group fiber.Router) {
 	group.Post("/notification/send-push", func(ctx *fiber.Ctx) error {
 		var request sendPushRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("SEND PUSH NOTIFICATION REQUEST RECEIVED")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("SEND PUSH NOTIFICATION REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
 
 		claims, err := jwe.ParseAndValidateJWE(request.Token)
 		if err != nil {
-			log.Printf("[ERROR] Invalid token: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
 		}
 
-		log.Printf("[INFO] Sending push notification for user ID: %s\n", claims.UserID)
-		log.Printf("[INFO] Title: %s\n", request.Title)
-		log.Printf("[INFO] Content: %s\n", request.Content)
+		s.logger.Printf("[INFO] Sending push notification for user ID: %s\n", claims.UserID)
+		s.logger.Printf("[INFO] Title: %s\n", request.Title)
+		s.logger.Printf("[INFO] Content: %s\n", request.Content)
 
-		pushResponse, err := sendPushNotification(claims.AccessToken, request.Title, request.Content, request.Url)
+		if request.Category == "" {
+			request.Category = notification.CategoryTransactional
+		}
+
+		delivery, err := s.sendPushNotification(claims.UserID, claims.AccessToken, request.Category, request.Title, request.Content, request.Url)
 		if err != nil {
-			log.Printf("[ERROR] Failed to send push notification: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to send push notification: %v\n", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to send push notification: "+err.Error())
 		}
 
-		response := buildPushNotificationResponse(pushResponse)
+		response := buildPushDeliveryResponse(delivery)
 
-		log.Println("[SUCCESS] Returning push notification response to frontend")
-		log.Println("=================================================================")
+		s.logger.Println("[SUCCESS] Returning push notification response to frontend")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
-}
 
-func sendInboxNotification(accessToken, title, content, url string) (alipay.SendInboxResponse, error) {
-	log.Println("=================================================================")
-	log.Println("PROCESSING INBOX NOTIFICATION")
-	log.Println("=================================================================")
+	// GET /api/notification/templates
+	group.Get("/notification/templates", func(ctx *fiber.Ctx) error {
+		return ctx.JSON(fiber.Map{
+			"success":   true,
+			"templates": s.templates.List(),
+		})
+	})
+
+	// POST /api/notification/send - Send any registered template, channel is taken from the template
+	group.Post("/notification/send", func(ctx *fiber.Ctx) error {
+		var request sendTemplateNotificationRequest
+		if err := ctx.BodyParser(&request); err != nil {
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+		}
 
-	requestID := generateNotificationRequestID()
-	log.Printf("[INFO] Generated Request ID: %s\n", requestID)
+		s.logger.Println("=================================================================")
+		s.logger.Println("SEND TEMPLATE NOTIFICATION REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
 
-	if url == "" {
-		url = "mini://platformapi/startapp?_ariver_appid=888888"
-	}
+		claims, err := jwe.ParseAndValidateJWE(request.Token)
+		if err != nil {
+			s.logger.Printf("[ERROR] Invalid token: %v\n", err)
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+		}
+
+		s.logger.Printf("[INFO] Sending template %s (%s) for user ID: %s\n", request.TemplateCode, request.Language, claims.UserID)
+
+		rendered, err := s.templates.Render(request.TemplateCode, request.Language, request.Parameters)
+		if err != nil {
+			s.logger.Printf("[ERROR] Template validation failed: %v\n", err)
+			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success":       false,
+				"resultStatus":  "F",
+				"resultMessage": err.Error(),
+			})
+		}
+
+		requestID := generateNotificationRequestID(s.clock.Now())
+		s.logger.Printf("[INFO] Generated Request ID: %s\n", requestID)
+
+		if rendered.Channel == notification.ChannelInbox {
+			if decision := s.decideNotification(claims.UserID, rendered.Category, rendered.Channel); decision.Action == notification.DecisionSuppress {
+				s.logger.Printf("[INFO] Notification %s suppressed: %s\n", requestID, decision.Reason)
+				return ctx.JSON(fiber.Map{
+					"success":   false,
+					"status":    deliveryOutcomeSuppressed,
+					"message":   decision.Reason,
+					"requestId": requestID,
+				})
+			}
+		}
+
+		var response fiber.Map
+		switch rendered.Channel {
+		case notification.ChannelPush:
+			delivery, err := s.deliverPush(claims.UserID, rendered.Category, alipay.SendPushRequest{
+				AccessToken:  claims.AccessToken,
+				RequestID:    requestID,
+				TemplateCode: rendered.Code,
+				Templates: []alipay.PushTemplate{
+					{
+						TemplateParameters: rendered.Parameters,
+					},
+				},
+			}, nil)
+			if err != nil {
+				s.logger.Printf("[ERROR] Failed to send push notification: %v\n", err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to send push notification: "+err.Error())
+			}
+			response = buildPushDeliveryResponse(delivery)
+
+		default:
+			inboxResponse, err := s.sendInbox(claims.UserID, alipay.SendInboxRequest{
+				AccessToken:  claims.AccessToken,
+				RequestID:    requestID,
+				TemplateCode: rendered.Code,
+				Templates: []alipay.InboxTemplate{
+					{
+						TemplateParameters: rendered.Parameters,
+					},
+				},
+			})
+			if err != nil {
+				s.logger.Printf("[ERROR] Failed to send notification: %v\n", err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to send notification: "+err.Error())
+			}
+			response = buildNotificationResponse(inboxResponse)
+		}
+
+		if _, exists := response["requestId"]; !exists {
+			response["requestId"] = requestID
+		}
+		response["channel"] = rendered.Channel
+		response["templateCode"] = rendered.Code
+
+		s.logger.Println("[SUCCESS] Returning template notification response to frontend")
+		s.logger.Println("=================================================================")
+		return ctx.JSON(response)
+	})
 
-	templateParams := map[string]string{
+	// GET /api/notification/preferences?token=...
+	group.Get("/notification/preferences", s.handleGetNotificationPreferences)
+
+	// PUT /api/notification/preferences
+	group.Put("/notification/preferences", s.handleUpdateNotificationPreferences)
+
+	// GET /api/notification/:requestId?token=... - Logged status of an inbox or push message
+	// of the user of the token, given as a Bearer token or in the query
+	group.Get("/notification/:requestId", func(ctx *fiber.Ctx) error {
+		requestID := ctx.Params("requestId")
+
+		token := strings.TrimPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+		if token == "" {
+			token = ctx.Query("token")
+		}
+		claims, err := jwe.ParseAndValidateJWE(token)
+		if err != nil {
+			s.logger.Printf("[ERROR] Invalid token: %v\n", err)
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+		}
+
+		if s.sendLog == nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, "Notification send log is not enabled")
+		}
+
+		// Messages of other users are reported as missing
+		record, exists := s.sendLog.Get(requestID)
+		if !exists || record.RecipientID != claims.UserID {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Notification not found",
+			})
+		}
+
+		return ctx.JSON(fiber.Map{
+			"success":      true,
+			"notification": record,
+		})
+	})
+}
+
+func (s *Server) sendInboxNotification(userID, accessToken, title, content, url string) (alipay.SendInboxResponse, string, error) {
+	s.logger.Println("=================================================================")
+	s.logger.Println("PROCESSING INBOX NOTIFICATION")
+	s.logger.Println("=================================================================")
+
+	requestID := generateNotificationRequestID(s.clock.Now())
+	s.logger.Printf("[INFO] Generated Request ID: %s\n", requestID)
+
+	rendered, err := s.templates.Render(commonInboxTemplate, "", map[string]string{
 		"Title":   title,
 		"Content": content,
 		"Url":     url,
+	})
+	if err != nil {
+		return alipay.SendInboxResponse{}, requestID, err
 	}
 
 	notificationRequest := alipay.SendInboxRequest{
 		AccessToken:  accessToken,
 		RequestID:    requestID,
-		TemplateCode: "MINI_APP_COMMON_INBOX",
+		TemplateCode: rendered.Code,
 		Templates: []alipay.InboxTemplate{
 			{
-				TemplateParameters: templateParams,
+				TemplateParameters: rendered.Parameters,
 			},
 		},
 	}
 
+	notificationResponse, err := s.sendInbox(userID, notificationRequest)
+	return notificationResponse, requestID, err
+}
+
+// sendInbox calls the SendInbox API, logs the attempt and announces the outcome on the event bus.
+// Sending again with the same request ID is idempotent on the wallet side.
+func (s *Server) sendInbox(recipientID string, notificationRequest alipay.SendInboxRequest) (alipay.SendInboxResponse, error) {
 	requestJSON, _ := json.MarshalIndent(notificationRequest, "", "  ")
-	log.Printf("[INFO] Notification request details:\n%s\n\n", string(requestJSON))
+	s.logger.Printf("[INFO] Notification request details:\n%s\n\n", string(requestJSON))
 
-	log.Println("[INFO] Calling Alipay SendInbox API...")
-	notificationResponse, err := alipay.Interface.SendInbox(notificationRequest)
+	s.logger.Println("[INFO] Calling Alipay SendInbox API...")
+	notificationResponse, err := s.gateway.SendInbox(notificationRequest)
 	if err != nil {
-		log.Printf("[ERROR] SendInbox API call failed: %v\n", err)
+		s.logger.Printf("[ERROR] SendInbox API call failed: %v\n", err)
+		// The wallet may still have received the request, reconcile it like a "U" result
+		s.recordNotificationAttempt(notification.ChannelInbox, recipientID, notificationRequest.AccessToken,
+			notificationRequest.RequestID, notificationRequest.TemplateCode, inboxParameters(notificationRequest),
+			alipay.Result{ResultStatus: "U", ResultMessage: err.Error()}, "")
 		return alipay.SendInboxResponse{}, fmt.Errorf("SendInbox API call failed: %v", err)
 	}
 
 	responseJSON, _ := json.MarshalIndent(notificationResponse, "", "  ")
-	log.Printf("[SUCCESS] SendInbox API response:\n%s\n\n", string(responseJSON))
+	s.logger.Printf("[SUCCESS] SendInbox API response:\n%s\n\n", string(responseJSON))
 
 	switch notificationResponse.Result.ResultStatus {
 	case "S":
-		log.Println("[SUCCESS] Notification sent successfully")
+		s.logger.Println("[SUCCESS] Notification sent successfully")
 		if notificationResponse.MessageID != "" {
-			log.Printf("[INFO] Message ID: %s\n", notificationResponse.MessageID)
+			s.logger.Printf("[INFO] Message ID: %s\n", notificationResponse.MessageID)
 		}
 
 	case "A":
-		log.Println("[SUCCESS] Notification accepted by wallet")
+		s.logger.Println("[SUCCESS] Notification accepted by wallet")
 
 	case "U":
-		log.Println("[WARNING] Notification status unknown")
+		s.logger.Println("[WARNING] Notification status unknown")
 
 	case "F":
-		log.Printf("[ERROR] Notification failed: %s\n", notificationResponse.Result.ResultMessage)
-		log.Printf("[ERROR] Error Code: %s\n", notificationResponse.Result.ResultCode)
+		s.logger.Printf("[ERROR] Notification failed: %s\n", notificationResponse.Result.ResultMessage)
+		s.logger.Printf("[ERROR] Error Code: %s\n", notificationResponse.Result.ResultCode)
 	}
 
-	log.Println("=================================================================")
-	log.Println("NOTIFICATION PROCESSING COMPLETED")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("NOTIFICATION PROCESSING COMPLETED")
+	s.logger.Println("=================================================================")
+
+	s.recordNotificationAttempt(notification.ChannelInbox, recipientID, notificationRequest.AccessToken,
+		notificationRequest.RequestID, notificationRequest.TemplateCode, inboxParameters(notificationRequest),
+		notificationResponse.Result, notificationResponse.MessageID)
+	s.publishNotificationOutcome(notification.ChannelInbox, notificationRequest.RequestID, notificationRequest.TemplateCode,
+		notificationResponse.Result, notificationResponse.MessageID)
 
 	return notificationResponse, nil
 }
@@ -197,69 +392,88 @@ func buildNotificationResponse(notificationResponse alipay.SendInboxResponse) fi
 	return response
 }
 
-func sendPushNotification(accessToken, title, content, url string) (alipay.SendPushResponse, error) {
-	log.Println("=================================================================")
-	log.Println("PROCESSING PUSH NOTIFICATION")
-	log.Println("=================================================================")
+// sendPushNotification sends a push through the common template, honouring the user's
+// opt-outs and quiet hours for the category
+func (s *Server) sendPushNotification(userID, accessToken, category, title, content, url string) (pushDelivery, error) {
+	s.logger.Println("=================================================================")
+	s.logger.Println("PROCESSING PUSH NOTIFICATION")
+	s.logger.Println("=================================================================")
 
-	requestID := generateNotificationRequestID()
-	log.Printf("[INFO] Generated Request ID: %s\n", requestID)
+	requestID := generateNotificationRequestID(s.clock.Now())
+	s.logger.Printf("[INFO] Generated Request ID: %s\n", requestID)
 
-	if url == "" {
-		url = "mini://platformapi/startapp?_ariver_appid=888888"
-	}
-
-	templateParams := map[string]string{
+	rendered, err := s.templates.Render(commonPushTemplate, "", map[string]string{
 		"Title":   title,
 		"Content": content,
 		"Url":     url,
+	})
+	if err != nil {
+		return pushDelivery{RequestID: requestID}, err
 	}
 
 	pushRequest := alipay.SendPushRequest{
 		AccessToken:  accessToken,
 		RequestID:    requestID,
-		TemplateCode: "MINI_APP_COMMON_PUSH",
+		TemplateCode: rendered.Code,
 		Templates: []alipay.PushTemplate{
 			{
-				TemplateParameters: templateParams,
+				TemplateParameters: rendered.Parameters,
 			},
 		},
 	}
 
+	return s.deliverPush(userID, category, pushRequest, func() (alipay.SendInboxResponse, string, error) {
+		return s.sendInboxNotification(userID, accessToken, title, content, url)
+	})
+}
+
+// sendPush calls the SendPush API, logs the attempt and announces the outcome on the event bus.
+// Sending again with the same request ID is idempotent on the wallet side.
+func (s *Server) sendPush(recipientID string, pushRequest alipay.SendPushRequest) (alipay.SendPushResponse, error) {
 	requestJSON, _ := json.MarshalIndent(pushRequest, "", "  ")
-	log.Printf("[INFO] Push notification request details:\n%s\n\n", string(requestJSON))
+	s.logger.Printf("[INFO] Push notification request details:\n%s\n\n", string(requestJSON))
 
-	log.Println("[INFO] Calling Alipay SendPush API...")
-	pushResponse, err := alipay.Interface.SendPush(pushRequest)
+	s.logger.Println("[INFO] Calling Alipay SendPush API...")
+	pushResponse, err := s.gateway.SendPush(pushRequest)
 	if err != nil {
-		log.Printf("[ERROR] SendPush API call failed: %v\n", err)
+		s.logger.Printf("[ERROR] SendPush API call failed: %v\n", err)
+		// The wallet may still have received the request, reconcile it like a "U" result
+		s.recordNotificationAttempt(notification.ChannelPush, recipientID, pushRequest.AccessToken,
+			pushRequest.RequestID, pushRequest.TemplateCode, pushParameters(pushRequest),
+			alipay.Result{ResultStatus: "U", ResultMessage: err.Error()}, "")
 		return alipay.SendPushResponse{}, fmt.Errorf("SendPush API call failed: %v", err)
 	}
 
 	responseJSON, _ := json.MarshalIndent(pushResponse, "", "  ")
-	log.Printf("[SUCCESS] SendPush API response:\n%s\n\n", string(responseJSON))
+	s.logger.Printf("[SUCCESS] SendPush API response:\n%s\n\n", string(responseJSON))
 
 	switch pushResponse.Result.ResultStatus {
 	case "S":
-		log.Println("[SUCCESS] Push notification sent successfully")
+		s.logger.Println("[SUCCESS] Push notification sent successfully")
 		if pushResponse.MessageID != "" {
-			log.Printf("[INFO] Message ID: %s\n", pushResponse.MessageID)
+			s.logger.Printf("[INFO] Message ID: %s\n", pushResponse.MessageID)
 		}
 
 	case "A":
-		log.Println("[SUCCESS] Push notification accepted by wallet")
+		s.logger.Println("[SUCCESS] Push notification accepted by wallet")
 
 	case "U":
-		log.Println("[WARNING] Push notification status unknown")
+		s.logger.Println("[WARNING] Push notification status unknown")
 
 	case "F":
-		log.Printf("[ERROR] Push notification failed: %s\n", pushResponse.Result.ResultMessage)
-		log.Printf("[ERROR] Error Code: %s\n", pushResponse.Result.ResultCode)
+		s.logger.Printf("[ERROR] Push notification failed: %s\n", pushResponse.Result.ResultMessage)
+		s.logger.Printf("[ERROR] Error Code: %s\n", pushResponse.Result.ResultCode)
 	}
 
-	log.Println("=================================================================")
-	log.Println("PUSH NOTIFICATION PROCESSING COMPLETED")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("PUSH NOTIFICATION PROCESSING COMPLETED")
+	s.logger.Println("=================================================================")
+
+	s.recordNotificationAttempt(notification.ChannelPush, recipientID, pushRequest.AccessToken,
+		pushRequest.RequestID, pushRequest.TemplateCode, pushParameters(pushRequest),
+		pushResponse.Result, pushResponse.MessageID)
+	s.publishNotificationOutcome(notification.ChannelPush, pushRequest.RequestID, pushRequest.TemplateCode,
+		pushResponse.Result, pushResponse.MessageID)
 
 	return pushResponse, nil
 }
@@ -296,6 +510,29 @@ func buildPushNotificationResponse(pushResponse alipay.SendPushResponse) fiber.M
 	return response
 }
 
-func generateNotificationRequestID() string {
-	return fmt.Sprintf("NOTIF-%s-%d", uuid.New().String(), time.Now().Unix())
+// publishNotificationOutcome announces the result of an inbox or push message on the event bus
+func (s *Server) publishNotificationOutcome(channel, requestID, templateCode string, result alipay.Result, messageID string) {
+	switch result.ResultStatus {
+	case "S", "A":
+		s.events.Publish(events.NotificationSent{
+			Channel:      channel,
+			RequestID:    requestID,
+			TemplateCode: templateCode,
+			MessageID:    messageID,
+			ResultStatus: result.ResultStatus,
+		})
+	default:
+		s.events.Publish(events.NotificationFailed{
+			Channel:      channel,
+			RequestID:    requestID,
+			TemplateCode: templateCode,
+			ResultStatus: result.ResultStatus,
+			ResultCode:   result.ResultCode,
+			Reason:       result.ResultMessage,
+		})
+	}
+}
+
+func generateNotificationRequestID(now time.Time) string {
+	return fmt.Sprintf("NOTIF-%s-%d", uuid.New().String(), now.Unix())
 }
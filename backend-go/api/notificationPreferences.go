@@ -0,0 +1,175 @@
+package api
+
+import (
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/jwe"
+	"superQiMiniAppBackend/notification"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Delivery outcomes after preferences are applied
+const (
+	deliveryOutcomeSent       = "SENT"
+	deliveryOutcomeDowngraded = "DOWNGRADED"
+	deliveryOutcomeDeferred   = "DEFERRED"
+	deliveryOutcomeSuppressed = "SUPPRESSED"
+)
+
+type updateNotificationPreferencesRequest struct {
+	Token      string                   `json:"token" validate:"required"`
+	OptOut     []string                 `json:"optOut"`
+	QuietHours *notification.QuietHours `json:"quietHours,omitempty"`
+}
+
+// pushDelivery is what happened to a push once the user's preferences were applied
+type pushDelivery struct {
+	Outcome       string
+	RequestID     string
+	Response      alipay.SendPushResponse
+	DeferredUntil time.Time
+	Reason        string
+}
+
+// GET /api/notification/preferences?token=...
+func (s *Server) handleGetNotificationPreferences(ctx *fiber.Ctx) error {
+	claims, err := jwe.ParseAndValidateJWE(ctx.Query("token"))
+	if err != nil {
+		s.logger.Printf("[ERROR] Invalid token: %v\n", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+	}
+
+	if s.preferences == nil {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "Notification preferences are not enabled")
+	}
+
+	return ctx.JSON(fiber.Map{
+		"success":     true,
+		"categories":  notification.Categories,
+		"preferences": s.preferences.Get(claims.UserID),
+	})
+}
+
+// PUT /api/notification/preferences
+func (s *Server) handleUpdateNotificationPreferences(ctx *fiber.Ctx) error {
+	var request updateNotificationPreferencesRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+
+	claims, err := jwe.ParseAndValidateJWE(request.Token)
+	if err != nil {
+		s.logger.Printf("[ERROR] Invalid token: %v\n", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
+	}
+
+	if s.preferences == nil {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "Notification preferences are not enabled")
+	}
+
+	s.logger.Printf("[INFO] Updating notification preferences for user ID: %s\n", claims.UserID)
+
+	preferences, err := s.preferences.Set(notification.Preferences{
+		CustomerID: claims.UserID,
+		OptOut:     request.OptOut,
+		QuietHours: request.QuietHours,
+	}, s.clock.Now())
+	if err != nil {
+		s.logger.Printf("[ERROR] Invalid notification preferences: %v\n", err)
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	return ctx.JSON(fiber.Map{
+		"success":     true,
+		"preferences": preferences,
+	})
+}
+
+// decideNotification applies the recipient's preferences, sending everything when none are loaded
+func (s *Server) decideNotification(customerID, category, channel string) notification.Decision {
+	if s.preferences == nil {
+		return notification.Decision{Action: notification.DecisionSend}
+	}
+	return s.preferences.Decide(customerID, category, channel, s.clock.Now())
+}
+
+// deliverPush sends a push unless the user opted out of its category. During quiet hours it
+// goes to the inbox through downgrade, or is held until they end when there is no inbox fallback.
+func (s *Server) deliverPush(userID, category string, pushRequest alipay.SendPushRequest,
+	downgrade func() (alipay.SendInboxResponse, string, error)) (pushDelivery, error) {
+	decision := s.decideNotification(userID, category, notification.ChannelPush)
+
+	switch decision.Action {
+	case notification.DecisionSuppress:
+		s.logger.Printf("[INFO] Push %s suppressed: %s\n", pushRequest.RequestID, decision.Reason)
+		return pushDelivery{Outcome: deliveryOutcomeSuppressed, RequestID: pushRequest.RequestID, Reason: decision.Reason}, nil
+
+	case notification.DecisionDowngrade:
+		if downgrade != nil {
+			s.logger.Printf("[INFO] Quiet hours for user %s, sending push %s to the inbox instead\n", userID, pushRequest.RequestID)
+			inboxResponse, requestID, err := downgrade()
+			return pushDelivery{
+				Outcome:   deliveryOutcomeDowngraded,
+				RequestID: requestID,
+				Response:  alipay.SendPushResponse(inboxResponse),
+				Reason:    decision.Reason,
+			}, err
+		}
+		fallthrough
+
+	case notification.DecisionDefer:
+		s.deferPush(userID, pushRequest, decision.Until)
+		return pushDelivery{
+			Outcome:       deliveryOutcomeDeferred,
+			RequestID:     pushRequest.RequestID,
+			DeferredUntil: decision.Until,
+			Reason:        decision.Reason,
+		}, nil
+	}
+
+	pushResponse, err := s.sendPush(userID, pushRequest)
+	return pushDelivery{Outcome: deliveryOutcomeSent, RequestID: pushRequest.RequestID, Response: pushResponse}, err
+}
+
+// deferPush sends a push once quiet hours are over. Deferred pushes are kept in memory only.
+func (s *Server) deferPush(userID string, pushRequest alipay.SendPushRequest, until time.Time) {
+	s.logger.Printf("[INFO] Quiet hours for user %s, deferring push %s until %s\n",
+		userID, pushRequest.RequestID, until.Format(time.RFC3339))
+
+	go func() {
+		<-s.clock.After(until.Sub(s.clock.Now()))
+		s.logger.Printf("[INFO] Sending deferred push %s\n", pushRequest.RequestID)
+		if _, err := s.sendPush(userID, pushRequest); err != nil {
+			s.logger.Printf("[ERROR] Deferred push %s failed: %v\n", pushRequest.RequestID, err)
+		}
+	}()
+}
+
+func buildPushDeliveryResponse(delivery pushDelivery) fiber.Map {
+	var response fiber.Map
+	switch delivery.Outcome {
+	case deliveryOutcomeSuppressed:
+		response = fiber.Map{
+			"success": false,
+			"status":  deliveryOutcomeSuppressed,
+			"message": delivery.Reason,
+		}
+
+	case deliveryOutcomeDeferred:
+		response = fiber.Map{
+			"success":       true,
+			"status":        deliveryOutcomeDeferred,
+			"deferredUntil": delivery.DeferredUntil,
+			"message":       delivery.Reason,
+		}
+
+	default:
+		response = buildPushNotificationResponse(delivery.Response)
+	}
+
+	response["delivery"] = delivery.Outcome
+	response["requestId"] = delivery.RequestID
+	return response
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/notification"
+	"time"
+)
+
+const notificationReconcileInterval = 10 * time.Second
+
+// recordNotificationAttempt adds a gateway call to the send log
+func (s *Server) recordNotificationAttempt(channel, recipientID, accessToken, requestID, templateCode string,
+	parameters map[string]string, result alipay.Result, messageID string) {
+	if s.sendLog == nil {
+		return
+	}
+
+	record := s.sendLog.Record(notification.SendAttempt{
+		RequestID:     requestID,
+		Channel:       channel,
+		TemplateCode:  templateCode,
+		Parameters:    parameters,
+		RecipientID:   recipientID,
+		AccessToken:   accessToken,
+		ResultStatus:  result.ResultStatus,
+		ResultCode:    result.ResultCode,
+		ResultMessage: result.ResultMessage,
+		MessageID:     messageID,
+	}, s.clock.Now())
+
+	if record.Status == notification.SendStatusUnknown {
+		s.logger.Printf("[INFO] %s result unknown, re-sending at %s\n", requestID, record.NextReconcileAt.Format(time.RFC3339))
+	}
+}
+
+// startNotificationReconciler periodically re-sends "U" results with their original request ID,
+// until the server is closed. Servers sharing a send log leave it to the first one.
+func (s *Server) startNotificationReconciler() {
+	if s.sendLog == nil {
+		s.logger.Println("[WARNING] Notification send log not initialized, unknown results will not be reconciled")
+		return
+	}
+	if !s.sendLog.AttachReconciler() {
+		s.logger.Println("[INFO] Notification send log is reconciled by another server")
+		return
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		defer s.sendLog.DetachReconciler()
+		for {
+			select {
+			case <-s.clock.After(notificationReconcileInterval):
+				s.reconcileNotifications()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) reconcileNotifications() {
+	due, tokens := s.sendLog.DueForReconcile(s.clock.Now())
+	for _, record := range due {
+		s.logger.Printf("[INFO] Reconciling %s %s (attempt %d)\n", record.Channel, record.RequestID, record.Attempts+1)
+
+		var err error
+		switch record.Channel {
+		case notification.ChannelPush:
+			_, err = s.sendPush(record.RecipientID, alipay.SendPushRequest{
+				AccessToken:  tokens[record.RequestID],
+				RequestID:    record.RequestID,
+				TemplateCode: record.TemplateCode,
+				Templates: []alipay.PushTemplate{
+					{
+						TemplateParameters: record.Parameters,
+					},
+				},
+			})
+		default:
+			_, err = s.sendInbox(record.RecipientID, alipay.SendInboxRequest{
+				AccessToken:  tokens[record.RequestID],
+				RequestID:    record.RequestID,
+				TemplateCode: record.TemplateCode,
+				Templates: []alipay.InboxTemplate{
+					{
+						TemplateParameters: record.Parameters,
+					},
+				},
+			})
+		}
+		if err != nil {
+			s.logger.Printf("[ERROR] Reconciling %s failed: %v\n", record.RequestID, err)
+		}
+	}
+}
+
+func inboxParameters(request alipay.SendInboxRequest) map[string]string {
+	if len(request.Templates) == 0 {
+		return nil
+	}
+	return request.Templates[0].TemplateParameters
+}
+
+func pushParameters(request alipay.SendPushRequest) map[string]string {
+	if len(request.Templates) == 0 {
+		return nil
+	}
+	return request.Templates[0].TemplateParameters
+}
@@ -1,11 +1,11 @@
 package api
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
 	"superQiMiniAppBackend/jwe"
 	"time"
 
@@ -13,33 +13,37 @@ import (
 	"github.com/google/uuid"
 )
 
+const sseKeepAliveInterval = 15 * time.Second
+
 type createPaymentRequest struct {
 	Token string `json:"token" validate:"required"`
 }
 
-func InitPaymentEndpoint(group fiber.Router) {
+func (s *Server) registerPaymentEndpoint(group fiber.Router) {
+	s.subscribePaymentPolling()
+
 	group.Post("/payment/create", func(ctx *fiber.Ctx) error {
 		var request createPaymentRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("PAYMENT CREATION REQUEST RECEIVED")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("PAYMENT CREATION REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
 
 		claims, err := jwe.ParseAndValidateJWE(request.Token)
 		if err != nil {
-			log.Printf("[ERROR] Invalid token: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token: "+err.Error())
 		}
 
-		log.Printf("[INFO] Creating payment for user ID: %s\n", claims.UserID)
+		s.logger.Printf("[INFO] Creating payment for user ID: %s\n", claims.UserID)
 
-		paymentResponse, err := createTestPayment(claims.UserID)
+		paymentRequest, paymentResponse, err := s.createTestPayment(claims.UserID)
 		if err != nil {
-			log.Printf("[ERROR] Failed to create payment: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to create payment: %v\n", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to create payment: "+err.Error())
 		}
 
@@ -51,20 +55,27 @@ func InitPaymentEndpoint(group fiber.Router) {
 		if paymentResponse.GetRedirectURL() != "" {
 			response["paymentUrl"] = paymentResponse.GetRedirectURL()
 			response["paymentId"] = paymentResponse.PaymentID
-			log.Printf("[INFO] Sending payment URL to frontend: %s\n", paymentResponse.GetRedirectURL())
+			s.logger.Printf("[INFO] Sending payment URL to frontend: %s\n", paymentResponse.GetRedirectURL())
 
-			// Start background polling for payment status
+			// Announce the payment, background polling picks it up from the event bus
 			if paymentResponse.PaymentID != "" {
-				log.Printf("[INFO] Starting background polling for payment: %s\n", paymentResponse.PaymentID)
-				StartPaymentPolling(paymentResponse.PaymentID, paymentResponse.PaymentRequestID)
+				s.events.Publish(events.PaymentCreated{
+					PaymentID:        paymentResponse.PaymentID,
+					PaymentRequestID: paymentResponse.PaymentRequestID,
+					UserID:           claims.UserID,
+					AccessToken:      claims.AccessToken,
+					ProductCode:      paymentRequest.ProductCode,
+					Amount:           paymentRequest.PaymentAmount,
+					OrderDescription: paymentRequest.Order.OrderDescription,
+				})
 			}
 		} else {
-			log.Println("[WARNING] No payment URL in response")
+			s.logger.Println("[WARNING] No payment URL in response")
 			response["success"] = false
 			response["error"] = "No redirect URL received from payment API"
 		}
 
-		log.Println("[SUCCESS] Returning payment response to frontend")
+		s.logger.Println("[SUCCESS] Returning payment response to frontend")
 		return ctx.JSON(response)
 	})
 
@@ -72,58 +83,131 @@ func InitPaymentEndpoint(group fiber.Router) {
 	group.Get("/payment/status/:paymentId", func(ctx *fiber.Ctx) error {
 		paymentId := ctx.Params("paymentId")
 
-		log.Printf("[INFO] Status check request for payment: %s\n", paymentId)
+		s.logger.Printf("[INFO] Status check request for payment: %s\n", paymentId)
 
 		// Get status from store
-		status, exists := paymentStore.Get(paymentId)
+		status, exists := s.payments.Get(paymentId)
 		if !exists {
-			log.Printf("[WARNING] Payment %s not found in cache\n", paymentId)
+			s.logger.Printf("[WARNING] Payment %s not found in cache\n", paymentId)
 			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"success": false,
 				"message": "Payment not found in cache. It may be too old or was never tracked.",
 			})
 		}
 
-		log.Printf("[INFO] Payment %s status: %s (completed: %v)\n", paymentId, status.Status, status.Completed)
-
-		return ctx.JSON(fiber.Map{
-			"success":          true,
-			"paymentId":        status.PaymentID,
-			"paymentRequestId": status.PaymentRequestID,
-			"status":           status.Status,
-			"paymentStatus":    status.PaymentStatus,
-			"completed":        status.Completed,
-			"message":          status.Message,
-			"lastChecked":      status.LastChecked,
-		})
+		s.logger.Printf("[INFO] Payment %s status: %s (completed: %v)\n", paymentId, status.Status, status.Completed)
+
+		return ctx.JSON(buildPaymentStatusResponse(*status))
 	})
+
+	// GET /api/payment/status/:paymentId/stream - Stream payment status changes as Server-Sent Events
+	group.Get("/payment/status/:paymentId/stream", s.handlePaymentStatusStream)
 }
 
-func createTestPayment(userID string) (alipay.PaymentResponse, error) {
-	log.Println("=================================================================")
-	log.Printf("CREATING TEST PAYMENT FOR USER: %s\n", userID)
-	log.Println("=================================================================")
+func (s *Server) handlePaymentStatusStream(ctx *fiber.Ctx) error {
+	paymentId := ctx.Params("paymentId")
 
-	paymentRequestID := fmt.Sprintf("PAY-%s-%d", uuid.New().String(), time.Now().Unix())
+	s.logger.Printf("[INFO] Status stream request for payment: %s\n", paymentId)
 
-	expiryTime := time.Now().Add(30 * time.Minute).Format("2006-01-02T15:04:05-07:00")
+	// Subscribe before reading the current status so no update is missed in between
+	updates, unsubscribe := s.payments.Subscribe(paymentId)
 
-	baseURL := os.Getenv("BASE_URL")
-	if baseURL == "" {
-		baseURL = "http://localhost:1999"
+	status, exists := s.payments.Get(paymentId)
+	if !exists {
+		unsubscribe()
+		s.logger.Printf("[WARNING] Payment %s not found in cache\n", paymentId)
+		return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"message": "Payment not found in cache. It may be too old or was never tracked.",
+		})
 	}
+	current := *status
 
-	// Frontend URL for redirect after payment
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "http://172.20.10.2:5173" // Default frontend URL
+	ctx.Set(fiber.HeaderContentType, "text/event-stream")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	ctx.Set(fiber.HeaderConnection, "keep-alive")
+	ctx.Set("X-Accel-Buffering", "no")
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		keepAlive := time.NewTicker(sseKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		if err := writePaymentStatusEvent(w, current); err != nil || current.Completed {
+			return
+		}
+
+		for {
+			select {
+			case update := <-updates:
+				if err := writePaymentStatusEvent(w, update); err != nil {
+					s.logger.Printf("[INFO] Status stream for payment %s closed by client\n", paymentId)
+					return
+				}
+				if update.Completed {
+					s.logger.Printf("[INFO] Payment %s completed, closing status stream\n", paymentId)
+					return
+				}
+
+			case <-keepAlive.C:
+				// Comment lines keep proxies from closing an idle connection
+				if _, err := w.WriteString(": keep-alive\n\n"); err != nil {
+					return
+				}
+				if err := w.Flush(); err != nil {
+					s.logger.Printf("[INFO] Status stream for payment %s closed by client\n", paymentId)
+					return
+				}
+			}
+		}
+	})
+
+	return nil
+}
+
+func writePaymentStatusEvent(w *bufio.Writer, status PaymentStatusInfo) error {
+	data, err := json.Marshal(buildPaymentStatusResponse(status))
+	if err != nil {
+		return err
 	}
 
+	if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func buildPaymentStatusResponse(status PaymentStatusInfo) fiber.Map {
+	return fiber.Map{
+		"success":          true,
+		"paymentId":        status.PaymentID,
+		"paymentRequestId": status.PaymentRequestID,
+		"status":           status.Status,
+		"paymentStatus":    status.PaymentStatus,
+		"completed":        status.Completed,
+		"message":          status.Message,
+		"lastChecked":      status.LastChecked,
+	}
+}
+
+func (s *Server) createTestPayment(userID string) (alipay.PaymentRequest, alipay.PaymentResponse, error) {
+	s.logger.Println("=================================================================")
+	s.logger.Printf("CREATING TEST PAYMENT FOR USER: %s\n", userID)
+	s.logger.Println("=================================================================")
+
+	paymentRequestID := fmt.Sprintf("PAY-%s-%d", uuid.New().String(), s.clock.Now().Unix())
+
+	expiryTime := s.clock.Now().Add(30 * time.Minute).Format("2006-01-02T15:04:05-07:00")
+
+	// Frontend URL for redirect after payment
+	frontendURL := s.frontendURL
+
 	paymentRequest := alipay.PaymentRequest{
 		ProductCode:      alipay.ONLINE_PURCHASE,
 		PaymentRequestID: paymentRequestID,
 		PaymentAmount: alipay.PaymentAmount{
-			Currency: "IQD",
+			Currency: s.currency(),
 			Value:    "1000",
 		},
 		Order: alipay.Order{
@@ -137,43 +221,43 @@ func createTestPayment(userID string) (alipay.PaymentResponse, error) {
 		// Public URL for payment notifications code should be set here
 	}
 
-	log.Println("[INFO] Payment request details:")
+	s.logger.Println("[INFO] Payment request details:")
 	requestJSON, _ := json.MarshalIndent(paymentRequest, "", "  ")
-	log.Printf("%s\n\n", string(requestJSON))
+	s.logger.Printf("%s\n\n", string(requestJSON))
 
-	log.Println("[INFO] Calling payment API...")
-	paymentResponse, err := alipay.Interface.Pay(paymentRequest)
+	s.logger.Println("[INFO] Calling payment API...")
+	paymentResponse, err := s.gateway.Pay(paymentRequest)
 	if err != nil {
-		log.Printf("[ERROR] Payment API error: %v\n", err)
-		return alipay.PaymentResponse{}, err
+		s.logger.Printf("[ERROR] Payment API error: %v\n", err)
+		return paymentRequest, alipay.PaymentResponse{}, err
 	}
 
 	responseJSON, _ := json.MarshalIndent(paymentResponse, "", "  ")
-	log.Printf("[SUCCESS] Payment API response received:\n%s\n\n", string(responseJSON))
+	s.logger.Printf("[SUCCESS] Payment API response received:\n%s\n\n", string(responseJSON))
 
 	redirectURL := paymentResponse.GetRedirectURL()
 
 	if paymentResponse.Result.ResultStatus == "A" {
-		log.Println("[SUCCESS] Payment accepted")
+		s.logger.Println("[SUCCESS] Payment accepted")
 		if redirectURL != "" {
-			log.Printf("[INFO] Redirection URL: %s\n", redirectURL)
-			log.Println("[INFO] Frontend should call my.tradePay() with this URL")
+			s.logger.Printf("[INFO] Redirection URL: %s\n", redirectURL)
+			s.logger.Println("[INFO] Frontend should call my.tradePay() with this URL")
 		} else {
-			log.Println("[WARNING] Redirection URL is empty in response")
+			s.logger.Println("[WARNING] Redirection URL is empty in response")
 		}
-		log.Printf("[INFO] Payment ID: %s\n", paymentResponse.PaymentID)
-		log.Printf("[INFO] Payment Request ID: %s\n", paymentResponse.PaymentRequestID)
+		s.logger.Printf("[INFO] Payment ID: %s\n", paymentResponse.PaymentID)
+		s.logger.Printf("[INFO] Payment Request ID: %s\n", paymentResponse.PaymentRequestID)
 	} else if paymentResponse.Result.ResultStatus == "S" {
-		log.Println("[SUCCESS] Payment completed immediately")
+		s.logger.Println("[SUCCESS] Payment completed immediately")
 	} else if paymentResponse.Result.ResultStatus == "U" {
-		log.Println("[WARNING] Unknown payment status - need to query later")
+		s.logger.Println("[WARNING] Unknown payment status - need to query later")
 	} else {
-		log.Printf("[ERROR] Payment failed: %s\n", paymentResponse.Result.ResultMessage)
+		s.logger.Printf("[ERROR] Payment failed: %s\n", paymentResponse.Result.ResultMessage)
 	}
 
-	log.Println("=================================================================")
-	log.Println("TEST PAYMENT CREATION COMPLETED")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("TEST PAYMENT CREATION COMPLETED")
+	s.logger.Println("=================================================================")
 
-	return paymentResponse, nil
+	return paymentRequest, paymentResponse, nil
 }
@@ -1,8 +1,8 @@
 package api
 
 import (
-	"log"
 	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
 	"time"
 )
 
@@ -12,60 +12,68 @@ const (
 	cleanupDelay     = 10 * time.Minute  // Keep in cache for 10 minutes after completion
 )
 
-// StartPaymentPolling starts a background goroutine to poll payment status
-func StartPaymentPolling(paymentID, paymentRequestID string) {
-	log.Printf("[PaymentPoller] Starting polling for payment: %s", paymentID)
+// subscribePaymentPolling starts polling every payment announced on the event bus
+func (s *Server) subscribePaymentPolling() {
+	s.events.Subscribe(events.TypePaymentCreated, func(event events.Event) {
+		created := event.(events.PaymentCreated)
+		s.startPaymentPolling(created.PaymentID, created.PaymentRequestID)
+	})
+}
+
+// startPaymentPolling starts a background goroutine to poll payment status
+func (s *Server) startPaymentPolling(paymentID, paymentRequestID string) {
+	s.logger.Printf("[PaymentPoller] Starting polling for payment: %s", paymentID)
 
 	// Initialize payment status as PENDING
-	paymentStore.Set(paymentID, &PaymentStatusInfo{
+	s.payments.Set(paymentID, &PaymentStatusInfo{
 		PaymentID:        paymentID,
 		PaymentRequestID: paymentRequestID,
+		MerchantID:       s.merchantID,
 		Status:           "PENDING",
-		LastChecked:      time.Now(),
+		LastChecked:      s.clock.Now(),
 		Completed:        false,
 		Message:          "Payment initiated, waiting for completion",
 	})
 
 	// Start polling in background
-	go pollPaymentStatus(paymentID, paymentRequestID)
+	go s.pollPaymentStatus(paymentID, paymentRequestID)
 }
 
 // pollPaymentStatus is the background polling worker
-func pollPaymentStatus(paymentID, paymentRequestID string) {
-	startTime := time.Now()
+func (s *Server) pollPaymentStatus(paymentID, paymentRequestID string) {
+	startTime := s.clock.Now()
 	attemptCount := 0
 	maxAttempts := int(maxPollingTime / pollingInterval) // 24 attempts (2 min / 5 sec)
 
-	log.Printf("[PaymentPoller] Started polling for payment %s (max %d attempts)", paymentID, maxAttempts)
-
-	ticker := time.NewTicker(pollingInterval)
-	defer ticker.Stop()
+	s.logger.Printf("[PaymentPoller] Started polling for payment %s (max %d attempts)", paymentID, maxAttempts)
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-s.clock.After(pollingInterval):
 			attemptCount++
-			elapsed := time.Since(startTime)
+			elapsed := s.clock.Now().Sub(startTime)
 
-			log.Printf("[PaymentPoller] Attempt %d/%d for payment %s (elapsed: %.0fs)",
+			s.logger.Printf("[PaymentPoller] Attempt %d/%d for payment %s (elapsed: %.0fs)",
 				attemptCount, maxAttempts, paymentID, elapsed.Seconds())
 
 			// Check payment status
-			status := checkPaymentStatus(paymentID, paymentRequestID)
+			status := s.checkPaymentStatus(paymentID, paymentRequestID)
 
 			// Update store
-			status.LastChecked = time.Now()
-			paymentStore.Set(paymentID, status)
+			status.LastChecked = s.clock.Now()
+			s.payments.Set(paymentID, status)
 
 			// Check if we should stop polling
 			if status.Completed {
-				log.Printf("[PaymentPoller] Payment %s is complete (status: %s). Stopping poll.", paymentID, status.Status)
+				s.logger.Printf("[PaymentPoller] Payment %s is complete (status: %s). Stopping poll.", paymentID, status.Status)
+
+				s.publishPaymentOutcome(status)
 
 				// Schedule cleanup after delay
 				go func() {
-					time.Sleep(cleanupDelay)
-					paymentStore.Delete(paymentID)
-					log.Printf("[PaymentPoller] Cleaned up payment %s from cache", paymentID)
+					<-s.clock.After(cleanupDelay)
+					s.payments.Delete(paymentID)
+					s.logger.Printf("[PaymentPoller] Cleaned up payment %s from cache", paymentID)
 				}()
 
 				return
@@ -73,18 +81,23 @@ func pollPaymentStatus(paymentID, paymentRequestID string) {
 
 			// Stop if max attempts reached
 			if attemptCount >= maxAttempts {
-				log.Printf("[PaymentPoller] Max polling time reached for payment %s. Stopping.", paymentID)
+				s.logger.Printf("[PaymentPoller] Max polling time reached for payment %s. Stopping.", paymentID)
 
 				// Mark as timeout
 				status.Status = "TIMEOUT"
 				status.Message = "Payment status check timed out after 2 minutes. Please check manually."
 				status.Completed = true
-				paymentStore.Set(paymentID, status)
+				s.payments.Set(paymentID, status)
+
+				s.events.Publish(events.PaymentTimedOut{
+					PaymentID:        paymentID,
+					PaymentRequestID: paymentRequestID,
+				})
 
 				// Schedule cleanup
 				go func() {
-					time.Sleep(cleanupDelay)
-					paymentStore.Delete(paymentID)
+					<-s.clock.After(cleanupDelay)
+					s.payments.Delete(paymentID)
 				}()
 
 				return
@@ -94,18 +107,19 @@ func pollPaymentStatus(paymentID, paymentRequestID string) {
 }
 
 // checkPaymentStatus queries Alipay and returns current status
-func checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
+func (s *Server) checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
 	inquiryRequest := alipay.InquiryPaymentRequest{
 		PaymentID:        paymentID,
 		PaymentRequestID: paymentRequestID,
 	}
 
-	inquiryResponse, err := alipay.Interface.InquiryPayment(inquiryRequest)
+	inquiryResponse, err := s.gateway.InquiryPayment(inquiryRequest)
 	if err != nil {
-		log.Printf("[PaymentPoller] Error querying payment %s: %v", paymentID, err)
+		s.logger.Printf("[PaymentPoller] Error querying payment %s: %v", paymentID, err)
 		return &PaymentStatusInfo{
 			PaymentID:        paymentID,
 			PaymentRequestID: paymentRequestID,
+			MerchantID:       s.merchantID,
 			Status:           "ERROR",
 			Completed:        false,
 			Message:          "Error checking payment status: " + err.Error(),
@@ -116,7 +130,10 @@ func checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
 	status := &PaymentStatusInfo{
 		PaymentID:        paymentID,
 		PaymentRequestID: paymentRequestID,
+		MerchantID:       s.merchantID,
 		PaymentStatus:    inquiryResponse.PaymentStatus,
+		PaymentAmount:    inquiryResponse.PaymentAmount,
+		PaymentTime:      inquiryResponse.PaymentTime,
 	}
 
 	// Handle based on result status
@@ -128,31 +145,31 @@ func checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
 			status.Status = "SUCCESS"
 			status.Message = "Payment completed successfully"
 			status.Completed = true
-			log.Printf("[PaymentPoller] Payment %s SUCCESS", paymentID)
+			s.logger.Printf("[PaymentPoller] Payment %s SUCCESS", paymentID)
 
 		case "PROCESSING":
 			status.Status = "PROCESSING"
 			status.Message = "Payment is still processing"
 			status.Completed = false
-			log.Printf("[PaymentPoller] Payment %s still PROCESSING", paymentID)
+			s.logger.Printf("[PaymentPoller] Payment %s still PROCESSING", paymentID)
 
 		case "AUTH_SUCCESS":
 			status.Status = "AUTH_SUCCESS"
 			status.Message = "Payment authorized but not finished"
 			status.Completed = false
-			log.Printf("[PaymentPoller] Payment %s AUTH_SUCCESS (not finished)", paymentID)
+			s.logger.Printf("[PaymentPoller] Payment %s AUTH_SUCCESS (not finished)", paymentID)
 
 		case "FAIL":
 			status.Status = "FAIL"
 			status.Message = "Payment failed"
 			status.Completed = true
-			log.Printf("[PaymentPoller] Payment %s FAILED", paymentID)
+			s.logger.Printf("[PaymentPoller] Payment %s FAILED", paymentID)
 
 		default:
 			status.Status = "UNKNOWN"
 			status.Message = "Unknown payment status: " + inquiryResponse.PaymentStatus
 			status.Completed = false
-			log.Printf("[PaymentPoller] Payment %s has unknown status: %s", paymentID, inquiryResponse.PaymentStatus)
+			s.logger.Printf("[PaymentPoller] Payment %s has unknown status: %s", paymentID, inquiryResponse.PaymentStatus)
 		}
 
 	case "F":
@@ -161,12 +178,12 @@ func checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
 			status.Status = "NOT_FOUND"
 			status.Message = "Payment not found. May not be accepted yet."
 			status.Completed = false
-			log.Printf("[PaymentPoller] Payment %s not found yet", paymentID)
+			s.logger.Printf("[PaymentPoller] Payment %s not found yet", paymentID)
 		} else {
 			status.Status = "FAIL"
 			status.Message = inquiryResponse.Result.ResultMessage
 			status.Completed = true
-			log.Printf("[PaymentPoller] Payment %s inquiry failed: %s", paymentID, inquiryResponse.Result.ResultMessage)
+			s.logger.Printf("[PaymentPoller] Payment %s inquiry failed: %s", paymentID, inquiryResponse.Result.ResultMessage)
 		}
 
 	case "U":
@@ -174,7 +191,7 @@ func checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
 		status.Status = "UNKNOWN"
 		status.Message = "Unknown exception, retrying..."
 		status.Completed = false
-		log.Printf("[PaymentPoller] Payment %s unknown exception", paymentID)
+		s.logger.Printf("[PaymentPoller] Payment %s unknown exception", paymentID)
 
 	default:
 		status.Status = "UNKNOWN"
@@ -184,3 +201,22 @@ func checkPaymentStatus(paymentID, paymentRequestID string) *PaymentStatusInfo {
 
 	return status
 }
+
+// publishPaymentOutcome announces a completed payment on the event bus
+func (s *Server) publishPaymentOutcome(status *PaymentStatusInfo) {
+	switch status.Status {
+	case "SUCCESS":
+		s.events.Publish(events.PaymentSucceeded{
+			PaymentID:        status.PaymentID,
+			PaymentRequestID: status.PaymentRequestID,
+			PaymentTime:      status.PaymentTime,
+			Amount:           status.PaymentAmount,
+		})
+	case "FAIL":
+		s.events.Publish(events.PaymentFailed{
+			PaymentID:        status.PaymentID,
+			PaymentRequestID: status.PaymentRequestID,
+			Reason:           status.Message,
+		})
+	}
+}
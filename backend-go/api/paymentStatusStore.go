@@ -2,38 +2,97 @@ package api
 
 import (
 	"log"
+	"superQiMiniAppBackend/alipay"
 	"sync"
 	"time"
 )
 
 // PaymentStatusInfo stores the current status of a payment
 type PaymentStatusInfo struct {
-	PaymentID        string    `json:"paymentId"`
-	PaymentRequestID string    `json:"paymentRequestId"`
-	Status           string    `json:"status"` // PENDING, SUCCESS, PROCESSING, FAIL, UNKNOWN
-	PaymentStatus    string    `json:"paymentStatus,omitempty"`
-	LastChecked      time.Time `json:"lastChecked"`
-	Completed        bool      `json:"completed"` // Whether polling should stop
-	Message          string    `json:"message,omitempty"`
+	PaymentID        string               `json:"paymentId"`
+	PaymentRequestID string               `json:"paymentRequestId"`
+	MerchantID       string               `json:"merchantId,omitempty"`
+	Status           string               `json:"status"` // PENDING, SUCCESS, PROCESSING, FAIL, UNKNOWN
+	PaymentStatus    string               `json:"paymentStatus,omitempty"`
+	PaymentAmount    alipay.PaymentAmount `json:"paymentAmount,omitempty"`
+	PaymentTime      string               `json:"paymentTime,omitempty"`
+	LastChecked      time.Time            `json:"lastChecked"`
+	Completed        bool                 `json:"completed"` // Whether polling should stop
+	Message          string               `json:"message,omitempty"`
 }
 
 // PaymentStatusStore is an in-memory store for tracking payment statuses
 type PaymentStatusStore struct {
-	mu       sync.RWMutex
-	payments map[string]*PaymentStatusInfo
+	mu          sync.RWMutex
+	payments    map[string]*PaymentStatusInfo
+	subscribers map[string]map[chan PaymentStatusInfo]struct{}
+	onUpdate    []func(PaymentStatusInfo)
 }
 
-// Global payment status store
-var paymentStore = &PaymentStatusStore{
-	payments: make(map[string]*PaymentStatusInfo),
+// NewPaymentStatusStore creates an empty payment status store
+func NewPaymentStatusStore() *PaymentStatusStore {
+	return &PaymentStatusStore{
+		payments:    make(map[string]*PaymentStatusInfo),
+		subscribers: make(map[string]map[chan PaymentStatusInfo]struct{}),
+	}
 }
 
-// Set updates or creates a payment status
+// Set updates or creates a payment status and notifies subscribers and handlers
 func (s *PaymentStatusStore) Set(paymentID string, info *PaymentStatusInfo) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.payments[paymentID] = info
 	log.Printf("[PaymentStore] Updated payment %s: Status=%s, Completed=%v", paymentID, info.Status, info.Completed)
+
+	// Subscribers only need the latest status, so an update they have not read yet is
+	// replaced. Sends happen under the lock, which leaves room once the old one is taken.
+	// A copy is sent so subscribers never share the pointer with the poller.
+	for ch := range s.subscribers[paymentID] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- *info
+	}
+
+	handlers := append([]func(PaymentStatusInfo){}, s.onUpdate...)
+	update := *info
+	s.mu.Unlock()
+
+	// Handlers run unlocked so they may read the store
+	for _, handler := range handlers {
+		handler(update)
+	}
+}
+
+// OnUpdate calls handler with every update of every payment
+func (s *PaymentStatusStore) OnUpdate(handler func(PaymentStatusInfo)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onUpdate = append(s.onUpdate, handler)
+}
+
+// Subscribe returns a channel receiving the latest status of a payment whenever it changes,
+// and a function to stop receiving them
+func (s *PaymentStatusStore) Subscribe(paymentID string) (<-chan PaymentStatusInfo, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan PaymentStatusInfo, 1)
+	if s.subscribers[paymentID] == nil {
+		s.subscribers[paymentID] = make(map[chan PaymentStatusInfo]struct{})
+	}
+	s.subscribers[paymentID][ch] = struct{}{}
+
+	unsubscribe := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers[paymentID], ch)
+		if len(s.subscribers[paymentID]) == 0 {
+			delete(s.subscribers, paymentID)
+		}
+	}
+
+	return ch, unsubscribe
 }
 
 // Get retrieves a payment status
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
+	"superQiMiniAppBackend/notification"
+	"sync"
+	"time"
+)
+
+const (
+	receiptRetention    = 24 * time.Hour   // How long a sent receipt is remembered for dedup
+	receiptMaxAttempts  = 5                // Inbox sends per receipt before giving up
+	receiptRetryBackoff = 10 * time.Second // Wait before the first retry, doubled after each one
+)
+
+// receiptContext keeps what is needed to send a receipt once the payment succeeds
+type receiptContext struct {
+	UserID           string
+	AccessToken      string
+	OrderDescription string
+	Amount           alipay.PaymentAmount
+	CreatedAt        time.Time
+}
+
+// ReceiptSender sends a receipt through the inbox (and optionally push) when a payment succeeds.
+// Each payment gets at most one receipt, no matter how often its success is reported.
+type ReceiptSender struct {
+	mu      sync.Mutex
+	clock   Clock
+	pending map[string]*receiptContext
+	sent    map[string]time.Time
+
+	pushEnabled   bool
+	inboxTemplate string
+	pushTemplate  string
+}
+
+// newReceiptSender reads the receipt settings from RECEIPT_PUSH_ENABLED, RECEIPT_INBOX_TEMPLATE_CODE
+// and RECEIPT_PUSH_TEMPLATE_CODE
+func newReceiptSender(clock Clock) *ReceiptSender {
+	return &ReceiptSender{
+		clock:         clock,
+		pending:       make(map[string]*receiptContext),
+		sent:          make(map[string]time.Time),
+		pushEnabled:   os.Getenv("RECEIPT_PUSH_ENABLED") == "true",
+		inboxTemplate: receiptTemplateCode("RECEIPT_INBOX_TEMPLATE_CODE", commonInboxTemplate),
+		pushTemplate:  receiptTemplateCode("RECEIPT_PUSH_TEMPLATE_CODE", commonPushTemplate),
+	}
+}
+
+// subscribeReceipts wires the receipt sender to the payment lifecycle events
+func (s *Server) subscribeReceipts() {
+	s.events.Subscribe(events.TypePaymentCreated, func(event events.Event) {
+		created := event.(events.PaymentCreated)
+		s.receipts.Track(created)
+	})
+
+	s.events.Subscribe(events.TypePaymentSucceeded, func(event events.Event) {
+		succeeded := event.(events.PaymentSucceeded)
+		// Gateway calls are slow, keep them off the poller goroutine
+		go s.sendReceipt(succeeded)
+	})
+
+	forget := func(event events.Event) {
+		switch e := event.(type) {
+		case events.PaymentFailed:
+			s.receipts.Forget(e.PaymentID)
+		case events.PaymentTimedOut:
+			s.receipts.Forget(e.PaymentID)
+		}
+	}
+	s.events.Subscribe(events.TypePaymentFailed, forget)
+	s.events.Subscribe(events.TypePaymentTimedOut, forget)
+}
+
+// Track remembers who paid so the receipt can be sent later
+func (r *ReceiptSender) Track(created events.PaymentCreated) {
+	if created.AccessToken == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[created.PaymentID] = &receiptContext{
+		UserID:           created.UserID,
+		AccessToken:      created.AccessToken,
+		OrderDescription: created.OrderDescription,
+		Amount:           created.Amount,
+		CreatedAt:        r.clock.Now(),
+	}
+}
+
+// Forget drops a payment that will never succeed
+func (r *ReceiptSender) Forget(paymentID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, paymentID)
+}
+
+// sendReceipt sends the receipt for a succeeded payment unless it was already sent
+func (s *Server) sendReceipt(succeeded events.PaymentSucceeded) {
+	receipt, claimed := s.receipts.claim(succeeded.PaymentID)
+	if !claimed {
+		return
+	}
+
+	if succeeded.Amount.Value != "" {
+		receipt.Amount = succeeded.Amount
+	}
+
+	s.logger.Printf("[Receipt] Sending receipt for payment %s to user %s", succeeded.PaymentID, receipt.UserID)
+
+	params := receiptTemplateParameters(succeeded.PaymentID, receipt)
+
+	inbox, err := s.renderReceipt(s.receipts.inboxTemplate, params)
+	if err != nil {
+		s.logger.Printf("[Receipt] ERROR: Inbox receipt template for payment %s is invalid: %v", succeeded.PaymentID, err)
+		s.receipts.release(succeeded.PaymentID, receipt)
+		return
+	}
+
+	// Request IDs derived from the payment ID make the wallet reject duplicates, so a failed
+	// send is retried with the same request ID after a growing wait
+	inboxRequest := alipay.SendInboxRequest{
+		AccessToken:  receipt.AccessToken,
+		RequestID:    "RECEIPT-INBOX-" + succeeded.PaymentID,
+		TemplateCode: inbox.Code,
+		Templates: []alipay.InboxTemplate{
+			{
+				TemplateParameters: inbox.Parameters,
+			},
+		},
+	}
+	for attempt := 1; ; attempt++ {
+		inboxResponse, err := s.sendInbox(receipt.UserID, inboxRequest)
+		if err == nil && inboxResponse.Result.ResultStatus == "F" {
+			err = fmt.Errorf("%s: %s", inboxResponse.Result.ResultCode, inboxResponse.Result.ResultMessage)
+		}
+		if err == nil {
+			break
+		}
+		if attempt == receiptMaxAttempts {
+			s.logger.Printf("[Receipt] ERROR: Inbox receipt for payment %s failed %d times, giving up: %v", succeeded.PaymentID, attempt, err)
+			s.receipts.release(succeeded.PaymentID, receipt)
+			return
+		}
+
+		wait := receiptRetryBackoff << (attempt - 1)
+		s.logger.Printf("[Receipt] WARNING: Inbox receipt for payment %s failed (attempt %d): %v, retrying in %s", succeeded.PaymentID, attempt, err, wait)
+		select {
+		case <-s.clock.After(wait):
+		case <-s.done:
+			s.logger.Printf("[Receipt] Server closing, dropping the retry of the inbox receipt for payment %s", succeeded.PaymentID)
+			s.receipts.release(succeeded.PaymentID, receipt)
+			return
+		}
+	}
+
+	pushDecision := s.decideNotification(receipt.UserID, notification.CategoryTransactional, notification.ChannelPush)
+	if s.receipts.pushEnabled && pushDecision.Action != notification.DecisionSend {
+		// The inbox receipt already went out, so a push the user does not want right now is simply skipped
+		s.logger.Printf("[Receipt] Skipping push receipt for payment %s: %s", succeeded.PaymentID, pushDecision.Reason)
+	} else if s.receipts.pushEnabled {
+		push, err := s.renderReceipt(s.receipts.pushTemplate, params)
+		if err != nil {
+			s.logger.Printf("[Receipt] WARNING: Push receipt template for payment %s is invalid: %v", succeeded.PaymentID, err)
+		} else if _, err := s.sendPush(receipt.UserID, alipay.SendPushRequest{
+			AccessToken:  receipt.AccessToken,
+			RequestID:    "RECEIPT-PUSH-" + succeeded.PaymentID,
+			TemplateCode: push.Code,
+			Templates: []alipay.PushTemplate{
+				{
+					TemplateParameters: push.Parameters,
+				},
+			},
+		}); err != nil {
+			s.logger.Printf("[Receipt] WARNING: Push receipt for payment %s failed: %v", succeeded.PaymentID, err)
+		}
+	}
+
+	s.logger.Printf("[Receipt] Receipt sent for payment %s", succeeded.PaymentID)
+}
+
+// claim marks a payment as receipted, returning false if it already was or its payer is unknown
+func (r *ReceiptSender) claim(paymentID string) (*receiptContext, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneLocked()
+
+	if _, alreadySent := r.sent[paymentID]; alreadySent {
+		log.Printf("[Receipt] Receipt for payment %s already sent, skipping", paymentID)
+		return nil, false
+	}
+
+	receipt, exists := r.pending[paymentID]
+	if !exists {
+		log.Printf("[Receipt] No payer known for payment %s, skipping receipt", paymentID)
+		return nil, false
+	}
+
+	delete(r.pending, paymentID)
+	r.sent[paymentID] = r.clock.Now()
+	return receipt, true
+}
+
+// release undoes a claim after a failed send so a later success event can retry
+func (r *ReceiptSender) release(paymentID string, receipt *receiptContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sent, paymentID)
+	r.pending[paymentID] = receipt
+}
+
+func (r *ReceiptSender) pruneLocked() {
+	now := r.clock.Now()
+	for paymentID, sentAt := range r.sent {
+		if now.Sub(sentAt) > receiptRetention {
+			delete(r.sent, paymentID)
+		}
+	}
+	for paymentID, receipt := range r.pending {
+		if now.Sub(receipt.CreatedAt) > receiptRetention {
+			delete(r.pending, paymentID)
+		}
+	}
+}
+
+func receiptTemplateParameters(paymentID string, receipt *receiptContext) map[string]string {
+	amount := fmt.Sprintf("%s %s", receipt.Amount.Value, receipt.Amount.Currency)
+
+	return map[string]string{
+		"Title":            "Payment receipt",
+		"Content":          fmt.Sprintf("You paid %s for %s. Payment ID: %s", amount, receipt.OrderDescription, paymentID),
+		"Amount":           amount,
+		"OrderDescription": receipt.OrderDescription,
+		"PaymentId":        paymentID,
+	}
+}
+
+// renderReceipt renders a receipt template, passing only the parameters it declares
+// so the common templates keep working alongside richer receipt templates
+func (s *Server) renderReceipt(templateCode string, params map[string]string) (notification.Rendered, error) {
+	template, exists := s.templates.Get(templateCode)
+	if !exists {
+		return notification.Rendered{}, fmt.Errorf("unknown template: %s", templateCode)
+	}
+
+	accepted := make(map[string]string)
+	for key, value := range params {
+		if template.Accepts(key) {
+			accepted[key] = value
+		}
+	}
+	return s.templates.Render(templateCode, "", accepted)
+}
+
+func receiptTemplateCode(envKey, fallback string) string {
+	if templateCode := os.Getenv(envKey); templateCode != "" {
+		return templateCode
+	}
+	return fallback
+}
@@ -3,9 +3,9 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
 	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -17,23 +17,23 @@ type refundRequest struct {
 	Amount    float64 `json:"amount" validate:"required"`
 }
 
-func InitRefundEndpoint(group fiber.Router) {
+func (s *Server) registerRefundEndpoint(group fiber.Router) {
 	group.Post("/payment/refund", func(ctx *fiber.Ctx) error {
 		var request refundRequest
 		if err := ctx.BodyParser(&request); err != nil {
-			log.Printf("[ERROR] Invalid refund request body: %v\n", err)
+			s.logger.Printf("[ERROR] Invalid refund request body: %v\n", err)
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 
-		log.Println("=================================================================")
-		log.Println("REFUND REQUEST RECEIVED")
-		log.Println("=================================================================")
-		log.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
-		log.Printf("[INFO] Refund Amount (IQD): %.2f\n", request.Amount)
+		s.logger.Println("=================================================================")
+		s.logger.Println("REFUND REQUEST RECEIVED")
+		s.logger.Println("=================================================================")
+		s.logger.Printf("[INFO] Payment ID: %s\n", request.PaymentID)
+		s.logger.Printf("[INFO] Refund Amount (IQD): %.2f\n", request.Amount)
 
 		// Validate inputs
 		if request.PaymentID == "" {
-			log.Println("[ERROR] Payment ID is required")
+			s.logger.Println("[ERROR] Payment ID is required")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -42,7 +42,7 @@ func InitRefundEndpoint(group fiber.Router) {
 		}
 
 		if request.Amount <= 0 {
-			log.Println("[ERROR] Invalid refund amount")
+			s.logger.Println("[ERROR] Invalid refund amount")
 			return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -50,9 +50,9 @@ func InitRefundEndpoint(group fiber.Router) {
 			})
 		}
 
-		refundResponse, err := processRefund(request.PaymentID, request.Amount)
+		refundResponse, err := s.processRefund(request.PaymentID, request.Amount)
 		if err != nil {
-			log.Printf("[ERROR] Failed to process refund: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to process refund: %v\n", err)
 			return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"success":       false,
 				"resultStatus":  "F",
@@ -62,104 +62,128 @@ func InitRefundEndpoint(group fiber.Router) {
 
 		response := buildRefundResponse(refundResponse)
 
-		log.Println("[SUCCESS] Returning refund response to frontend")
-		log.Println("=================================================================")
+		s.logger.Println("[SUCCESS] Returning refund response to frontend")
+		s.logger.Println("=================================================================")
 		return ctx.JSON(response)
 	})
 }
 
-func processRefund(paymentID string, amountIQD float64) (alipay.RefundResponse, error) {
-	log.Println("=================================================================")
-	log.Printf("PROCESSING REFUND FOR PAYMENT: %s\n", paymentID)
-	log.Println("=================================================================")
+func (s *Server) processRefund(paymentID string, amountIQD float64) (alipay.RefundResponse, error) {
+	s.logger.Println("=================================================================")
+	s.logger.Printf("PROCESSING REFUND FOR PAYMENT: %s\n", paymentID)
+	s.logger.Println("=================================================================")
 
-	refundRequestID := generateRefundRequestID()
-	log.Printf("[INFO] Generated Refund Request ID: %s\n", refundRequestID)
+	refundRequestID := generateRefundRequestID(s.clock.Now())
+	s.logger.Printf("[INFO] Generated Refund Request ID: %s\n", refundRequestID)
 
 	amountInFils := int64(amountIQD * 1000)
-	log.Printf("[INFO] Amount in fils: %d\n", amountInFils)
+	s.logger.Printf("[INFO] Amount in fils: %d\n", amountInFils)
 
 	refundRequest := alipay.RefundRequest{
 		RefundRequestID: refundRequestID,
 		PaymentID:       paymentID,
 		RefundAmount: alipay.RefundAmount{
-			Currency: "IQD",
+			Currency: s.currency(),
 			Value:    strconv.FormatInt(amountInFils, 10),
 		},
 		RefundReason: "Customer requested refund from mini app",
 	}
 
 	requestJSON, _ := json.MarshalIndent(refundRequest, "", "  ")
-	log.Printf("[INFO] Refund request details:\n%s\n\n", string(requestJSON))
+	s.logger.Printf("[INFO] Refund request details:\n%s\n\n", string(requestJSON))
 
-	log.Println("[INFO] Calling Alipay refund API...")
-	refundResponse, err := alipay.Interface.Refund(refundRequest)
+	s.logger.Println("[INFO] Calling Alipay refund API...")
+	refundResponse, err := s.gateway.Refund(refundRequest)
 	if err != nil {
-		log.Printf("[ERROR] Refund API call failed: %v\n", err)
+		s.logger.Printf("[ERROR] Refund API call failed: %v\n", err)
 		return alipay.RefundResponse{}, fmt.Errorf("refund API call failed: %v", err)
 	}
 
 	responseJSON, _ := json.MarshalIndent(refundResponse, "", "  ")
-	log.Printf("[SUCCESS] Refund API response:\n%s\n\n", string(responseJSON))
+	s.logger.Printf("[SUCCESS] Refund API response:\n%s\n\n", string(responseJSON))
 
 	switch refundResponse.Result.ResultStatus {
 	case "S":
-		log.Println("[SUCCESS]  Refund successful immediately")
-		log.Printf("[INFO] Refund ID: %s\n", refundResponse.RefundID)
-		log.Printf("[INFO] Refund Time: %s\n", refundResponse.RefundTime)
+		s.logger.Println("[SUCCESS]  Refund successful immediately")
+		s.logger.Printf("[INFO] Refund ID: %s\n", refundResponse.RefundID)
+		s.logger.Printf("[INFO] Refund Time: %s\n", refundResponse.RefundTime)
 
 	case "U":
-		log.Println("[WARNING] Refund status unknown - starting polling...")
-		finalResponse := pollRefundStatus(refundRequestID)
+		s.logger.Println("[WARNING] Refund status unknown - starting polling...")
+		finalResponse := s.pollRefundStatus(refundRequestID)
 		if finalResponse != nil {
+			s.publishRefundOutcome(refundRequest, *finalResponse)
 			return *finalResponse, nil
 		}
-		log.Println("[WARNING] Polling completed but status still unknown")
+		s.logger.Println("[WARNING] Polling completed but status still unknown")
 
 	case "F":
-		log.Printf("[ERROR] Refund failed: %s\n", refundResponse.Result.ResultMessage)
-		log.Printf("[ERROR] Error Code: %s\n", refundResponse.Result.ResultCode)
+		s.logger.Printf("[ERROR] Refund failed: %s\n", refundResponse.Result.ResultMessage)
+		s.logger.Printf("[ERROR] Error Code: %s\n", refundResponse.Result.ResultCode)
 	}
 
-	log.Println("=================================================================")
-	log.Println("REFUND PROCESSING COMPLETED")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("REFUND PROCESSING COMPLETED")
+	s.logger.Println("=================================================================")
 
+	s.publishRefundOutcome(refundRequest, refundResponse)
 	return refundResponse, nil
 }
 
-func pollRefundStatus(refundRequestID string) *alipay.RefundResponse {
+// publishRefundOutcome announces a finished refund on the event bus, unknown outcomes are not published
+func (s *Server) publishRefundOutcome(refundRequest alipay.RefundRequest, refundResponse alipay.RefundResponse) {
+	switch refundResponse.Result.ResultStatus {
+	case "S":
+		s.events.Publish(events.RefundSucceeded{
+			PaymentID:       refundRequest.PaymentID,
+			RefundRequestID: refundRequest.RefundRequestID,
+			RefundID:        refundResponse.RefundID,
+			RefundTime:      refundResponse.RefundTime,
+			Amount:          refundRequest.RefundAmount,
+		})
+	case "F":
+		s.events.Publish(events.RefundFailed{
+			PaymentID:       refundRequest.PaymentID,
+			RefundRequestID: refundRequest.RefundRequestID,
+			ResultCode:      refundResponse.Result.ResultCode,
+			Reason:          refundResponse.Result.ResultMessage,
+			Amount:          refundRequest.RefundAmount,
+		})
+	}
+}
+
+func (s *Server) pollRefundStatus(refundRequestID string) *alipay.RefundResponse {
 	const maxAttempts = 12
 	const intervalSeconds = 5
 
-	log.Println("=================================================================")
-	log.Printf("STARTING REFUND STATUS POLLING FOR: %s\n", refundRequestID)
-	log.Println("=================================================================")
-	log.Printf("[INFO] Max attempts: %d, Interval: %d seconds\n", maxAttempts, intervalSeconds)
+	s.logger.Println("=================================================================")
+	s.logger.Printf("STARTING REFUND STATUS POLLING FOR: %s\n", refundRequestID)
+	s.logger.Println("=================================================================")
+	s.logger.Printf("[INFO] Max attempts: %d, Interval: %d seconds\n", maxAttempts, intervalSeconds)
 
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		log.Printf("[INFO] Polling attempt %d/%d...\n", attempt, maxAttempts)
+		s.logger.Printf("[INFO] Polling attempt %d/%d...\n", attempt, maxAttempts)
 
 		inquiryRequest := alipay.InquiryRefundRequest{
 			RefundRequestID: refundRequestID,
 		}
 
-		inquiryResponse, err := alipay.Interface.InquiryRefund(inquiryRequest)
+		inquiryResponse, err := s.gateway.InquiryRefund(inquiryRequest)
 		if err != nil {
-			log.Printf("[ERROR] Inquiry attempt %d failed: %v\n", attempt, err)
-			time.Sleep(intervalSeconds * time.Second)
+			s.logger.Printf("[ERROR] Inquiry attempt %d failed: %v\n", attempt, err)
+			<-s.clock.After(intervalSeconds * time.Second)
 			continue
 		}
 
 		inquiryJSON, _ := json.MarshalIndent(inquiryResponse, "", "  ")
-		log.Printf("[INFO] Inquiry response:\n%s\n\n", string(inquiryJSON))
+		s.logger.Printf("[INFO] Inquiry response:\n%s\n\n", string(inquiryJSON))
 
 		if inquiryResponse.Result.ResultStatus == "S" {
 			switch inquiryResponse.RefundStatus {
 			case "SUCCESS":
-				log.Println("[SUCCESS] Refund completed successfully!")
-				log.Printf("[INFO] Refund ID: %s\n", inquiryResponse.RefundID)
-				log.Printf("[INFO] Refund Time: %s\n", inquiryResponse.RefundTime)
+				s.logger.Println("[SUCCESS] Refund completed successfully!")
+				s.logger.Printf("[INFO] Refund ID: %s\n", inquiryResponse.RefundID)
+				s.logger.Printf("[INFO] Refund Time: %s\n", inquiryResponse.RefundTime)
 
 				return &alipay.RefundResponse{
 					Result: alipay.Result{
@@ -172,7 +196,7 @@ func pollRefundStatus(refundRequestID string) *alipay.RefundResponse {
 				}
 
 			case "FAIL":
-				log.Printf("[ERROR] Refund failed: %s\n", inquiryResponse.RefundFailReason)
+				s.logger.Printf("[ERROR] Refund failed: %s\n", inquiryResponse.RefundFailReason)
 
 				return &alipay.RefundResponse{
 					Result: alipay.Result{
@@ -183,17 +207,17 @@ func pollRefundStatus(refundRequestID string) *alipay.RefundResponse {
 				}
 
 			case "PROCESSING":
-				log.Println("[INFO] Refund still processing...")
+				s.logger.Println("[INFO] Refund still processing...")
 
 			default:
-				log.Printf("[WARNING] Unknown refund status: %s\n", inquiryResponse.RefundStatus)
+				s.logger.Printf("[WARNING] Unknown refund status: %s\n", inquiryResponse.RefundStatus)
 			}
 
 		} else if inquiryResponse.Result.ResultStatus == "F" {
-			log.Printf("[ERROR] Inquiry failed: %s\n", inquiryResponse.Result.ResultMessage)
+			s.logger.Printf("[ERROR] Inquiry failed: %s\n", inquiryResponse.Result.ResultMessage)
 
 			if inquiryResponse.Result.ResultCode == "REFUND_NOT_EXIST" {
-				log.Println("[ERROR] Refund does not exist in wallet system")
+				s.logger.Println("[ERROR] Refund does not exist in wallet system")
 				return &alipay.RefundResponse{
 					Result: alipay.Result{
 						ResultCode:    "REFUND_NOT_EXIST",
@@ -205,15 +229,15 @@ func pollRefundStatus(refundRequestID string) *alipay.RefundResponse {
 		}
 
 		if attempt < maxAttempts {
-			log.Printf("[INFO] Waiting %d seconds before next attempt...\n", intervalSeconds)
-			time.Sleep(intervalSeconds * time.Second)
+			s.logger.Printf("[INFO] Waiting %d seconds before next attempt...\n", intervalSeconds)
+			<-s.clock.After(intervalSeconds * time.Second)
 		}
 	}
 
-	log.Println("=================================================================")
-	log.Println("[WARNING] POLLING TIMEOUT - Refund status still unknown")
-	log.Println("[WARNING] Manual intervention may be required")
-	log.Println("=================================================================")
+	s.logger.Println("=================================================================")
+	s.logger.Println("[WARNING] POLLING TIMEOUT - Refund status still unknown")
+	s.logger.Println("[WARNING] Manual intervention may be required")
+	s.logger.Println("=================================================================")
 
 	return nil
 }
@@ -250,6 +274,6 @@ func buildRefundResponse(refundResponse alipay.RefundResponse) fiber.Map {
 	return response
 }
 
-func generateRefundRequestID() string {
-	return fmt.Sprintf("REFUND-%s-%d", uuid.New().String(), time.Now().Unix())
+func generateRefundRequestID(now time.Time) string {
+	return fmt.Sprintf("REFUND-%s-%d", uuid.New().String(), now.Unix())
 }
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/events"
+	"superQiMiniAppBackend/notification"
+	"superQiMiniAppBackend/scanner"
+	"superQiMiniAppBackend/storage"
+	"superQiMiniAppBackend/webhook"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Clock tells the time to handlers and background workers, so tests can control it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Config holds the dependencies of a Server. Only Gateway is required, missing stores
+// start empty and the rest defaults to the process-wide event bus, clock and logger.
+type Config struct {
+	Gateway    alipay.Gateway
+	Events     *events.Bus
+	Clock      Clock
+	Logger     *log.Logger
+	Payments   *PaymentStatusStore
+	Agreements *AgreementStore
+	Sessions   *UserSessionStore
+	Campaigns  *CampaignStore
+
+	// Notification and file services default to the process-wide ones set up by the
+	// Init functions of their packages
+	Templates   *notification.Registry
+	SendLog     *notification.SendLog
+	Preferences *notification.PreferenceStore
+	FileStore   storage.FileStore
+	FileIndex   *storage.Index
+	Uploads     *storage.UploadSessionStore
+	Scanner     scanner.Scanner
+	Webhooks    *webhook.Dispatcher
+
+	// CampaignRate is the number of campaign messages sent per second, across every
+	// campaign of the server. It defaults to the CAMPAIGN_RATE_PER_SECOND variable.
+	CampaignRate int
+
+	// TenantID is written into the tokens the server issues, empty for a single tenant
+	TenantID string
+	// MerchantID owns the payments of the server, only its sessions receive their order
+	// events. It defaults to the MERCHANT_ID variable.
+	MerchantID string
+	// Currencies accepted for payments, the first is the default. IQD when empty.
+	Currencies []string
+	// BaseURL and FrontendURL default to the BASE_URL and FRONTEND_URL variables
+	BaseURL     string
+	FrontendURL string
+	// AgreementRedirectHosts may receive the user back from an agreement authorization
+	// besides the hosts of BaseURL and FrontendURL. They default to the comma separated
+	// AGREEMENT_REDIRECT_HOSTS variable.
+	AgreementRedirectHosts []string
+}
+
+// Server serves the mini app API with the dependencies it was created with
+type Server struct {
+	gateway        alipay.Gateway
+	events         *events.Bus
+	clock          Clock
+	logger         *log.Logger
+	payments       *PaymentStatusStore
+	agreements     *AgreementStore
+	sessions       *UserSessionStore
+	campaigns      *CampaignStore
+	tenantID       string
+	merchantID     string
+	currencies     []string
+	baseURL        string
+	frontendURL    string
+	redirectHosts  map[string]bool
+	templates      *notification.Registry
+	sendLog        *notification.SendLog
+	preferences    *notification.PreferenceStore
+	fileStore      storage.FileStore
+	files          *storage.Index
+	uploads        *storage.UploadSessionStore
+	scanner        scanner.Scanner
+	webhooks       *webhook.Dispatcher
+	receipts       *ReceiptSender
+	merchantEvents *MerchantEventHub
+	fileScans      *fileScanQueue
+
+	// done is closed by Close to stop the background workers
+	done      chan struct{}
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+
+	// Campaign messages are spaced by campaignInterval, nextCampaignSend is the next free slot
+	campaignMu       sync.Mutex
+	campaignInterval time.Duration
+	nextCampaignSend time.Time
+}
+
+// NewServer creates a server from config, filling in defaults for what it leaves out
+func NewServer(config Config) (*Server, error) {
+	if config.Gateway == nil {
+		return nil, errors.New("a gateway is required")
+	}
+	if config.Events == nil {
+		config.Events = events.Default
+	}
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+	if config.Payments == nil {
+		config.Payments = NewPaymentStatusStore()
+	}
+	if config.Agreements == nil {
+		agreements, err := OpenAgreementStore(config.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		config.Agreements = agreements
+	}
+	if config.Sessions == nil {
+		config.Sessions = NewUserSessionStore()
+	}
+	if config.Campaigns == nil {
+		campaigns, err := OpenCampaignStore(config.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		config.Campaigns = campaigns
+	}
+	if config.Templates == nil {
+		config.Templates = notification.Templates
+	}
+	if config.SendLog == nil {
+		config.SendLog = notification.Log
+	}
+	if config.Preferences == nil {
+		config.Preferences = notification.UserPreferences
+	}
+	if config.FileStore == nil {
+		config.FileStore = storage.Default
+	}
+	if config.FileIndex == nil {
+		config.FileIndex = storage.Files
+	}
+	if config.Uploads == nil {
+		config.Uploads = storage.Uploads
+	}
+	if config.Scanner == nil {
+		config.Scanner = scanner.Default
+	}
+	if config.Webhooks == nil {
+		config.Webhooks = webhook.Default
+	}
+	if config.CampaignRate <= 0 {
+		config.CampaignRate, _ = strconv.Atoi(os.Getenv("CAMPAIGN_RATE_PER_SECOND"))
+	}
+	if config.CampaignRate <= 0 {
+		config.CampaignRate = defaultCampaignRatePerSecond
+	}
+	if config.MerchantID == "" {
+		config.MerchantID = os.Getenv("MERCHANT_ID")
+	}
+	if len(config.Currencies) == 0 {
+		config.Currencies = []string{"IQD"}
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = os.Getenv("BASE_URL")
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = "http://localhost:1999"
+	}
+	if config.FrontendURL == "" {
+		config.FrontendURL = os.Getenv("FRONTEND_URL")
+	}
+	if config.FrontendURL == "" {
+		config.FrontendURL = "http://172.20.10.2:5173" // Default frontend URL
+	}
+	if len(config.AgreementRedirectHosts) == 0 {
+		for _, host := range strings.Split(os.Getenv("AGREEMENT_REDIRECT_HOSTS"), ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				config.AgreementRedirectHosts = append(config.AgreementRedirectHosts, host)
+			}
+		}
+	}
+	redirectHosts := make(map[string]bool)
+	for _, configured := range []string{config.BaseURL, config.FrontendURL} {
+		if parsed, err := url.Parse(configured); err == nil && parsed.Hostname() != "" {
+			redirectHosts[strings.ToLower(parsed.Hostname())] = true
+		}
+	}
+	for _, host := range config.AgreementRedirectHosts {
+		redirectHosts[strings.ToLower(host)] = true
+	}
+
+	return &Server{
+		gateway:        config.Gateway,
+		events:         config.Events,
+		clock:          config.Clock,
+		logger:         config.Logger,
+		payments:       config.Payments,
+		agreements:     config.Agreements,
+		sessions:       config.Sessions,
+		campaigns:      config.Campaigns,
+		tenantID:       config.TenantID,
+		merchantID:     config.MerchantID,
+		currencies:     config.Currencies,
+		baseURL:        config.BaseURL,
+		frontendURL:    config.FrontendURL,
+		redirectHosts:  redirectHosts,
+		templates:      config.Templates,
+		sendLog:        config.SendLog,
+		preferences:    config.Preferences,
+		fileStore:      config.FileStore,
+		files:          config.FileIndex,
+		uploads:        config.Uploads,
+		scanner:        config.Scanner,
+		webhooks:       config.Webhooks,
+		receipts:       newReceiptSender(config.Clock),
+		merchantEvents: newMerchantEventHub(),
+		fileScans:      newFileScanQueue(),
+		done:           make(chan struct{}),
+
+		campaignInterval: time.Second / time.Duration(config.CampaignRate),
+	}, nil
+}
+
+// Close stops the background workers the server started and waits for them to return
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.workers.Wait()
+}
+
+// currency is the currency of payments and refunds that do not name one
+func (s *Server) currency() string {
+	return s.currencies[0]
+}
+
+// acceptsCurrency reports whether payments may be made in currency
+func (s *Server) acceptsCurrency(currency string) bool {
+	for _, accepted := range s.currencies {
+		if accepted == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// Register mounts every endpoint on group and starts the background workers behind them.
+// It subscribes to the event bus, so it must be called once per server.
+func (s *Server) Register(group fiber.Router) {
+	s.registerAuthEndpoint(group)
+	s.registerUserInfoEndpoint(group)
+	s.registerMerchantInfoEndpoint(group)
+	s.registerPaymentEndpoint(group)
+	s.registerRefundEndpoint(group)
+	s.registerAgreementEndpoint(group)
+	s.registerNotificationEndpoint(group)
+	s.registerCampaignEndpoint(group)
+	s.registerInquiryEndpoint(group)
+	s.registerUploadFileEndpoint(group)
+	s.registerChunkedUploadEndpoint(group)
+	s.registerFilesEndpoint(group)
+	s.registerInquiryPaymentEndpoint(group)
+	s.registerEscrowEndpoint(group)
+	s.registerMerchantEventsEndpoint(group)
+	s.registerWebhookEndpoint(group)
+}
@@ -0,0 +1,409 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/alipay"
+	"superQiMiniAppBackend/api"
+	"superQiMiniAppBackend/events"
+	"superQiMiniAppBackend/jwe"
+	"superQiMiniAppBackend/mockgateway"
+	"superQiMiniAppBackend/notification"
+	"superQiMiniAppBackend/scanner"
+	"superQiMiniAppBackend/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	testClientID = "test-client"
+	testJWEKey   = "integration_test_key_0123456789!"
+	testAdminKey = "test-admin-key"
+)
+
+// The suite runs against a mock gateway on a loopback port, signed and verified like the real one
+var (
+	gateway *mockgateway.Gateway
+	client  *alipay.Client
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "api-test-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"MINI_APP_ID":                   "test-app",
+		"NOTIFICATION_TEMPLATES_PATH":   "",
+		"NOTIFICATION_LOG_PATH":         filepath.Join(dir, "notification_log.json"),
+		"NOTIFICATION_PREFERENCES_PATH": filepath.Join(dir, "notification_preferences.json"),
+		"AGREEMENTS_PATH":               filepath.Join(dir, "agreements.json"),
+		"CAMPAIGNS_PATH":                filepath.Join(dir, "campaigns.json"),
+		"STORAGE_BACKEND":               "local",
+		"STORAGE_LOCAL_DIR":             filepath.Join(dir, "files"),
+		"FILE_INDEX_PATH":               filepath.Join(dir, "file_index.json"),
+		"UPLOAD_SESSIONS_PATH":          filepath.Join(dir, "upload_sessions.json"),
+		"UPLOAD_CHUNK_DIR":              filepath.Join(dir, "chunks"),
+		"SCANNER_BACKEND":               "none",
+		"RECEIPT_PUSH_ENABLED":          "false",
+		"ADMIN_API_KEY":                 testAdminKey,
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	jwe.SetKey([]byte(testJWEKey))
+
+	for _, initialize := range []func() error{
+		notification.InitTemplateRegistry,
+		notification.InitSendLog,
+		notification.InitPreferences,
+		storage.InitFileStore,
+		scanner.InitScanner,
+	} {
+		if err := initialize(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	keys := filepath.Join(dir, "keys")
+	if err := mockgateway.GenerateKeys(keys); err != nil {
+		log.Fatal(err)
+	}
+	merchantKey, err := mockgateway.LoadPublicKey(filepath.Join(keys, "merchant_public_key.pem"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	gatewayKey, err := mockgateway.LoadPrivateKey(filepath.Join(keys, "gateway_private_key.pem"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	gatewayURL := "http://" + listener.Addr().String()
+
+	// Payments wait for the test to complete them and refunds succeed at once unless programmed
+	gateway, err = mockgateway.New(mockgateway.Config{
+		ClientID:          testClientID,
+		MerchantPublicKey: merchantKey,
+		GatewayPrivateKey: gatewayKey,
+		PublicURL:         gatewayURL,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go gateway.Serve(listener)
+	defer gateway.Shutdown()
+	// Pooled keep-alive connections of the client can keep the shutdown waiting until they expire
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	client, err = alipay.NewClient(alipay.Config{
+		GatewayURL:             gatewayURL,
+		MerchantPrivateKeyPath: filepath.Join(keys, "merchant_private_key.pem"),
+		AlipayPublicKeyPath:    filepath.Join(keys, "gateway_public_key.pem"),
+		ClientID:               testClientID,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return m.Run()
+}
+
+// harness is one server with its own event bus, stores and clock, mounted on a fresh app
+type harness struct {
+	t          *testing.T
+	app        *fiber.App
+	server     *api.Server
+	clock      *fakeClock
+	bus        *events.Bus
+	agreements *api.AgreementStore
+	sessions   *api.UserSessionStore
+
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	return newHarnessWith(t, nil)
+}
+
+// newHarnessWith lets configure change the server config before the server is created
+func newHarnessWith(t *testing.T, configure func(*api.Config)) *harness {
+	t.Helper()
+	t.Cleanup(gateway.ResetScenarios)
+
+	agreements, err := api.NewAgreementStore(filepath.Join(t.TempDir(), "agreements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaigns, err := api.NewCampaignStore(filepath.Join(t.TempDir(), "campaigns.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		t:          t,
+		app:        fiber.New(fiber.Config{DisableStartupMessage: true}),
+		clock:      newFakeClock(time.Now()),
+		bus:        events.NewBus(),
+		agreements: agreements,
+		sessions:   api.NewUserSessionStore(),
+	}
+	h.bus.SubscribeAll(func(event events.Event) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.events = append(h.events, event)
+	})
+
+	config := api.Config{
+		Gateway:    client,
+		Events:     h.bus,
+		Clock:      h.clock,
+		Agreements: h.agreements,
+		Sessions:   h.sessions,
+		Campaigns:  campaigns,
+
+		// Agreement authorizations redirect back to the merchant's frontend
+		FrontendURL: "https://merchant.example",
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	server, err := api.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Register(h.app.Group("/api"))
+	t.Cleanup(server.Close)
+	h.server = server
+	return h
+}
+
+// response is a decoded JSON answer of the app
+type response struct {
+	Status int
+	Body   map[string]interface{}
+	Raw    []byte
+}
+
+func (r response) String(key string) string {
+	value, _ := r.Body[key].(string)
+	return value
+}
+
+func (r response) Bool(key string) bool {
+	value, _ := r.Body[key].(bool)
+	return value
+}
+
+// do sends a request with a JSON body, or none when body is nil
+func (h *harness) do(method, path string, body interface{}) response {
+	h.t.Helper()
+	return h.send(h.request(method, path, body))
+}
+
+// doAsAdmin sends a request to an admin endpoint with the admin key
+func (h *harness) doAsAdmin(method, path string, body interface{}) response {
+	h.t.Helper()
+
+	request := h.request(method, path, body)
+	request.Header.Set("X-Admin-Key", testAdminKey)
+	return h.send(request)
+}
+
+func (h *harness) request(method, path string, body interface{}) *http.Request {
+	h.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	return request
+}
+
+func (h *harness) send(request *http.Request) response {
+	h.t.Helper()
+
+	result, err := h.app.Test(request, -1)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", request.Method, request.URL.Path, err)
+	}
+	defer result.Body.Close()
+
+	raw, err := io.ReadAll(result.Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	decoded := map[string]interface{}{}
+	json.Unmarshal(raw, &decoded)
+	return response{Status: result.StatusCode, Body: decoded, Raw: raw}
+}
+
+// doWhileAdvancing sends a request whose handler waits on the clock, advancing it by step
+// until the handler answers
+func (h *harness) doWhileAdvancing(step time.Duration, method, path string, body interface{}) response {
+	h.t.Helper()
+
+	done := make(chan response, 1)
+	go func() {
+		done <- h.do(method, path, body)
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case result := <-done:
+			return result
+		case <-deadline:
+			h.t.Fatalf("%s %s did not answer", method, path)
+		case <-time.After(5 * time.Millisecond):
+			h.clock.Advance(step)
+		}
+	}
+}
+
+// eventually advances the clock by step until condition holds
+func (h *harness) eventually(step time.Duration, description string, condition func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", description)
+		}
+		h.clock.Advance(step)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// login signs a user in through the apply-token endpoint and returns their JWE and user ID
+func (h *harness) login(authCode string) (string, string) {
+	h.t.Helper()
+
+	result := h.do(http.MethodPost, "/api/auth/apply-token", fiber.Map{"auth_code": authCode})
+	if result.Status != fiber.StatusOK || result.String("token") == "" {
+		h.t.Fatalf("apply-token answered %d: %s", result.Status, result.Raw)
+	}
+
+	claims, err := jwe.ParseAndValidateJWE(result.String("token"))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return result.String("token"), claims.UserID
+}
+
+// publishedTypes lists the types of the events published so far, in order
+func (h *harness) publishedTypes() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	types := make([]string, 0, len(h.events))
+	for _, event := range h.events {
+		types = append(types, event.Type())
+	}
+	return types
+}
+
+func (h *harness) published(eventType string) bool {
+	for _, published := range h.publishedTypes() {
+		if published == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayCalled reports whether the gateway received a request on path with the field set to value
+func gatewayCalled(path, field, value string) bool {
+	for _, call := range gateway.Calls(path) {
+		if fmt.Sprint(call.Request[field]) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeClock only moves when advanced, firing the timers that fall due
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"superQiMiniAppBackend/events"
+	"superQiMiniAppBackend/jwe"
+	"superQiMiniAppBackend/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// TenantHeader names the tenant of a request
+const TenantHeader = "X-Tenant-ID"
+
+// TenantRouter serves several tenants, each with its own Server, and therefore its own
+// gateway client, stores and event bus. A request goes to the tenant in the claims of its
+// token, then the one named by TenantHeader, then the one of its subdomain, and otherwise
+// the default tenant. A token is only accepted by the tenant that issued it.
+type TenantRouter struct {
+	registry *tenant.Registry
+	servers  map[string]*Server
+	handlers map[string]fasthttp.RequestHandler
+}
+
+// NewTenantRouter creates a server for every tenant of registry from the config newConfig
+// returns for it. Servers get an event bus of their own unless the config sets one.
+func NewTenantRouter(registry *tenant.Registry, newConfig func(tenant.Tenant) (Config, error)) (*TenantRouter, error) {
+	router := &TenantRouter{
+		registry: registry,
+		servers:  make(map[string]*Server),
+		handlers: make(map[string]fasthttp.RequestHandler),
+	}
+
+	for _, t := range registry.Tenants() {
+		config, err := newConfig(t)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+		config.TenantID = t.ID
+		if len(config.Currencies) == 0 {
+			config.Currencies = t.Currencies
+		}
+		if config.BaseURL == "" {
+			config.BaseURL = t.BaseURL
+		}
+		if config.FrontendURL == "" {
+			config.FrontendURL = t.FrontendURL
+		}
+		if config.Events == nil {
+			config.Events = events.NewBus()
+		}
+
+		server, err := NewServer(config)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+		router.servers[t.ID] = server
+	}
+	return router, nil
+}
+
+// Close stops the background workers of every tenant
+func (r *TenantRouter) Close() {
+	for _, server := range r.servers {
+		server.Close()
+	}
+}
+
+// Mount registers the endpoints of every tenant under prefix and routes the requests
+// app receives there to them
+func (r *TenantRouter) Mount(app *fiber.App, prefix string) {
+	for id, server := range r.servers {
+		tenantApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+		server.Register(tenantApp.Group(prefix))
+		r.handlers[id] = tenantApp.Handler()
+	}
+
+	app.Use(prefix, func(ctx *fiber.Ctx) error {
+		t, err := r.resolve(ctx)
+		if err != nil {
+			return err
+		}
+		r.handlers[t.ID](ctx.Context())
+		return nil
+	})
+}
+
+// resolve finds the tenant of a request
+func (r *TenantRouter) resolve(ctx *fiber.Ctx) (tenant.Tenant, error) {
+	var requested *tenant.Tenant
+	if id := ctx.Get(TenantHeader); id != "" {
+		t, exists := r.registry.Get(id)
+		if !exists {
+			log.Printf("[ERROR] Unknown tenant %s\n", id)
+			return tenant.Tenant{}, fiber.NewError(fiber.StatusNotFound, "Unknown tenant "+id)
+		}
+		requested = &t
+	} else if t, exists := r.registry.ForHost(ctx.Hostname()); exists {
+		requested = &t
+	}
+
+	if claimed := tokenTenant(ctx); claimed != "" {
+		if requested != nil && requested.ID != claimed {
+			log.Printf("[ERROR] Token of tenant %s sent to tenant %s\n", claimed, requested.ID)
+			return tenant.Tenant{}, fiber.NewError(fiber.StatusForbidden, "Token belongs to another tenant")
+		}
+		t, exists := r.registry.Get(claimed)
+		if !exists {
+			return tenant.Tenant{}, fiber.NewError(fiber.StatusUnauthorized, "Token belongs to an unknown tenant")
+		}
+		return t, nil
+	}
+
+	if requested != nil {
+		return *requested, nil
+	}
+	if t, exists := r.registry.Default(); exists {
+		return t, nil
+	}
+	return tenant.Tenant{}, fiber.NewError(fiber.StatusBadRequest, "Tenant is required, set the "+TenantHeader+" header")
+}
+
+// tokenTenant returns the tenant in the claims of the token a request carries, as a Bearer
+// token, a token query or form field, or a token field of its JSON body. Requests without
+// a valid token have none, the endpoints reject them as before.
+func tokenTenant(ctx *fiber.Ctx) string {
+	token := strings.TrimPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+	if token == "" {
+		token = ctx.Query("token")
+	}
+	if token == "" && strings.HasPrefix(ctx.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		var body struct {
+			Token string `json:"token"`
+		}
+		if json.Unmarshal(ctx.Body(), &body) == nil {
+			token = body.Token
+		}
+	}
+	if token == "" {
+		token = ctx.FormValue("token")
+	}
+	if token == "" {
+		return ""
+	}
+
+	claims, err := jwe.ParseAndValidateJWE(token)
+	if err != nil {
+		return ""
+	}
+	return claims.TenantID
+}
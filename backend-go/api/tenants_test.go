@@ -0,0 +1,246 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/api"
+	"superQiMiniAppBackend/jwe"
+	"superQiMiniAppBackend/notification"
+	"superQiMiniAppBackend/storage"
+	"superQiMiniAppBackend/tenant"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tenants serves two tenants on the mock gateway, each with its own session store, send log,
+// preferences and files, opened the way the backend opens them
+type tenants struct {
+	t        *testing.T
+	app      *fiber.App
+	sessions map[string]*api.UserSessionStore
+}
+
+func newTenants(t *testing.T, defaultID string) *tenants {
+	t.Helper()
+	t.Cleanup(gateway.ResetScenarios)
+
+	definitions := []tenant.Tenant{
+		{ID: "north", ClientID: testClientID, GatewayURL: "unused", MerchantPrivateKeyPath: "unused", AlipayPublicKeyPath: "unused"},
+		{ID: "south", Subdomain: "sud", ClientID: testClientID, GatewayURL: "unused", MerchantPrivateKeyPath: "unused", AlipayPublicKeyPath: "unused", Currencies: []string{"USD"}},
+	}
+	registry, err := tenant.NewRegistry(definitions, defaultID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &tenants{
+		t:        t,
+		app:      fiber.New(fiber.Config{DisableStartupMessage: true}),
+		sessions: make(map[string]*api.UserSessionStore),
+	}
+	router, err := api.NewTenantRouter(registry, func(definition tenant.Tenant) (api.Config, error) {
+		ts.sessions[definition.ID] = api.NewUserSessionStore()
+		config := api.Config{
+			Gateway:  client,
+			Clock:    newFakeClock(time.Now()),
+			Sessions: ts.sessions[definition.ID],
+		}
+
+		var err error
+		if config.SendLog, err = notification.OpenSendLog(definition.ID); err != nil {
+			return api.Config{}, err
+		}
+		t.Cleanup(config.SendLog.Close)
+		if config.Preferences, err = notification.OpenPreferences(definition.ID); err != nil {
+			return api.Config{}, err
+		}
+		if config.FileStore, err = storage.OpenFileStore(definition.ID); err != nil {
+			return api.Config{}, err
+		}
+		if config.FileIndex, err = storage.OpenFileIndex(definition.ID); err != nil {
+			return api.Config{}, err
+		}
+		return config, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Mount(ts.app, "/api")
+	t.Cleanup(router.Close)
+	return ts
+}
+
+// do sends a JSON request to the tenant named by header, or to the one host and token resolve to
+func (ts *tenants) do(method, path, host, header string, body interface{}) response {
+	ts.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		payload, _ := json.Marshal(body)
+		reader = bytes.NewReader(payload)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	request.Host = host
+	if body != nil {
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	if header != "" {
+		request.Header.Set(api.TenantHeader, header)
+	}
+
+	result, err := ts.app.Test(request, -1)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer result.Body.Close()
+	raw, _ := io.ReadAll(result.Body)
+	decoded := map[string]interface{}{}
+	json.Unmarshal(raw, &decoded)
+	return response{Status: result.StatusCode, Body: decoded, Raw: raw}
+}
+
+func (ts *tenants) login(host, header string) (string, string) {
+	ts.t.Helper()
+
+	result := ts.do(http.MethodPost, "/api/auth/apply-token", host, header, fiber.Map{"auth_code": "tenant-code"})
+	if result.Status != fiber.StatusOK {
+		ts.t.Fatalf("apply-token answered %d: %s", result.Status, result.Raw)
+	}
+	claims, err := jwe.ParseAndValidateJWE(result.String("token"))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return result.String("token"), claims.TenantID
+}
+
+func TestTenantsResolvedAndPartitioned(t *testing.T) {
+	ts := newTenants(t, "")
+
+	token, issuer := ts.login("example.com", "north")
+	if issuer != "north" {
+		t.Fatalf("token issued for tenant %q", issuer)
+	}
+	if len(ts.sessions["north"].List()) != 1 || len(ts.sessions["south"].List()) != 0 {
+		t.Fatal("session was not stored by the north tenant only")
+	}
+
+	// The token finds its tenant without a header, and is refused by the other one
+	if result := ts.do(http.MethodPost, "/api/user/info", "example.com", "", fiber.Map{"token": token}); result.Status != fiber.StatusOK {
+		t.Fatalf("user info answered %d: %s", result.Status, result.Raw)
+	}
+	if result := ts.do(http.MethodPost, "/api/user/info", "example.com", "south", fiber.Map{"token": token}); result.Status != fiber.StatusForbidden {
+		t.Fatalf("other tenant answered %d: %s", result.Status, result.Raw)
+	}
+
+	// Payments made for one tenant are unknown to the other
+	created := ts.do(http.MethodPost, "/api/payment/create", "example.com", "", fiber.Map{"token": token})
+	paymentID := created.String("paymentId")
+	if created.Status != fiber.StatusOK || paymentID == "" {
+		t.Fatalf("payment create answered %d: %s", created.Status, created.Raw)
+	}
+	if result := ts.do(http.MethodGet, "/api/payment/status/"+paymentID, "example.com", "north", nil); result.Status != fiber.StatusOK {
+		t.Fatalf("north payment status answered %d: %s", result.Status, result.Raw)
+	}
+	if result := ts.do(http.MethodGet, "/api/payment/status/"+paymentID, "example.com", "south", nil); result.Status != fiber.StatusNotFound {
+		t.Fatalf("south payment status answered %d: %s", result.Status, result.Raw)
+	}
+	if !gatewayCalled("/v1/payments/pay", "paymentAmount", "map[currency:IQD value:1000]") {
+		t.Fatal("north payment was not made in IQD")
+	}
+
+	// The subdomain selects the south tenant, which pays in its own currency
+	southToken, issuer := ts.login("sud.example.com:1999", "")
+	if issuer != "south" || len(ts.sessions["south"].List()) != 1 {
+		t.Fatalf("subdomain login was issued for tenant %q", issuer)
+	}
+	if created := ts.do(http.MethodPost, "/api/payment/create", "example.com", "", fiber.Map{"token": southToken}); created.Status != fiber.StatusOK {
+		t.Fatalf("south payment create answered %d: %s", created.Status, created.Raw)
+	}
+	if !gatewayCalled("/v1/payments/pay", "paymentAmount", "map[currency:USD value:1000]") {
+		t.Fatal("south payment was not made in USD")
+	}
+
+	if result := ts.do(http.MethodGet, "/api/payment/status/"+paymentID, "example.com", "west", nil); result.Status != fiber.StatusNotFound {
+		t.Fatalf("unknown tenant answered %d: %s", result.Status, result.Raw)
+	}
+	if result := ts.do(http.MethodGet, "/api/payment/status/"+paymentID, "example.com", "", nil); result.Status != fiber.StatusBadRequest {
+		t.Fatalf("unresolved tenant answered %d: %s", result.Status, result.Raw)
+	}
+}
+
+func TestDefaultTenant(t *testing.T) {
+	ts := newTenants(t, "south")
+
+	if _, issuer := ts.login("localhost:1999", ""); issuer != "south" {
+		t.Fatalf("token issued for tenant %q", issuer)
+	}
+}
+
+func TestTenantsKeepNotificationsAndFilesApart(t *testing.T) {
+	ts := newTenants(t, "")
+	northToken, _ := ts.login("example.com", "north")
+	southToken, _ := ts.login("sud.example.com", "")
+
+	// The same user has preferences of their own in every tenant
+	updated := ts.do(http.MethodPut, "/api/notification/preferences", "example.com", "", fiber.Map{
+		"token":  northToken,
+		"optOut": []string{notification.CategoryMarketing},
+	})
+	if updated.Status != fiber.StatusOK {
+		t.Fatalf("preferences update answered %d: %s", updated.Status, updated.Raw)
+	}
+	north := ts.do(http.MethodGet, "/api/notification/preferences?token="+northToken, "example.com", "", nil)
+	if !strings.Contains(string(north.Raw), `"optOut":["marketing"]`) {
+		t.Errorf("north preferences answered %d: %s", north.Status, north.Raw)
+	}
+	south := ts.do(http.MethodGet, "/api/notification/preferences?token="+southToken, "example.com", "", nil)
+	preferences, _ := south.Body["preferences"].(map[string]interface{})
+	if optOut, _ := preferences["optOut"].([]interface{}); south.Status != fiber.StatusOK || len(optOut) != 0 {
+		t.Errorf("south preferences answered %d: %s", south.Status, south.Raw)
+	}
+
+	// Messages are logged by the tenant that sent them
+	inbox := ts.do(http.MethodPost, "/api/notification/send-inbox", "example.com", "", fiber.Map{
+		"token":   northToken,
+		"title":   "Hello",
+		"content": "Your order has shipped",
+	})
+	requestID := inbox.String("requestId")
+	if inbox.Status != fiber.StatusOK || requestID == "" {
+		t.Fatalf("send-inbox answered %d: %s", inbox.Status, inbox.Raw)
+	}
+	if result := ts.do(http.MethodGet, "/api/notification/"+requestID+"?token="+northToken, "example.com", "", nil); result.Status != fiber.StatusOK {
+		t.Errorf("north notification answered %d: %s", result.Status, result.Raw)
+	}
+	if result := ts.do(http.MethodGet, "/api/notification/"+requestID+"?token="+southToken, "example.com", "", nil); result.Status != fiber.StatusNotFound {
+		t.Errorf("south notification answered %d: %s", result.Status, result.Raw)
+	}
+
+	// Files are indexed by the tenant they were uploaded to
+	upload := uploadRequest(t, northToken, "tenant.pdf", []byte("%PDF-1.4\n% "+t.Name()+" "+time.Now().String()+"\n%%EOF\n"))
+	uploaded, err := ts.app.Test(upload, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		FileID string `json:"fileId"`
+	}
+	json.NewDecoder(uploaded.Body).Decode(&file)
+	uploaded.Body.Close()
+	if uploaded.StatusCode != fiber.StatusOK || file.FileID == "" {
+		t.Fatalf("upload answered %d", uploaded.StatusCode)
+	}
+	if result := ts.do(http.MethodGet, "/api/files/"+file.FileID+"/meta?token="+northToken, "example.com", "", nil); result.Status != fiber.StatusOK {
+		t.Errorf("north file answered %d: %s", result.Status, result.Raw)
+	}
+	if result := ts.do(http.MethodGet, "/api/files/"+file.FileID+"/meta?token="+southToken, "example.com", "", nil); result.Status != fiber.StatusNotFound {
+		t.Errorf("south file answered %d: %s", result.Status, result.Raw)
+	}
+}
@@ -1,154 +1,309 @@
 package api
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"path/filepath"
+	"strconv"
+	"superQiMiniAppBackend/storage"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 const (
-	uploadDir     = "./uploads"
 	maxUploadSize = 10 * 1024 * 1024 // 10MB
 )
 
 type UploadFileResponse struct {
-	Success    bool   `json:"success"`
-	FileName   string `json:"fileName,omitempty"`
-	FileSize   int64  `json:"fileSize,omitempty"`
-	FileType   string `json:"fileType,omitempty"`
-	FilePath   string `json:"filePath,omitempty"`
-	MD5        string `json:"md5,omitempty"`
-	Message    string `json:"message,omitempty"`
-	UploadTime string `json:"uploadTime,omitempty"`
+	Success        bool              `json:"success"`
+	FileID         string            `json:"fileId,omitempty"`
+	FileName       string            `json:"fileName,omitempty"`
+	FileSize       int64             `json:"fileSize,omitempty"`
+	FileType       string            `json:"fileType,omitempty"`
+	URL            string            `json:"url,omitempty"`
+	ScanStatus     string            `json:"scanStatus,omitempty"`
+	DerivativeURLs map[string]string `json:"derivativeUrls,omitempty"`
+	MD5            string            `json:"md5,omitempty"`
+	Message        string            `json:"message,omitempty"`
+	ErrorCode      string            `json:"errorCode,omitempty"`
+	UploadTime     string            `json:"uploadTime,omitempty"`
 }
 
-func InitUploadFileEndpoint(group fiber.Router) {
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Printf("[ERROR] Failed to create upload directory: %v\n", err)
-	}
-
-	group.Post("/upload", handleFileUpload)
+func (s *Server) registerUploadFileEndpoint(group fiber.Router) {
+	group.Post("/upload", withUploadPolicy(loadUploadPolicy("UPLOAD", documentUploadPolicy)), s.handleFileUpload)
 }
 
-func handleFileUpload(ctx *fiber.Ctx) error {
-	log.Println("=================================================================")
-	log.Println("FILE UPLOAD REQUEST RECEIVED")
-	log.Println("=================================================================")
+func (s *Server) handleFileUpload(ctx *fiber.Ctx) error {
+	s.logger.Println("=================================================================")
+	s.logger.Println("FILE UPLOAD REQUEST RECEIVED")
+	s.logger.Println("=================================================================")
+
+	// Uploaded files belong to the caller, who is identified by the JWE
+	ownerID, err := s.authenticateFileOwner(ctx)
+	if err != nil {
+		return uploadFailure(ctx, fiber.StatusUnauthorized, UploadErrorUnauthorized, "A valid token is required to upload files")
+	}
+
+	policy, _ := ctx.Locals("uploadPolicy").(UploadPolicy)
 
 	// Get the file from form data
 	fileKey := ctx.FormValue("fileName", "file")
 	fileType := ctx.FormValue("fileType", "")
 
-	log.Printf("[INFO] File key: %s\n", fileKey)
-	log.Printf("[INFO] File type: %s\n", fileType)
+	s.logger.Printf("[INFO] File key: %s\n", fileKey)
+	s.logger.Printf("[INFO] File type: %s\n", fileType)
 
 	// Get the uploaded file
 	file, err := ctx.FormFile(fileKey)
 	if err != nil {
-		log.Printf("[ERROR] Failed to get file from form: %v\n", err)
-		return ctx.Status(fiber.StatusBadRequest).JSON(UploadFileResponse{
-			Success: false,
-			Message: "Failed to get file from form: " + err.Error(),
-		})
-	}
-
-	// Validate file size
-	if file.Size > maxUploadSize {
-		log.Printf("[ERROR] File too large: %d bytes (max: %d bytes)\n", file.Size, maxUploadSize)
-		return ctx.Status(fiber.StatusBadRequest).JSON(UploadFileResponse{
-			Success: false,
-			Message: fmt.Sprintf("File too large. Maximum size is %d MB", maxUploadSize/(1024*1024)),
-		})
-	}
-
-	// Validate file type if provided
-	if fileType != "" {
-		validTypes := map[string]bool{
-			"PDF": true, "DOC": true, "DOCX": true,
-			"XLS": true, "XLSX": true, "PPT": true, "PPTX": true,
-		}
-		if !validTypes[fileType] {
-			log.Printf("[WARNING] Unsupported file type: %s\n", fileType)
-		}
+		s.logger.Printf("[ERROR] Failed to get file from form: %v\n", err)
+		return uploadFailure(ctx, fiber.StatusBadRequest, UploadErrorFileMissing, "Failed to get file from form: "+err.Error())
 	}
 
-	log.Printf("[INFO] File name: %s\n", file.Filename)
-	log.Printf("[INFO] File size: %d bytes (%.2f KB)\n", file.Size, float64(file.Size)/1024)
-	log.Printf("[INFO] Content type: %s\n", file.Header.Get("Content-Type"))
+	s.logger.Printf("[INFO] File name: %s\n", file.Filename)
+	s.logger.Printf("[INFO] File size: %d bytes (%.2f KB)\n", file.Size, float64(file.Size)/1024)
+	s.logger.Printf("[INFO] Content type: %s\n", file.Header.Get("Content-Type"))
 
 	// Open the uploaded file
 	src, err := file.Open()
 	if err != nil {
-		log.Printf("[ERROR] Failed to open uploaded file: %v\n", err)
-		return ctx.Status(fiber.StatusInternalServerError).JSON(UploadFileResponse{
-			Success: false,
-			Message: "Failed to open uploaded file: " + err.Error(),
-		})
+		s.logger.Printf("[ERROR] Failed to open uploaded file: %v\n", err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to open uploaded file")
 	}
 	defer src.Close()
 
-	// Generate unique filename to avoid conflicts
-	timestamp := time.Now().Format("20060102-150405")
-	ext := filepath.Ext(file.Filename)
-	baseFilename := file.Filename[:len(file.Filename)-len(ext)]
-	uniqueFilename := fmt.Sprintf("%s_%s%s", baseFilename, timestamp, ext)
-	destPath := filepath.Join(uploadDir, uniqueFilename)
-
-	// Create destination file
-	dst, err := os.Create(destPath)
+	// The type comes from the file content, the client's fileType and Content-Type are only cross-checked
+	upload, err := validateUpload(policy, file.Filename, fileType, src, file.Size)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create destination file: %v\n", err)
-		return ctx.Status(fiber.StatusInternalServerError).JSON(UploadFileResponse{
-			Success: false,
-			Message: "Failed to create destination file: " + err.Error(),
-		})
+		rejection := err.(*uploadError)
+		s.logger.Printf("[ERROR] Upload rejected (%s): %s\n", rejection.Code, rejection.Message)
+		return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
 	}
-	defer dst.Close()
 
-	// Calculate MD5 hash while copying
-	hash := md5.New()
-	multiWriter := io.MultiWriter(dst, hash)
+	s.logger.Printf("[INFO] Detected type: %s (%s)\n", upload.Kind, upload.ContentType)
 
-	// Copy file content
-	bytesWritten, err := io.Copy(multiWriter, src)
+	if err := s.checkStorageQuota(ownerID, file.Size); err != nil {
+		rejection := err.(*uploadError)
+		s.logger.Printf("[ERROR] Upload rejected (%s): %s\n", rejection.Code, rejection.Message)
+		return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
+	}
+
+	record, err := s.storeUpload(ownerID, upload, src, file.Size)
+	if rejection, ok := err.(*uploadError); ok {
+		s.logger.Printf("[ERROR] Upload rejected (%s): %s\n", rejection.Code, rejection.Message)
+		return uploadFailure(ctx, rejection.Status, rejection.Code, rejection.Message)
+	}
 	if err != nil {
-		log.Printf("[ERROR] Failed to save file: %v\n", err)
-		return ctx.Status(fiber.StatusInternalServerError).JSON(UploadFileResponse{
-			Success: false,
-			Message: "Failed to save file: " + err.Error(),
-		})
-	}
-
-	md5Hash := hex.EncodeToString(hash.Sum(nil))
-
-	log.Println("=================================================================")
-	log.Println("FILE UPLOAD SUCCESS")
-	log.Println("=================================================================")
-	log.Printf("[SUCCESS] File saved to: %s\n", destPath)
-	log.Printf("[SUCCESS] Bytes written: %d\n", bytesWritten)
-	log.Printf("[SUCCESS] MD5 checksum: %s\n", md5Hash)
-	log.Println("=================================================================")
-
-	// Get absolute path for response
-	absPath, _ := filepath.Abs(destPath)
-
-	response := UploadFileResponse{
-		Success:    true,
-		FileName:   uniqueFilename,
-		FileSize:   file.Size,
-		FileType:   fileType,
-		FilePath:   absPath,
-		MD5:        md5Hash,
-		Message:    "File uploaded successfully",
-		UploadTime: time.Now().Format(time.RFC3339),
-	}
-
-	return ctx.JSON(response)
+		s.logger.Printf("[ERROR] Failed to save file: %v\n", err)
+		return uploadFailure(ctx, fiber.StatusInternalServerError, UploadErrorStorage, "Failed to save file")
+	}
+
+	return ctx.JSON(s.buildUploadFileResponse(record))
+}
+
+// storeUpload writes validated content to the file store and indexes it for its owner.
+// Content is stored once per SHA-256, an upload of content the server already has only
+// adds a record referencing it. Images are stripped of their metadata and stored with
+// their thumbnails.
+func (s *Server) storeUpload(ownerID string, upload validatedUpload, content io.ReadSeeker, size int64) (storage.FileRecord, error) {
+	// Files get an opaque ID, the original name is only kept as metadata
+	fileID := fmt.Sprintf("FILE-%s", uuid.New().String())
+
+	var processed processedImage
+	if isImageKind(upload.Kind) {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return storage.FileRecord{}, err
+		}
+		processed, err = processImage(upload.Kind, data)
+		if err != nil {
+			return storage.FileRecord{}, err
+		}
+		s.logger.Printf("[INFO] Processed %dx%d image, %d bytes without metadata\n", processed.Width, processed.Height, len(processed.Data))
+		content, size = bytes.NewReader(processed.Data), int64(len(processed.Data))
+	}
+
+	// The content is hashed before storing since its hash is its key
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha256Hash, md5Hash), content); err != nil {
+		return storage.FileRecord{}, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return storage.FileRecord{}, err
+	}
+
+	record := storage.FileRecord{
+		ID:          fileID,
+		Key:         contentKey(hex.EncodeToString(sha256Hash.Sum(nil))),
+		OwnerID:     ownerID,
+		FileName:    upload.FileName,
+		FileType:    upload.Kind,
+		ContentType: upload.ContentType,
+		Size:        size,
+		MD5:         hex.EncodeToString(md5Hash.Sum(nil)),
+		SHA256:      hex.EncodeToString(sha256Hash.Sum(nil)),
+		Width:       processed.Width,
+		Height:      processed.Height,
+		ScanStatus:  storage.ScanStatusPending,
+		CreatedAt:   s.clock.Now(),
+	}
+
+	unlock := lockContent(record.SHA256)
+	defer unlock()
+
+	// Infected content has been deleted, so it is stored and scanned again
+	existing := []storage.FileRecord{}
+	for _, sibling := range s.files.WithHash(record.SHA256) {
+		if sibling.ScanStatus != storage.ScanStatusInfected {
+			existing = append(existing, sibling)
+		}
+	}
+
+	if len(existing) > 0 {
+		// Same content as an earlier upload: share its content, thumbnails and scan verdict
+		original := existing[0]
+		record.Derivatives = original.Derivatives
+		for _, sibling := range existing {
+			if sibling.ScanStatus == storage.ScanStatusClean {
+				record.ScanStatus = storage.ScanStatusClean
+				record.ScannedAt = sibling.ScannedAt
+				break
+			}
+		}
+		s.logger.Printf("[INFO] Content %s already stored, referenced by %d file(s)\n", record.SHA256, len(existing))
+	} else {
+		if _, err := s.fileStore.Put(record.Key, content, size, upload.ContentType); err != nil {
+			return storage.FileRecord{}, err
+		}
+
+		derivatives, err := s.storeThumbnails(record, processed.Thumbnails)
+		if err != nil {
+			s.fileStore.Delete(record.Key)
+			return storage.FileRecord{}, err
+		}
+		record.Derivatives = derivatives
+	}
+
+	s.files.Add(record)
+
+	// The file stays quarantined until the scanner has passed it
+	if record.ScanStatus == storage.ScanStatusPending {
+		s.queueFileScan(record.ID)
+	}
+
+	s.logger.Println("=================================================================")
+	s.logger.Println("FILE UPLOAD SUCCESS")
+	s.logger.Println("=================================================================")
+	s.logger.Printf("[SUCCESS] File ID: %s\n", record.ID)
+	s.logger.Printf("[SUCCESS] Size: %d bytes\n", record.Size)
+	s.logger.Printf("[SUCCESS] MD5 checksum: %s\n", record.MD5)
+	s.logger.Printf("[SUCCESS] SHA-256: %s\n", record.SHA256)
+	s.logger.Println("=================================================================")
+
+	return record, nil
+}
+
+// releaseFile removes a file record, deleting its content once no other file references it
+func (s *Server) releaseFile(record storage.FileRecord) error {
+	unlock := lockContent(record.SHA256)
+	defer unlock()
+
+	if remaining := s.files.Delete(record.ID); remaining > 0 {
+		s.logger.Printf("[INFO] Content of file %s is still referenced by %d file(s)\n", record.ID, remaining)
+		return nil
+	}
+
+	s.deleteDerivatives(record)
+	return s.fileStore.Delete(record.Key)
+}
+
+// contentKey is where content is stored, addressed by its SHA-256
+func contentKey(hash string) string {
+	return "blobs/" + hash[:2] + "/" + hash
+}
+
+// Uploads and deletions of the same content are serialized so content is never deleted
+// while a new upload is about to reference it
+var contentLocks [64]sync.Mutex
+
+func lockContent(hash string) func() {
+	stripe := 0
+	if len(hash) >= 2 {
+		if value, err := strconv.ParseUint(hash[:2], 16, 8); err == nil {
+			stripe = int(value) % len(contentLocks)
+		}
+	}
+	contentLocks[stripe].Lock()
+	return contentLocks[stripe].Unlock
+}
+
+// storeThumbnails writes the thumbnails of a file, removing them all if one fails
+func (s *Server) storeThumbnails(record storage.FileRecord, thumbnails []thumbnail) ([]storage.Derivative, error) {
+	derivatives := []storage.Derivative{}
+	for _, thumb := range thumbnails {
+		derivative := storage.Derivative{
+			Name:        thumb.Name,
+			ContentType: thumb.ContentType,
+			Width:       thumb.Width,
+			Height:      thumb.Height,
+			Size:        int64(len(thumb.Data)),
+		}
+		if _, err := s.fileStore.Put(derivativeKey(record, derivative), bytes.NewReader(thumb.Data), derivative.Size, derivative.ContentType); err != nil {
+			record.Derivatives = derivatives
+			s.deleteDerivatives(record)
+			return nil, err
+		}
+		derivatives = append(derivatives, derivative)
+	}
+	return derivatives, nil
+}
+
+func (s *Server) deleteDerivatives(record storage.FileRecord) {
+	for _, derivative := range record.Derivatives {
+		if err := s.fileStore.Delete(derivativeKey(record, derivative)); err != nil {
+			s.logger.Printf("[ERROR] Failed to delete %s of file %s: %v\n", derivative.Name, record.ID, err)
+		}
+	}
+}
+
+func (s *Server) buildUploadFileResponse(record storage.FileRecord) UploadFileResponse {
+	return UploadFileResponse{
+		Success:        true,
+		FileID:         record.ID,
+		FileName:       record.FileName,
+		FileSize:       record.Size,
+		FileType:       record.FileType,
+		URL:            s.fileDownloadURL(record.ID),
+		ScanStatus:     record.ScanStatus,
+		DerivativeURLs: s.derivativeURLs(record),
+		MD5:            record.MD5,
+		Message:        uploadMessage(record),
+		UploadTime:     record.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func uploadFailure(ctx *fiber.Ctx, status int, code, message string) error {
+	return ctx.Status(status).JSON(UploadFileResponse{
+		Success:   false,
+		Message:   message,
+		ErrorCode: code,
+	})
+}
+
+// fileDownloadURL is the stable backend URL of an uploaded file
+func (s *Server) fileDownloadURL(fileID string) string {
+	return s.baseURL + "/api/files/" + fileID
+}
+
+func uploadMessage(record storage.FileRecord) string {
+	if record.ScanStatus == storage.ScanStatusPending {
+		return "File uploaded successfully, available once it has been scanned"
+	}
+	return "File uploaded successfully"
 }
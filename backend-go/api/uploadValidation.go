@@ -0,0 +1,294 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upload error codes returned in UploadFileResponse.ErrorCode
+const (
+	UploadErrorUnauthorized    = "UNAUTHORIZED"
+	UploadErrorFileMissing     = "FILE_MISSING"
+	UploadErrorFileTooLarge    = "FILE_TOO_LARGE"
+	UploadErrorInvalidFileName = "INVALID_FILE_NAME"
+	UploadErrorTypeNotAllowed  = "TYPE_NOT_ALLOWED"
+	UploadErrorTypeMismatch    = "TYPE_MISMATCH"
+	UploadErrorStorage         = "STORAGE_ERROR"
+	UploadErrorQuotaExceeded   = "QUOTA_EXCEEDED"
+)
+
+const maxFileNameLength = 255
+
+// fileKind is a file type the backend recognizes by its content
+type fileKind struct {
+	MIMEType   string
+	Extensions []string
+}
+
+var fileKinds = map[string]fileKind{
+	"PDF":  {MIMEType: "application/pdf", Extensions: []string{".pdf"}},
+	"DOC":  {MIMEType: "application/msword", Extensions: []string{".doc"}},
+	"XLS":  {MIMEType: "application/vnd.ms-excel", Extensions: []string{".xls"}},
+	"PPT":  {MIMEType: "application/vnd.ms-powerpoint", Extensions: []string{".ppt"}},
+	"DOCX": {MIMEType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Extensions: []string{".docx"}},
+	"XLSX": {MIMEType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Extensions: []string{".xlsx"}},
+	"PPTX": {MIMEType: "application/vnd.openxmlformats-officedocument.presentationml.presentation", Extensions: []string{".pptx"}},
+	"JPG":  {MIMEType: "image/jpeg", Extensions: []string{".jpg", ".jpeg"}},
+	"PNG":  {MIMEType: "image/png", Extensions: []string{".png"}},
+	"GIF":  {MIMEType: "image/gif", Extensions: []string{".gif"}},
+	"WEBP": {MIMEType: "image/webp", Extensions: []string{".webp"}},
+	"TXT":  {MIMEType: "text/plain; charset=utf-8", Extensions: []string{".txt"}},
+}
+
+// Legacy Office files share the OLE2 compound document signature
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// UploadPolicy limits what a route accepts
+type UploadPolicy struct {
+	AllowedTypes []string // fileKinds keys
+	MaxSize      int64
+}
+
+// Default policy of POST /api/upload, overridable with UPLOAD_ALLOWED_TYPES and UPLOAD_MAX_SIZE
+var documentUploadPolicy = UploadPolicy{
+	AllowedTypes: []string{"PDF", "DOC", "DOCX", "XLS", "XLSX", "PPT", "PPTX", "JPG", "PNG", "GIF", "WEBP"},
+	MaxSize:      maxUploadSize,
+}
+
+// uploadError is an upload rejection with a status and a machine readable code
+type uploadError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+// validatedUpload is what is known about a file after validation
+type validatedUpload struct {
+	FileName    string
+	Kind        string
+	ContentType string
+}
+
+// loadUploadPolicy applies the <prefix>_ALLOWED_TYPES and <prefix>_MAX_SIZE overrides to a route's defaults
+func loadUploadPolicy(prefix string, defaults UploadPolicy) UploadPolicy {
+	policy := defaults
+
+	if allowed := os.Getenv(prefix + "_ALLOWED_TYPES"); allowed != "" {
+		policy.AllowedTypes = nil
+		for _, kind := range strings.Split(allowed, ",") {
+			kind = strings.ToUpper(strings.TrimSpace(kind))
+			if _, known := fileKinds[kind]; known {
+				policy.AllowedTypes = append(policy.AllowedTypes, kind)
+			}
+		}
+	}
+
+	if maxSize, err := strconv.ParseInt(os.Getenv(prefix+"_MAX_SIZE"), 10, 64); err == nil && maxSize > 0 {
+		policy.MaxSize = maxSize
+	}
+
+	return policy
+}
+
+// withUploadPolicy makes the policy available to the upload handler of a route
+func withUploadPolicy(policy UploadPolicy) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		ctx.Locals("uploadPolicy", policy)
+		return ctx.Next()
+	}
+}
+
+// storageQuota is the number of bytes a user may store, set with USER_STORAGE_QUOTA; 0 means unlimited
+func storageQuota() int64 {
+	quota, err := strconv.ParseInt(os.Getenv("USER_STORAGE_QUOTA"), 10, 64)
+	if err != nil || quota < 0 {
+		return 0
+	}
+	return quota
+}
+
+// checkStorageQuota rejects an upload that would take an owner over their quota.
+// Stored content, counted once however many files share it, and unfinished chunked
+// uploads both count as used space.
+func (s *Server) checkStorageQuota(ownerID string, size int64) error {
+	quota := storageQuota()
+	if quota == 0 {
+		return nil
+	}
+
+	var used int64
+	for _, size := range s.files.OwnerContent(ownerID) {
+		used += size
+	}
+	if s.uploads != nil {
+		used += s.uploads.Reserved(ownerID)
+	}
+
+	if used+size > quota {
+		return &uploadError{
+			Status:  fiber.StatusRequestEntityTooLarge,
+			Code:    UploadErrorQuotaExceeded,
+			Message: fmt.Sprintf("Storage quota exceeded: %d of %d bytes used", used, quota),
+		}
+	}
+	return nil
+}
+
+func (p UploadPolicy) allows(kind string) bool {
+	for _, allowed := range p.AllowedTypes {
+		if allowed == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUpload checks the name, declared type and content of a file against a policy
+func validateUpload(policy UploadPolicy, fileName, declaredType string, content io.ReaderAt, size int64) (validatedUpload, error) {
+	upload, err := validateUploadName(policy, fileName, declaredType, size)
+	if err != nil {
+		return validatedUpload{}, err
+	}
+
+	if !contentMatches(upload.Kind, content, size) {
+		return validatedUpload{}, &uploadError{
+			Status:  fiber.StatusUnprocessableEntity,
+			Code:    UploadErrorTypeMismatch,
+			Message: fmt.Sprintf("File content is not a valid %s file", upload.Kind),
+		}
+	}
+
+	return upload, nil
+}
+
+// validateUploadName runs the checks that do not need the content, so chunked uploads can fail early
+func validateUploadName(policy UploadPolicy, fileName, declaredType string, size int64) (validatedUpload, error) {
+	if size > policy.MaxSize {
+		return validatedUpload{}, &uploadError{
+			Status:  fiber.StatusRequestEntityTooLarge,
+			Code:    UploadErrorFileTooLarge,
+			Message: fmt.Sprintf("File too large. Maximum size is %d MB", policy.MaxSize/(1024*1024)),
+		}
+	}
+
+	name, err := sanitizeFileName(fileName)
+	if err != nil {
+		return validatedUpload{}, err
+	}
+
+	kind := kindForExtension(filepath.Ext(name))
+	if kind == "" || !policy.allows(kind) {
+		return validatedUpload{}, &uploadError{
+			Status:  fiber.StatusUnsupportedMediaType,
+			Code:    UploadErrorTypeNotAllowed,
+			Message: fmt.Sprintf("File type %q is not allowed. Allowed types: %s", filepath.Ext(name), strings.Join(policy.AllowedTypes, ", ")),
+		}
+	}
+
+	if declaredType != "" && normalizeKind(declaredType) != kind {
+		return validatedUpload{}, &uploadError{
+			Status:  fiber.StatusUnprocessableEntity,
+			Code:    UploadErrorTypeMismatch,
+			Message: fmt.Sprintf("Declared type %s does not match the file extension %s", declaredType, filepath.Ext(name)),
+		}
+	}
+
+	return validatedUpload{FileName: name, Kind: kind, ContentType: fileKinds[kind].MIMEType}, nil
+}
+
+// sanitizeFileName keeps only the base name of a client supplied file name
+func sanitizeFileName(fileName string) (string, error) {
+	// Clients on Windows send backslash separated paths
+	name := filepath.Base(strings.ReplaceAll(fileName, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == ':' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+
+	if name == "" || len(name) > maxFileNameLength {
+		return "", &uploadError{
+			Status:  fiber.StatusBadRequest,
+			Code:    UploadErrorInvalidFileName,
+			Message: "Invalid file name",
+		}
+	}
+	return name, nil
+}
+
+func kindForExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	for kind, info := range fileKinds {
+		for _, candidate := range info.Extensions {
+			if candidate == ext {
+				return kind
+			}
+		}
+	}
+	return ""
+}
+
+func normalizeKind(declaredType string) string {
+	kind := strings.ToUpper(strings.TrimPrefix(declaredType, "."))
+	if kind == "JPEG" {
+		return "JPG"
+	}
+	return kind
+}
+
+// contentMatches sniffs the magic bytes of the content and checks they fit the kind
+func contentMatches(kind string, content io.ReaderAt, size int64) bool {
+	head := make([]byte, 512)
+	n, err := content.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	head = head[:n]
+
+	switch kind {
+	case "DOC", "XLS", "PPT":
+		return bytes.HasPrefix(head, oleSignature)
+	case "DOCX", "XLSX", "PPTX":
+		return officeOpenXMLKind(content, size) == kind
+	}
+
+	detected := http.DetectContentType(head)
+	return detected == fileKinds[kind].MIMEType
+}
+
+// officeOpenXMLKind tells DOCX, XLSX and PPTX apart by the part names inside the zip
+func officeOpenXMLKind(content io.ReaderAt, size int64) string {
+	archive, err := zip.NewReader(content, size)
+	if err != nil {
+		return ""
+	}
+
+	for _, entry := range archive.File {
+		switch entry.Name {
+		case "word/document.xml":
+			return "DOCX"
+		case "xl/workbook.xml":
+			return "XLSX"
+		case "ppt/presentation.xml":
+			return "PPTX"
+		}
+	}
+	return ""
+}
@@ -2,14 +2,12 @@ package api
 
 import (
 	"encoding/json"
-	"log"
-	"superQiMiniAppBackend/alipay"
 	"superQiMiniAppBackend/jwe"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func InitUserInfoEndpoint(group fiber.Router) {
+func (s *Server) registerUserInfoEndpoint(group fiber.Router) {
 	group.Post("/user/info", func(ctx *fiber.Ctx) error {
 		var request map[string]string
 		if err := ctx.BodyParser(&request); err != nil {
@@ -21,32 +19,32 @@ func InitUserInfoEndpoint(group fiber.Router) {
 			return fiber.NewError(fiber.StatusBadRequest, "Token is required")
 		}
 
-		log.Println("=================================================================")
-		log.Println("INQUIRING USER INFO")
-		log.Println("=================================================================")
+		s.logger.Println("=================================================================")
+		s.logger.Println("INQUIRING USER INFO")
+		s.logger.Println("=================================================================")
 
 		// Decrypt the JWE token to get the access token
 		claims, err := jwe.ParseAndValidateJWE(token)
 		if err != nil {
-			log.Printf("[ERROR] Failed to decrypt JWE token: %v\n", err)
+			s.logger.Printf("[ERROR] Failed to decrypt JWE token: %v\n", err)
 			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
 		}
 
-		userInfo, err := alipay.Interface.InquiryUserInfo(claims.AccessToken)
+		userInfo, err := s.gateway.InquiryUserInfo(claims.AccessToken)
 		if err != nil {
-			log.Printf("[ERROR] User info inquiry failed: %v\n", err)
+			s.logger.Printf("[ERROR] User info inquiry failed: %v\n", err)
 			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 		}
 
 		userInfoJson, _ := json.MarshalIndent(userInfo, "", "  ")
-		log.Printf("[RESPONSE] User info retrieved:\n%s\n\n", string(userInfoJson))
+		s.logger.Printf("[RESPONSE] User info retrieved:\n%s\n\n", string(userInfoJson))
 
 		if userInfo.Result.ResultCode != "SUCCESS" {
-			log.Printf("[ERROR] User info inquiry returned error: %s\n", userInfo.Result.ResultMessage)
+			s.logger.Printf("[ERROR] User info inquiry returned error: %s\n", userInfo.Result.ResultMessage)
 			return fiber.NewError(fiber.StatusBadRequest, "Failed to retrieve user info: "+userInfo.Result.ResultMessage)
 		}
 
-		log.Println("[SUCCESS] User info retrieved successfully")
+		s.logger.Println("[SUCCESS] User info retrieved successfully")
 		return ctx.JSON(userInfo)
 	})
 }
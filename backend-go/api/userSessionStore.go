@@ -0,0 +1,63 @@
+package api
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserSession is the latest access token obtained for a user through /auth/apply-token
+type UserSession struct {
+	UserID      string    `json:"userId"`
+	AccessToken string    `json:"-"`
+	LastSeenAt  time.Time `json:"lastSeenAt"`
+}
+
+// UserSessionStore is an in-memory store for user sessions keyed by user ID
+type UserSessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*UserSession
+}
+
+// NewUserSessionStore creates an empty user session store
+func NewUserSessionStore() *UserSessionStore {
+	return &UserSessionStore{
+		sessions: make(map[string]*UserSession),
+	}
+}
+
+// Set updates or creates the session of a user, seen at now
+func (s *UserSessionStore) Set(userID, accessToken string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[userID] = &UserSession{
+		UserID:      userID,
+		AccessToken: accessToken,
+		LastSeenAt:  now,
+	}
+	log.Printf("[UserSessionStore] Stored session for user %s", userID)
+}
+
+// Get retrieves the session of a user
+func (s *UserSessionStore) Get(userID string) (*UserSession, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.sessions[userID]
+	return session, exists
+}
+
+// List returns every session, most recently seen first
+func (s *UserSessionStore) List() []UserSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]UserSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, *session)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeenAt.After(list[j].LastSeenAt)
+	})
+	return list
+}
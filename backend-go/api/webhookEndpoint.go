@@ -0,0 +1,76 @@
+package api
+
+import (
+	"superQiMiniAppBackend/events"
+	"superQiMiniAppBackend/webhook"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (s *Server) registerWebhookEndpoint(group fiber.Router) {
+	if s.webhooks == nil {
+		s.logger.Println("[WARNING] Webhook dispatcher not initialized, outbound webhooks are disabled")
+		return
+	}
+
+	// Every lifecycle event is offered to the dispatcher, which filters by subscription
+	s.events.SubscribeAll(func(event events.Event) {
+		if err := s.webhooks.Enqueue(event.Type(), event); err != nil {
+			s.logger.Printf("[ERROR] Failed to queue webhook for %s: %v\n", event.Type(), err)
+		}
+	})
+
+	adminGroup := group.Group("/admin/webhooks", requireAdminKey)
+
+	// GET /api/admin/webhooks/deliveries?status=PENDING|DELIVERED|DEAD
+	adminGroup.Get("/deliveries", func(ctx *fiber.Ctx) error {
+		deliveries := s.webhooks.Deliveries(ctx.Query("status"))
+		return ctx.JSON(fiber.Map{
+			"success":    true,
+			"count":      len(deliveries),
+			"deliveries": deliveries,
+		})
+	})
+
+	// GET /api/admin/webhooks/dead-letters
+	adminGroup.Get("/dead-letters", func(ctx *fiber.Ctx) error {
+		deliveries := s.webhooks.Deliveries(webhook.StatusDead)
+		return ctx.JSON(fiber.Map{
+			"success":    true,
+			"count":      len(deliveries),
+			"deliveries": deliveries,
+		})
+	})
+
+	// GET /api/admin/webhooks/deliveries/:id
+	adminGroup.Get("/deliveries/:id", func(ctx *fiber.Ctx) error {
+		delivery, exists := s.webhooks.Get(ctx.Params("id"))
+		if !exists {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": "Delivery not found",
+			})
+		}
+		return ctx.JSON(fiber.Map{
+			"success":  true,
+			"delivery": delivery,
+		})
+	})
+
+	// POST /api/admin/webhooks/deliveries/:id/replay
+	adminGroup.Post("/deliveries/:id/replay", func(ctx *fiber.Ctx) error {
+		s.logger.Printf("[INFO] Replay requested for webhook delivery %s\n", ctx.Params("id"))
+
+		delivery, err := s.webhooks.Replay(ctx.Params("id"))
+		if err != nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"message": err.Error(),
+			})
+		}
+		return ctx.JSON(fiber.Map{
+			"success":  true,
+			"delivery": delivery,
+		})
+	})
+}
@@ -0,0 +1,115 @@
+// Command mockgateway runs a mock SuperQi gateway so the backend can be developed offline.
+// Point ALIPAY_GATEWAY_URL at it, with the key pairs written by -generate-keys.
+package main
+
+import (
+	"crypto/rsa"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"superQiMiniAppBackend/mockgateway"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	// The backend's .env is optional here, it only supplies defaults
+	_ = godotenv.Load()
+
+	generateKeys := flag.String("generate-keys", "", "write merchant and gateway key pairs to this directory and exit")
+	addr := flag.String("addr", envOr("MOCK_GATEWAY_ADDR", ":2999"), "address to listen on")
+	clientID := flag.String("client-id", envOr("ALIPAY_CLIENT_ID", "mock-client"), "Client-Id the backend sends")
+	merchantPublicKey := flag.String("merchant-public-key", envOr("MOCK_GATEWAY_MERCHANT_PUBLIC_KEY_PATH", "./keys/merchant_public_key.pem"), "PEM public key verifying request signatures")
+	merchantPublicKeys := flag.String("merchant-public-keys", os.Getenv("MOCK_GATEWAY_MERCHANT_PUBLIC_KEYS"), "more public keys by key version, as 2=./keys/merchant_public_key_2.pem,...")
+	gatewayPrivateKey := flag.String("gateway-private-key", envOr("MOCK_GATEWAY_PRIVATE_KEY_PATH", "./keys/gateway_private_key.pem"), "PEM private key signing responses")
+	gatewayKeyVersion := flag.String("gateway-key-version", envOr("MOCK_GATEWAY_KEY_VERSION", "1"), "keyVersion of the gateway private key")
+	publicURL := flag.String("public-url", envOr("MOCK_GATEWAY_PUBLIC_URL", "http://localhost:2999"), "base URL of the cashier and authorization pages")
+	autoPayDelay := flag.Duration("auto-pay-delay", envDuration("MOCK_GATEWAY_AUTO_PAY_DELAY", 5*time.Second), "pay cashier payments after this delay, 0 to wait for the cashier page")
+	refundDelay := flag.Duration("refund-delay", envDuration("MOCK_GATEWAY_REFUND_DELAY", 2*time.Second), "time refunds stay PROCESSING")
+	scenarios := flag.String("scenarios", os.Getenv("MOCK_GATEWAY_SCENARIOS_PATH"), "JSON file of programmed responses by endpoint path")
+	flag.Parse()
+
+	if *generateKeys != "" {
+		if err := mockgateway.GenerateKeys(*generateKeys); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Key pairs written to %s", *generateKeys)
+		log.Printf("Backend: ALIPAY_MERCHANT_PRIVATE_KEY_PATH=%s/merchant_private_key.pem ALIPAY_PUBLIC_KEY_PATH=%s/gateway_public_key.pem", *generateKeys, *generateKeys)
+		return
+	}
+
+	merchantKey, err := mockgateway.LoadPublicKey(*merchantPublicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gatewayKey, err := mockgateway.LoadPrivateKey(*gatewayPrivateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	merchantKeys := map[string]*rsa.PublicKey{}
+	for _, entry := range strings.Split(*merchantPublicKeys, ",") {
+		version, path, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			continue
+		}
+		if merchantKeys[version], err = mockgateway.LoadPublicKey(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	gateway, err := mockgateway.New(mockgateway.Config{
+		ClientID:           *clientID,
+		MerchantPublicKey:  merchantKey,
+		GatewayPrivateKey:  gatewayKey,
+		PublicURL:          *publicURL,
+		AutoPayDelay:       *autoPayDelay,
+		RefundDelay:        *refundDelay,
+		MerchantPublicKeys: merchantKeys,
+		GatewayKeyVersion:  *gatewayKeyVersion,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *scenarios != "" {
+		data, err := os.ReadFile(*scenarios)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := gateway.LoadScenarios(data); err != nil {
+			log.Fatalf("Invalid scenarios in %s: %v", *scenarios, err)
+		}
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		gateway.Shutdown()
+	}()
+
+	log.Printf("Mock gateway listening on %s for client %s", *addr, *clientID)
+	if err := gateway.Listen(*addr); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"log"
+	"sync"
+)
+
+// Handler reacts to a published event
+type Handler func(Event)
+
+// Bus is an in-process publish/subscribe event bus.
+// Handlers run synchronously in the publisher's goroutine and in subscription order,
+// so a handler doing slow work (gateway calls, HTTP) should start its own goroutine.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+	all      []Handler
+}
+
+// Default is the bus shared by the whole backend
+var Default = NewBus()
+
+func NewBus() *Bus {
+	return &Bus{
+		handlers: make(map[string][]Handler),
+	}
+}
+
+// Subscribe registers a handler for one event type
+func (b *Bus) Subscribe(eventType string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+}
+
+// SubscribeAll registers a handler for every event type
+func (b *Bus) SubscribeAll(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.all = append(b.all, handler)
+}
+
+// Publish delivers an event to its subscribers.
+// A panicking handler is logged and does not stop delivery to the others.
+func (b *Bus) Publish(event Event) {
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.handlers[event.Type()])+len(b.all))
+	handlers = append(handlers, b.handlers[event.Type()]...)
+	handlers = append(handlers, b.all...)
+	b.mu.RUnlock()
+
+	log.Printf("[EventBus] Publishing %s to %d handler(s)", event.Type(), len(handlers))
+
+	for _, handler := range handlers {
+		dispatch(event, handler)
+	}
+}
+
+func dispatch(event Event, handler Handler) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[EventBus] ERROR: Handler for %s panicked: %v", event.Type(), r)
+		}
+	}()
+	handler(event)
+}
+
+// Subscribe registers a handler for one event type on the default bus
+func Subscribe(eventType string, handler Handler) {
+	Default.Subscribe(eventType, handler)
+}
+
+// SubscribeAll registers a handler for every event type on the default bus
+func SubscribeAll(handler Handler) {
+	Default.SubscribeAll(handler)
+}
+
+// Publish delivers an event on the default bus
+func Publish(event Event) {
+	Default.Publish(event)
+}
@@ -0,0 +1,152 @@
+package events
+
+import "superQiMiniAppBackend/alipay"
+
+// Event types published on the bus
+const (
+	TypePaymentCreated     = "payment.created"
+	TypePaymentSucceeded   = "payment.succeeded"
+	TypePaymentFailed      = "payment.failed"
+	TypePaymentTimedOut    = "payment.timed_out"
+	TypeRefundSucceeded    = "refund.succeeded"
+	TypeRefundFailed       = "refund.failed"
+	TypeEscrowCreated      = "escrow.created"
+	TypeEscrowAccepted     = "escrow.accepted"
+	TypeEscrowConfirmed    = "escrow.confirmed"
+	TypeEscrowCancelled    = "escrow.cancelled"
+	TypeEscrowVoided       = "escrow.voided"
+	TypeNotificationSent   = "notification.sent"
+	TypeNotificationFailed = "notification.failed"
+)
+
+// Event is implemented by every lifecycle event
+type Event interface {
+	Type() string
+}
+
+// PaymentCreated is published once the payment API accepted a new payment
+type PaymentCreated struct {
+	PaymentID        string               `json:"paymentId"`
+	PaymentRequestID string               `json:"paymentRequestId,omitempty"`
+	UserID           string               `json:"userId,omitempty"`
+	AccessToken      string               `json:"-"`
+	ProductCode      string               `json:"productCode,omitempty"`
+	Amount           alipay.PaymentAmount `json:"amount,omitempty"`
+	OrderDescription string               `json:"orderDescription,omitempty"`
+}
+
+func (PaymentCreated) Type() string { return TypePaymentCreated }
+
+// PaymentSucceeded is published when polling sees the payment as SUCCESS
+type PaymentSucceeded struct {
+	PaymentID        string               `json:"paymentId"`
+	PaymentRequestID string               `json:"paymentRequestId,omitempty"`
+	PaymentTime      string               `json:"paymentTime,omitempty"`
+	Amount           alipay.PaymentAmount `json:"amount,omitempty"`
+}
+
+func (PaymentSucceeded) Type() string { return TypePaymentSucceeded }
+
+// PaymentFailed is published when polling sees the payment as failed
+type PaymentFailed struct {
+	PaymentID        string `json:"paymentId"`
+	PaymentRequestID string `json:"paymentRequestId,omitempty"`
+	Reason           string `json:"reason,omitempty"`
+}
+
+func (PaymentFailed) Type() string { return TypePaymentFailed }
+
+// PaymentTimedOut is published when polling gave up before the payment finished
+type PaymentTimedOut struct {
+	PaymentID        string `json:"paymentId"`
+	PaymentRequestID string `json:"paymentRequestId,omitempty"`
+}
+
+func (PaymentTimedOut) Type() string { return TypePaymentTimedOut }
+
+// RefundSucceeded is published when a refund is completed
+type RefundSucceeded struct {
+	PaymentID       string              `json:"paymentId"`
+	RefundRequestID string              `json:"refundRequestId,omitempty"`
+	RefundID        string              `json:"refundId,omitempty"`
+	RefundTime      string              `json:"refundTime,omitempty"`
+	Amount          alipay.RefundAmount `json:"amount,omitempty"`
+}
+
+func (RefundSucceeded) Type() string { return TypeRefundSucceeded }
+
+// RefundFailed is published when a refund is rejected or never found
+type RefundFailed struct {
+	PaymentID       string              `json:"paymentId"`
+	RefundRequestID string              `json:"refundRequestId,omitempty"`
+	ResultCode      string              `json:"resultCode,omitempty"`
+	Reason          string              `json:"reason,omitempty"`
+	Amount          alipay.RefundAmount `json:"amount,omitempty"`
+}
+
+func (RefundFailed) Type() string { return TypeRefundFailed }
+
+// EscrowCreated is published once an escrow payment was created
+type EscrowCreated struct {
+	PaymentID        string               `json:"paymentId"`
+	PaymentRequestID string               `json:"paymentRequestId,omitempty"`
+	UserID           string               `json:"userId,omitempty"`
+	Amount           alipay.PaymentAmount `json:"amount,omitempty"`
+}
+
+func (EscrowCreated) Type() string { return TypeEscrowCreated }
+
+// EscrowAccepted is published when the merchant accepted an escrow payment
+type EscrowAccepted struct {
+	PaymentID string `json:"paymentId"`
+}
+
+func (EscrowAccepted) Type() string { return TypeEscrowAccepted }
+
+// EscrowConfirmed is published when the customer confirmed an escrow order
+type EscrowConfirmed struct {
+	PaymentID   string `json:"paymentId"`
+	ConfirmID   string `json:"confirmId,omitempty"`
+	ConfirmTime string `json:"confirmTime,omitempty"`
+}
+
+func (EscrowConfirmed) Type() string { return TypeEscrowConfirmed }
+
+// EscrowCancelled is published when an escrow payment was cancelled
+type EscrowCancelled struct {
+	PaymentID string `json:"paymentId"`
+}
+
+func (EscrowCancelled) Type() string { return TypeEscrowCancelled }
+
+// EscrowVoided is published when an escrow payment was voided
+type EscrowVoided struct {
+	PaymentID string `json:"paymentId"`
+	VoidID    string `json:"voidId,omitempty"`
+	VoidTime  string `json:"voidTime,omitempty"`
+}
+
+func (EscrowVoided) Type() string { return TypeEscrowVoided }
+
+// NotificationSent is published when the wallet accepted an inbox or push message
+type NotificationSent struct {
+	Channel      string `json:"channel"` // INBOX or PUSH
+	RequestID    string `json:"requestId"`
+	TemplateCode string `json:"templateCode"`
+	MessageID    string `json:"messageId,omitempty"`
+	ResultStatus string `json:"resultStatus,omitempty"`
+}
+
+func (NotificationSent) Type() string { return TypeNotificationSent }
+
+// NotificationFailed is published when an inbox or push message was not delivered
+type NotificationFailed struct {
+	Channel      string `json:"channel"` // INBOX or PUSH
+	RequestID    string `json:"requestId"`
+	TemplateCode string `json:"templateCode"`
+	ResultStatus string `json:"resultStatus,omitempty"`
+	ResultCode   string `json:"resultCode,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+func (NotificationFailed) Type() string { return TypeNotificationFailed }
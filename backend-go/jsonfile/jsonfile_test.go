@@ -0,0 +1,52 @@
+package jsonfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"superQiMiniAppBackend/jsonfile"
+)
+
+func TestSaveThenLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "records.json")
+	saved := []map[string]int{{"a": 1}, {"b": 2}}
+
+	if err := jsonfile.Save(path, saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	var loaded []map[string]int
+	if err := jsonfile.Load(path, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("loaded %v, saved %v", loaded, saved)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	loaded := []string{"unchanged"}
+	if err := jsonfile.Load(filepath.Join(t.TempDir(), "missing.json"), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || loaded[0] != "unchanged" {
+		t.Errorf("missing file changed the value to %v", loaded)
+	}
+}
+
+func TestLoadMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "malformed.json")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded []string
+	if err := jsonfile.Load(path, &loaded); err == nil {
+		t.Error("malformed file loaded without an error")
+	}
+}
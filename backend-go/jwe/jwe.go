@@ -13,6 +13,7 @@ import (
 type TokenClaims struct {
 	UserID      string `json:"user_id"`
 	AccessToken string `json:"access_token"`
+	TenantID    string `json:"tenant_id,omitempty"`
 }
 
 var sharedKey = []byte("this_is_a_32_byte_example_key!32")
@@ -26,6 +27,11 @@ func init() {
 	}
 }
 
+// SetKey replaces the 32 byte key tokens are encrypted with, e.g. to use a fixed key in tests
+func SetKey(key []byte) {
+	sharedKey = key
+}
+
 func CreateJWE(claims TokenClaims) (string, error) {
 	recipient := jose.Recipient{
 		Algorithm: jose.DIRECT,
@@ -3,8 +3,15 @@ package main
 import (
 	"log"
 	"os"
+	"os/signal"
 	"superQiMiniAppBackend/alipay"
 	"superQiMiniAppBackend/api"
+	"superQiMiniAppBackend/notification"
+	"superQiMiniAppBackend/scanner"
+	"superQiMiniAppBackend/storage"
+	"superQiMiniAppBackend/tenant"
+	"superQiMiniAppBackend/webhook"
+	"syscall"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -17,25 +24,56 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
-	err := alipay.InitAlipayClient()
-	if err := err; err != nil {
-		log.Fatal(err)
-	}
-
 	app := initWebServer()
 
-	apiGroup := app.Group("/api")
-	api.InitAuthEndpoint(apiGroup)
-	api.InitUserInfoEndpoint(apiGroup)
-	api.InitMerchantInfoEndpoint(apiGroup)
-	api.InitPaymentEndpoint(apiGroup)
-	api.InitRefundEndpoint(apiGroup)
-	api.InitAgreementEndpoint(apiGroup)
-	api.InitNotificationEndpoint(apiGroup)
-	api.InitInquiryEndpoint(apiGroup)
-	api.InitUploadFileEndpoint(apiGroup)
-	api.InitInquiryPaymentEndpoint(apiGroup)
-	api.InitEscrowEndpoint(apiGroup)
+	if path := os.Getenv("TENANTS_PATH"); path != "" {
+		router, clients, err := newTenantRouter(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		router.Mount(app, "/api")
+		reloadKeysOnSignal(clients...)
+	} else {
+		if err := notification.InitTemplateRegistry(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := notification.InitSendLog(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := notification.InitPreferences(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := storage.InitFileStore(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := scanner.InitScanner(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := webhook.InitDispatcher(); err != nil {
+			log.Fatal(err)
+		}
+
+		client, err := alipay.NewClientFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloadKeysOnSignal(client)
+
+		server, err := api.NewServer(api.Config{
+			Gateway: client,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		apiGroup := app.Group("/api")
+		server.Register(apiGroup)
+	}
 
 	port := os.Getenv("PORT")
 	if len(port) == 0 {
@@ -48,6 +86,88 @@ func main() {
 	}
 }
 
+// newTenantRouter serves every tenant of the registry at path with its own gateway client,
+// stores and background workers
+func newTenantRouter(path string) (*api.TenantRouter, []*alipay.Client, error) {
+	registry, err := tenant.LoadRegistry(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var clients []*alipay.Client
+	router, err := api.NewTenantRouter(registry, func(t tenant.Tenant) (api.Config, error) {
+		client, err := alipay.NewClient(t.AlipayConfig())
+		if err != nil {
+			return api.Config{}, err
+		}
+		clients = append(clients, client)
+
+		config := api.Config{
+			Gateway:    client,
+			MerchantID: t.MerchantID,
+			Logger:     log.New(log.Writer(), "["+t.ID+"] ", log.Flags()),
+		}
+		if err := openTenantServices(t, &config); err != nil {
+			return api.Config{}, err
+		}
+		return config, nil
+	})
+	return router, clients, err
+}
+
+// openTenantServices gives a tenant notification, file and webhook services of its own, kept
+// in its own directories, so no tenant sees or re-sends the records of another
+func openTenantServices(t tenant.Tenant, config *api.Config) error {
+	appID := t.MiniAppID
+	if appID == "" {
+		appID = os.Getenv("MINI_APP_ID")
+	}
+
+	var err error
+	if config.Templates, err = notification.LoadTemplateRegistry(appID); err != nil {
+		return err
+	}
+	if config.SendLog, err = notification.OpenSendLog(t.ID); err != nil {
+		return err
+	}
+	if config.Preferences, err = notification.OpenPreferences(t.ID); err != nil {
+		return err
+	}
+	if config.FileStore, err = storage.OpenFileStore(t.ID); err != nil {
+		return err
+	}
+	if config.FileIndex, err = storage.OpenFileIndex(t.ID); err != nil {
+		return err
+	}
+	if config.Uploads, err = storage.OpenUploadSessions(t.ID); err != nil {
+		return err
+	}
+	if config.Scanner, err = scanner.NewScannerFromEnv(); err != nil {
+		return err
+	}
+	if config.Webhooks, err = webhook.OpenDispatcher(t.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reloadKeysOnSignal reloads the keys of the clients from disk on every SIGHUP
+func reloadKeysOnSignal(clients ...*alipay.Client) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			log.Println("[INFO] SIGHUP received, reloading keys")
+			for _, client := range clients {
+				if err := client.ReloadKeys(); err != nil {
+					log.Printf("[ERROR] Failed to reload keys, keeping the current ones: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
 func initWebServer() *fiber.App {
 	app := fiber.New()
 
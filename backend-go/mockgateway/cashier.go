@@ -0,0 +1,114 @@
+package mockgateway
+
+import (
+	"html/template"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var cashierPage = template.Must(template.New("cashier").Parse(`<!DOCTYPE html>
+<html><head><title>Mock cashier</title></head>
+<body>
+<h1>Mock cashier</h1>
+<p>{{.Description}}</p>
+<p><strong>{{.Amount.Value}} {{.Amount.Currency}}</strong></p>
+<p>Status: {{.Status}}</p>
+{{if eq .Status "PROCESSING"}}
+<form method="POST">
+<button name="action" value="pay">Pay</button>
+<button name="action" value="fail">Fail</button>
+</form>
+{{else if .RedirectURL}}
+<p><a href="{{.RedirectURL}}">Back to the merchant</a></p>
+{{end}}
+</body></html>`))
+
+// handleCashierPage is where the redirectActionForm of a payment leads
+func (g *Gateway) handleCashierPage(ctx *fiber.Ctx) error {
+	g.mu.RLock()
+	p, exists := g.payments[ctx.Params("paymentId")]
+	var view payment
+	if exists {
+		view = *p
+	}
+	g.mu.RUnlock()
+
+	if !exists {
+		return fiber.NewError(fiber.StatusNotFound, "Payment not found")
+	}
+
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return cashierPage.Execute(ctx, view)
+}
+
+// handleCashierSubmit pays or fails the payment, then returns to the merchant's redirect URL
+func (g *Gateway) handleCashierSubmit(ctx *fiber.Ctx) error {
+	paymentID := ctx.Params("paymentId")
+	g.CompletePayment(paymentID, ctx.FormValue("action") != "fail")
+
+	g.mu.RLock()
+	p, exists := g.payments[paymentID]
+	redirectURL := ""
+	if exists {
+		redirectURL = p.RedirectURL
+	}
+	g.mu.RUnlock()
+
+	if !exists {
+		return fiber.NewError(fiber.StatusNotFound, "Payment not found")
+	}
+	if redirectURL != "" {
+		return ctx.Redirect(redirectURL, fiber.StatusSeeOther)
+	}
+	return ctx.Redirect("/cashier/"+paymentID, fiber.StatusSeeOther)
+}
+
+// handleCompletePayment settles a cashier payment without the page, for scripts and tests.
+// ?result=fail fails it instead of paying it.
+func (g *Gateway) handleCompletePayment(ctx *fiber.Ctx) error {
+	if !g.CompletePayment(ctx.Params("paymentId"), ctx.Query("result") != "fail") {
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"message": "Payment not found or not processing",
+		})
+	}
+	return ctx.JSON(fiber.Map{"success": true})
+}
+
+// handleState dumps the simulated state for inspection
+func (g *Gateway) handleState(ctx *fiber.Ctx) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	users := make([]mockUser, 0, len(g.tokens))
+	for _, user := range g.tokens {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ExpiresAt.Before(users[j].ExpiresAt) })
+
+	payments := make([]payment, 0, len(g.payments))
+	for _, p := range g.payments {
+		payments = append(payments, *p)
+	}
+	sort.Slice(payments, func(i, j int) bool { return payments[i].CreatedAt.Before(payments[j].CreatedAt) })
+
+	refunds := make([]refund, 0, len(g.refunds))
+	for _, r := range g.refunds {
+		refunds = append(refunds, *r)
+	}
+	sort.Slice(refunds, func(i, j int) bool { return refunds[i].CreatedAt.Before(refunds[j].CreatedAt) })
+
+	messages := make([]message, 0, len(g.messages))
+	for _, m := range g.messages {
+		messages = append(messages, *m)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].SentAt.Before(messages[j].SentAt) })
+
+	return ctx.JSON(fiber.Map{
+		"users":    users,
+		"payments": payments,
+		"refunds":  refunds,
+		"messages": messages,
+	})
+}
@@ -0,0 +1,183 @@
+// Package mockgateway is a stand-in for the SuperQi open API gateway. It implements every
+// path used by alipay.Client, verifies request signatures with the merchant public key,
+// signs its responses and simulates payment, escrow and refund lifecycles with signed
+// asynchronous payment notifications, so the backend can run without network access.
+// Tests can program per-endpoint failures, delays and status sequences with Program.
+package mockgateway
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"superQiMiniAppBackend/alipay"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Config of a mock gateway
+type Config struct {
+	ClientID          string
+	MerchantPublicKey *rsa.PublicKey  // verifies request signatures of key version 1
+	GatewayPrivateKey *rsa.PrivateKey // signs responses and notifications
+	PublicURL         string          // base of cashier and authorization URLs handed to clients
+	AutoPayDelay      time.Duration   // cashier payments are paid after this delay, 0 waits for the cashier page
+	RefundDelay       time.Duration   // refunds stay PROCESSING this long
+
+	// MerchantPublicKeys verifies request signatures of other key versions, as during a rotation
+	MerchantPublicKeys map[string]*rsa.PublicKey
+	GatewayKeyVersion  string // keyVersion of the gateway's signatures, 1 when empty
+}
+
+// Gateway holds the simulated state of the gateway
+type Gateway struct {
+	config     Config
+	app        *fiber.App
+	httpClient *http.Client
+
+	mu             sync.RWMutex
+	tokens         map[string]*mockUser // by access token
+	payments       map[string]*payment  // by payment ID
+	requests       map[string]string    // payment request ID to payment ID
+	refunds        map[string]*refund   // by refund ID
+	refundRequests map[string]string    // refund request ID to refund ID
+	messages       map[string]*message  // by channel and request ID
+
+	scenarios map[string][]*programmedStep // by endpoint path
+	calls     []Call
+}
+
+// New creates a gateway and registers its routes
+func New(config Config) (*Gateway, error) {
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("client ID is required")
+	}
+	if config.MerchantPublicKey == nil || config.GatewayPrivateKey == nil {
+		return nil, fmt.Errorf("merchant public key and gateway private key are required")
+	}
+	if config.PublicURL == "" {
+		return nil, fmt.Errorf("public URL is required")
+	}
+
+	gateway := &Gateway{
+		config:         config,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+		tokens:         make(map[string]*mockUser),
+		payments:       make(map[string]*payment),
+		requests:       make(map[string]string),
+		refunds:        make(map[string]*refund),
+		refundRequests: make(map[string]string),
+		messages:       make(map[string]*message),
+		scenarios:      make(map[string][]*programmedStep),
+	}
+
+	// Handlers keep paths, parameters and headers beyond the request, which Fiber reuses otherwise
+	gateway.app = fiber.New(fiber.Config{DisableStartupMessage: true, Immutable: true})
+	gateway.registerRoutes()
+	return gateway, nil
+}
+
+// App is the Fiber application serving the gateway
+func (g *Gateway) App() *fiber.App {
+	return g.app
+}
+
+// Listen serves the gateway on addr until Shutdown
+func (g *Gateway) Listen(addr string) error {
+	return g.app.Listen(addr)
+}
+
+// Serve serves the gateway on an existing listener, e.g. a random port in tests
+func (g *Gateway) Serve(listener net.Listener) error {
+	return g.app.Listener(listener)
+}
+
+// Shutdown stops the gateway
+func (g *Gateway) Shutdown() error {
+	return g.app.Shutdown()
+}
+
+func (g *Gateway) registerRoutes() {
+	api := g.app.Group("/v1", g.verifySignature, g.runScenario)
+
+	api.Post("/authorizations/applyToken", g.handleApplyToken)
+	api.Post("/authorizations/prepare", g.handlePrepare)
+	api.Post("/authorizations/cancelToken", g.handleCancelToken)
+	api.Post("/users/inquiryUserInfo", g.handleInquiryUserInfo)
+	api.Post("/users/inquiryUserCardList", g.handleInquiryUserCardList)
+	api.Post("/merchants/inquiryMerchantInfo", g.handleInquiryMerchantInfo)
+
+	api.Post("/payments/pay", g.handlePay)
+	api.Post("/payments/inquiryPayment", g.handleInquiryPayment)
+	api.Post("/payments/refund", g.handleRefund)
+	api.Post("/payments/inquiryRefund", g.handleInquiryRefund)
+	api.Post("/payments/merchantAccept", g.handleMerchantAccept)
+	api.Post("/payments/confirm", g.handleConfirm)
+	api.Post("/payments/cancel", g.handleCancel)
+	api.Post("/payments/void", g.handleVoid)
+
+	api.Post("/messages/sendInbox", g.handleSendMessage("INBOX"))
+	api.Post("/messages/sendPush", g.handleSendMessage("PUSH"))
+
+	// Pages a user would see in the wallet
+	g.app.Get("/cashier/:paymentId", g.handleCashierPage)
+	g.app.Post("/cashier/:paymentId", g.handleCashierSubmit)
+	g.app.Get("/authorize", g.handleAuthorizePage)
+
+	// Inspection and control for developers and tests
+	g.app.Get("/mock/state", g.handleState)
+	g.app.Post("/mock/payments/:paymentId/complete", g.handleCompletePayment)
+	g.app.Get("/mock/scenarios", g.handleScenarios)
+	g.app.Post("/mock/scenarios", g.handleProgram)
+	g.app.Delete("/mock/scenarios", g.handleResetScenarios)
+	g.app.Get("/mock/calls", g.handleCalls)
+}
+
+// respond writes a signed JSON response in the shape the client expects
+func (g *Gateway) respond(ctx *fiber.Ctx, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	responseTime := time.Now().Format("2006-01-02T15:04:05-07:00")
+	signature, err := sign(g.config.GatewayPrivateKey, ctx.Method(), ctx.Path(), g.config.ClientID, responseTime, payload)
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, "application/json; charset=UTF-8")
+	ctx.Set("Client-Id", g.config.ClientID)
+	ctx.Set("Response-Time", responseTime)
+	ctx.Set("Signature", g.formatSignature(signature))
+	return ctx.Send(payload)
+}
+
+// parseBody decodes the request body into the client's request type
+func parseBody(ctx *fiber.Ctx, request interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(ctx.Body()))
+	return decoder.Decode(request)
+}
+
+func success() alipay.Result {
+	return alipay.Result{ResultStatus: "S", ResultCode: "SUCCESS", ResultMessage: "success"}
+}
+
+func failure(code, message string) alipay.Result {
+	return alipay.Result{ResultStatus: "F", ResultCode: code, ResultMessage: message}
+}
+
+func (g *Gateway) publicURL(path string) string {
+	return strings.TrimRight(g.config.PublicURL, "/") + path
+}
+
+func logf(format string, args ...interface{}) {
+	log.Printf("[MockGateway] "+format, args...)
+}
@@ -0,0 +1,69 @@
+package mockgateway
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// message is an inbox or push message delivered to a mock user
+type message struct {
+	ID           string              `json:"messageId"`
+	RequestID    string              `json:"requestId"`
+	Channel      string              `json:"channel"`
+	CustomerID   string              `json:"customerId"`
+	TemplateCode string              `json:"templateCode"`
+	Parameters   []map[string]string `json:"templateParameters"`
+	SentAt       time.Time           `json:"sentAt"`
+}
+
+// handleSendMessage implements sendInbox and sendPush, which share their request shape
+func (g *Gateway) handleSendMessage(channel string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var request struct {
+			AccessToken  string `json:"accessToken"`
+			RequestID    string `json:"requestId"`
+			TemplateCode string `json:"templateCode"`
+			Templates    []struct {
+				TemplateParameters map[string]string `json:"templateParameters"`
+			} `json:"templates"`
+		}
+		if err := parseBody(ctx, &request); err != nil {
+			return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+		}
+		if request.RequestID == "" || request.TemplateCode == "" {
+			return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "requestId and templateCode are required")})
+		}
+
+		user, ok := g.lookupUser(request.AccessToken)
+		if !ok {
+			return g.respond(ctx, fiber.Map{"result": failure("INVALID_ACCESS_TOKEN", "The access token is invalid or expired")})
+		}
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		// A repeated requestId is not delivered twice
+		if existing, exists := g.messages[channel+"/"+request.RequestID]; exists {
+			return g.respond(ctx, fiber.Map{"result": success(), "messageId": existing.ID})
+		}
+
+		sent := &message{
+			ID:           uuid.New().String(),
+			RequestID:    request.RequestID,
+			Channel:      channel,
+			CustomerID:   user.CustomerID,
+			TemplateCode: request.TemplateCode,
+			Parameters:   []map[string]string{},
+			SentAt:       time.Now(),
+		}
+		for _, template := range request.Templates {
+			sent.Parameters = append(sent.Parameters, template.TemplateParameters)
+		}
+		g.messages[channel+"/"+request.RequestID] = sent
+
+		logf("Delivered %s message %s (%s) to customer %s", channel, sent.ID, sent.TemplateCode, sent.CustomerID)
+		return g.respond(ctx, fiber.Map{"result": success(), "messageId": sent.ID})
+	}
+}
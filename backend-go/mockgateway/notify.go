@@ -0,0 +1,123 @@
+package mockgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"superQiMiniAppBackend/alipay"
+)
+
+const (
+	notifyAttempts = 5
+	notifyBackoff  = time.Second
+)
+
+// notification is one delivery attempt of a payment result notification
+type notification struct {
+	Attempt    int       `json:"attempt"`
+	SentAt     time.Time `json:"sentAt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// notifyPayment posts the signed result of a payment to its paymentNotifyUrl, retrying with
+// exponential backoff until the merchant answers 200 or the attempts run out
+func (g *Gateway) notifyPayment(paymentID string) {
+	g.mu.RLock()
+	p, exists := g.payments[paymentID]
+	if !exists {
+		g.mu.RUnlock()
+		return
+	}
+	body := map[string]interface{}{
+		"notifyType":       "PAYMENT_RESULT",
+		"result":           success(),
+		"paymentId":        p.ID,
+		"paymentRequestId": p.RequestID,
+		"paymentAmount":    p.Amount,
+		"paymentStatus":    p.Status,
+	}
+	if p.Status == PaymentFail {
+		body["result"] = failure("PAYMENT_FAIL", "The payment failed")
+	}
+	if p.PaidAt != nil {
+		body["paymentTime"] = p.PaidAt.Format(gatewayTimeFormat)
+	}
+	notifyURL := p.NotifyURL
+	g.mu.RUnlock()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		logf("Failed to encode notification of payment %s: %v", paymentID, err)
+		return
+	}
+
+	backoff := notifyBackoff
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		statusCode, err := g.postNotification(notifyURL, payload)
+
+		record := notification{Attempt: attempt, SentAt: time.Now(), StatusCode: statusCode}
+		if err == nil && statusCode != http.StatusOK {
+			err = fmt.Errorf("HTTP %d", statusCode)
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		g.mu.Lock()
+		p.Notified = append(p.Notified, record)
+		g.mu.Unlock()
+
+		if err == nil {
+			logf("Notified %s of payment %s", notifyURL, paymentID)
+			return
+		}
+
+		logf("Notification %d/%d of payment %s failed: %v", attempt, notifyAttempts, paymentID, err)
+		if attempt < notifyAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (g *Gateway) postNotification(notifyURL string, payload []byte) (int, error) {
+	target, err := url.Parse(notifyURL)
+	if err != nil {
+		return 0, err
+	}
+
+	requestTime := time.Now().Format(gatewayTimeFormat)
+	signature, err := sign(g.config.GatewayPrivateKey, http.MethodPost, target.Path, g.config.ClientID, requestTime, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, notifyURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	request.Header.Set("Client-Id", g.config.ClientID)
+	request.Header.Set("Request-Time", requestTime)
+	request.Header.Set("Signature", g.formatSignature(signature))
+
+	response, err := g.httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// The merchant acknowledges with a successful result, like the gateway's own responses
+	var ack struct {
+		Result alipay.Result `json:"result"`
+	}
+	if response.StatusCode == http.StatusOK && json.NewDecoder(response.Body).Decode(&ack) == nil && ack.Result.ResultStatus != "" && ack.Result.ResultStatus != "S" {
+		return response.StatusCode, fmt.Errorf("merchant answered %s %s", ack.Result.ResultStatus, ack.Result.ResultCode)
+	}
+	return response.StatusCode, nil
+}
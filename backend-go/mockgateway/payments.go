@@ -0,0 +1,476 @@
+package mockgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"superQiMiniAppBackend/alipay"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Payment statuses reported by inquiryPayment
+const (
+	PaymentProcessing  = "PROCESSING"
+	PaymentSuccess     = "SUCCESS"
+	PaymentAuthSuccess = "AUTH_SUCCESS"
+	PaymentFail        = "FAIL"
+	PaymentCancelled   = "CANCELLED"
+)
+
+// Escrow statuses, reported in the extendInfo of inquiryPayment
+const (
+	EscrowPaid      = "PAID"
+	EscrowAccepted  = "ACCEPTED"
+	EscrowConfirmed = "CONFIRMED"
+	EscrowCancelled = "CANCELLED"
+	EscrowVoided    = "VOIDED"
+)
+
+// Refund statuses reported by inquiryRefund
+const (
+	RefundProcessing = "PROCESSING"
+	RefundSuccess    = "SUCCESS"
+)
+
+const gatewayTimeFormat = "2006-01-02T15:04:05-07:00"
+
+type payment struct {
+	ID           string               `json:"paymentId"`
+	RequestID    string               `json:"paymentRequestId"`
+	ProductCode  string               `json:"productCode"`
+	Amount       alipay.PaymentAmount `json:"paymentAmount"`
+	Description  string               `json:"orderDescription,omitempty"`
+	BuyerID      string               `json:"buyerId,omitempty"`
+	Status       string               `json:"paymentStatus"`
+	EscrowStatus string               `json:"escrowStatus,omitempty"`
+	NotifyURL    string               `json:"paymentNotifyUrl,omitempty"`
+	RedirectURL  string               `json:"paymentRedirectUrl,omitempty"`
+	ExpiresAt    *time.Time           `json:"expiresAt,omitempty"`
+	CreatedAt    time.Time            `json:"createdAt"`
+	PaidAt       *time.Time           `json:"paidAt,omitempty"`
+	Refunded     int64                `json:"refunded"`
+	Transactions []alipay.Transaction `json:"transactions"`
+	Notified     []notification       `json:"notifications,omitempty"`
+}
+
+type refund struct {
+	ID          string              `json:"refundId"`
+	RequestID   string              `json:"refundRequestId"`
+	PaymentID   string              `json:"paymentId"`
+	Amount      alipay.RefundAmount `json:"refundAmount"`
+	Reason      string              `json:"refundReason,omitempty"`
+	Status      string              `json:"refundStatus"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	CompletedAt *time.Time          `json:"completedAt,omitempty"`
+}
+
+func isEscrow(p *payment) bool {
+	return p.ProductCode == alipay.ESCROW_PAYMENT
+}
+
+// findPayment looks a payment up by ID or request ID; callers hold g.mu
+func (g *Gateway) findPayment(paymentID, paymentRequestID string) (*payment, bool) {
+	if paymentID == "" {
+		paymentID = g.requests[paymentRequestID]
+	}
+	p, exists := g.payments[paymentID]
+	return p, exists
+}
+
+func parseAmount(value string) (int64, error) {
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, fmt.Errorf("amount %q must be a positive integer in the smallest currency unit", value)
+	}
+	return amount, nil
+}
+
+func (g *Gateway) handlePay(ctx *fiber.Ctx) error {
+	var request alipay.PaymentRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+	if request.PaymentRequestID == "" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "paymentRequestId is required")})
+	}
+	if _, err := parseAmount(request.PaymentAmount.Value); err != nil || request.PaymentAmount.Currency == "" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "paymentAmount must have a currency and a positive integer value")})
+	}
+
+	switch request.ProductCode {
+	case alipay.ONLINE_PURCHASE, alipay.ONLINE_PURCHASE_AUTH_CAPTURE, alipay.ESCROW_PAYMENT, alipay.AGREEMENT_PAYMENT:
+	default:
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Unknown productCode "+request.ProductCode)})
+	}
+
+	if request.ProductCode == alipay.AGREEMENT_PAYMENT {
+		if _, ok := g.lookupUser(request.PaymentAuthCode); !ok {
+			return g.respond(ctx, fiber.Map{"result": failure("INVALID_ACCESS_TOKEN", "The paymentAuthCode is invalid or expired")})
+		}
+	}
+
+	g.mu.Lock()
+	// A repeated paymentRequestId returns the payment it created the first time
+	if existing, exists := g.findPayment("", request.PaymentRequestID); exists {
+		if existing.Amount != request.PaymentAmount {
+			g.mu.Unlock()
+			return g.respond(ctx, fiber.Map{"result": failure("REPEAT_REQ_INCONSISTENT", "paymentRequestId was already used with different parameters")})
+		}
+		response := g.payResponse(existing)
+		g.mu.Unlock()
+		return g.respond(ctx, response)
+	}
+
+	now := time.Now()
+	p := &payment{
+		ID:           "2025" + now.Format("0102150405") + uuid.New().String()[:8],
+		RequestID:    request.PaymentRequestID,
+		ProductCode:  request.ProductCode,
+		Amount:       request.PaymentAmount,
+		Description:  request.Order.OrderDescription,
+		BuyerID:      request.Order.Buyer.ReferenceBuyerID,
+		Status:       PaymentProcessing,
+		NotifyURL:    request.PaymentNotifyURL,
+		RedirectURL:  request.PaymentRedirectURL,
+		CreatedAt:    now,
+		Transactions: []alipay.Transaction{},
+	}
+	if expiry, err := time.Parse(gatewayTimeFormat, request.PaymentExpiryTime); err == nil {
+		p.ExpiresAt = &expiry
+	}
+	g.payments[p.ID] = p
+	g.requests[p.RequestID] = p.ID
+
+	// Agreement payments are deducted from the wallet straight away, the others wait for the cashier
+	if p.ProductCode == alipay.AGREEMENT_PAYMENT {
+		g.settleLocked(p, true)
+	}
+	response := g.payResponse(p)
+	g.mu.Unlock()
+
+	logf("Created payment %s (%s) for %s %s", p.ID, p.RequestID, p.Amount.Value, p.Amount.Currency)
+
+	if p.ProductCode != alipay.AGREEMENT_PAYMENT {
+		if g.config.AutoPayDelay > 0 {
+			time.AfterFunc(g.config.AutoPayDelay, func() { g.CompletePayment(p.ID, true) })
+		}
+		if p.ExpiresAt != nil {
+			time.AfterFunc(time.Until(*p.ExpiresAt), func() { g.CompletePayment(p.ID, false) })
+		}
+	}
+
+	return g.respond(ctx, response)
+}
+
+// payResponse is the pay result for a payment in its current state; callers hold g.mu
+func (g *Gateway) payResponse(p *payment) fiber.Map {
+	response := fiber.Map{
+		"paymentId":        p.ID,
+		"paymentRequestId": p.RequestID,
+	}
+
+	switch p.Status {
+	case PaymentSuccess, PaymentAuthSuccess:
+		response["result"] = success()
+		response["paymentTime"] = p.PaidAt.Format(gatewayTimeFormat)
+	case PaymentProcessing:
+		response["result"] = alipay.Result{ResultStatus: "A", ResultCode: "ACCEPT", ResultMessage: "accept"}
+		response["redirectActionForm"] = alipay.RedirectActionForm{
+			RedirectURL: g.publicURL("/cashier/" + p.ID),
+			Method:      "GET",
+		}
+	default:
+		response["result"] = failure("PAYMENT_FAIL", "Payment is "+p.Status)
+	}
+	return response
+}
+
+// CompletePayment pays or fails a payment still waiting at the cashier, as the wallet user would.
+// It reports false when the payment does not exist or is no longer processing.
+func (g *Gateway) CompletePayment(paymentID string, paid bool) bool {
+	g.mu.Lock()
+	p, exists := g.payments[paymentID]
+	if !exists || p.Status != PaymentProcessing {
+		g.mu.Unlock()
+		return false
+	}
+	g.settleLocked(p, paid)
+	g.mu.Unlock()
+	return true
+}
+
+// settleLocked moves a processing payment to its final status and notifies the merchant;
+// callers hold g.mu
+func (g *Gateway) settleLocked(p *payment, paid bool) {
+	now := time.Now()
+	transactionType := "PAYMENT"
+
+	switch {
+	case !paid:
+		p.Status = PaymentFail
+	case p.ProductCode == alipay.ONLINE_PURCHASE_AUTH_CAPTURE:
+		p.Status = PaymentAuthSuccess
+		transactionType = "AUTHORIZATION"
+	default:
+		p.Status = PaymentSuccess
+	}
+	if paid {
+		p.PaidAt = &now
+		p.Transactions = append(p.Transactions, alipay.Transaction{
+			TransactionAmount: p.Amount,
+			TransactionID:     uuid.New().String(),
+			TransactionTime:   now.Format(gatewayTimeFormat),
+			TransactionType:   transactionType,
+			TransactionStatus: "SUCCESS",
+		})
+		if isEscrow(p) {
+			p.EscrowStatus = EscrowPaid
+		}
+	}
+
+	logf("Payment %s is %s", p.ID, p.Status)
+
+	if p.NotifyURL != "" {
+		go g.notifyPayment(p.ID)
+	}
+}
+
+func (g *Gateway) handleInquiryPayment(ctx *fiber.Ctx) error {
+	var request alipay.InquiryPaymentRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	p, exists := g.findPayment(request.PaymentID, request.PaymentRequestID)
+	if !exists {
+		return g.respond(ctx, fiber.Map{"result": failure("ORDER_NOT_EXIST", "The order does not exist")})
+	}
+
+	response := fiber.Map{
+		"result":           success(),
+		"paymentId":        p.ID,
+		"paymentRequestId": p.RequestID,
+		"paymentAmount":    p.Amount,
+		"paymentStatus":    p.Status,
+		"transactions":     p.Transactions,
+	}
+	if p.PaidAt != nil {
+		response["paymentTime"] = p.PaidAt.Format(gatewayTimeFormat)
+	}
+	if isEscrow(p) && p.EscrowStatus != "" {
+		extendInfo, _ := json.Marshal(map[string]string{"escrowStatus": p.EscrowStatus})
+		response["extendInfo"] = string(extendInfo)
+	}
+	return g.respond(ctx, response)
+}
+
+// escrowTransition applies an escrow operation to a payment if its escrow status allows it
+func (g *Gateway) escrowTransition(ctx *fiber.Ctx, paymentID, paymentRequestID string, from []string, apply func(p *payment) fiber.Map) error {
+	g.mu.Lock()
+	p, exists := g.findPayment(paymentID, paymentRequestID)
+	if !exists {
+		g.mu.Unlock()
+		return g.respond(ctx, fiber.Map{"result": failure("ORDER_NOT_EXIST", "The order does not exist")})
+	}
+	if !isEscrow(p) {
+		g.mu.Unlock()
+		return g.respond(ctx, fiber.Map{"result": failure("ORDER_STATUS_INVALID", "The payment is not an escrow payment")})
+	}
+
+	allowed := false
+	for _, status := range from {
+		if p.EscrowStatus == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		status := p.EscrowStatus
+		g.mu.Unlock()
+		if status == "" {
+			status = "unpaid"
+		}
+		return g.respond(ctx, fiber.Map{"result": failure("ORDER_STATUS_INVALID", "The escrow payment is "+status)})
+	}
+
+	response := apply(p)
+	response["result"] = success()
+	logf("Escrow payment %s is %s", p.ID, p.EscrowStatus)
+	g.mu.Unlock()
+
+	return g.respond(ctx, response)
+}
+
+func (g *Gateway) handleMerchantAccept(ctx *fiber.Ctx) error {
+	var request alipay.MerchantAcceptRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+
+	return g.escrowTransition(ctx, request.PaymentID, request.PaymentRequestID, []string{EscrowPaid}, func(p *payment) fiber.Map {
+		p.EscrowStatus = EscrowAccepted
+		return fiber.Map{"paymentId": p.ID, "paymentRequestId": p.RequestID}
+	})
+}
+
+func (g *Gateway) handleConfirm(ctx *fiber.Ctx) error {
+	var request alipay.ConfirmOrderRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+
+	return g.escrowTransition(ctx, request.PaymentID, request.PaymentRequestID, []string{EscrowAccepted}, func(p *payment) fiber.Map {
+		p.EscrowStatus = EscrowConfirmed
+		return fiber.Map{"confirmId": uuid.New().String(), "confirmTime": time.Now().Format(gatewayTimeFormat)}
+	})
+}
+
+// handleCancel cancels an escrow payment the merchant has not accepted, refunding the buyer
+func (g *Gateway) handleCancel(ctx *fiber.Ctx) error {
+	var request alipay.CancelPaymentRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+
+	return g.escrowTransition(ctx, request.PaymentID, request.PaymentRequestID, []string{"", EscrowPaid}, func(p *payment) fiber.Map {
+		p.EscrowStatus = EscrowCancelled
+		p.Status = PaymentCancelled
+		return fiber.Map{"paymentId": p.ID, "paymentRequestId": p.RequestID}
+	})
+}
+
+// handleVoid voids an accepted escrow payment that has not been confirmed
+func (g *Gateway) handleVoid(ctx *fiber.Ctx) error {
+	var request alipay.VoidRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+
+	return g.escrowTransition(ctx, request.PaymentID, request.PaymentRequestID, []string{EscrowAccepted}, func(p *payment) fiber.Map {
+		p.EscrowStatus = EscrowVoided
+		return fiber.Map{"voidId": uuid.New().String(), "voidTime": time.Now().Format(gatewayTimeFormat)}
+	})
+}
+
+func (g *Gateway) handleRefund(ctx *fiber.Ctx) error {
+	var request alipay.RefundRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+	if request.RefundRequestID == "" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "refundRequestId is required")})
+	}
+	amount, err := parseAmount(request.RefundAmount.Value)
+	if err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", err.Error())})
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// A repeated refundRequestId returns the refund it created the first time
+	if refundID, exists := g.refundRequests[request.RefundRequestID]; exists {
+		return g.respond(ctx, g.refundResponse(g.refunds[refundID]))
+	}
+
+	p, exists := g.findPayment(request.PaymentID, request.PaymentRequestID)
+	if !exists {
+		return g.respond(ctx, fiber.Map{"result": failure("ORDER_NOT_EXIST", "The order does not exist")})
+	}
+	if p.Status != PaymentSuccess || p.EscrowStatus == EscrowCancelled || p.EscrowStatus == EscrowVoided {
+		return g.respond(ctx, fiber.Map{"result": failure("ORDER_STATUS_INVALID", "The payment is "+p.Status+" and cannot be refunded")})
+	}
+	if request.RefundAmount.Currency != p.Amount.Currency {
+		return g.respond(ctx, fiber.Map{"result": failure("CURRENCY_NOT_SUPPORT", "The refund currency differs from the payment")})
+	}
+	paid, _ := parseAmount(p.Amount.Value)
+	if p.Refunded+amount > paid {
+		return g.respond(ctx, fiber.Map{"result": failure("REFUND_AMOUNT_EXCEED", "The refund amount exceeds the refundable amount")})
+	}
+
+	r := &refund{
+		ID:        "2025" + time.Now().Format("0102150405") + uuid.New().String()[:8],
+		RequestID: request.RefundRequestID,
+		PaymentID: p.ID,
+		Amount:    request.RefundAmount,
+		Reason:    request.RefundReason,
+		Status:    RefundProcessing,
+		CreatedAt: time.Now(),
+	}
+	p.Refunded += amount
+	g.refunds[r.ID] = r
+	g.refundRequests[r.RequestID] = r.ID
+
+	if g.config.RefundDelay > 0 {
+		time.AfterFunc(g.config.RefundDelay, func() {
+			g.mu.Lock()
+			g.completeRefundLocked(r)
+			g.mu.Unlock()
+		})
+	} else {
+		g.completeRefundLocked(r)
+	}
+
+	logf("Refund %s of %s %s on payment %s is %s", r.ID, r.Amount.Value, r.Amount.Currency, p.ID, r.Status)
+	return g.respond(ctx, g.refundResponse(r))
+}
+
+// completeRefundLocked finishes a processing refund; callers hold g.mu
+func (g *Gateway) completeRefundLocked(r *refund) {
+	now := time.Now()
+	r.Status = RefundSuccess
+	r.CompletedAt = &now
+}
+
+// refundResponse is the refund result for a refund in its current state; callers hold g.mu
+func (g *Gateway) refundResponse(r *refund) fiber.Map {
+	if r.Status == RefundProcessing {
+		return fiber.Map{
+			"result":   alipay.Result{ResultStatus: "U", ResultCode: "REFUND_IN_PROCESS", ResultMessage: "refund is processing"},
+			"refundId": r.ID,
+		}
+	}
+	return fiber.Map{
+		"result":     success(),
+		"refundId":   r.ID,
+		"refundTime": r.CompletedAt.Format(gatewayTimeFormat),
+	}
+}
+
+func (g *Gateway) handleInquiryRefund(ctx *fiber.Ctx) error {
+	var request alipay.InquiryRefundRequest
+	if err := parseBody(ctx, &request); err != nil {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	refundID := request.RefundID
+	if refundID == "" {
+		refundID = g.refundRequests[request.RefundRequestID]
+	}
+	r, exists := g.refunds[refundID]
+	if !exists {
+		return g.respond(ctx, fiber.Map{"result": failure("REFUND_NOT_EXIST", "The refund does not exist")})
+	}
+
+	response := fiber.Map{
+		"result":          success(),
+		"refundId":        r.ID,
+		"refundRequestId": r.RequestID,
+		"refundAmount":    r.Amount,
+		"refundReason":    r.Reason,
+		"refundStatus":    r.Status,
+	}
+	if r.CompletedAt != nil {
+		response["refundTime"] = r.CompletedAt.Format(gatewayTimeFormat)
+	}
+	return g.respond(ctx, response)
+}
@@ -0,0 +1,309 @@
+package mockgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"superQiMiniAppBackend/alipay"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Step is a programmed response for one endpoint. A request is still handled by the
+// simulation unless the step replaces the response entirely, so state keeps advancing
+// while the caller sees the programmed answer.
+type Step struct {
+	Match      map[string]string      `json:"match,omitempty"`      // top-level request fields that must have these values
+	Times      int                    `json:"times,omitempty"`      // requests served, 0 for one, negative for all remaining
+	Delay      time.Duration          `json:"delay,omitempty"`      // wait before answering, longer than the client timeout simulates a timeout
+	HTTPStatus int                    `json:"httpStatus,omitempty"` // answer with this status and Body, unsigned, instead of 200
+	EmptyBody  bool                   `json:"emptyBody,omitempty"`  // answer 200 with no body
+	Body       map[string]interface{} `json:"body,omitempty"`       // replaces the response
+	Result     *alipay.Result         `json:"result,omitempty"`     // replaces the result of the simulated response
+	Fields     map[string]interface{} `json:"fields,omitempty"`     // set on the simulated response, e.g. paymentStatus
+}
+
+// UnmarshalJSON accepts delays as duration strings such as "1.5s"
+func (s *Step) UnmarshalJSON(data []byte) error {
+	type plain Step
+	var step struct {
+		plain
+		Delay interface{} `json:"delay,omitempty"`
+	}
+	if err := json.Unmarshal(data, &step); err != nil {
+		return err
+	}
+	*s = Step(step.plain)
+
+	switch delay := step.Delay.(type) {
+	case nil:
+	case string:
+		parsed, err := time.ParseDuration(delay)
+		if err != nil {
+			return fmt.Errorf("invalid delay %q: %v", delay, err)
+		}
+		s.Delay = parsed
+	case float64:
+		s.Delay = time.Duration(delay)
+	default:
+		return fmt.Errorf("invalid delay %v", delay)
+	}
+	return nil
+}
+
+// UnknownResult answers with resultStatus U, the outcome the client must inquire about later
+func UnknownResult() Step {
+	return Step{Result: &alipay.Result{ResultStatus: "U", ResultCode: "UNKNOWN_EXCEPTION", ResultMessage: "An API calling is failed, which is caused by unknown reasons."}}
+}
+
+// FailResult answers with resultStatus F and code, such as ORDER_NOT_EXIST
+func FailResult(code string) Step {
+	return Step{Result: &alipay.Result{ResultStatus: "F", ResultCode: code, ResultMessage: code}}
+}
+
+// ServerError answers with an HTTP error status, which the client reports as an error
+func ServerError(status int) Step {
+	return Step{HTTPStatus: status, Body: map[string]interface{}{"error": http.StatusText(status)}}
+}
+
+// EmptyResponse answers 200 without a body, which the client rejects
+func EmptyResponse() Step {
+	return Step{EmptyBody: true}
+}
+
+// Slow delays the simulated response
+func Slow(delay time.Duration) Step {
+	return Step{Delay: delay}
+}
+
+// WithFields overrides fields of the next times simulated responses, e.g.
+// WithFields(3, map[string]interface{}{"paymentStatus": "PROCESSING"})
+func WithFields(times int, fields map[string]interface{}) Step {
+	return Step{Times: times, Fields: fields}
+}
+
+// Call is a request the gateway received, in order of arrival
+type Call struct {
+	Path       string                 `json:"path"`
+	Request    map[string]interface{} `json:"request"`
+	Programmed bool                   `json:"programmed"`
+	ReceivedAt time.Time              `json:"receivedAt"`
+}
+
+type programmedStep struct {
+	Step
+	remaining int // negative for unlimited
+}
+
+// endpointPath accepts "/v1/payments/pay", "/payments/pay" or "payments/pay"
+func endpointPath(path string) string {
+	path = "/" + strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(path, "/v1/") {
+		path = "/v1" + path
+	}
+	return path
+}
+
+// Program queues steps for an endpoint. Steps are used in order, a request matching none
+// of the queued steps gets the simulated response.
+func (g *Gateway) Program(path string, steps ...Step) {
+	path = endpointPath(path)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, step := range steps {
+		remaining := step.Times
+		if remaining == 0 {
+			remaining = 1
+		}
+		g.scenarios[path] = append(g.scenarios[path], &programmedStep{Step: step, remaining: remaining})
+	}
+}
+
+// ResetScenarios drops every programmed step and the call log
+func (g *Gateway) ResetScenarios() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.scenarios = make(map[string][]*programmedStep)
+	g.calls = nil
+}
+
+// Calls returns the requests received on an endpoint, or on every endpoint when path is empty
+func (g *Gateway) Calls(path string) []Call {
+	if path != "" {
+		path = endpointPath(path)
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	calls := []Call{}
+	for _, call := range g.calls {
+		if path == "" || call.Path == path {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// nextStep consumes the first queued step matching the request
+func (g *Gateway) nextStep(path string, request map[string]interface{}) (Step, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	call := Call{Path: path, Request: request, ReceivedAt: time.Now()}
+	defer func() { g.calls = append(g.calls, call) }()
+
+	queue := g.scenarios[path]
+	for i, step := range queue {
+		if !matches(step.Match, request) {
+			continue
+		}
+		if step.remaining > 0 {
+			step.remaining--
+			if step.remaining == 0 {
+				g.scenarios[path] = append(queue[:i:i], queue[i+1:]...)
+			}
+		}
+		call.Programmed = true
+		return step.Step, true
+	}
+	return Step{}, false
+}
+
+func matches(match map[string]string, request map[string]interface{}) bool {
+	for field, value := range match {
+		if fmt.Sprint(request[field]) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// runScenario answers with the next programmed step for the endpoint, if any
+func (g *Gateway) runScenario(ctx *fiber.Ctx) error {
+	request := map[string]interface{}{}
+	json.Unmarshal(ctx.Body(), &request)
+
+	step, programmed := g.nextStep(ctx.Path(), request)
+	if !programmed {
+		return ctx.Next()
+	}
+
+	if step.Delay > 0 {
+		time.Sleep(step.Delay)
+	}
+
+	switch {
+	case step.HTTPStatus != 0 && step.HTTPStatus != fiber.StatusOK:
+		logf("Scenario: %s answered HTTP %d", ctx.Path(), step.HTTPStatus)
+		if step.Body == nil {
+			return ctx.SendStatus(step.HTTPStatus)
+		}
+		return ctx.Status(step.HTTPStatus).JSON(step.Body)
+
+	case step.EmptyBody:
+		logf("Scenario: %s answered with an empty body", ctx.Path())
+		ctx.Status(fiber.StatusOK)
+		return nil
+
+	case step.Body != nil:
+		logf("Scenario: %s answered with a programmed body", ctx.Path())
+		return g.respond(ctx, step.Body)
+
+	case step.Result == nil && len(step.Fields) == 0:
+		return ctx.Next()
+	}
+
+	// The simulation handles the request, then the programmed result and fields are applied
+	if err := ctx.Next(); err != nil {
+		return err
+	}
+	response := map[string]interface{}{}
+	if err := json.Unmarshal(ctx.Response().Body(), &response); err != nil {
+		return err
+	}
+	if step.Result != nil {
+		response["result"] = step.Result
+	}
+	for field, value := range step.Fields {
+		response[field] = value
+	}
+
+	logf("Scenario: %s answered with programmed fields", ctx.Path())
+	return g.respond(ctx, response)
+}
+
+// handleProgram queues steps over HTTP: {"path": "/v1/payments/inquiryPayment", "steps": [...]}
+func (g *Gateway) handleProgram(ctx *fiber.Ctx) error {
+	var request struct {
+		Path  string `json:"path"`
+		Steps []Step `json:"steps"`
+	}
+	if err := json.Unmarshal(ctx.Body(), &request); err != nil || request.Path == "" {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"message": "path and steps are required",
+		})
+	}
+
+	g.Program(request.Path, request.Steps...)
+	return ctx.JSON(fiber.Map{"success": true})
+}
+
+func (g *Gateway) handleScenarios(ctx *fiber.Ctx) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	paths := make([]string, 0, len(g.scenarios))
+	for path := range g.scenarios {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	scenarios := fiber.Map{}
+	for _, path := range paths {
+		steps := []fiber.Map{}
+		for _, step := range g.scenarios[path] {
+			steps = append(steps, fiber.Map{"step": step.Step, "remaining": step.remaining})
+		}
+		if len(steps) > 0 {
+			scenarios[path] = steps
+		}
+	}
+	return ctx.JSON(scenarios)
+}
+
+func (g *Gateway) handleResetScenarios(ctx *fiber.Ctx) error {
+	g.ResetScenarios()
+	return ctx.JSON(fiber.Map{"success": true})
+}
+
+func (g *Gateway) handleCalls(ctx *fiber.Ctx) error {
+	calls := g.Calls(ctx.Query("path"))
+	return ctx.JSON(fiber.Map{"count": len(calls), "calls": calls})
+}
+
+// LoadScenarios programs the steps of a JSON file mapping endpoint paths to step lists
+func (g *Gateway) LoadScenarios(data []byte) error {
+	var scenarios map[string][]Step
+	if err := json.Unmarshal(data, &scenarios); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(scenarios))
+	for path := range scenarios {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		g.Program(path, scenarios[path]...)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package mockgateway
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// signContent is the string signed in both directions:
+// "<METHOD> <path>\n<clientId>.<request or response time>.<body>"
+func signContent(method, path, clientID, timestamp string, body []byte) []byte {
+	return []byte(fmt.Sprintf("%s %s\n%s.%s.%s", method, path, clientID, timestamp, body))
+}
+
+func sign(key *rsa.PrivateKey, method, path, clientID, timestamp string, body []byte) (string, error) {
+	hash := sha256.Sum256(signContent(method, path, clientID, timestamp, body))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func verify(key *rsa.PublicKey, method, path, clientID, timestamp string, body []byte, signature string) error {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %v", err)
+	}
+	hash := sha256.Sum256(signContent(method, path, clientID, timestamp, body))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], decoded)
+}
+
+func (g *Gateway) formatSignature(signature string) string {
+	version := g.config.GatewayKeyVersion
+	if version == "" {
+		version = "1"
+	}
+	return "algorithm=RSA256, keyVersion=" + version + ", signature=" + signature
+}
+
+// merchantKey is the merchant public key of a key version, version 1 when it names none
+func (g *Gateway) merchantKey(version string) (*rsa.PublicKey, error) {
+	if key, exists := g.config.MerchantPublicKeys[version]; exists {
+		return key, nil
+	}
+	if version == "" || version == "1" {
+		return g.config.MerchantPublicKey, nil
+	}
+	return nil, fmt.Errorf("unknown key version %s", version)
+}
+
+// parseSignatureHeader extracts the key version and signature from "algorithm=RSA256, keyVersion=1, signature=..."
+func parseSignatureHeader(header string) (string, string, error) {
+	var version string
+	for _, part := range strings.Split(header, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch name {
+		case "algorithm":
+			if value != "RSA256" {
+				return "", "", fmt.Errorf("unsupported algorithm %s", value)
+			}
+		case "keyVersion":
+			version = value
+		case "signature":
+			// Base64 padding also uses '=', so everything after the first one is the value
+			return version, value, nil
+		}
+	}
+	return "", "", errors.New("no signature in Signature header")
+}
+
+// verifySignature rejects requests that were not signed by the merchant key, the way the
+// real gateway does: HTTP 200 with a failed result
+func (g *Gateway) verifySignature(ctx *fiber.Ctx) error {
+	clientID := ctx.Get("Client-Id")
+	if clientID != g.config.ClientID {
+		logf("Rejected %s: unknown Client-Id %q", ctx.Path(), clientID)
+		return g.respond(ctx, fiber.Map{"result": failure("INVALID_CLIENT", "Client-Id is not registered")})
+	}
+
+	requestTime := ctx.Get("Request-Time")
+	if requestTime == "" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request-Time header is required")})
+	}
+
+	version, signature, err := parseSignatureHeader(ctx.Get("Signature"))
+	var key *rsa.PublicKey
+	if err == nil {
+		key, err = g.merchantKey(version)
+	}
+	if err == nil {
+		err = verify(key, ctx.Method(), ctx.Path(), clientID, requestTime, ctx.Body(), signature)
+	}
+	if err != nil {
+		logf("Rejected %s: invalid signature: %v", ctx.Path(), err)
+		return g.respond(ctx, fiber.Map{"result": failure("INVALID_SIGNATURE", "The signature is invalid")})
+	}
+
+	return ctx.Next()
+}
+
+// LoadPrivateKey reads a PKCS1 or PKCS8 PEM RSA private key
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA private key", path)
+	}
+	return key, nil
+}
+
+// LoadPublicKey reads a PKIX PEM RSA public key
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", path)
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+	return block, nil
+}
+
+// GenerateKeys writes a merchant and a gateway key pair to dir, in the formats the backend
+// (ALIPAY_MERCHANT_PRIVATE_KEY_PATH, ALIPAY_PUBLIC_KEY_PATH) and the mock gateway load
+func GenerateKeys(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, name := range []string{"merchant", "gateway"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		if err := writeKeyPair(dir, name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeKeyPair(dir, name string, key *rsa.PrivateKey) error {
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(filepath.Join(dir, name+"_private_key.pem"), private, 0600); err != nil {
+		return err
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	return os.WriteFile(filepath.Join(dir, name+"_public_key.pem"), public, 0644)
+}
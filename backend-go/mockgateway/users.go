@@ -0,0 +1,242 @@
+package mockgateway
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenLifetime  = 7 * 24 * time.Hour
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// mockUser is the wallet user an access token was issued for
+type mockUser struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	AuthCode     string    `json:"authCode"`
+	CustomerID   string    `json:"customerId"`
+	UserID       string    `json:"userId"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	Cancelled    bool      `json:"cancelled"`
+}
+
+// userFor derives a stable user from an auth code, so the same code always signs in the same user
+func userFor(authCode string) (string, string) {
+	id := uuid.NewSHA1(uuid.NameSpaceOID, []byte(authCode)).String()
+	digits := strings.NewReplacer("-", "", "a", "1", "b", "2", "c", "3", "d", "4", "e", "5", "f", "6").Replace(id)
+	return "2160" + digits[:12], "2160" + digits[12:24]
+}
+
+func (g *Gateway) handleApplyToken(ctx *fiber.Ctx) error {
+	var request struct {
+		GrantType string `json:"grantType"`
+		AuthCode  string `json:"authCode"`
+	}
+	if err := parseBody(ctx, &request); err != nil || request.AuthCode == "" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "authCode is required")})
+	}
+	if request.GrantType != "AUTHORIZATION_CODE" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Unsupported grantType "+request.GrantType)})
+	}
+
+	customerID, userID := userFor(request.AuthCode)
+	now := time.Now()
+	user := &mockUser{
+		AccessToken:  "mock-token-" + uuid.New().String(),
+		RefreshToken: "mock-refresh-" + uuid.New().String(),
+		AuthCode:     request.AuthCode,
+		CustomerID:   customerID,
+		UserID:       userID,
+		ExpiresAt:    now.Add(accessTokenLifetime),
+	}
+
+	g.mu.Lock()
+	g.tokens[user.AccessToken] = user
+	g.mu.Unlock()
+
+	logf("Issued access token for customer %s", customerID)
+
+	return g.respond(ctx, fiber.Map{
+		"result":                 success(),
+		"accessToken":            user.AccessToken,
+		"accessTokenExpiryTime":  user.ExpiresAt.Format(time.RFC3339),
+		"refreshToken":           user.RefreshToken,
+		"refreshTokenExpiryTime": now.Add(refreshTokenLifetime).Format(time.RFC3339),
+		"customerId":             customerID,
+	})
+}
+
+// lookupUser returns the user of a valid access token
+func (g *Gateway) lookupUser(accessToken string) (*mockUser, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	user, exists := g.tokens[accessToken]
+	if !exists || user.Cancelled || time.Now().After(user.ExpiresAt) {
+		return nil, false
+	}
+	return user, true
+}
+
+// authenticated parses a request carrying an accessToken and looks up its user
+func (g *Gateway) authenticated(ctx *fiber.Ctx) (*mockUser, error) {
+	var request struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := parseBody(ctx, &request); err != nil {
+		return nil, g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "Request body is not valid JSON")})
+	}
+	user, ok := g.lookupUser(request.AccessToken)
+	if !ok {
+		return nil, g.respond(ctx, fiber.Map{"result": failure("INVALID_ACCESS_TOKEN", "The access token is invalid or expired")})
+	}
+	return user, nil
+}
+
+func (g *Gateway) handlePrepare(ctx *fiber.Ctx) error {
+	var request struct {
+		Scopes          string `json:"scopes"`
+		ExtendInfo      string `json:"extendInfo"`
+		AuthRedirectURL string `json:"authRedirectUrl"`
+		State           string `json:"state"`
+	}
+	if err := parseBody(ctx, &request); err != nil || request.Scopes == "" {
+		return g.respond(ctx, fiber.Map{"result": failure("PARAM_ILLEGAL", "scopes is required")})
+	}
+
+	query := url.Values{}
+	query.Set("scopes", request.Scopes)
+	if request.AuthRedirectURL != "" {
+		query.Set("redirectUrl", request.AuthRedirectURL)
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+
+	return g.respond(ctx, fiber.Map{
+		"result":  success(),
+		"authUrl": g.publicURL("/authorize?" + query.Encode()),
+	})
+}
+
+func (g *Gateway) handleCancelToken(ctx *fiber.Ctx) error {
+	user, err := g.authenticated(ctx)
+	if user == nil {
+		return err
+	}
+
+	g.mu.Lock()
+	user.Cancelled = true
+	g.mu.Unlock()
+
+	logf("Cancelled access token of customer %s", user.CustomerID)
+	return g.respond(ctx, fiber.Map{"result": success()})
+}
+
+func (g *Gateway) handleInquiryUserInfo(ctx *fiber.Ctx) error {
+	user, err := g.authenticated(ctx)
+	if user == nil {
+		return err
+	}
+
+	phone := "96477" + user.UserID[len(user.UserID)-8:]
+	return g.respond(ctx, fiber.Map{
+		"result": success(),
+		"userInfo": fiber.Map{
+			"userId": user.UserID,
+			"loginIdInfos": []fiber.Map{{
+				"loginId":     phone,
+				"hashLoginId": uuid.NewSHA1(uuid.NameSpaceOID, []byte(phone)).String(),
+				"maskLoginId": phone[:5] + "****" + phone[len(phone)-4:],
+				"loginIdType": "MOBILE_PHONE",
+			}},
+			"userName": fiber.Map{
+				"fullName":  "Mock User",
+				"firstName": "Mock",
+				"lastName":  "User",
+			},
+			"userNameInArabic": fiber.Map{
+				"fullName":  "مستخدم تجريبي",
+				"firstName": "مستخدم",
+				"lastName":  "تجريبي",
+			},
+			"avatar":      "",
+			"gender":      "M",
+			"birthDate":   "1990-01-01",
+			"nationality": "IQ",
+			"contactInfos": []fiber.Map{{
+				"contactType": "MOBILE_PHONE",
+				"contactNo":   phone,
+			}},
+		},
+	})
+}
+
+func (g *Gateway) handleInquiryUserCardList(ctx *fiber.Ctx) error {
+	user, err := g.authenticated(ctx)
+	if user == nil {
+		return err
+	}
+
+	suffix := user.UserID[len(user.UserID)-4:]
+	return g.respond(ctx, fiber.Map{
+		"result": success(),
+		"cardList": []fiber.Map{{
+			"maskedCardNo":  "6262 **** **** " + suffix,
+			"accountNumber": fmt.Sprintf("IQ%s%s", user.CustomerID, suffix),
+		}},
+	})
+}
+
+func (g *Gateway) handleInquiryMerchantInfo(ctx *fiber.Ctx) error {
+	user, err := g.authenticated(ctx)
+	if user == nil {
+		return err
+	}
+
+	return g.respond(ctx, fiber.Map{
+		"result": success(),
+		"merchantInfo": fiber.Map{
+			"merchantId":   "2188" + g.config.ClientID,
+			"merchantName": "Mock Merchant",
+			"merchantLogo": "",
+		},
+	})
+}
+
+// handleAuthorizePage stands in for the wallet's consent screen, it sends the user back
+// to the redirect URL with a fresh auth code
+func (g *Gateway) handleAuthorizePage(ctx *fiber.Ctx) error {
+	authCode := "mock-auth-" + uuid.New().String()
+	redirectURL := ctx.Query("redirectUrl")
+	if redirectURL == "" {
+		ctx.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return ctx.SendString(fmt.Sprintf(authorizePage, ctx.Query("scopes"), authCode))
+	}
+
+	target, err := url.Parse(redirectURL)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid redirectUrl")
+	}
+	query := target.Query()
+	query.Set("authCode", authCode)
+	if state := ctx.Query("state"); state != "" {
+		query.Set("state", state)
+	}
+	target.RawQuery = query.Encode()
+	return ctx.Redirect(target.String())
+}
+
+const authorizePage = `<!DOCTYPE html>
+<html><head><title>Mock authorization</title></head>
+<body>
+<h1>Mock authorization</h1>
+<p>Scopes: %s</p>
+<p>Auth code: <code>%s</code></p>
+</body></html>`
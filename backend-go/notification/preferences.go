@@ -0,0 +1,261 @@
+package notification
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+	_ "time/tzdata" // quiet hours need IANA time zones even on hosts without zoneinfo
+)
+
+// Notification categories users can opt out of
+const (
+	CategoryMarketing     = "marketing"
+	CategoryTransactional = "transactional"
+	CategoryEscrow        = "escrow"
+)
+
+// Categories lists every category users can opt out of
+var Categories = []string{CategoryMarketing, CategoryTransactional, CategoryEscrow}
+
+// Delivery decisions for a message
+const (
+	DecisionSend      = "SEND"
+	DecisionSuppress  = "SUPPRESS"  // user opted out of the category
+	DecisionDefer     = "DEFER"     // push held until quiet hours end
+	DecisionDowngrade = "DOWNGRADE" // push sent to the inbox instead during quiet hours
+)
+
+const defaultPreferencesPath = "./data/notification-preferences.json"
+
+// QuietHours is a daily window, in the user's time zone, during which no push is sent.
+// The window may wrap midnight, e.g. 22:00 to 07:00.
+type QuietHours struct {
+	Start    string `json:"start"` // HH:MM
+	End      string `json:"end"`   // HH:MM
+	Timezone string `json:"timezone"`
+}
+
+// Preferences are the notification settings of one customer
+type Preferences struct {
+	CustomerID string      `json:"customerId"`
+	OptOut     []string    `json:"optOut"`
+	QuietHours *QuietHours `json:"quietHours,omitempty"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+}
+
+// Decision tells a sender what to do with a message
+type Decision struct {
+	Action string
+	Until  time.Time // end of quiet hours for DEFER and DOWNGRADE
+	Reason string
+}
+
+// PreferenceStore persists notification preferences keyed by customer ID
+type PreferenceStore struct {
+	mu          sync.RWMutex
+	preferences map[string]*Preferences
+	path        string
+}
+
+// UserPreferences is the preference store used by the backend, set by InitPreferences
+var UserPreferences *PreferenceStore
+
+// InitPreferences loads preferences from NOTIFICATION_PREFERENCES_PATH
+func InitPreferences() error {
+	store, err := OpenPreferences("")
+	if err != nil {
+		return err
+	}
+	UserPreferences = store
+	return nil
+}
+
+// OpenPreferences loads the preferences of a tenant from its directory next to
+// NOTIFICATION_PREFERENCES_PATH, or from the path itself when tenantID is empty
+func OpenPreferences(tenantID string) (*PreferenceStore, error) {
+	path := os.Getenv("NOTIFICATION_PREFERENCES_PATH")
+	if path == "" {
+		path = defaultPreferencesPath
+	}
+	path = tenant.ScopedPath(path, tenantID)
+
+	store, err := NewPreferenceStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Notification] Loaded preferences for %d customer(s) from %s", len(store.preferences), path)
+	return store, nil
+}
+
+// NewPreferenceStore creates a preference store, restoring it from path if it exists
+func NewPreferenceStore(path string) (*PreferenceStore, error) {
+	store := &PreferenceStore{
+		preferences: make(map[string]*Preferences),
+		path:        path,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Validate checks categories, time formats and the time zone
+func (p Preferences) Validate() error {
+	for _, category := range p.OptOut {
+		if !isCategory(category) {
+			return fmt.Errorf("unknown notification category: %s", category)
+		}
+	}
+
+	if p.QuietHours != nil {
+		if _, err := parseClock(p.QuietHours.Start); err != nil {
+			return fmt.Errorf("invalid quiet hours start: %v", err)
+		}
+		if _, err := parseClock(p.QuietHours.End); err != nil {
+			return fmt.Errorf("invalid quiet hours end: %v", err)
+		}
+		if _, err := time.LoadLocation(p.QuietHours.Timezone); err != nil || p.QuietHours.Timezone == "" {
+			return fmt.Errorf("invalid time zone: %q", p.QuietHours.Timezone)
+		}
+	}
+	return nil
+}
+
+// Get returns the preferences of a customer, defaults when none were saved
+func (s *PreferenceStore) Get(customerID string) Preferences {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	preferences, exists := s.preferences[customerID]
+	if !exists {
+		return Preferences{CustomerID: customerID, OptOut: []string{}}
+	}
+	return *preferences
+}
+
+// Set validates and saves the preferences of a customer, updated at now
+func (s *PreferenceStore) Set(preferences Preferences, now time.Time) (Preferences, error) {
+	if err := preferences.Validate(); err != nil {
+		return Preferences{}, err
+	}
+	if preferences.OptOut == nil {
+		preferences.OptOut = []string{}
+	}
+	preferences.UpdatedAt = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.preferences[preferences.CustomerID] = &preferences
+	s.saveLocked()
+
+	log.Printf("[Notification] Saved preferences for customer %s", preferences.CustomerID)
+	return preferences, nil
+}
+
+// Decide applies a customer's preferences to a message of the given category and channel
+func (s *PreferenceStore) Decide(customerID, category, channel string, now time.Time) Decision {
+	preferences := s.Get(customerID)
+
+	for _, optedOut := range preferences.OptOut {
+		if optedOut == category {
+			return Decision{Action: DecisionSuppress, Reason: "Customer opted out of " + category + " notifications"}
+		}
+	}
+
+	if channel != ChannelPush || preferences.QuietHours == nil {
+		return Decision{Action: DecisionSend}
+	}
+
+	end, inQuietHours := preferences.QuietHours.window(now)
+	if !inQuietHours {
+		return Decision{Action: DecisionSend}
+	}
+
+	// Marketing can wait, anything else still reaches the user silently through the inbox
+	if category == CategoryMarketing {
+		return Decision{Action: DecisionDefer, Until: end, Reason: "Quiet hours"}
+	}
+	return Decision{Action: DecisionDowngrade, Until: end, Reason: "Quiet hours"}
+}
+
+// window reports whether now falls into the quiet hours and when they end
+func (q QuietHours) window(now time.Time) (time.Time, bool) {
+	location, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := parseClock(q.End)
+	if err != nil || start == end {
+		return time.Time{}, false
+	}
+
+	local := now.In(location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	current := local.Sub(midnight)
+
+	var inQuietHours bool
+	if start < end {
+		inQuietHours = current >= start && current < end
+	} else {
+		inQuietHours = current >= start || current < end
+	}
+	if !inQuietHours {
+		return time.Time{}, false
+	}
+
+	endsAt := midnight.Add(end)
+	if !endsAt.After(local) {
+		endsAt = midnight.AddDate(0, 0, 1).Add(end)
+	}
+	return endsAt, true
+}
+
+// parseClock parses HH:MM into the offset from midnight
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+func isCategory(category string) bool {
+	for _, known := range Categories {
+		if known == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PreferenceStore) load() error {
+	var preferences []*Preferences
+	if err := jsonfile.Load(s.path, &preferences); err != nil {
+		return fmt.Errorf("failed to load notification preferences %s: %v", s.path, err)
+	}
+	for _, entry := range preferences {
+		s.preferences[entry.CustomerID] = entry
+	}
+	return nil
+}
+
+// saveLocked writes the preferences to disk; the caller must hold the lock
+func (s *PreferenceStore) saveLocked() {
+	preferences := make([]*Preferences, 0, len(s.preferences))
+	for _, entry := range s.preferences {
+		preferences = append(preferences, entry)
+	}
+
+	if err := jsonfile.Save(s.path, preferences); err != nil {
+		log.Printf("[Notification] ERROR: Failed to save preferences: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package notification
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+)
+
+// Send statuses
+const (
+	SendStatusSent       = "SENT"       // gateway returned S or A
+	SendStatusUnknown    = "UNKNOWN"    // gateway returned U or could not be reached, will be re-sent
+	SendStatusFailed     = "FAILED"     // gateway returned F
+	SendStatusUnresolved = "UNRESOLVED" // still unknown after every reconciliation attempt
+)
+
+const (
+	maxReconcileAttempts = 5
+	initialReconcileWait = 30 * time.Second
+	sendLogRetention     = 7 * 24 * time.Hour
+	defaultSendLogPath   = "./data/notification-log.json"
+)
+
+// SendRecord is every attempt made for one inbox or push request ID
+type SendRecord struct {
+	RequestID       string            `json:"requestId"`
+	Channel         string            `json:"channel"`
+	TemplateCode    string            `json:"templateCode"`
+	Parameters      map[string]string `json:"parameters"`
+	RecipientID     string            `json:"recipientId"`
+	Status          string            `json:"status"`
+	ResultStatus    string            `json:"resultStatus"`
+	ResultCode      string            `json:"resultCode,omitempty"`
+	ResultMessage   string            `json:"resultMessage,omitempty"`
+	MessageID       string            `json:"messageId,omitempty"`
+	Attempts        int               `json:"attempts"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	LastAttemptAt   time.Time         `json:"lastAttemptAt"`
+	NextReconcileAt time.Time         `json:"nextReconcileAt,omitempty"`
+}
+
+// SendAttempt is the outcome of one gateway call
+type SendAttempt struct {
+	RequestID     string
+	Channel       string
+	TemplateCode  string
+	Parameters    map[string]string
+	RecipientID   string
+	AccessToken   string
+	ResultStatus  string
+	ResultCode    string
+	ResultMessage string
+	MessageID     string
+}
+
+// SendLog persists notification attempts so their status can be looked up and
+// unknown results re-sent with the same request ID. Changes are written to disk in
+// the background.
+type SendLog struct {
+	mu       sync.RWMutex
+	records  map[string]*SendRecord
+	tokens   map[string]string // access tokens for re-sending, kept in memory only
+	inFlight map[string]bool   // request IDs claimed by the reconciler and not recorded yet
+	path     string
+
+	// reconciled is set while a reconciler is attached to the log
+	reconciled bool
+
+	// dirty is set when the records changed since they were last written
+	dirty   bool
+	persist chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Log is the send log used by the backend, set by InitSendLog
+var Log *SendLog
+
+// InitSendLog loads the send log from NOTIFICATION_LOG_PATH
+func InitSendLog() error {
+	sendLog, err := OpenSendLog("")
+	if err != nil {
+		return err
+	}
+	Log = sendLog
+	return nil
+}
+
+// OpenSendLog loads the send log of a tenant from its directory next to NOTIFICATION_LOG_PATH,
+// or from NOTIFICATION_LOG_PATH itself when tenantID is empty
+func OpenSendLog(tenantID string) (*SendLog, error) {
+	path := os.Getenv("NOTIFICATION_LOG_PATH")
+	if path == "" {
+		path = defaultSendLogPath
+	}
+	path = tenant.ScopedPath(path, tenantID)
+
+	sendLog, err := NewSendLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Notification] Loaded %d logged send(s) from %s", len(sendLog.records), path)
+	return sendLog, nil
+}
+
+// NewSendLog creates a send log, restoring records from path if it exists
+func NewSendLog(path string) (*SendLog, error) {
+	sendLog := &SendLog{
+		records:  make(map[string]*SendRecord),
+		tokens:   make(map[string]string),
+		inFlight: make(map[string]bool),
+		path:     path,
+		persist:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if err := sendLog.load(); err != nil {
+		return nil, err
+	}
+	go sendLog.writeLog()
+	return sendLog, nil
+}
+
+// Close stops the background writer and writes the pending changes of the log
+func (l *SendLog) Close() {
+	close(l.stop)
+	<-l.stopped
+}
+
+// AttachReconciler reserves the log for one reconciler. It reports false when another
+// one is already attached, so every unknown result is re-sent once.
+func (l *SendLog) AttachReconciler() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reconciled {
+		return false
+	}
+	l.reconciled = true
+	return true
+}
+
+// DetachReconciler lets another reconciler attach to the log
+func (l *SendLog) DetachReconciler() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reconciled = false
+}
+
+// Record stores an attempt made at now, updating the record when the request ID was sent before
+func (l *SendLog) Record(attempt SendAttempt, now time.Time) SendRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, exists := l.records[attempt.RequestID]
+	if !exists {
+		record = &SendRecord{
+			RequestID: attempt.RequestID,
+			CreatedAt: now,
+		}
+		l.records[attempt.RequestID] = record
+	}
+
+	record.Channel = attempt.Channel
+	record.TemplateCode = attempt.TemplateCode
+	record.Parameters = attempt.Parameters
+	record.RecipientID = attempt.RecipientID
+	record.ResultStatus = attempt.ResultStatus
+	record.ResultCode = attempt.ResultCode
+	record.ResultMessage = attempt.ResultMessage
+	if attempt.MessageID != "" {
+		record.MessageID = attempt.MessageID
+	}
+	record.Attempts++
+	record.LastAttemptAt = now
+	record.NextReconcileAt = time.Time{}
+	delete(l.inFlight, attempt.RequestID)
+
+	switch attempt.ResultStatus {
+	case "S", "A":
+		record.Status = SendStatusSent
+		delete(l.tokens, attempt.RequestID)
+	case "F":
+		record.Status = SendStatusFailed
+		delete(l.tokens, attempt.RequestID)
+	default:
+		if record.Attempts >= maxReconcileAttempts {
+			record.Status = SendStatusUnresolved
+			delete(l.tokens, attempt.RequestID)
+			log.Printf("[Notification] WARNING: %s still unknown after %d attempts, giving up", record.RequestID, record.Attempts)
+		} else {
+			record.Status = SendStatusUnknown
+			record.NextReconcileAt = now.Add(initialReconcileWait << (record.Attempts - 1))
+			if attempt.AccessToken != "" {
+				l.tokens[attempt.RequestID] = attempt.AccessToken
+			}
+		}
+	}
+
+	l.pruneLocked(now)
+	l.saveLocked()
+	return *record
+}
+
+// Get returns the record of a request ID
+func (l *SendLog) Get(requestID string) (SendRecord, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, exists := l.records[requestID]
+	if !exists {
+		return SendRecord{}, false
+	}
+	return *record, true
+}
+
+// DueForReconcile claims the unknown sends whose next attempt is due and returns them with
+// the token to re-send them. A claimed send is not due again until its re-send is recorded.
+// Records restored after a restart have no token and are marked unresolved.
+func (l *SendLog) DueForReconcile(now time.Time) ([]SendRecord, map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	due := []SendRecord{}
+	tokens := make(map[string]string)
+	changed := false
+	for requestID, record := range l.records {
+		if record.Status != SendStatusUnknown || record.NextReconcileAt.After(now) || l.inFlight[requestID] {
+			continue
+		}
+		token, exists := l.tokens[requestID]
+		if !exists {
+			record.Status = SendStatusUnresolved
+			record.NextReconcileAt = time.Time{}
+			changed = true
+			log.Printf("[Notification] WARNING: %s cannot be re-sent without an access token", requestID)
+			continue
+		}
+		l.inFlight[requestID] = true
+		record.NextReconcileAt = now.Add(initialReconcileWait << record.Attempts)
+		changed = true
+		due = append(due, *record)
+		tokens[requestID] = token
+	}
+
+	if changed {
+		l.saveLocked()
+	}
+	return due, tokens
+}
+
+// pruneLocked drops finished records older than the retention window
+func (l *SendLog) pruneLocked(now time.Time) {
+	for requestID, record := range l.records {
+		if record.Status != SendStatusUnknown && now.Sub(record.LastAttemptAt) > sendLogRetention {
+			delete(l.records, requestID)
+			delete(l.tokens, requestID)
+		}
+	}
+}
+
+func (l *SendLog) load() error {
+	var records []*SendRecord
+	if err := jsonfile.Load(l.path, &records); err != nil {
+		return fmt.Errorf("failed to load notification log %s: %v", l.path, err)
+	}
+	for _, record := range records {
+		l.records[record.RequestID] = record
+	}
+	return nil
+}
+
+// saveLocked asks the background writer to write the log; the caller must hold the lock
+func (l *SendLog) saveLocked() {
+	l.dirty = true
+	select {
+	case l.persist <- struct{}{}:
+	default:
+	}
+}
+
+// writeLog is the background writer persisting the log after it changed, and once more
+// when the log is closed. Records arriving while it writes are written together next time.
+func (l *SendLog) writeLog() {
+	defer close(l.stopped)
+
+	for {
+		select {
+		case <-l.persist:
+			l.flush()
+		case <-l.stop:
+			l.flush()
+			return
+		}
+	}
+}
+
+// flush writes the log to disk if it changed. Only the writer calls it, so writes never overlap.
+func (l *SendLog) flush() {
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return
+	}
+	records := make([]SendRecord, 0, len(l.records))
+	for _, record := range l.records {
+		records = append(records, *record)
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	if err := jsonfile.Save(l.path, records); err != nil {
+		log.Printf("[Notification] ERROR: Failed to save send log: %v", err)
+	}
+}
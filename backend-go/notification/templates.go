@@ -0,0 +1,240 @@
+package notification
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"superQiMiniAppBackend/alipay"
+	"sync"
+)
+
+// Notification channels
+const (
+	ChannelInbox = "INBOX"
+	ChannelPush  = "PUSH"
+)
+
+// Parameter filled with the default deep link when a template expects it and the caller left it out
+const urlParameter = "Url"
+
+// Variant overrides a template for one language
+type Variant struct {
+	Code       string            `json:"code,omitempty"`       // wallet template code for this language
+	Parameters map[string]string `json:"parameters,omitempty"` // default parameter values, e.g. a translated Title
+}
+
+// Template describes a wallet message template and the parameters it needs
+type Template struct {
+	Code               string             `json:"code"`
+	Channel            string             `json:"channel"`
+	Category           string             `json:"category,omitempty"` // preference category, transactional by default
+	RequiredParameters []string           `json:"requiredParameters"`
+	OptionalParameters []string           `json:"optionalParameters,omitempty"`
+	Page               string             `json:"page,omitempty"` // mini app page opened by the default deep link
+	Variants           map[string]Variant `json:"variants,omitempty"`
+}
+
+// Accepts reports whether the template declares the parameter
+func (t Template) Accepts(key string) bool {
+	for _, parameter := range t.RequiredParameters {
+		if parameter == key {
+			return true
+		}
+	}
+	for _, parameter := range t.OptionalParameters {
+		if parameter == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Rendered is a template resolved for one language with validated parameters
+type Rendered struct {
+	Code       string
+	Channel    string
+	Category   string
+	Parameters map[string]string
+}
+
+// Registry holds the message templates the backend may send
+type Registry struct {
+	mu        sync.RWMutex
+	appID     string
+	templates map[string]Template
+}
+
+// Templates is the registry used by the backend, set by InitTemplateRegistry
+var Templates *Registry
+
+// Built-in templates used when NOTIFICATION_TEMPLATES_PATH is not set
+var defaultTemplates = []Template{
+	{
+		Code:               "MINI_APP_COMMON_INBOX",
+		Channel:            ChannelInbox,
+		RequiredParameters: []string{"Title", "Content"},
+		OptionalParameters: []string{urlParameter},
+	},
+	{
+		Code:               "MINI_APP_COMMON_PUSH",
+		Channel:            ChannelPush,
+		RequiredParameters: []string{"Title", "Content"},
+		OptionalParameters: []string{urlParameter},
+	},
+}
+
+// InitTemplateRegistry loads templates from the JSON file at NOTIFICATION_TEMPLATES_PATH
+// and builds default deep links from MINI_APP_ID
+func InitTemplateRegistry() error {
+	registry, err := LoadTemplateRegistry(os.Getenv("MINI_APP_ID"))
+	if err != nil {
+		return err
+	}
+	Templates = registry
+	return nil
+}
+
+// LoadTemplateRegistry loads templates from the JSON file at NOTIFICATION_TEMPLATES_PATH,
+// with deep links into the mini app appID
+func LoadTemplateRegistry(appID string) (*Registry, error) {
+	if appID == "" {
+		return nil, errors.New("MINI_APP_ID is not set")
+	}
+
+	templates := defaultTemplates
+	if path := os.Getenv("NOTIFICATION_TEMPLATES_PATH"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("failed to parse notification templates %s: %v", path, err)
+		}
+	}
+
+	registry, err := NewRegistry(appID, templates)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Notification] Loaded %d template(s) for app %s", len(templates), appID)
+	return registry, nil
+}
+
+// NewRegistry validates and indexes templates by code
+func NewRegistry(appID string, templates []Template) (*Registry, error) {
+	registry := &Registry{
+		appID:     appID,
+		templates: make(map[string]Template),
+	}
+
+	for _, template := range templates {
+		if template.Code == "" {
+			return nil, errors.New("notification template without code")
+		}
+		if template.Channel != ChannelInbox && template.Channel != ChannelPush {
+			return nil, fmt.Errorf("template %s has unsupported channel %q", template.Code, template.Channel)
+		}
+		if template.Category == "" {
+			template.Category = CategoryTransactional
+		}
+		if !isCategory(template.Category) {
+			return nil, fmt.Errorf("template %s has unknown category %q", template.Code, template.Category)
+		}
+		if _, duplicate := registry.templates[template.Code]; duplicate {
+			return nil, fmt.Errorf("template %s is defined twice", template.Code)
+		}
+		registry.templates[template.Code] = template
+	}
+
+	return registry, nil
+}
+
+// Get returns a template by code
+func (r *Registry) Get(code string) (Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	template, exists := r.templates[code]
+	return template, exists
+}
+
+// List returns every template sorted by code
+func (r *Registry) List() []Template {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]Template, 0, len(r.templates))
+	for _, template := range r.templates {
+		list = append(list, template)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// DeepLink returns the link opening the mini app, optionally on a specific page
+func (r *Registry) DeepLink(page string) string {
+	link := "mini://platformapi/startapp?_ariver_appid=" + url.QueryEscape(r.appID)
+	if page != "" {
+		link += "&page=" + url.QueryEscape(page)
+	}
+	return link
+}
+
+// Render resolves a template for a language and validates the parameters against it.
+// Variant defaults are applied first, caller parameters win.
+func (r *Registry) Render(code, language string, parameters map[string]string) (Rendered, error) {
+	template, exists := r.Get(code)
+	if !exists {
+		return Rendered{}, fmt.Errorf("unknown template: %s", code)
+	}
+
+	if language == "" {
+		language = alipay.LANGUAGE_ENGLISH
+	}
+
+	rendered := Rendered{
+		Code:       template.Code,
+		Channel:    template.Channel,
+		Category:   template.Category,
+		Parameters: make(map[string]string),
+	}
+
+	if variant, exists := template.Variants[language]; exists {
+		if variant.Code != "" {
+			rendered.Code = variant.Code
+		}
+		for key, value := range variant.Parameters {
+			rendered.Parameters[key] = value
+		}
+	}
+
+	for key, value := range parameters {
+		if !template.Accepts(key) {
+			return Rendered{}, fmt.Errorf("template %s does not accept parameter %s", code, key)
+		}
+		if value != "" {
+			rendered.Parameters[key] = value
+		}
+	}
+
+	missing := []string{}
+	for _, key := range template.RequiredParameters {
+		if strings.TrimSpace(rendered.Parameters[key]) == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return Rendered{}, fmt.Errorf("template %s is missing parameters: %s", code, strings.Join(missing, ", "))
+	}
+
+	if template.Accepts(urlParameter) && rendered.Parameters[urlParameter] == "" {
+		rendered.Parameters[urlParameter] = r.DeepLink(template.Page)
+	}
+
+	return rendered, nil
+}
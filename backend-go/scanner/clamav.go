@@ -0,0 +1,114 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamAVTimeout = 2 * time.Minute
+	clamAVChunkSize      = 64 * 1024
+)
+
+// ClamAVScanner streams content to clamd over TCP with the INSTREAM command
+type ClamAVScanner struct {
+	address string
+	timeout time.Duration
+}
+
+// NewClamAVScanner creates a scanner for the clamd listening at address
+func NewClamAVScanner(address string, timeout time.Duration) *ClamAVScanner {
+	return &ClamAVScanner{address: address, timeout: timeout}
+}
+
+func (s *ClamAVScanner) Name() string {
+	return "clamav"
+}
+
+// Ping checks that clamd answers
+func (s *ClamAVScanner) Ping() error {
+	reply, err := s.command("zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply to PING: %s", reply)
+	}
+	return nil
+}
+
+// Scan sends the content in length-prefixed chunks and parses the verdict,
+// e.g. "stream: OK" or "stream: Eicar-Test-Signature FOUND"
+func (s *ClamAVScanner) Scan(content io.Reader) (Result, error) {
+	reply, err := s.command("zINSTREAM\x00", content)
+	if err != nil {
+		return Result{}, err
+	}
+
+	verdict := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case verdict == "OK":
+		return Result{Clean: true}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Clean: false, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		// Includes "INSTREAM size limit exceeded. ERROR" when the file is over clamd's StreamMaxLength
+		return Result{}, fmt.Errorf("clamd: %s", verdict)
+	}
+}
+
+// command sends a null-terminated command, followed by the stream if there is one, and reads the reply
+func (s *ClamAVScanner) command(command string, stream io.Reader) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.WriteString(command); err != nil {
+		return "", err
+	}
+
+	if stream != nil {
+		buffer := make([]byte, clamAVChunkSize)
+		for {
+			n, readErr := stream.Read(buffer)
+			if n > 0 {
+				if err := binary.Write(writer, binary.BigEndian, uint32(n)); err != nil {
+					return "", err
+				}
+				if _, err := writer.Write(buffer[:n]); err != nil {
+					return "", err
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return "", readErr
+			}
+		}
+		// A zero length chunk ends the stream
+		if err := binary.Write(writer, binary.BigEndian, uint32(0)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
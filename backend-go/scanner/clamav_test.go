@@ -0,0 +1,173 @@
+package scanner_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/scanner"
+)
+
+// clamd is a stub of the clamd INSTREAM protocol answering with the verdict for the content it received
+type clamd struct {
+	listener net.Listener
+	verdict  func(content []byte) string
+
+	mu       sync.Mutex
+	received [][]byte
+}
+
+func newClamd(t *testing.T, verdict func(content []byte) string) *clamd {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &clamd{listener: listener, verdict: verdict}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(t, conn)
+		}
+	}()
+	return d
+}
+
+func (d *clamd) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	command, err := reader.ReadString(0)
+	if err != nil {
+		t.Errorf("clamd stub failed to read the command: %v", err)
+		return
+	}
+
+	switch command {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+
+	case "zINSTREAM\x00":
+		var content bytes.Buffer
+		for {
+			var size uint32
+			if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+				t.Errorf("clamd stub failed to read a chunk size: %v", err)
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&content, reader, int64(size)); err != nil {
+				t.Errorf("clamd stub failed to read a chunk: %v", err)
+				return
+			}
+		}
+
+		d.mu.Lock()
+		d.received = append(d.received, content.Bytes())
+		d.mu.Unlock()
+		conn.Write([]byte(d.verdict(content.Bytes()) + "\x00"))
+
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func (d *clamd) scanner() *scanner.ClamAVScanner {
+	return scanner.NewClamAVScanner(d.listener.Addr().String(), 5*time.Second)
+}
+
+func (d *clamd) lastReceived() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.received) == 0 {
+		return nil
+	}
+	return d.received[len(d.received)-1]
+}
+
+// eicarVerdict finds the EICAR test string, and rejects streams over 1 MB like clamd's StreamMaxLength
+func eicarVerdict(content []byte) string {
+	switch {
+	case len(content) > 1<<20:
+		return "INSTREAM size limit exceeded. ERROR"
+	case bytes.Contains(content, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")):
+		return "stream: Eicar-Test-Signature FOUND"
+	default:
+		return "stream: OK"
+	}
+}
+
+func TestClamAVPing(t *testing.T) {
+	d := newClamd(t, eicarVerdict)
+	if err := d.scanner().Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClamAVCleanContent(t *testing.T) {
+	d := newClamd(t, eicarVerdict)
+
+	// Larger than a chunk, so the content is streamed in several
+	content := bytes.Repeat([]byte("clean "), 30000)
+	result, err := d.scanner().Scan(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Clean || result.Signature != "" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if !bytes.Equal(d.lastReceived(), content) {
+		t.Errorf("clamd received %d bytes, sent %d", len(d.lastReceived()), len(content))
+	}
+}
+
+func TestClamAVInfectedContent(t *testing.T) {
+	d := newClamd(t, eicarVerdict)
+
+	eicar := `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+	result, err := d.scanner().Scan(strings.NewReader(eicar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Clean || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestClamAVError(t *testing.T) {
+	d := newClamd(t, eicarVerdict)
+
+	_, err := d.scanner().Scan(bytes.NewReader(make([]byte, 2<<20)))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("expected the clamd error, got %v", err)
+	}
+}
+
+func TestClamAVUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	if _, err := scanner.NewClamAVScanner(address, time.Second).Scan(strings.NewReader("content")); err == nil {
+		t.Error("scan without clamd succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+package scanner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const defaultClamAVAddress = "localhost:3310"
+
+// Result is the verdict of a scan; Signature names what was found in an infected file
+type Result struct {
+	Clean     bool
+	Signature string
+}
+
+// Scanner inspects file content for malware
+type Scanner interface {
+	Name() string
+	Scan(content io.Reader) (Result, error)
+}
+
+// Default is the scanner used by the backend, set by InitScanner
+var Default Scanner = NoopScanner{}
+
+// InitScanner selects the scanner from SCANNER_BACKEND: "none" (default) or "clamav",
+// which connects to clamd at CLAMAV_ADDRESS
+func InitScanner() error {
+	scanner, err := NewScannerFromEnv()
+	if err != nil {
+		return err
+	}
+	Default = scanner
+	return nil
+}
+
+// NewScannerFromEnv creates the scanner SCANNER_BACKEND selects, as InitScanner does
+func NewScannerFromEnv() (Scanner, error) {
+	backend := os.Getenv("SCANNER_BACKEND")
+	if backend == "" {
+		backend = "none"
+	}
+
+	switch backend {
+	case "none":
+		log.Printf("[Scanner] Scanning disabled, uploads are marked clean without inspection")
+		return NoopScanner{}, nil
+
+	case "clamav":
+		address := os.Getenv("CLAMAV_ADDRESS")
+		if address == "" {
+			address = defaultClamAVAddress
+		}
+		timeout := defaultClamAVTimeout
+		if value := os.Getenv("CLAMAV_TIMEOUT"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid CLAMAV_TIMEOUT: %s", value)
+			}
+			timeout = parsed
+		}
+
+		clamav := NewClamAVScanner(address, timeout)
+		if err := clamav.Ping(); err != nil {
+			// Uploads stay quarantined and are retried, so an unreachable clamd is not fatal at startup
+			log.Printf("[Scanner] WARNING: clamd at %s is not reachable: %v", address, err)
+		}
+		log.Printf("[Scanner] Using ClamAV at %s", address)
+		return clamav, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported SCANNER_BACKEND: %s", backend)
+	}
+}
+
+// NoopScanner reports every file as clean
+type NoopScanner struct{}
+
+func (NoopScanner) Name() string {
+	return "none"
+}
+
+func (NoopScanner) Scan(content io.Reader) (Result, error) {
+	return Result{Clean: true}, nil
+}
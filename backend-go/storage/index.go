@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+)
+
+const defaultIndexPath = "./data/files.json"
+
+// FileRecord is the metadata of an uploaded file; Key is where its content lives in the FileStore.
+// Records with the same SHA256 share their content.
+type FileRecord struct {
+	ID          string       `json:"id"`
+	Key         string       `json:"-"`
+	OwnerID     string       `json:"ownerId,omitempty"`
+	FileName    string       `json:"fileName"`
+	FileType    string       `json:"fileType,omitempty"`
+	ContentType string       `json:"contentType"`
+	Size        int64        `json:"size"`
+	MD5         string       `json:"md5"`
+	SHA256      string       `json:"sha256,omitempty"`
+	Width       int          `json:"width,omitempty"`
+	Height      int          `json:"height,omitempty"`
+	Derivatives []Derivative `json:"derivatives,omitempty"`
+	ScanStatus  string       `json:"scanStatus,omitempty"`
+	ScanResult  string       `json:"scanResult,omitempty"`
+	ScannedAt   *time.Time   `json:"scannedAt,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+}
+
+// Scan statuses of a file; content is only served once it is clean
+const (
+	ScanStatusPending  = "PENDING"
+	ScanStatusClean    = "CLEAN"
+	ScanStatusInfected = "INFECTED"
+	ScanStatusError    = "ERROR"
+)
+
+// Available reports whether the content of a file may be served.
+// Files indexed before scanning was introduced have no status and are treated as clean.
+func (r FileRecord) Available() bool {
+	return r.ScanStatus == "" || r.ScanStatus == ScanStatusClean
+}
+
+// Derivative is a rendition generated from an uploaded file, such as an image thumbnail
+type Derivative struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// storedRecord keeps the key when the index is written to disk
+type storedRecord struct {
+	FileRecord
+	Key string `json:"key"`
+}
+
+// Index persists file metadata keyed by file ID
+type Index struct {
+	mu      sync.RWMutex
+	records map[string]*FileRecord
+	refs    map[string]map[string]int // content hash to the number of records of each owner
+	path    string
+}
+
+// Files is the file index used by the backend, set by InitFileStore
+var Files *Index
+
+// InitFileIndex loads the file index from FILE_INDEX_PATH
+func InitFileIndex() error {
+	index, err := OpenFileIndex("")
+	if err != nil {
+		return err
+	}
+	Files = index
+	return nil
+}
+
+// OpenFileIndex loads the file index of a tenant from its directory next to FILE_INDEX_PATH,
+// or from the path itself when tenantID is empty
+func OpenFileIndex(tenantID string) (*Index, error) {
+	path := os.Getenv("FILE_INDEX_PATH")
+	if path == "" {
+		path = defaultIndexPath
+	}
+	path = tenant.ScopedPath(path, tenantID)
+
+	index, err := NewIndex(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Storage] Loaded %d file record(s) from %s", len(index.records), path)
+	return index, nil
+}
+
+// NewIndex creates a file index, restoring it from path if it exists
+func NewIndex(path string) (*Index, error) {
+	index := &Index{
+		records: make(map[string]*FileRecord),
+		refs:    make(map[string]map[string]int),
+		path:    path,
+	}
+	if err := index.load(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Add stores the metadata of a new file
+func (i *Index) Add(record FileRecord) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.records[record.ID] = &record
+	i.addRefLocked(&record)
+	i.saveLocked()
+}
+
+// Get returns the metadata of a file
+func (i *Index) Get(id string) (FileRecord, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	record, exists := i.records[id]
+	if !exists {
+		return FileRecord{}, false
+	}
+	return *record, true
+}
+
+// Update changes the metadata of a file in place
+func (i *Index) Update(id string, update func(record *FileRecord)) (FileRecord, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	record, exists := i.records[id]
+	if !exists {
+		return FileRecord{}, false
+	}
+	update(record)
+	i.saveLocked()
+	return *record, true
+}
+
+// Delete removes the metadata of a file and returns how many records still share its content
+func (i *Index) Delete(id string) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	record, exists := i.records[id]
+	if !exists {
+		return 0
+	}
+	delete(i.records, id)
+
+	remaining := 0
+	if owners := i.refs[record.SHA256]; record.SHA256 != "" && owners != nil {
+		owners[record.OwnerID]--
+		if owners[record.OwnerID] <= 0 {
+			delete(owners, record.OwnerID)
+		}
+		for _, count := range owners {
+			remaining += count
+		}
+		if remaining == 0 {
+			delete(i.refs, record.SHA256)
+		}
+	}
+
+	i.saveLocked()
+	return remaining
+}
+
+// References returns how many records of any owner share the content with this hash
+func (i *Index) References(hash string) int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	total := 0
+	for _, count := range i.refs[hash] {
+		total += count
+	}
+	return total
+}
+
+// OwnerContent returns the hashes an owner references with the size of their content,
+// so content an owner has uploaded several times is only counted once
+func (i *Index) OwnerContent(ownerID string) map[string]int64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	content := make(map[string]int64)
+	for _, record := range i.records {
+		if record.OwnerID != ownerID {
+			continue
+		}
+		hash := record.SHA256
+		if hash == "" {
+			// Files stored before content addressing are not shared
+			hash = "file:" + record.ID
+		}
+		if record.ScanStatus != ScanStatusInfected {
+			content[hash] = record.Size
+		}
+	}
+	return content
+}
+
+// WithHash returns every record sharing the content with this hash, oldest first
+func (i *Index) WithHash(hash string) []FileRecord {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	list := []FileRecord{}
+	if hash == "" {
+		return list
+	}
+	for _, record := range i.records {
+		if record.SHA256 == hash {
+			list = append(list, *record)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.Before(list[b].CreatedAt)
+	})
+	return list
+}
+
+// List returns the files of an owner, newest first
+func (i *Index) List(ownerID string) []FileRecord {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	list := []FileRecord{}
+	for _, record := range i.records {
+		if record.OwnerID == ownerID {
+			list = append(list, *record)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.After(list[b].CreatedAt)
+	})
+	return list
+}
+
+// PendingScans returns the files still waiting for a scan, oldest first
+func (i *Index) PendingScans() []FileRecord {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	list := []FileRecord{}
+	for _, record := range i.records {
+		if record.ScanStatus == ScanStatusPending {
+			list = append(list, *record)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.Before(list[b].CreatedAt)
+	})
+	return list
+}
+
+func (i *Index) load() error {
+	var records []storedRecord
+	if err := jsonfile.Load(i.path, &records); err != nil {
+		return fmt.Errorf("failed to load file index %s: %v", i.path, err)
+	}
+	for _, stored := range records {
+		record := stored.FileRecord
+		record.Key = stored.Key
+		i.records[record.ID] = &record
+		i.addRefLocked(&record)
+	}
+	return nil
+}
+
+func (i *Index) addRefLocked(record *FileRecord) {
+	if record.SHA256 == "" {
+		return
+	}
+	if i.refs[record.SHA256] == nil {
+		i.refs[record.SHA256] = make(map[string]int)
+	}
+	i.refs[record.SHA256][record.OwnerID]++
+}
+
+// saveLocked writes the index to disk; the caller must hold the lock
+func (i *Index) saveLocked() {
+	records := make([]storedRecord, 0, len(i.records))
+	for _, record := range i.records {
+		records = append(records, storedRecord{FileRecord: *record, Key: record.Key})
+	}
+
+	if err := jsonfile.Save(i.path, records); err != nil {
+		log.Printf("[Storage] ERROR: Failed to save file index: %v", err)
+	}
+}
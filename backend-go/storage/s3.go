@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const s3Timeout = 30 * time.Second
+
+// S3Config configures an S3-compatible store such as AWS S3 or MinIO
+type S3Config struct {
+	Endpoint  string // host[:port], without scheme
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3Store keeps files in an S3-compatible bucket
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Store connects to the endpoint and creates the bucket if it does not exist
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("S3 storage needs S3_ENDPOINT and S3_BUCKET")
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check S3 bucket %s: %v", config.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create S3 bucket %s: %v", config.Bucket, err)
+		}
+	}
+
+	return &S3Store{client: client, bucket: config.Bucket}, nil
+}
+
+// Put uploads the object
+func (s *S3Store) Put(key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := s.client.PutObject(context.Background(), s.bucket, key, reader, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size, ContentType: contentType, ModifiedAt: time.Now()}, nil
+}
+
+// Get downloads the object, or the requested byte range of it
+func (s *S3Store) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	options := minio.GetObjectOptions{}
+	switch {
+	case length >= 0:
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		if err := options.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	case offset > 0:
+		if err := options.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	object, err := s.client.GetObject(context.Background(), s.bucket, key, options)
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	// GetObject is lazy, stat it so a missing key is reported here and not on the first read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, mapS3Error(err)
+	}
+	return object, nil
+}
+
+// Stat returns the size, content type and modification time of the object
+func (s *S3Store) Stat(key string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return ObjectInfo{Key: key, Size: info.Size, ContentType: info.ContentType, ModifiedAt: info.LastModified}, nil
+}
+
+// Delete removes the object; deleting a missing object is not an error
+func (s *S3Store) Delete(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// List returns every object whose key starts with prefix
+func (s *S3Store) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:         object.Key,
+			Size:        object.Size,
+			ContentType: object.ContentType,
+			ModifiedAt:  object.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+func mapS3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"superQiMiniAppBackend/tenant"
+	"time"
+)
+
+const defaultLocalDir = "./uploads"
+
+// ErrNotFound is returned when a key does not exist in the store
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+}
+
+// FileStore keeps file contents under opaque keys
+type FileStore interface {
+	Put(key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error)
+	Get(key string, offset, length int64) (io.ReadCloser, error) // length < 0 reads to the end
+	Stat(key string) (ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// Default is the file store used by the backend, set by InitFileStore
+var Default FileStore
+
+// InitFileStore sets up the backend selected by STORAGE_BACKEND (local or s3) and loads the file index
+func InitFileStore() error {
+	store, err := OpenFileStore("")
+	if err != nil {
+		return err
+	}
+
+	if err := InitFileIndex(); err != nil {
+		return err
+	}
+	if err := InitUploadSessions(); err != nil {
+		return err
+	}
+
+	Default = store
+	return nil
+}
+
+// OpenFileStore sets up the backend selected by STORAGE_BACKEND for a tenant. Its files go to
+// a directory of its own next to STORAGE_LOCAL_DIR, or under its ID in the S3 bucket.
+func OpenFileStore(tenantID string) (FileStore, error) {
+	backend := os.Getenv("STORAGE_BACKEND")
+
+	var store FileStore
+	switch backend {
+	case "", "local":
+		dir := os.Getenv("STORAGE_LOCAL_DIR")
+		if dir == "" {
+			dir = defaultLocalDir
+		}
+		dir = tenant.ScopedPath(dir, tenantID)
+		local, err := NewLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		store = local
+		log.Printf("[Storage] Using local disk at %s", dir)
+
+	case "s3":
+		s3, err := NewS3Store(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		})
+		if err != nil {
+			return nil, err
+		}
+		store = s3
+		if tenantID != "" {
+			store = &prefixedStore{store: s3, prefix: tenantID + "/"}
+		}
+		log.Printf("[Storage] Using S3 bucket %s at %s", os.Getenv("S3_BUCKET"), os.Getenv("S3_ENDPOINT"))
+
+	default:
+		return nil, fmt.Errorf("unsupported STORAGE_BACKEND: %s", backend)
+	}
+	return store, nil
+}
+
+// prefixedStore keeps the objects of a store under a prefix of their keys
+type prefixedStore struct {
+	store  FileStore
+	prefix string
+}
+
+func (s *prefixedStore) Put(key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.store.Put(s.prefix+key, reader, size, contentType)
+	info.Key = key
+	return info, err
+}
+
+func (s *prefixedStore) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return s.store.Get(s.prefix+key, offset, length)
+}
+
+func (s *prefixedStore) Stat(key string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.store.Stat(s.prefix + key)
+	info.Key = key
+	return info, err
+}
+
+func (s *prefixedStore) Delete(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	return s.store.Delete(s.prefix + key)
+}
+
+func (s *prefixedStore) List(prefix string) ([]ObjectInfo, error) {
+	objects, err := s.store.List(s.prefix + prefix)
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, s.prefix)
+	}
+	return objects, err
+}
+
+// validateKey rejects keys that could escape the store root
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid storage key: %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid storage key: %q", key)
+		}
+	}
+	return nil
+}
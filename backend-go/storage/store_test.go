@@ -0,0 +1,179 @@
+package storage_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/storage"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewLocalStore(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFileStore(t, store, "")
+
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Errorf("a rejected key was written outside the root: %v", err)
+	}
+}
+
+// TestS3Store runs against the MinIO or S3 endpoint in S3_TEST_ENDPOINT, such as one started with
+// docker run -p 9000:9000 minio/minio server /data
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("S3_TEST_BUCKET")
+	if bucket == "" {
+		bucket = "storage-test"
+	}
+	accessKey := os.Getenv("S3_TEST_ACCESS_KEY")
+	if accessKey == "" {
+		accessKey = "minioadmin"
+	}
+	secretKey := os.Getenv("S3_TEST_SECRET_KEY")
+	if secretKey == "" {
+		secretKey = "minioadmin"
+	}
+
+	store, err := storage.NewS3Store(storage.S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		UseSSL:    os.Getenv("S3_TEST_USE_SSL") == "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket may be shared, every run keeps to keys of its own
+	testFileStore(t, store, "test-"+strconv.FormatInt(time.Now().UnixNano(), 36)+"/")
+}
+
+// testFileStore checks the behavior every FileStore must have, with keys under prefix
+func testFileStore(t *testing.T, store storage.FileStore, prefix string) {
+	t.Run("rejects keys escaping the root", func(t *testing.T) {
+		for _, key := range []string{"", "/etc/passwd", "../escape", prefix + "a/../../escape", prefix + "a//b", prefix + `a\b`, prefix + "./a"} {
+			if _, err := store.Put(key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+				t.Errorf("Put accepted key %q", key)
+			}
+			if _, err := store.Get(key, 0, -1); err == nil {
+				t.Errorf("Get accepted key %q", key)
+			}
+			if _, err := store.Stat(key); err == nil {
+				t.Errorf("Stat accepted key %q", key)
+			}
+			if err := store.Delete(key); err == nil {
+				t.Errorf("Delete accepted key %q", key)
+			}
+		}
+	})
+
+	t.Run("reads ranges", func(t *testing.T) {
+		key := prefix + "ranges/digits.txt"
+		put(t, store, key, "0123456789")
+
+		for _, test := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, -1, "0123456789"},
+			{0, 4, "0123"},
+			{3, 4, "3456"},
+			{7, -1, "789"},
+			{8, 10, "89"},
+		} {
+			if got := get(t, store, key, test.offset, test.length); got != test.want {
+				t.Errorf("Get(%d, %d) = %q, want %q", test.offset, test.length, got, test.want)
+			}
+		}
+
+		info, err := store.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != key || info.Size != 10 {
+			t.Errorf("unexpected stat %+v", info)
+		}
+	})
+
+	t.Run("lists by prefix", func(t *testing.T) {
+		for _, key := range []string{"list/a/one.txt", "list/a/two.txt", "list/b/three.txt"} {
+			put(t, store, prefix+key, key)
+		}
+
+		objects, err := store.List(prefix + "list/a/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+			if object.Size != int64(len(strings.TrimPrefix(object.Key, prefix))) {
+				t.Errorf("%s has size %d", object.Key, object.Size)
+			}
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != prefix+"list/a/one.txt,"+prefix+"list/a/two.txt" {
+			t.Errorf("unexpected keys %v", keys)
+		}
+	})
+
+	t.Run("deletes", func(t *testing.T) {
+		key := prefix + "delete/gone.txt"
+		put(t, store, key, "gone")
+
+		if err := store.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat(key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Stat after Delete returned %v", err)
+		}
+		if _, err := store.Get(key, 0, -1); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Get after Delete returned %v", err)
+		}
+		if err := store.Delete(key); err != nil {
+			t.Errorf("deleting a missing object returned %v", err)
+		}
+	})
+}
+
+func put(t *testing.T, store storage.FileStore, key, content string) {
+	t.Helper()
+
+	if _, err := store.Put(key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Delete(key)
+	})
+}
+
+func get(t *testing.T, store storage.FileStore, key string, offset, length int64) string {
+	t.Helper()
+
+	reader, err := store.Get(key, offset, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
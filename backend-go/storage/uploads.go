@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultUploadSessionsPath = "./data/upload-sessions.json"
+	defaultChunkDir           = "./data/chunks"
+	defaultUploadSessionTTL   = 24 * time.Hour
+	uploadSweepInterval       = 10 * time.Minute
+)
+
+// ErrChunkChecksum is returned when a chunk does not match the checksum sent with it
+var ErrChunkChecksum = errors.New("chunk checksum mismatch")
+
+// UploadSession is a resumable upload whose chunks are kept on local disk until it completes
+type UploadSession struct {
+	ID           string         `json:"id"`
+	OwnerID      string         `json:"ownerId"`
+	FileName     string         `json:"fileName"`
+	FileType     string         `json:"fileType,omitempty"`
+	Size         int64          `json:"size"`
+	ChunkSize    int64          `json:"chunkSize"`
+	TotalChunks  int            `json:"totalChunks"`
+	SHA256       string         `json:"sha256,omitempty"`
+	Received     map[int]string `json:"received"` // chunk index to its SHA-256
+	CreatedAt    time.Time      `json:"createdAt"`
+	LastActivity time.Time      `json:"lastActivity"`
+	ExpiresAt    time.Time      `json:"expiresAt"`
+}
+
+// ChunkLength is the expected length of a chunk
+func (s UploadSession) ChunkLength(index int) int64 {
+	if index == s.TotalChunks-1 {
+		return s.Size - s.ChunkSize*int64(s.TotalChunks-1)
+	}
+	return s.ChunkSize
+}
+
+// Missing lists the chunk indexes that have not been received yet
+func (s UploadSession) Missing() []int {
+	missing := []int{}
+	for index := 0; index < s.TotalChunks; index++ {
+		if _, received := s.Received[index]; !received {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// UploadSessionStore persists upload sessions and keeps their chunks under dir
+type UploadSessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*UploadSession
+	path     string
+	dir      string
+	ttl      time.Duration
+}
+
+// Uploads is the upload session store used by the backend, set by InitUploadSessions
+var Uploads *UploadSessionStore
+
+// InitUploadSessions loads upload sessions from UPLOAD_SESSIONS_PATH and starts expiring
+// abandoned ones after UPLOAD_SESSION_TTL of inactivity
+func InitUploadSessions() error {
+	store, err := OpenUploadSessions("")
+	if err != nil {
+		return err
+	}
+	Uploads = store
+	return nil
+}
+
+// OpenUploadSessions loads the upload sessions of a tenant, keeping them and their chunks in
+// directories of its own next to UPLOAD_SESSIONS_PATH and UPLOAD_CHUNK_DIR, and starts
+// expiring its abandoned sessions
+func OpenUploadSessions(tenantID string) (*UploadSessionStore, error) {
+	path := os.Getenv("UPLOAD_SESSIONS_PATH")
+	if path == "" {
+		path = defaultUploadSessionsPath
+	}
+	dir := os.Getenv("UPLOAD_CHUNK_DIR")
+	if dir == "" {
+		dir = defaultChunkDir
+	}
+	ttl := defaultUploadSessionTTL
+	if value := os.Getenv("UPLOAD_SESSION_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid UPLOAD_SESSION_TTL: %s", value)
+		}
+		ttl = parsed
+	}
+	path = tenant.ScopedPath(path, tenantID)
+	dir = tenant.ScopedPath(dir, tenantID)
+
+	store, err := NewUploadSessionStore(path, dir, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Storage] Loaded %d upload session(s) from %s, chunks in %s", len(store.sessions), path, dir)
+
+	go func() {
+		ticker := time.NewTicker(uploadSweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			store.Expire(time.Now())
+		}
+	}()
+	return store, nil
+}
+
+// NewUploadSessionStore creates an upload session store, restoring it from path if it exists
+func NewUploadSessionStore(path, dir string, ttl time.Duration) (*UploadSessionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory %s: %v", dir, err)
+	}
+
+	store := &UploadSessionStore{
+		sessions: make(map[string]*UploadSession),
+		path:     path,
+		dir:      dir,
+		ttl:      ttl,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create starts a session; the caller fills in the owner, file and chunk layout
+func (s *UploadSessionStore) Create(session UploadSession) UploadSession {
+	now := time.Now()
+	session.ID = fmt.Sprintf("UPLOAD-%s-%d", uuid.New().String(), now.Unix())
+	session.Received = make(map[int]string)
+	session.CreatedAt = now
+	session.LastActivity = now
+	session.ExpiresAt = now.Add(s.ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = &session
+	s.saveLocked()
+	return cloneSession(&session)
+}
+
+// Get returns a session
+func (s *UploadSessionStore) Get(id string) (UploadSession, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.sessions[id]
+	if !exists {
+		return UploadSession{}, false
+	}
+	return cloneSession(session), true
+}
+
+// PutChunk writes a chunk after checking its SHA-256; re-sending a chunk replaces it
+func (s *UploadSessionStore) PutChunk(id string, index int, content io.Reader, checksum string) (UploadSession, error) {
+	if _, exists := s.Get(id); !exists {
+		return UploadSession{}, ErrNotFound
+	}
+
+	// Chunks are written outside the lock, a chunk file only becomes visible once it is verified
+	tmp, err := os.CreateTemp(s.sessionDir(id), "chunk-*.tmp")
+	if errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(s.sessionDir(id), 0755); err == nil {
+			tmp, err = os.CreateTemp(s.sessionDir(id), "chunk-*.tmp")
+		}
+	}
+	if err != nil {
+		return UploadSession{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != checksum {
+		return UploadSession{}, ErrChunkChecksum
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The session may have expired or been cancelled while the chunk was written
+	session, exists := s.sessions[id]
+	if !exists {
+		return UploadSession{}, ErrNotFound
+	}
+	if err := os.Rename(tmp.Name(), s.chunkPath(id, index)); err != nil {
+		return UploadSession{}, err
+	}
+
+	now := time.Now()
+	session.Received[index] = sum
+	session.LastActivity = now
+	session.ExpiresAt = now.Add(s.ttl)
+	s.saveLocked()
+	return cloneSession(session), nil
+}
+
+// Assemble concatenates the chunks of a complete session into w in order
+func (s *UploadSessionStore) Assemble(id string, w io.Writer) error {
+	session, exists := s.Get(id)
+	if !exists {
+		return ErrNotFound
+	}
+
+	for index := 0; index < session.TotalChunks; index++ {
+		chunk, err := os.Open(s.chunkPath(id, index))
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", index, err)
+		}
+		_, err = io.Copy(w, chunk)
+		chunk.Close()
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", index, err)
+		}
+	}
+	return nil
+}
+
+// TempFile creates a scratch file next to the chunks, used to assemble uploads
+func (s *UploadSessionStore) TempFile() (*os.File, error) {
+	return os.CreateTemp(s.dir, "assembly-*.tmp")
+}
+
+// Delete removes a session and its chunks
+func (s *UploadSessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(id)
+	s.saveLocked()
+}
+
+// Reserved is the total size of an owner's sessions, counted against their quota
+func (s *UploadSessionStore) Reserved(ownerID string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for _, session := range s.sessions {
+		if session.OwnerID == ownerID {
+			total += session.Size
+		}
+	}
+	return total
+}
+
+// Expire removes sessions that have been inactive past their expiry
+func (s *UploadSessionStore) Expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := 0
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			s.deleteLocked(id)
+			expired++
+		}
+	}
+	if expired > 0 {
+		log.Printf("[Storage] Expired %d abandoned upload session(s)", expired)
+		s.saveLocked()
+	}
+}
+
+func (s *UploadSessionStore) deleteLocked(id string) {
+	delete(s.sessions, id)
+	if err := os.RemoveAll(s.sessionDir(id)); err != nil {
+		log.Printf("[Storage] ERROR: Failed to remove chunks of %s: %v", id, err)
+	}
+}
+
+func (s *UploadSessionStore) sessionDir(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *UploadSessionStore) chunkPath(id string, index int) string {
+	return filepath.Join(s.sessionDir(id), strconv.Itoa(index))
+}
+
+func cloneSession(session *UploadSession) UploadSession {
+	clone := *session
+	clone.Received = make(map[int]string, len(session.Received))
+	for index, sum := range session.Received {
+		clone.Received[index] = sum
+	}
+	return clone
+}
+
+func (s *UploadSessionStore) load() error {
+	var sessions []*UploadSession
+	if err := jsonfile.Load(s.path, &sessions); err != nil {
+		return fmt.Errorf("failed to load upload sessions %s: %v", s.path, err)
+	}
+	for _, session := range sessions {
+		if session.Received == nil {
+			session.Received = make(map[int]string)
+		}
+		s.sessions[session.ID] = session
+	}
+	return nil
+}
+
+// saveLocked writes the sessions to disk; the caller must hold the lock
+func (s *UploadSessionStore) saveLocked() {
+	sessions := make([]*UploadSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+
+	if err := jsonfile.Save(s.path, sessions); err != nil {
+		log.Printf("[Storage] ERROR: Failed to save upload sessions: %v", err)
+	}
+}
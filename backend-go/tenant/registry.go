@@ -0,0 +1,174 @@
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"superQiMiniAppBackend/alipay"
+)
+
+// Tenant is one mini app, operated under its own merchant client ID and keys
+type Tenant struct {
+	ID string `json:"id"`
+	// Subdomain routes requests to the tenant by host, it defaults to ID
+	Subdomain              string `json:"subdomain,omitempty"`
+	ClientID               string `json:"clientId"`
+	GatewayURL             string `json:"gatewayUrl"`
+	MerchantPrivateKeyPath string `json:"merchantPrivateKeyPath"`
+	AlipayPublicKeyPath    string `json:"alipayPublicKeyPath"`
+	// KeysPath names a key set file of versioned keys, which replaces the two key paths
+	KeysPath string `json:"keysPath,omitempty"`
+	// Currencies accepted for payments, the first one is used when a request names none
+	Currencies []string `json:"currencies,omitempty"`
+	// BaseURL is where the gateway reaches this backend, FrontendURL where payers are redirected
+	BaseURL     string `json:"baseUrl,omitempty"`
+	FrontendURL string `json:"frontendUrl,omitempty"`
+	// MerchantID owns the payments of the tenant, it defaults to MERCHANT_ID
+	MerchantID string `json:"merchantId,omitempty"`
+	// MiniAppID is the app notification deep links open, it defaults to MINI_APP_ID
+	MiniAppID string `json:"miniAppId,omitempty"`
+}
+
+// ScopedPath moves the file or directory at path into a subdirectory named after the tenant,
+// so every tenant keeps its own copy. An empty tenant ID leaves path as it is.
+func ScopedPath(path, tenantID string) string {
+	if tenantID == "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(path), tenantID, filepath.Base(path))
+}
+
+// AlipayConfig is the gateway client configuration of the tenant
+func (t Tenant) AlipayConfig() alipay.Config {
+	return alipay.Config{
+		GatewayURL:             t.GatewayURL,
+		MerchantPrivateKeyPath: t.MerchantPrivateKeyPath,
+		AlipayPublicKeyPath:    t.AlipayPublicKeyPath,
+		ClientID:               t.ClientID,
+		KeysPath:               t.KeysPath,
+	}
+}
+
+// Registry holds the tenants served by the backend. It does not change once created.
+type Registry struct {
+	tenants    map[string]Tenant
+	subdomains map[string]string
+	order      []string
+	defaultID  string
+}
+
+type registryFile struct {
+	Default string   `json:"default"`
+	Tenants []Tenant `json:"tenants"`
+}
+
+// NewRegistry validates tenants and indexes them. Requests that name no tenant go to
+// defaultID, or fail to resolve when it is empty.
+func NewRegistry(tenants []Tenant, defaultID string) (*Registry, error) {
+	if len(tenants) == 0 {
+		return nil, errors.New("at least one tenant is required")
+	}
+
+	registry := &Registry{
+		tenants:    make(map[string]Tenant),
+		subdomains: make(map[string]string),
+		defaultID:  defaultID,
+	}
+	for _, t := range tenants {
+		if t.ID == "" {
+			return nil, errors.New("tenant id is required")
+		}
+		if strings.ContainsAny(t.ID, `/\`) || t.ID == "." || t.ID == ".." {
+			return nil, fmt.Errorf("tenant id %q names its data directory and cannot be a path", t.ID)
+		}
+		if _, exists := registry.tenants[t.ID]; exists {
+			return nil, fmt.Errorf("tenant %s is defined twice", t.ID)
+		}
+		if t.ClientID == "" || t.GatewayURL == "" {
+			return nil, fmt.Errorf("tenant %s needs clientId and gatewayUrl", t.ID)
+		}
+		if t.KeysPath == "" && (t.MerchantPrivateKeyPath == "" || t.AlipayPublicKeyPath == "") {
+			return nil, fmt.Errorf("tenant %s needs keysPath, or merchantPrivateKeyPath and alipayPublicKeyPath", t.ID)
+		}
+		if t.Subdomain == "" {
+			t.Subdomain = t.ID
+		}
+		t.Subdomain = strings.ToLower(t.Subdomain)
+		if other, exists := registry.subdomains[t.Subdomain]; exists {
+			return nil, fmt.Errorf("tenants %s and %s share the subdomain %s", other, t.ID, t.Subdomain)
+		}
+
+		registry.tenants[t.ID] = t
+		registry.subdomains[t.Subdomain] = t.ID
+		registry.order = append(registry.order, t.ID)
+	}
+
+	if defaultID != "" {
+		if _, exists := registry.tenants[defaultID]; !exists {
+			return nil, fmt.Errorf("default tenant %s is not defined", defaultID)
+		}
+	}
+	return registry, nil
+}
+
+// LoadRegistry reads a registry from a JSON file of the form {"default": "...", "tenants": [...]}
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file registryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %w", path, err)
+	}
+
+	registry, err := NewRegistry(file.Tenants, file.Default)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Tenants] Loaded %d tenant(s) from %s", len(registry.order), path)
+	return registry, nil
+}
+
+// Get returns the tenant with the given ID
+func (r *Registry) Get(id string) (Tenant, bool) {
+	t, exists := r.tenants[id]
+	return t, exists
+}
+
+// Default returns the tenant of requests that name none
+func (r *Registry) Default() (Tenant, bool) {
+	return r.Get(r.defaultID)
+}
+
+// ForHost returns the tenant whose subdomain is the first label of host
+func (r *Registry) ForHost(host string) (Tenant, bool) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	label, _, found := strings.Cut(strings.ToLower(host), ".")
+	if !found {
+		return Tenant{}, false
+	}
+	id, exists := r.subdomains[label]
+	if !exists {
+		return Tenant{}, false
+	}
+	return r.Get(id)
+}
+
+// Tenants returns every tenant in the order they were defined
+func (r *Registry) Tenants() []Tenant {
+	list := make([]Tenant, 0, len(r.order))
+	for _, id := range r.order {
+		list = append(list, r.tenants[id])
+	}
+	return list
+}
@@ -0,0 +1,472 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"superQiMiniAppBackend/jsonfile"
+	"superQiMiniAppBackend/tenant"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxAttempts        = 8
+	initialBackoff     = 10 * time.Second
+	maxBackoff         = time.Hour
+	deliveredRetention = 24 * time.Hour
+	workerInterval     = time.Second
+	defaultQueuePath   = "./data/webhook-deliveries.json"
+)
+
+// Default is the dispatcher used by the backend, set by InitDispatcher
+var Default *Dispatcher
+
+// Clock tells the time to the dispatcher, so tests can control retries
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Config holds the subscriptions and queue of a dispatcher
+type Config struct {
+	Subscriptions []Subscription
+	// QueuePath is where deliveries are persisted, so retries survive restarts
+	QueuePath string
+	// Clock defaults to the system clock
+	Clock Clock
+	// TenantID is written into the envelopes, empty for a single tenant
+	TenantID string
+}
+
+// Dispatcher signs and sends events to subscriptions, retrying failed deliveries
+// with exponential backoff. Deliveries are persisted in the background so queuing
+// an event never waits for the disk.
+type Dispatcher struct {
+	mu            sync.RWMutex
+	subscriptions []Subscription
+	deliveries    map[string]*Delivery
+	queuePath     string
+	tenantID      string
+	httpClient    *http.Client
+	clock         Clock
+	wake          chan struct{}
+
+	// dirty is set when the deliveries changed since they were last written
+	dirty   bool
+	persist chan struct{}
+	stop    chan struct{}
+	workers sync.WaitGroup
+}
+
+// InitDispatcher loads subscriptions and the delivery queue from the paths in
+// WEBHOOK_SUBSCRIPTIONS_PATH and WEBHOOK_QUEUE_PATH, and starts the delivery worker
+func InitDispatcher() error {
+	dispatcher, err := OpenDispatcher("")
+	if err != nil {
+		return err
+	}
+	Default = dispatcher
+	return nil
+}
+
+// OpenDispatcher starts the dispatcher of a tenant. Tenants share the subscriptions in
+// WEBHOOK_SUBSCRIPTIONS_PATH, which tell their events apart by the tenant of the envelope,
+// and each queues its deliveries in a directory of its own next to WEBHOOK_QUEUE_PATH.
+func OpenDispatcher(tenantID string) (*Dispatcher, error) {
+	var subscriptions []Subscription
+	if path := os.Getenv("WEBHOOK_SUBSCRIPTIONS_PATH"); path != "" {
+		loaded, err := loadSubscriptions(path)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = loaded
+	}
+
+	queuePath := os.Getenv("WEBHOOK_QUEUE_PATH")
+	if queuePath == "" {
+		queuePath = defaultQueuePath
+	}
+
+	dispatcher, err := NewDispatcher(Config{
+		Subscriptions: subscriptions,
+		QueuePath:     tenant.ScopedPath(queuePath, tenantID),
+		TenantID:      tenantID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Webhook] Loaded %d subscription(s), %d queued deliveries", len(subscriptions), len(dispatcher.deliveries))
+
+	dispatcher.Start()
+	return dispatcher, nil
+}
+
+// NewDispatcher creates a dispatcher, restoring deliveries from the queue path if it exists.
+// Nothing is sent or written until Start is called.
+func NewDispatcher(config Config) (*Dispatcher, error) {
+	for _, subscription := range config.Subscriptions {
+		if subscription.ID == "" || subscription.URL == "" || subscription.Secret == "" {
+			return nil, errors.New("webhook subscriptions need an id, url and secret")
+		}
+	}
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+
+	dispatcher := &Dispatcher{
+		subscriptions: config.Subscriptions,
+		deliveries:    make(map[string]*Delivery),
+		queuePath:     config.QueuePath,
+		tenantID:      config.TenantID,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		clock:   config.Clock,
+		wake:    make(chan struct{}, 1),
+		persist: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	if err := dispatcher.load(); err != nil {
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+// Start runs the delivery worker and the writer persisting the queue
+func (d *Dispatcher) Start() {
+	d.workers.Add(2)
+	go d.run()
+	go d.writeQueue()
+}
+
+// Close stops the workers and writes the pending changes of the queue
+func (d *Dispatcher) Close() {
+	close(d.stop)
+	d.workers.Wait()
+}
+
+// Enqueue queues an event for every subscription interested in its type
+func (d *Dispatcher) Enqueue(eventType string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	envelope := Envelope{
+		ID:        "EVT-" + uuid.New().String(),
+		Type:      eventType,
+		Tenant:    d.tenantID,
+		CreatedAt: d.clock.Now(),
+		Data:      dataJSON,
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	queued := 0
+	for _, subscription := range d.subscriptions {
+		if !subscription.Matches(eventType) {
+			continue
+		}
+		delivery := &Delivery{
+			ID:             "WHD-" + uuid.New().String(),
+			SubscriptionID: subscription.ID,
+			URL:            subscription.URL,
+			EventID:        envelope.ID,
+			EventType:      eventType,
+			Payload:        payload,
+			Status:         StatusPending,
+			CreatedAt:      envelope.CreatedAt,
+			NextAttemptAt:  envelope.CreatedAt,
+		}
+		d.deliveries[delivery.ID] = delivery
+		queued++
+	}
+	if queued > 0 {
+		d.saveLocked()
+	}
+	d.mu.Unlock()
+
+	if queued > 0 {
+		log.Printf("[Webhook] Queued %s for %d subscription(s)", eventType, queued)
+		d.notify()
+	}
+	return nil
+}
+
+// Deliveries returns deliveries with the given status (all when empty), newest first
+func (d *Dispatcher) Deliveries(status string) []Delivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	list := []Delivery{}
+	for _, delivery := range d.deliveries {
+		if status == "" || delivery.Status == status {
+			list = append(list, *delivery)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Get returns a single delivery
+func (d *Dispatcher) Get(deliveryID string) (Delivery, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	delivery, exists := d.deliveries[deliveryID]
+	if !exists {
+		return Delivery{}, false
+	}
+	return *delivery, true
+}
+
+// Replay puts a delivery back into the queue with a fresh retry budget
+func (d *Dispatcher) Replay(deliveryID string) (Delivery, error) {
+	d.mu.Lock()
+	delivery, exists := d.deliveries[deliveryID]
+	if !exists {
+		d.mu.Unlock()
+		return Delivery{}, fmt.Errorf("delivery %s not found", deliveryID)
+	}
+	delivery.Status = StatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = d.clock.Now()
+	delivery.DeliveredAt = time.Time{}
+	replayed := *delivery
+	d.saveLocked()
+	d.mu.Unlock()
+
+	log.Printf("[Webhook] Replaying delivery %s", deliveryID)
+	d.notify()
+	return replayed, nil
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the background worker sending due deliveries
+func (d *Dispatcher) run() {
+	defer d.workers.Done()
+
+	for {
+		select {
+		case <-d.clock.After(workerInterval):
+		case <-d.wake:
+		case <-d.stop:
+			return
+		}
+		d.processDue()
+	}
+}
+
+func (d *Dispatcher) processDue() {
+	now := d.clock.Now()
+
+	d.mu.RLock()
+	due := []Delivery{}
+	for _, delivery := range d.deliveries {
+		if delivery.Status == StatusPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, *delivery)
+		}
+	}
+	d.mu.RUnlock()
+
+	for _, delivery := range due {
+		statusCode, err := d.send(delivery)
+		d.recordAttempt(delivery.ID, statusCode, err)
+	}
+
+	d.mu.Lock()
+	if d.pruneLocked(now) {
+		d.saveLocked()
+	}
+	d.mu.Unlock()
+}
+
+func (d *Dispatcher) send(delivery Delivery) (int, error) {
+	secret := d.secretFor(delivery.SubscriptionID)
+	if secret == "" {
+		return 0, fmt.Errorf("subscription %s no longer exists", delivery.SubscriptionID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Webhook-Id", delivery.EventID)
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set(SignatureHeader, Sign(secret, d.clock.Now().Unix(), delivery.Payload))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) recordAttempt(deliveryID string, statusCode int, sendErr error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery, exists := d.deliveries[deliveryID]
+	if !exists {
+		return
+	}
+
+	now := d.clock.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = now
+	delivery.LastStatusCode = statusCode
+
+	switch {
+	case sendErr == nil:
+		delivery.Status = StatusDelivered
+		delivery.DeliveredAt = now
+		delivery.LastError = ""
+		log.Printf("[Webhook] Delivered %s (%s) to %s", delivery.ID, delivery.EventType, delivery.URL)
+
+	case delivery.Attempts >= maxAttempts:
+		delivery.Status = StatusDead
+		delivery.LastError = sendErr.Error()
+		log.Printf("[Webhook] ERROR: Delivery %s moved to dead letters after %d attempts: %v", delivery.ID, delivery.Attempts, sendErr)
+
+	default:
+		delivery.LastError = sendErr.Error()
+		delivery.NextAttemptAt = now.Add(backoff(delivery.Attempts))
+		log.Printf("[Webhook] WARNING: Delivery %s attempt %d failed: %v (next attempt at %s)",
+			delivery.ID, delivery.Attempts, sendErr, delivery.NextAttemptAt.Format(time.RFC3339))
+	}
+
+	d.saveLocked()
+}
+
+func (d *Dispatcher) secretFor(subscriptionID string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, subscription := range d.subscriptions {
+		if subscription.ID == subscriptionID {
+			return subscription.Secret
+		}
+	}
+	return ""
+}
+
+// pruneLocked drops delivered entries older than the retention window
+func (d *Dispatcher) pruneLocked(now time.Time) bool {
+	pruned := false
+	for id, delivery := range d.deliveries {
+		if delivery.Status == StatusDelivered && now.Sub(delivery.DeliveredAt) > deliveredRetention {
+			delete(d.deliveries, id)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// backoff returns the delay before the next attempt: 10s, 20s, 40s, ... capped at one hour
+func backoff(attempts int) time.Duration {
+	delay := initialBackoff << (attempts - 1)
+	if delay <= 0 || delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+func (d *Dispatcher) load() error {
+	var deliveries []*Delivery
+	if err := jsonfile.Load(d.queuePath, &deliveries); err != nil {
+		return fmt.Errorf("failed to load webhook queue %s: %v", d.queuePath, err)
+	}
+	for _, delivery := range deliveries {
+		d.deliveries[delivery.ID] = delivery
+	}
+	return nil
+}
+
+// saveLocked asks the writer to persist the queue; the caller must hold the lock
+func (d *Dispatcher) saveLocked() {
+	d.dirty = true
+	select {
+	case d.persist <- struct{}{}:
+	default:
+	}
+}
+
+// writeQueue is the background writer persisting the queue after it changed, and once
+// more when the dispatcher is closed
+func (d *Dispatcher) writeQueue() {
+	defer d.workers.Done()
+
+	for {
+		select {
+		case <-d.persist:
+			d.flush()
+		case <-d.stop:
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush writes the queue to disk if it changed. Only the writer calls it, so writes never overlap.
+func (d *Dispatcher) flush() {
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return
+	}
+	deliveries := make([]Delivery, 0, len(d.deliveries))
+	for _, delivery := range d.deliveries {
+		deliveries = append(deliveries, *delivery)
+	}
+	d.dirty = false
+	d.mu.Unlock()
+
+	if err := jsonfile.Save(d.queuePath, deliveries); err != nil {
+		log.Printf("[Webhook] ERROR: Failed to save queue: %v", err)
+	}
+}
+
+func loadSubscriptions(path string) ([]Subscription, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []Subscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook subscriptions %s: %v", path, err)
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,357 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"superQiMiniAppBackend/webhook"
+)
+
+const testSecret = "whsec_test"
+
+// receiver is a subscriber answering with the programmed status codes, then 200
+type receiver struct {
+	server *httptest.Server
+	clock  *fakeClock
+
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+func newReceiver(t *testing.T, clock *fakeClock, statuses ...int) *receiver {
+	t.Helper()
+
+	r := &receiver{clock: clock, statuses: statuses}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		r.requests = append(r.requests, receivedRequest{header: req.Header.Clone(), body: body, at: clock.Now()})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *receiver) received() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func newDispatcher(t *testing.T, clock *fakeClock, queuePath string, url string) *webhook.Dispatcher {
+	t.Helper()
+
+	dispatcher, err := webhook.NewDispatcher(webhook.Config{
+		Subscriptions: []webhook.Subscription{{ID: "erp", URL: url, Secret: testSecret, Events: []string{"refund"}}},
+		QueuePath:     queuePath,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dispatcher
+}
+
+// eventually advances the clock by step until condition holds
+func eventually(t *testing.T, clock *fakeClock, step time.Duration, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		clock.Advance(step)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func onlyDelivery(t *testing.T, dispatcher *webhook.Dispatcher) webhook.Delivery {
+	t.Helper()
+
+	deliveries := dispatcher.Deliveries("")
+	if len(deliveries) != 1 {
+		t.Fatalf("expected one delivery, got %d", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestDeliveryIsSigned(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	subscriber := newReceiver(t, clock)
+	dispatcher := newDispatcher(t, clock, filepath.Join(t.TempDir(), "queue.json"), subscriber.server.URL)
+	dispatcher.Start()
+	defer dispatcher.Close()
+
+	if err := dispatcher.Enqueue("payment.succeeded", map[string]string{"paymentId": "P1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatcher.Enqueue("refund.succeeded", map[string]string{"refundId": "R1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, clock, time.Second, "the delivery", func() bool {
+		return len(dispatcher.Deliveries(webhook.StatusDelivered)) == 1
+	})
+
+	requests := subscriber.received()
+	if len(requests) != 1 {
+		t.Fatalf("the subscriber only listens to refunds, got %d requests", len(requests))
+	}
+	request := requests[0]
+	if request.header.Get("X-Webhook-Event") != "refund.succeeded" {
+		t.Errorf("unexpected event header %q", request.header.Get("X-Webhook-Event"))
+	}
+
+	var envelope webhook.Envelope
+	if err := json.Unmarshal(request.body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != "refund.succeeded" || envelope.ID != request.header.Get("X-Webhook-Id") {
+		t.Errorf("unexpected envelope %+v", envelope)
+	}
+	if string(envelope.Data) != `{"refundId":"R1"}` {
+		t.Errorf("unexpected data %s", envelope.Data)
+	}
+	if envelope.Tenant != "" {
+		t.Errorf("envelope of a single tenant names tenant %q", envelope.Tenant)
+	}
+
+	// The receiver recomputes the signature from the timestamp and the raw body
+	signature := request.header.Get(webhook.SignatureHeader)
+	timestampText, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	timestamp, err := strconv.ParseInt(timestampText, 10, 64)
+	if err != nil {
+		t.Fatalf("malformed signature %q", signature)
+	}
+	if signature != webhook.Sign(testSecret, timestamp, request.body) {
+		t.Errorf("signature %q does not match the body", signature)
+	}
+	if signature == webhook.Sign("another secret", timestamp, request.body) {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestEnvelopeNamesTheTenant(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	subscriber := newReceiver(t, clock)
+	dispatcher, err := webhook.NewDispatcher(webhook.Config{
+		Subscriptions: []webhook.Subscription{{ID: "erp", URL: subscriber.server.URL, Secret: testSecret, Events: []string{"*"}}},
+		QueuePath:     filepath.Join(t.TempDir(), "queue.json"),
+		Clock:         clock,
+		TenantID:      "north",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Start()
+	defer dispatcher.Close()
+
+	if err := dispatcher.Enqueue("payment.succeeded", map[string]string{"paymentId": "P1"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, clock, time.Second, "the delivery", func() bool {
+		return len(subscriber.received()) == 1
+	})
+
+	var envelope webhook.Envelope
+	if err := json.Unmarshal(subscriber.received()[0].body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Tenant != "north" {
+		t.Errorf("envelope names tenant %q, want north", envelope.Tenant)
+	}
+}
+
+func TestFailedDeliveryIsRetriedWithBackoff(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	subscriber := newReceiver(t, clock, http.StatusInternalServerError, http.StatusBadGateway)
+	dispatcher := newDispatcher(t, clock, filepath.Join(t.TempDir(), "queue.json"), subscriber.server.URL)
+	dispatcher.Start()
+	defer dispatcher.Close()
+
+	if err := dispatcher.Enqueue("refund.succeeded", map[string]string{"refundId": "R1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, clock, time.Second, "the first attempt", func() bool {
+		return onlyDelivery(t, dispatcher).Attempts == 1
+	})
+	failed := onlyDelivery(t, dispatcher)
+	if failed.Status != webhook.StatusPending || failed.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected delivery after a failure %+v", failed)
+	}
+	if wait := failed.NextAttemptAt.Sub(failed.LastAttemptAt); wait != 10*time.Second {
+		t.Errorf("expected the first retry after 10s, got %s", wait)
+	}
+
+	eventually(t, clock, time.Second, "the second attempt", func() bool {
+		return onlyDelivery(t, dispatcher).Attempts == 2
+	})
+	if wait := onlyDelivery(t, dispatcher).NextAttemptAt.Sub(onlyDelivery(t, dispatcher).LastAttemptAt); wait != 20*time.Second {
+		t.Errorf("expected the second retry after 20s, got %s", wait)
+	}
+
+	eventually(t, clock, time.Second, "the delivery", func() bool {
+		return onlyDelivery(t, dispatcher).Status == webhook.StatusDelivered
+	})
+
+	requests := subscriber.received()
+	if len(requests) != 3 {
+		t.Fatalf("expected three attempts, got %d", len(requests))
+	}
+	for i, minimum := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		if gap := requests[i+1].at.Sub(requests[i].at); gap < minimum {
+			t.Errorf("retry %d came after %s, before its %s backoff", i+1, gap, minimum)
+		}
+	}
+	// Every attempt carries the same event
+	if requests[0].header.Get("X-Webhook-Id") != requests[2].header.Get("X-Webhook-Id") {
+		t.Error("retries changed the event ID")
+	}
+}
+
+func TestDeliveryIsDeadAfterMaxAttemptsAndReplayable(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	statuses := make([]int, 8)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+	subscriber := newReceiver(t, clock, statuses...)
+	dispatcher := newDispatcher(t, clock, filepath.Join(t.TempDir(), "queue.json"), subscriber.server.URL)
+	dispatcher.Start()
+	defer dispatcher.Close()
+
+	if err := dispatcher.Enqueue("refund.failed", map[string]string{"refundId": "R1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, clock, time.Minute, "the dead letter", func() bool {
+		return len(dispatcher.Deliveries(webhook.StatusDead)) == 1
+	})
+	dead := onlyDelivery(t, dispatcher)
+	if dead.Attempts != 8 || dead.LastError != "HTTP 503" {
+		t.Fatalf("unexpected dead letter %+v", dead)
+	}
+
+	// Backoff doubles from 10s and stays below the one hour cap for eight attempts
+	requests := subscriber.received()
+	for i := 1; i < len(requests); i++ {
+		minimum := 10 * time.Second << (i - 1)
+		if gap := requests[i].at.Sub(requests[i-1].at); gap < minimum {
+			t.Errorf("attempt %d came after %s, before its %s backoff", i+1, gap, minimum)
+		}
+	}
+
+	replayed, err := dispatcher.Replay(dead.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Status != webhook.StatusPending || replayed.Attempts != 0 {
+		t.Fatalf("unexpected replayed delivery %+v", replayed)
+	}
+	eventually(t, clock, time.Second, "the replayed delivery", func() bool {
+		return onlyDelivery(t, dispatcher).Status == webhook.StatusDelivered
+	})
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	clock := newFakeClock(time.Unix(1700000000, 0))
+	subscriber := newReceiver(t, clock, http.StatusInternalServerError)
+	queuePath := filepath.Join(t.TempDir(), "queue.json")
+
+	dispatcher := newDispatcher(t, clock, queuePath, subscriber.server.URL)
+	dispatcher.Start()
+	if err := dispatcher.Enqueue("refund.succeeded", map[string]string{"refundId": "R1"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, clock, time.Second, "the first attempt", func() bool {
+		return onlyDelivery(t, dispatcher).Attempts == 1
+	})
+	dispatcher.Close()
+
+	restarted := newDispatcher(t, clock, queuePath, subscriber.server.URL)
+	restored := onlyDelivery(t, restarted)
+	if restored.Status != webhook.StatusPending || restored.Attempts != 1 {
+		t.Fatalf("unexpected restored delivery %+v", restored)
+	}
+
+	restarted.Start()
+	defer restarted.Close()
+	eventually(t, clock, time.Second, "the delivery after the restart", func() bool {
+		return onlyDelivery(t, restarted).Status == webhook.StatusDelivered
+	})
+}
+
+// fakeClock only moves when advanced, firing the timers that fall due
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
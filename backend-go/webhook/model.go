@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Delivery statuses
+const (
+	StatusPending   = "PENDING"
+	StatusDelivered = "DELIVERED"
+	StatusDead      = "DEAD"
+)
+
+// Subscription is a downstream system listening to backend events
+type Subscription struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // exact types ("refund.succeeded"), categories ("refund") or "*"
+}
+
+// Matches reports whether the subscription wants events of the given type
+func (s Subscription) Matches(eventType string) bool {
+	for _, filter := range s.Events {
+		if filter == "*" || filter == eventType || strings.HasPrefix(eventType, filter+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Envelope is the JSON body POSTed to subscribers. Tenant names the tenant whose event it is
+// when the backend serves several.
+type Envelope struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Tenant    string          `json:"tenant,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Delivery tracks one envelope sent to one subscription
+type Delivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscriptionId"`
+	URL            string          `json:"url"`
+	EventID        string          `json:"eventId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	LastAttemptAt  time.Time       `json:"lastAttemptAt,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    time.Time       `json:"deliveredAt,omitempty"`
+}
@@ -0,0 +1,26 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// SignatureHeader carries the HMAC signature of a delivery
+const SignatureHeader = "X-Webhook-Signature"
+
+// Sign returns the signature header value for a payload sent at the given unix time.
+// Receivers recompute HMAC-SHA256(secret, "<timestamp>.<body>") and compare it with v1.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, computeSignature(secret, timestamp, payload))
+}
+
+func computeSignature(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}